@@ -25,6 +25,7 @@ import (
 type Authenticator struct {
 	bucket          base.Bucket
 	channelComputer ChannelComputer
+	passwordPolicy  *PasswordPolicy
 }
 
 // Interface for deriving the set of channels and roles a User/Role has access to.
@@ -166,9 +167,21 @@ func (auth *Authenticator) rebuildChannels(princ Principal) error {
 	// always grant access to the public document channel
 	channels.AddChannel(ch.DocumentStarChannel, 1)
 
+	// Provenance is informational, so failing to compute it doesn't fail the rebuild; the
+	// principal just doesn't record any.
+	var provenance GrantProvenance
+	if computer, ok := auth.channelComputer.(ProvenanceComputer); ok {
+		var err error
+		if provenance, err = computer.ComputeChannelProvenanceForPrincipal(princ); err != nil {
+			base.Warn("ProvenanceComputer.ComputeChannelProvenanceForPrincipal returned error for %v: %v", princ, err)
+			provenance = nil
+		}
+	}
+
 	base.LogTo("Access", "Computed channels for %q: %s", princ.Name(), channels)
 	princ.SetPreviousChannels(nil)
 	princ.setChannels(channels)
+	princ.setChannelProvenance(provenance)
 
 	return nil
 
@@ -192,8 +205,18 @@ func (auth *Authenticator) rebuildRoles(user User) error {
 		roles.Add(explicit)
 	}
 
+	var provenance GrantProvenance
+	if computer, ok := auth.channelComputer.(ProvenanceComputer); ok {
+		var err error
+		if provenance, err = computer.ComputeRoleProvenanceForUser(user); err != nil {
+			base.Warn("ProvenanceComputer.ComputeRoleProvenanceForUser failed on user %s: %v", user.Name(), err)
+			provenance = nil // As for channels, this doesn't fail the rebuild
+		}
+	}
+
 	base.LogTo("Access", "Computed roles for %q: %s", user.Name(), roles)
 	user.setRolesSince(roles)
+	user.setRoleProvenance(provenance)
 	return nil
 }
 
@@ -272,13 +295,35 @@ func (auth *Authenticator) Delete(p Principal) error {
 // Authenticates a user given the username and password.
 // If the username and password are both "", it will return a default empty User object, not nil.
 func (auth *Authenticator) AuthenticateUser(username string, password string) User {
-	user, _ := auth.GetUser(username)
-	if user == nil || !user.Authenticate(password) {
-		return nil
-	}
+	user, _ := auth.AuthenticateUserPassword(username, password)
 	return user
 }
 
+// Authenticates a user given the username and password, enforcing the password policy's lockout
+// and upgrading the user's password hash if it's weaker than the policy's. Returns a nil User if
+// the login fails, and ErrLockedOut if the user is locked out.
+func (auth *Authenticator) AuthenticateUserPassword(username string, password string) (User, error) {
+	user, err := auth.GetUser(username)
+	if user == nil {
+		return nil, err
+	}
+	impl := user.(*userImpl)
+	if err := auth.checkLockout(impl); err != nil {
+		return nil, err
+	}
+	if !user.Authenticate(password) {
+		if err := auth.recordLoginFailure(impl); err != nil {
+			base.Warn("Error recording failed login of user %q: %v", username, err)
+		}
+		return nil, nil
+	}
+	auth.clearLoginFailures(impl)
+	if err := auth.upgradePasswordHash(impl, password); err != nil {
+		base.Warn("Error upgrading password hash of user %q: %v", username, err)
+	}
+	return user, nil
+}
+
 // Authenticates a user based on a JWT token string and a set of providers.  Attempts to match the
 // issuer in the token with a provider.
 // Used to authenticate a JWT token coming from an insecure source (e.g. client request)
@@ -357,6 +357,40 @@ func TestRebuildChannelsError(t *testing.T) {
 	assert.DeepEquals(t, err, computer.err)
 }
 
+type provenanceComputer struct {
+	mockComputer
+	provenanceErr error
+}
+
+func (self *provenanceComputer) ComputeChannelProvenanceForPrincipal(Principal) (GrantProvenance, error) {
+	return nil, self.provenanceErr
+}
+
+func (self *provenanceComputer) ComputeRoleProvenanceForUser(User) (GrantProvenance, error) {
+	return nil, self.provenanceErr
+}
+
+func TestRebuildProvenanceError(t *testing.T) {
+
+	gTestBucket := base.GetTestBucketOrPanic()
+	defer gTestBucket.Close()
+	computer := provenanceComputer{
+		mockComputer:  mockComputer{channels: ch.AtSequence(ch.SetOf("derived1"), 1)},
+		provenanceErr: errors.New("I'm sorry, Dave."),
+	}
+	auth := NewAuthenticator(gTestBucket.Bucket, &computer)
+	user, _ := auth.NewUser("testUser", "password", ch.SetOf("explicit1"))
+	user.setChannels(nil)
+	assert.Equals(t, auth.Save(user), nil)
+
+	// The provenance isn't recorded, but the user's channels and roles are still rebuilt:
+	user2, err := auth.GetUser("testUser")
+	assert.Equals(t, err, nil)
+	assert.DeepEquals(t, user2.Channels(), ch.AtSequence(ch.SetOf("explicit1", "derived1", "!"), 1))
+	assert.True(t, user2.ChannelProvenance() == nil)
+	assert.True(t, user2.RoleProvenance() == nil)
+}
+
 func TestRebuildUserRoles(t *testing.T) {
 
 	gTestBucket := base.GetTestBucketOrPanic()
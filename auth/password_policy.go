@@ -0,0 +1,299 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/couchbase/go-couchbase"
+	"github.com/couchbase/sync_gateway/base"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Rules for user passwords and password logins: the strength of passwords set through the admin
+// API, the bcrypt cost of password hashes, and the lockout of accounts after failed logins.
+type PasswordPolicy struct {
+	MinLength     int             `json:"min_length,omitempty"`     // Minimum number of characters
+	RequireUpper  bool            `json:"require_upper,omitempty"`  // Must contain an uppercase letter
+	RequireLower  bool            `json:"require_lower,omitempty"`  // Must contain a lowercase letter
+	RequireDigit  bool            `json:"require_digit,omitempty"`  // Must contain a digit
+	RequireSymbol bool            `json:"require_symbol,omitempty"` // Must contain a non-alphanumeric character
+	BcryptCost    int             `json:"bcrypt_cost,omitempty"`    // Cost of new password hashes; weaker hashes are upgraded on login
+	Lockout       *LockoutOptions `json:"lockout,omitempty"`        // Locks out users after failed logins, if set
+}
+
+// Temporarily locks out a user after too many failed password logins, to defeat brute-force
+// attacks. Failures are tracked in the bucket, so they're counted across all nodes.
+type LockoutOptions struct {
+	MaxFailures       int    `json:"max_failures"`                  // Failed logins that lock out the user
+	FailureWindowSecs uint32 `json:"failure_window_secs,omitempty"` // Period the failures are counted over; defaults to 5 minutes
+	LockoutSecs       uint32 `json:"lockout_secs,omitempty"`        // How long the user is locked out; defaults to 15 minutes
+}
+
+const (
+	kDefaultLockoutFailureWindowSecs = 5 * 60
+	kDefaultLockoutSecs              = 15 * 60
+)
+
+// Error returned when authenticating a user who's locked out.
+var ErrLockedOut = base.HTTPErrorf(http.StatusUnauthorized, "Too many failed login attempts; try again later")
+
+// Failed password logins of a user, as stored in the bucket.
+type loginFailures struct {
+	Count       int       `json:"count"`                  // Failures since First
+	First       time.Time `json:"first"`                  // Time of the first failure counted
+	LockedUntil time.Time `json:"locked_until,omitempty"` // End of the lockout, if locked out
+}
+
+func docIDForLoginFailures(username string) string {
+	return "_sync:loginfailures:" + username
+}
+
+// Checks that the policy's values are in range.
+func (policy *PasswordPolicy) Validate() error {
+	if policy.MinLength < 0 {
+		return fmt.Errorf("password_policy.min_length must be >= 0")
+	}
+	if policy.BcryptCost != 0 && (policy.BcryptCost < bcrypt.MinCost || policy.BcryptCost > bcrypt.MaxCost) {
+		return fmt.Errorf("password_policy.bcrypt_cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+	}
+	if policy.Lockout != nil && policy.Lockout.MaxFailures <= 0 {
+		return fmt.Errorf("password_policy.lockout.max_failures must be > 0")
+	}
+	return nil
+}
+
+// Returns an error, with status 400, if a password doesn't meet the policy.
+func (policy *PasswordPolicy) CheckPassword(password string) error {
+	if policy == nil {
+		return nil
+	}
+	var problems []string
+	if len([]rune(password)) < policy.MinLength {
+		problems = append(problems, fmt.Sprintf("be at least %d characters long", policy.MinLength))
+	}
+	var hasUpper, hasLower, hasDigit, hasSymbol bool
+	for _, c := range password {
+		switch {
+		case unicode.IsUpper(c):
+			hasUpper = true
+		case unicode.IsLower(c):
+			hasLower = true
+		case unicode.IsDigit(c):
+			hasDigit = true
+		case !unicode.IsLetter(c):
+			hasSymbol = true
+		}
+	}
+	if policy.RequireUpper && !hasUpper {
+		problems = append(problems, "contain an uppercase letter")
+	}
+	if policy.RequireLower && !hasLower {
+		problems = append(problems, "contain a lowercase letter")
+	}
+	if policy.RequireDigit && !hasDigit {
+		problems = append(problems, "contain a digit")
+	}
+	if policy.RequireSymbol && !hasSymbol {
+		problems = append(problems, "contain a symbol")
+	}
+	if len(problems) > 0 {
+		return base.HTTPErrorf(http.StatusBadRequest, "Password must %s", strings.Join(problems, ", and "))
+	}
+	return nil
+}
+
+// The bcrypt cost of new password hashes.
+func (policy *PasswordPolicy) bcryptCost() int {
+	if policy == nil || policy.BcryptCost == 0 {
+		return kBcryptCostFactor
+	}
+	return policy.BcryptCost
+}
+
+func (lockout *LockoutOptions) failureWindow() time.Duration {
+	if lockout.FailureWindowSecs == 0 {
+		return kDefaultLockoutFailureWindowSecs * time.Second
+	}
+	return time.Duration(lockout.FailureWindowSecs) * time.Second
+}
+
+func (lockout *LockoutOptions) lockoutDuration() time.Duration {
+	if lockout.LockoutSecs == 0 {
+		return kDefaultLockoutSecs * time.Second
+	}
+	return time.Duration(lockout.LockoutSecs) * time.Second
+}
+
+// Sets the password policy the Authenticator enforces.
+func (auth *Authenticator) SetPasswordPolicy(policy *PasswordPolicy) {
+	auth.passwordPolicy = policy
+}
+
+// Returns an error if a password doesn't meet the password policy.
+func (auth *Authenticator) CheckPasswordPolicy(password string) error {
+	return auth.passwordPolicy.CheckPassword(password)
+}
+
+func (auth *Authenticator) lockoutOptions() *LockoutOptions {
+	if auth.passwordPolicy == nil {
+		return nil
+	}
+	return auth.passwordPolicy.Lockout
+}
+
+// Returns ErrLockedOut if the user is locked out. Only reads the user's failed-login record if
+// the user doc says there is one, so a user without failed logins costs no extra bucket reads.
+func (auth *Authenticator) checkLockout(user *userImpl) error {
+	if auth.lockoutOptions() == nil || !user.LoginFailures_ {
+		return nil
+	}
+	var failures loginFailures
+	if _, err := auth.bucket.Get(docIDForLoginFailures(user.Name_), &failures); err != nil {
+		if base.IsDocNotFoundError(err) {
+			return nil
+		}
+		return err
+	}
+	if time.Now().Before(failures.LockedUntil) {
+		return ErrLockedOut
+	}
+	return nil
+}
+
+// Records a failed login; after too many, the user is locked out. The first failure also flags
+// the user doc as having a failed-login record.
+func (auth *Authenticator) recordLoginFailure(user *userImpl) error {
+	lockout := auth.lockoutOptions()
+	username := user.Name_
+	if lockout == nil || username == "" {
+		return nil
+	}
+	window, lockoutDuration := lockout.failureWindow(), lockout.lockoutDuration()
+	expiry := base.DurationToCbsExpiry(window + lockoutDuration)
+	var lockedOut bool
+	err := auth.bucket.Update(docIDForLoginFailures(username), expiry, func(currentValue []byte) ([]byte, *uint32, error) {
+		// Be careful: this block can be invoked multiple times if there are races!
+		var failures loginFailures
+		if currentValue != nil {
+			if err := json.Unmarshal(currentValue, &failures); err != nil {
+				return nil, nil, err
+			}
+		}
+		now := time.Now()
+		if failures.Count == 0 || now.Sub(failures.First) > window {
+			failures.Count = 0
+			failures.First = now
+		}
+		failures.Count++
+		lockedOut = failures.Count >= lockout.MaxFailures
+		if lockedOut {
+			failures.Count = 0
+			failures.LockedUntil = now.Add(lockoutDuration)
+		}
+		data, err := json.Marshal(failures)
+		return data, &expiry, err
+	})
+	if lockedOut {
+		base.Warn("User %q is locked out for %v after %d failed logins", username, lockoutDuration, lockout.MaxFailures)
+	}
+	if err == nil && !user.LoginFailures_ {
+		err = auth.setLoginFailuresFlag(user, true)
+	}
+	return err
+}
+
+// Forgets a user's failed logins, after a successful one. Does nothing if the user doc says there
+// aren't any.
+func (auth *Authenticator) clearLoginFailures(user *userImpl) {
+	if !user.LoginFailures_ {
+		return
+	}
+	if err := auth.bucket.Delete(docIDForLoginFailures(user.Name_)); err != nil && !base.IsDocNotFoundError(err) {
+		base.Warn("Error clearing failed logins of user %q: %v", user.Name_, err)
+		return
+	}
+	if err := auth.setLoginFailuresFlag(user, false); err != nil {
+		base.Warn("Error clearing failed logins of user %q: %v", user.Name_, err)
+	}
+}
+
+// Sets or clears the flag in a user doc that says the user has a failed-login record.
+func (auth *Authenticator) setLoginFailuresFlag(user *userImpl, flag bool) error {
+	err := auth.bucket.Update(user.DocID(), 0, func(currentValue []byte) ([]byte, *uint32, error) {
+		// Be careful: this block can be invoked multiple times if there are races!
+		if currentValue == nil {
+			return nil, nil, couchbase.UpdateCancel
+		}
+		stored := &userImpl{}
+		if err := json.Unmarshal(currentValue, stored); err != nil {
+			return nil, nil, err
+		}
+		if stored.LoginFailures_ == flag {
+			return nil, nil, couchbase.UpdateCancel
+		}
+		stored.LoginFailures_ = flag
+		data, err := json.Marshal(stored)
+		return data, nil, err
+	})
+	if err == couchbase.UpdateCancel {
+		err = nil
+	}
+	if err == nil {
+		user.LoginFailures_ = flag
+	}
+	return err
+}
+
+// Rehashes a user's password if its hash is weaker than the policy's bcrypt cost. Called after
+// a successful login, which is the only time the password is known.
+func (auth *Authenticator) upgradePasswordHash(user *userImpl, password string) error {
+	cost := auth.passwordPolicy.bcryptCost()
+	if user.PasswordHash_ == nil || password == "" {
+		return nil
+	} else if hashCost, err := bcrypt.Cost(user.PasswordHash_); err != nil || hashCost >= cost {
+		return err
+	}
+	newHash, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+	if err != nil {
+		return err
+	}
+	oldHash := user.PasswordHash_
+	err = auth.bucket.Update(user.DocID(), 0, func(currentValue []byte) ([]byte, *uint32, error) {
+		// Be careful: this block can be invoked multiple times if there are races!
+		if currentValue == nil {
+			return nil, nil, couchbase.UpdateCancel
+		}
+		stored := &userImpl{}
+		if err := json.Unmarshal(currentValue, stored); err != nil {
+			return nil, nil, err
+		}
+		if !bytes.Equal(stored.PasswordHash_, oldHash) {
+			return nil, nil, couchbase.UpdateCancel // The password was changed meanwhile
+		}
+		stored.PasswordHash_ = newHash
+		data, err := json.Marshal(stored)
+		return data, nil, err
+	})
+	if err == couchbase.UpdateCancel {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	base.LogTo("Auth", "Upgraded password hash of user %q to bcrypt cost %d", user.Name_, cost)
+	user.PasswordHash_ = newHash
+	return nil
+}
@@ -0,0 +1,105 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package auth
+
+import (
+	"testing"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbaselabs/go.assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestPasswordPolicy(t *testing.T) {
+	var policy *PasswordPolicy
+	assert.Equals(t, policy.CheckPassword("x"), nil)
+
+	policy = &PasswordPolicy{MinLength: 8, RequireUpper: true, RequireDigit: true, RequireSymbol: true}
+	assert.Equals(t, policy.Validate(), nil)
+	assert.Equals(t, policy.CheckPassword("Passw0rd!"), nil)
+	err := policy.CheckPassword("pass")
+	assert.True(t, err != nil)
+	assert.Equals(t, err.Error(), "400 Password must be at least 8 characters long, and contain an uppercase letter, and contain a digit, and contain a symbol")
+	assert.True(t, policy.CheckPassword("Password!") != nil)
+	assert.True(t, policy.CheckPassword("ünïcödé_1Ü") == nil)
+
+	assert.True(t, (&PasswordPolicy{MinLength: -1}).Validate() != nil)
+	assert.True(t, (&PasswordPolicy{BcryptCost: 100}).Validate() != nil)
+	assert.True(t, (&PasswordPolicy{Lockout: &LockoutOptions{}}).Validate() != nil)
+}
+
+func TestLoginLockout(t *testing.T) {
+	gTestBucket := base.GetTestBucketOrPanic()
+	defer gTestBucket.Close()
+	auth := NewAuthenticator(gTestBucket.Bucket, nil)
+	auth.SetPasswordPolicy(&PasswordPolicy{BcryptCost: bcrypt.MinCost, Lockout: &LockoutOptions{MaxFailures: 3}})
+	user, _ := auth.NewUser("naomi", "letmein", nil)
+	assert.Equals(t, auth.Save(user), nil)
+
+	// A successful login resets the count of failures:
+	for i := 0; i < 2; i++ {
+		user, err := auth.AuthenticateUserPassword("naomi", "wrong")
+		assert.True(t, user == nil && err == nil)
+	}
+	user, err := auth.AuthenticateUserPassword("naomi", "letmein")
+	assert.True(t, user != nil && err == nil)
+	_, _, err = gTestBucket.Bucket.GetRaw(docIDForLoginFailures("naomi"))
+	assert.True(t, base.IsDocNotFoundError(err))
+	user, _ = auth.GetUser("naomi")
+	assert.False(t, user.(*userImpl).LoginFailures_)
+
+	for i := 0; i < 3; i++ {
+		user, err = auth.AuthenticateUserPassword("naomi", "wrong")
+		assert.True(t, user == nil && err == nil)
+	}
+	// Now even the right password fails:
+	user, err = auth.AuthenticateUserPassword("naomi", "letmein")
+	assert.True(t, user == nil)
+	assert.Equals(t, err, ErrLockedOut)
+	assert.True(t, auth.AuthenticateUser("naomi", "letmein") == nil)
+
+	// Other Authenticators, e.g. on other nodes, see the lockout:
+	otherAuth := NewAuthenticator(gTestBucket.Bucket, nil)
+	otherAuth.SetPasswordPolicy(auth.passwordPolicy)
+	_, err = otherAuth.AuthenticateUserPassword("naomi", "letmein")
+	assert.Equals(t, err, ErrLockedOut)
+	user, _ = auth.GetUser("naomi")
+	assert.True(t, user.(*userImpl).LoginFailures_)
+
+	// Unknown users aren't tracked:
+	user, err = auth.AuthenticateUserPassword("nobody", "wrong")
+	assert.True(t, user == nil && err == nil)
+	_, _, err = gTestBucket.Bucket.GetRaw(docIDForLoginFailures("nobody"))
+	assert.True(t, base.IsDocNotFoundError(err))
+}
+
+func TestUpgradePasswordHash(t *testing.T) {
+	gTestBucket := base.GetTestBucketOrPanic()
+	defer gTestBucket.Close()
+	auth := NewAuthenticator(gTestBucket.Bucket, nil)
+	auth.SetPasswordPolicy(&PasswordPolicy{BcryptCost: bcrypt.MinCost})
+	user, _ := auth.NewUser("naomi", "letmein", nil)
+	assert.Equals(t, auth.Save(user), nil)
+	cost, _ := bcrypt.Cost(user.PasswordHash())
+	assert.Equals(t, cost, bcrypt.MinCost)
+
+	// Logging in with a stronger policy rehashes the password:
+	auth.SetPasswordPolicy(&PasswordPolicy{BcryptCost: bcrypt.MinCost + 1})
+	assert.True(t, auth.AuthenticateUser("naomi", "wrong") == nil)
+	user, _ = auth.GetUser("naomi")
+	cost, _ = bcrypt.Cost(user.PasswordHash())
+	assert.Equals(t, cost, bcrypt.MinCost)
+
+	assert.True(t, auth.AuthenticateUser("naomi", "letmein") != nil)
+	user, _ = auth.GetUser("naomi")
+	cost, _ = bcrypt.Cost(user.PasswordHash())
+	assert.Equals(t, cost, bcrypt.MinCost+1)
+	assert.True(t, user.Authenticate("letmein"))
+}
@@ -63,10 +63,14 @@ type Principal interface {
 	// the guest user, else 403.
 	UnauthError(message string) error
 
+	// Where the Principal's channels came from, if recorded (see ProvenanceComputer); else nil.
+	ChannelProvenance() GrantProvenance
+
 	DocID() string
 	accessViewKey() string
 	validate() error
 	setChannels(ch.TimedSet)
+	setChannelProvenance(GrantProvenance)
 	getVbNo(hashFunction VBHashFunction) uint16
 }
 
@@ -91,12 +95,25 @@ type User interface {
 	// Sets the disabled property
 	SetDisabled(bool)
 
+	// The namespace the user belongs to, if the database is partitioned into namespaces. A user in
+	// a namespace only sees that namespace's changes. "" if none.
+	Namespace() string
+
+	// Sets the namespace the user belongs to.
+	SetNamespace(string)
+
 	// Authenticates the user's password.
 	Authenticate(password string) bool
 
 	// Changes the user's password.
 	SetPassword(password string)
 
+	// The bcrypt hash of the user's password, or nil if it has none.
+	PasswordHash() []byte
+
+	// Sets the user's password from a bcrypt hash, e.g. one exported from another database.
+	SetPasswordHash(hash []byte) error
+
 	// The set of Roles the user belongs to (including ones given to it by the sync function)
 	RoleNames() ch.TimedSet
 
@@ -134,5 +151,9 @@ type User interface {
 	// input set
 	GetAddedChannels(channels ch.TimedSet) base.Set
 
+	// Where the user's roles came from, if recorded (see ProvenanceComputer); else nil.
+	RoleProvenance() GrantProvenance
+
 	setRolesSince(ch.TimedSet)
+	setRoleProvenance(GrantProvenance)
 }
@@ -0,0 +1,76 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package auth
+
+import (
+	"sort"
+)
+
+// Sources of a grant of a channel or role.
+const (
+	GrantSourceExplicit = "explicit"      // Granted through the admin API
+	GrantSourceSync     = "sync_function" // Granted by a document's sync function, via access() or role()
+	GrantSourcePublic   = "public"        // The public "!" channel, which every principal can see
+)
+
+// Where a grant of a channel or role to a principal came from.
+type Grant struct {
+	Source   string `json:"source"`         // One of the GrantSource constants
+	DocID    string `json:"doc,omitempty"`  // Doc whose sync function made the grant
+	RevID    string `json:"rev,omitempty"`  // Current revision of the doc, which may be newer than the one that made the grant
+	Role     string `json:"role,omitempty"` // Set if a user's channel is inherited from this role
+	Sequence uint64 `json:"seq"`            // Sequence at which the grant was made
+}
+
+// Maps channel or role names to the grants of them. A name can be granted more than once.
+type GrantProvenance map[string][]Grant
+
+// Optionally implemented by a ChannelComputer, to record on principals where their channels
+// and roles came from, whenever they're recomputed. Explicit grants are included. A nil result
+// means provenance isn't recorded.
+type ProvenanceComputer interface {
+	ComputeChannelProvenanceForPrincipal(Principal) (GrantProvenance, error)
+	ComputeRoleProvenanceForUser(User) (GrantProvenance, error)
+}
+
+// Adds a grant of a channel or role.
+func (provenance GrantProvenance) Add(name string, grant Grant) {
+	provenance[name] = append(provenance[name], grant)
+}
+
+// Adds the grants in another GrantProvenance, with their Role set to the given role.
+func (provenance GrantProvenance) AddFromRole(other GrantProvenance, role string) {
+	for name, grants := range other {
+		for _, grant := range grants {
+			grant.Role = role
+			provenance.Add(name, grant)
+		}
+	}
+}
+
+// The number of grants, of all names.
+func (provenance GrantProvenance) Len() (n int) {
+	for _, grants := range provenance {
+		n += len(grants)
+	}
+	return n
+}
+
+// Sorts each name's grants by sequence, oldest first.
+func (provenance GrantProvenance) Sort() {
+	for _, grants := range provenance {
+		sort.Slice(grants, func(i, j int) bool {
+			if grants[i].Sequence != grants[j].Sequence {
+				return grants[i].Sequence < grants[j].Sequence
+			}
+			return grants[i].DocID < grants[j].DocID
+		})
+	}
+}
@@ -22,12 +22,13 @@ import (
 
 /** A group that users can belong to, with associated channel permisisons. */
 type roleImpl struct {
-	Name_             string      `json:"name,omitempty"`
-	ExplicitChannels_ ch.TimedSet `json:"admin_channels,omitempty"`
-	Channels_         ch.TimedSet `json:"all_channels"`
-	Sequence_         uint64      `json:"sequence"`
-	PreviousChannels_ ch.TimedSet `json:"previous_channels,omitempty"`
-	vbNo              *uint16
+	Name_              string          `json:"name,omitempty"`
+	ExplicitChannels_  ch.TimedSet     `json:"admin_channels,omitempty"`
+	Channels_          ch.TimedSet     `json:"all_channels"`
+	Sequence_          uint64          `json:"sequence"`
+	PreviousChannels_  ch.TimedSet     `json:"previous_channels,omitempty"`
+	ChannelProvenance_ GrantProvenance `json:"channel_provenance,omitempty"`
+	vbNo               *uint16
 }
 
 var kValidNameRegexp *regexp.Regexp
@@ -123,6 +124,14 @@ func (role *roleImpl) setChannels(channels ch.TimedSet) {
 	role.Channels_ = channels
 }
 
+func (role *roleImpl) ChannelProvenance() GrantProvenance {
+	return role.ChannelProvenance_
+}
+
+func (role *roleImpl) setChannelProvenance(provenance GrantProvenance) {
+	role.ChannelProvenance_ = provenance
+}
+
 func (role *roleImpl) ExplicitChannels() ch.TimedSet {
 	return role.ExplicitChannels_
 }
@@ -35,12 +35,15 @@ type userImpl struct {
 // Marshalable data is stored in separate struct from userImpl,
 // to work around limitations of JSON marshaling.
 type userImplBody struct {
-	Email_           string      `json:"email,omitempty"`
-	Disabled_        bool        `json:"disabled,omitempty"`
-	PasswordHash_    []byte      `json:"passwordhash_bcrypt,omitempty"`
-	OldPasswordHash_ interface{} `json:"passwordhash,omitempty"` // For pre-beta compatibility
-	ExplicitRoles_   ch.TimedSet `json:"explicit_roles,omitempty"`
-	RolesSince_      ch.TimedSet `json:"rolesSince"`
+	Email_           string          `json:"email,omitempty"`
+	Disabled_        bool            `json:"disabled,omitempty"`
+	Namespace_       string          `json:"namespace,omitempty"`
+	PasswordHash_    []byte          `json:"passwordhash_bcrypt,omitempty"`
+	OldPasswordHash_ interface{}     `json:"passwordhash,omitempty"` // For pre-beta compatibility
+	ExplicitRoles_   ch.TimedSet     `json:"explicit_roles,omitempty"`
+	RolesSince_      ch.TimedSet     `json:"rolesSince"`
+	RoleProvenance_  GrantProvenance `json:"role_provenance,omitempty"`
+	LoginFailures_   bool            `json:"login_failures,omitempty"` // Has a failed-login record; see recordLoginFailure
 
 	OldExplicitRoles_ []string `json:"admin_roles,omitempty"` // obsolete; declared for migration
 }
@@ -157,6 +160,14 @@ func (user *userImpl) SetDisabled(disabled bool) {
 	user.Disabled_ = disabled
 }
 
+func (user *userImpl) Namespace() string {
+	return user.Namespace_
+}
+
+func (user *userImpl) SetNamespace(namespace string) {
+	user.Namespace_ = namespace
+}
+
 func (user *userImpl) Email() string {
 	return user.Email_
 }
@@ -178,6 +189,14 @@ func (user *userImpl) setRolesSince(rolesSince ch.TimedSet) {
 	user.roles = nil // invalidate in-memory cache list of Role objects
 }
 
+func (user *userImpl) RoleProvenance() GrantProvenance {
+	return user.RoleProvenance_
+}
+
+func (user *userImpl) setRoleProvenance(provenance GrantProvenance) {
+	user.RoleProvenance_ = provenance
+}
+
 func (user *userImpl) ExplicitRoles() ch.TimedSet {
 	return user.ExplicitRoles_
 }
@@ -209,7 +228,11 @@ func (user *userImpl) SetPassword(password string) {
 	if password == "" {
 		user.PasswordHash_ = nil
 	} else {
-		hash, err := bcrypt.GenerateFromPassword([]byte(password), kBcryptCostFactor)
+		cost := kBcryptCostFactor
+		if user.auth != nil {
+			cost = user.auth.passwordPolicy.bcryptCost()
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), cost)
 		if err != nil {
 			panic(fmt.Sprintf("Error hashing password: %v", err))
 		}
@@ -217,6 +240,20 @@ func (user *userImpl) SetPassword(password string) {
 	}
 }
 
+func (user *userImpl) PasswordHash() []byte {
+	return user.PasswordHash_
+}
+
+// Changes a user's password to the one the given bcrypt hash was generated from.
+func (user *userImpl) SetPasswordHash(hash []byte) error {
+	if _, err := bcrypt.Cost(hash); err != nil {
+		return base.HTTPErrorf(http.StatusBadRequest, "Invalid password hash: %v", err)
+	}
+	user.PasswordHash_ = hash
+	user.OldPasswordHash_ = nil
+	return nil
+}
+
 // Returns the sequence number since which the user has been able to access the channel, else zero.  Sets the vb
 // for an admin channel grant, if needed.
 func (user *userImpl) CanSeeChannelSinceVbSeq(channel string, hashFunction VBHashFunction) (base.VbSeq, bool) {
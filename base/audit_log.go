@@ -0,0 +1,174 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package base
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// Types of security-relevant events recorded in the audit log.
+type AuditEvent string
+
+const (
+	AuditAuthSuccess   AuditEvent = "auth_success"   // A user or admin user authenticated
+	AuditAuthFailure   AuditEvent = "auth_failure"   // An authentication attempt failed
+	AuditAccessDenied  AuditEvent = "access_denied"  // An admin user lacked the permission a request needs
+	AuditUserUpdate    AuditEvent = "user_update"    // A user was created or updated
+	AuditUserDelete    AuditEvent = "user_delete"    // A user was deleted
+	AuditRoleUpdate    AuditEvent = "role_update"    // A role was created or updated
+	AuditRoleDelete    AuditEvent = "role_delete"    // A role was deleted
+	AuditSessionCreate AuditEvent = "session_create" // A login session was created
+	AuditSessionDelete AuditEvent = "session_delete" // One or more login sessions were deleted
+	AuditConfigChange  AuditEvent = "config_change"  // A database was created, deleted or reconfigured
+	AuditPurge         AuditEvent = "purge"          // Documents were purged
+	AuditMaintenance   AuditEvent = "maintenance"    // A maintenance job was started
+)
+
+// All the types of audit events.
+var AllAuditEvents = []AuditEvent{AuditAuthSuccess, AuditAuthFailure, AuditAccessDenied, AuditUserUpdate,
+	AuditUserDelete, AuditRoleUpdate, AuditRoleDelete, AuditSessionCreate, AuditSessionDelete, AuditConfigChange, AuditPurge,
+	AuditMaintenance}
+
+// Configuration of the audit log.
+type AuditLogConfig struct {
+	LogFilePath *string            `json:"log_file_path"`      // Path of the audit log file
+	Rotation    *LogRotationConfig `json:"rotation,omitempty"` // Rotation of the log file
+	Events      []AuditEvent       `json:"events,omitempty"`   // Events to record; if empty, all are recorded
+}
+
+func (config *AuditLogConfig) Validate() error {
+	if config.LogFilePath == nil || *config.LogFilePath == "" {
+		return fmt.Errorf("The audit log must define a \"log_file_path\"")
+	}
+	if _, err := IsFilePathWritable(*config.LogFilePath); err != nil {
+		return err
+	}
+	if rotation := config.Rotation; rotation != nil {
+		if rotation.MaxSize < 0 || rotation.MaxAge < 0 || rotation.MaxBackups < 0 {
+			return fmt.Errorf("Audit log rotation MaxSize, MaxAge and MaxBackups must be >= 0")
+		}
+	}
+	for _, event := range config.Events {
+		if !isAuditEvent(event) {
+			return fmt.Errorf("Unknown audit log event %q", event)
+		}
+	}
+	return nil
+}
+
+func isAuditEvent(event AuditEvent) bool {
+	for _, e := range AllAuditEvents {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// A record in the audit log. Each is written as a single line of JSON.
+type AuditRecord struct {
+	Timestamp     time.Time              `json:"timestamp"`
+	Event         AuditEvent             `json:"event"`
+	Database      string                 `json:"db,omitempty"`
+	RealUser      string                 `json:"real_user"`                // The user who made the request
+	EffectiveUser string                 `json:"effective_user,omitempty"` // The user the action was performed as, or on
+	RemoteAddr    string                 `json:"remote_addr,omitempty"`
+	Details       map[string]interface{} `json:"details,omitempty"`
+}
+
+// Writes audit records, as JSON lines, to a Writer.
+type AuditLogger struct {
+	output io.Writer
+	events map[AuditEvent]bool // Events to record, or nil for all
+	lock   sync.Mutex
+}
+
+func NewAuditLogger(output io.Writer, events []AuditEvent) *AuditLogger {
+	logger := &AuditLogger{output: output}
+	if len(events) > 0 {
+		logger.events = make(map[AuditEvent]bool, len(events))
+		for _, event := range events {
+			logger.events[event] = true
+		}
+	}
+	return logger
+}
+
+// Returns true if the logger records events of the given type.
+func (logger *AuditLogger) Records(event AuditEvent) bool {
+	return logger.events == nil || logger.events[event]
+}
+
+// Writes a record, unless its event is filtered out. If the record has no timestamp, it's set
+// to the current time.
+func (logger *AuditLogger) Log(record AuditRecord) {
+	if !logger.Records(record.Event) {
+		return
+	}
+	if record.Timestamp.IsZero() {
+		record.Timestamp = time.Now()
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		Warn("Couldn't encode audit record for %s event: %v", record.Event, err)
+		return
+	}
+	line = append(line, '\n')
+
+	logger.lock.Lock()
+	defer logger.lock.Unlock()
+	if _, err := logger.output.Write(line); err != nil {
+		Warn("Couldn't write to audit log: %v", err)
+	}
+}
+
+var auditLogger *AuditLogger
+var auditLoggerLock sync.RWMutex
+
+// Starts writing the audit log to the file given in the config.
+func EnableAuditLog(config *AuditLogConfig) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	log.Printf("Audit log entries will be written to the file %v", *config.LogFilePath)
+	SetAuditLogger(NewAuditLogger(newRollingLogWriter(*config.LogFilePath, config.Rotation), config.Events))
+	return nil
+}
+
+// Sets the AuditLogger that Audit writes to, or disables the audit log if it's nil.
+func SetAuditLogger(logger *AuditLogger) {
+	auditLoggerLock.Lock()
+	defer auditLoggerLock.Unlock()
+	auditLogger = logger
+}
+
+func getAuditLogger() *AuditLogger {
+	auditLoggerLock.RLock()
+	defer auditLoggerLock.RUnlock()
+	return auditLogger
+}
+
+// Returns true if events of the given type are being recorded in the audit log.
+func AuditEnabled(event AuditEvent) bool {
+	logger := getAuditLogger()
+	return logger != nil && logger.Records(event)
+}
+
+// Writes a record to the audit log, if it's enabled.
+func Audit(record AuditRecord) {
+	if logger := getAuditLogger(); logger != nil {
+		logger.Log(record)
+	}
+}
@@ -0,0 +1,71 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package base
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestAuditLogger(t *testing.T) {
+	var output bytes.Buffer
+	logger := NewAuditLogger(&output, []AuditEvent{AuditAuthFailure, AuditPurge})
+	assert.True(t, logger.Records(AuditAuthFailure))
+	assert.False(t, logger.Records(AuditAuthSuccess))
+
+	logger.Log(AuditRecord{Event: AuditAuthSuccess, RealUser: "alice"})
+	logger.Log(AuditRecord{Event: AuditAuthFailure, EffectiveUser: "alice", RemoteAddr: "10.0.0.1:5000",
+		Details: map[string]interface{}{"method": "basic"}})
+	logger.Log(AuditRecord{Event: AuditPurge, Database: "db", RealUser: "ADMIN"})
+
+	lines := strings.Split(strings.TrimSuffix(output.String(), "\n"), "\n")
+	assert.Equals(t, len(lines), 2)
+
+	var record AuditRecord
+	assert.Equals(t, json.Unmarshal([]byte(lines[0]), &record), nil)
+	assert.Equals(t, record.Event, AuditAuthFailure)
+	assert.Equals(t, record.RealUser, "")
+	assert.Equals(t, record.EffectiveUser, "alice")
+	assert.Equals(t, record.RemoteAddr, "10.0.0.1:5000")
+	assert.DeepEquals(t, record.Details, map[string]interface{}{"method": "basic"})
+	assert.False(t, record.Timestamp.IsZero())
+
+	record = AuditRecord{}
+	assert.Equals(t, json.Unmarshal([]byte(lines[1]), &record), nil)
+	assert.Equals(t, record.Event, AuditPurge)
+	assert.Equals(t, record.Database, "db")
+	assert.Equals(t, record.RealUser, "ADMIN")
+
+	// With no filter, everything is recorded:
+	assert.True(t, NewAuditLogger(&output, nil).Records(AuditConfigChange))
+}
+
+func TestAuditLogConfigValidation(t *testing.T) {
+	config := &AuditLogConfig{}
+	assert.True(t, config.Validate() != nil)
+
+	path := "/nonexistent-dir/audit.log"
+	config.LogFilePath = &path
+	assert.True(t, config.Validate() != nil)
+
+	path = "/tmp/sg_audit_test.log"
+	assert.Equals(t, config.Validate(), nil)
+
+	config.Events = []AuditEvent{AuditPurge, "bogus"}
+	assert.True(t, config.Validate() != nil)
+
+	config.Events = []AuditEvent{AuditPurge}
+	config.Rotation = &LogRotationConfig{MaxSize: -1}
+	assert.True(t, config.Validate() != nil)
+}
@@ -0,0 +1,139 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package base
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A schedule in the style of a crontab entry: five space-separated fields giving the minute
+// (0-59), hour (0-23), day of month (1-31), month (1-12) and day of week (0-6, Sunday is 0.)
+// Each field is "*", a number, a range "a-b", or a comma-separated list of these, and any but
+// a number may be followed by a step "/n". The shortcuts "@hourly", "@daily" (or "@midnight"),
+// "@weekly" and "@monthly" are also recognized. Times are interpreted in the local time zone.
+type CronSchedule struct {
+	spec                          string
+	minute, hour, dom, month, dow uint64 // Bitmaps of the allowed values of each field
+	anyDom, anyDow                bool   // Day-of-month or day-of-week field is "*"
+}
+
+var cronShortcuts = map[string]string{
+	"@hourly":   "0 * * * *",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@weekly":   "0 0 * * 0",
+	"@monthly":  "0 0 1 * *",
+}
+
+// Parses a cron-style schedule.
+func ParseCronSchedule(spec string) (*CronSchedule, error) {
+	expanded := strings.TrimSpace(spec)
+	if shortcut, found := cronShortcuts[expanded]; found {
+		expanded = shortcut
+	}
+	fields := strings.Fields(expanded)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("Invalid schedule %q: expected 5 fields", spec)
+	}
+	schedule := &CronSchedule{spec: spec, anyDom: fields[2] == "*", anyDow: fields[4] == "*"}
+	var err error
+	for i, field := range []struct {
+		bits     *uint64
+		min, max int
+	}{
+		{&schedule.minute, 0, 59},
+		{&schedule.hour, 0, 23},
+		{&schedule.dom, 1, 31},
+		{&schedule.month, 1, 12},
+		{&schedule.dow, 0, 6},
+	} {
+		if *field.bits, err = parseCronField(fields[i], field.min, field.max); err != nil {
+			return nil, fmt.Errorf("Invalid schedule %q: %v", spec, err)
+		}
+	}
+	return schedule, nil
+}
+
+func parseCronField(field string, min, max int) (bits uint64, err error) {
+	for _, item := range strings.Split(field, ",") {
+		rangeStr, step := item, 1
+		if i := strings.Index(item, "/"); i >= 0 {
+			rangeStr = item[:i]
+			if step, err = strconv.Atoi(item[i+1:]); err != nil || step <= 0 {
+				return 0, fmt.Errorf("bad step in %q", item)
+			}
+		}
+		first, last := min, max
+		if rangeStr != "*" {
+			bounds := strings.SplitN(rangeStr, "-", 2)
+			if first, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("bad value in %q", item)
+			}
+			last = first
+			if len(bounds) == 2 {
+				if last, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("bad range in %q", item)
+				}
+			} else if step > 1 {
+				last = max // "a/n" means every n starting at a
+			}
+			if first < min || last > max || first > last {
+				return 0, fmt.Errorf("%q is out of range %d-%d", item, min, max)
+			}
+		}
+		for value := first; value <= last; value += step {
+			bits |= 1 << uint(value)
+		}
+	}
+	return bits, nil
+}
+
+func (schedule *CronSchedule) String() string {
+	return schedule.spec
+}
+
+// Returns the first time after t that matches the schedule, or the zero time if there's none
+// within the next five years (as with "0 0 31 2 *".)
+func (schedule *CronSchedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if !hasCronBit(schedule.month, int(t.Month())) {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		} else if !schedule.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		} else if !hasCronBit(schedule.hour, t.Hour()) {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		} else if !hasCronBit(schedule.minute, t.Minute()) {
+			t = t.Add(time.Minute)
+		} else {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// As in cron, if both the day-of-month and day-of-week are restricted, a day matching either
+// one matches.
+func (schedule *CronSchedule) matchesDay(t time.Time) bool {
+	domMatch := hasCronBit(schedule.dom, t.Day())
+	dowMatch := hasCronBit(schedule.dow, int(t.Weekday()))
+	if schedule.anyDom || schedule.anyDow {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+func hasCronBit(bits uint64, value int) bool {
+	return bits&(1<<uint(value)) != 0
+}
@@ -0,0 +1,51 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package base
+
+import (
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestCronScheduleNext(t *testing.T) {
+	// Wednesday, May 16 2018, 10:17:30
+	now := time.Date(2018, time.May, 16, 10, 17, 30, 0, time.UTC)
+	next := func(spec string) time.Time {
+		schedule, err := ParseCronSchedule(spec)
+		assertNoError(t, err, "ParseCronSchedule")
+		return schedule.Next(now)
+	}
+	at := func(month time.Month, day, hour, minute int) time.Time {
+		return time.Date(2018, month, day, hour, minute, 0, 0, time.UTC)
+	}
+
+	assert.Equals(t, next("* * * * *"), at(time.May, 16, 10, 18))
+	assert.Equals(t, next("*/15 * * * *"), at(time.May, 16, 10, 30))
+	assert.Equals(t, next("5,17 * * * *"), at(time.May, 16, 11, 5))
+	assert.Equals(t, next("30 3 * * *"), at(time.May, 17, 3, 30))
+	assert.Equals(t, next("@daily"), at(time.May, 17, 0, 0))
+	assert.Equals(t, next("@hourly"), at(time.May, 16, 11, 0))
+	assert.Equals(t, next("0 0 * * 0"), at(time.May, 20, 0, 0))
+	assert.Equals(t, next("0 9-17/4 * * 1-5"), at(time.May, 16, 13, 0))
+	assert.Equals(t, next("0 0 1 */3 *"), at(time.July, 1, 0, 0))
+	// Day-of-month and day-of-week are OR'd when both are given:
+	assert.Equals(t, next("0 0 20 * 5"), at(time.May, 18, 0, 0))
+	assert.Equals(t, next("0 0 31 2 *"), time.Time{})
+}
+
+func TestCronScheduleInvalid(t *testing.T) {
+	for _, spec := range []string{"", "* * * *", "* * * * * *", "60 * * * *", "* 24 * * *",
+		"* * 0 * *", "* * * 13 *", "* * * * 7", "*/0 * * * *", "5-1 * * * *", "a * * * *", "@often"} {
+		_, err := ParseCronSchedule(spec)
+		assert.True(t, err != nil)
+	}
+}
@@ -91,6 +91,25 @@ func HTTPErrorf(status int, format string, args ...interface{}) *HTTPError {
 	return &HTTPError{status, fmt.Sprintf(format, args...)}
 }
 
+// An HTTPError with structured details about what went wrong. REST responses include the
+// details as additional properties of the JSON error body.
+type HTTPErrorWithDetails struct {
+	HTTPError
+	Details map[string]interface{}
+}
+
+func HTTPErrorWithDetailsf(status int, details map[string]interface{}, format string, args ...interface{}) *HTTPErrorWithDetails {
+	return &HTTPErrorWithDetails{HTTPError{status, fmt.Sprintf(format, args...)}, details}
+}
+
+// Returns the structured details of an error, if it's an HTTPErrorWithDetails; else nil.
+func ErrorDetails(err error) map[string]interface{} {
+	if detailedErr, ok := pkgerrors.Cause(err).(*HTTPErrorWithDetails); ok {
+		return detailedErr.Details
+	}
+	return nil
+}
+
 // Attempts to map an error to an HTTP status code and message.
 // Defaults to 500 if it doesn't recognize the error. Returns 200 for a nil error.
 func ErrorAsHTTPStatus(err error) (int, string) {
@@ -121,6 +140,10 @@ func ErrorAsHTTPStatus(err error) (int, string) {
 	switch unwrappedErr := unwrappedErr.(type) {
 	case *HTTPError:
 		return unwrappedErr.Status, unwrappedErr.Message
+	case *HTTPErrorWithDetails:
+		return unwrappedErr.Status, unwrappedErr.Message
+	case *RateLimitError:
+		return unwrappedErr.Status, unwrappedErr.Message
 	case *gomemcached.MCResponse:
 		switch unwrappedErr.Status {
 		case gomemcached.KEY_ENOENT:
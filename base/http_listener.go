@@ -2,7 +2,10 @@ package base
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"expvar"
+	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"sync"
@@ -20,7 +23,7 @@ func init() {
 
 // This is like a combination of http.ListenAndServe and http.ListenAndServeTLS, which also
 // uses ThrottledListen to limit the number of open HTTP connections.
-func ListenAndServeHTTP(addr string, connLimit int, certFile *string, keyFile *string, handler http.Handler, readTimeout *int, writeTimeout *int, http2Enabled bool) error {
+func ListenAndServeHTTP(addr string, connLimit int, certFile *string, keyFile *string, clientCAFile *string, handler http.Handler, readTimeout *int, writeTimeout *int, http2Enabled bool) error {
 	var config *tls.Config
 	if certFile != nil {
 		config = &tls.Config{}
@@ -37,6 +40,20 @@ func ListenAndServeHTTP(addr string, connLimit int, certFile *string, keyFile *s
 		if err != nil {
 			return err
 		}
+		if clientCAFile != nil {
+			// Verify client certificates, if given, against the CA cert(s):
+			pem, err := ioutil.ReadFile(*clientCAFile)
+			if err != nil {
+				return err
+			}
+			config.ClientCAs = x509.NewCertPool()
+			if !config.ClientCAs.AppendCertsFromPEM(pem) {
+				return fmt.Errorf("No certificates found in %s", *clientCAFile)
+			}
+			config.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	} else if clientCAFile != nil {
+		Warn("Client certificates can't be used on %v since it doesn't use SSL", addr)
 	}
 	listener, err := ThrottledListen("tcp", addr, connLimit)
 	if err != nil {
@@ -0,0 +1,76 @@
+package base
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// JSON deltas describe how to turn one JSON object into another. A delta is itself a JSON object
+// with an entry for each property that changed:
+//   - a property that was removed is given as an empty array: "key": []
+//   - a property whose old and new values are both objects is given as a nested delta
+//   - a property whose new value is an object or array is given wrapped in an array: "key": [value]
+//   - any other new value is given as-is: "key": value
+// This is a subset of the delta format used by Couchbase Lite, so deltas created here can be
+// applied by clients.
+
+// Returns a delta that transforms the object old into the object new. Returns an empty
+// (non-nil) delta if they're equal.
+func CreateJSONDelta(old, new map[string]interface{}) map[string]interface{} {
+	delta := map[string]interface{}{}
+	for key := range old {
+		if _, found := new[key]; !found {
+			delta[key] = []interface{}{}
+		}
+	}
+	for key, newValue := range new {
+		oldValue, found := old[key]
+		if found && reflect.DeepEqual(oldValue, newValue) {
+			continue
+		}
+		oldObject, oldIsObject := oldValue.(map[string]interface{})
+		newObject, newIsObject := newValue.(map[string]interface{})
+		if found && oldIsObject && newIsObject {
+			delta[key] = CreateJSONDelta(oldObject, newObject)
+		} else if _, newIsArray := newValue.([]interface{}); newIsObject || newIsArray {
+			delta[key] = []interface{}{newValue}
+		} else {
+			delta[key] = newValue
+		}
+	}
+	return delta
+}
+
+// Applies a delta created by CreateJSONDelta to the object old, returning the new object.
+// The old object is not modified.
+func ApplyJSONDelta(old map[string]interface{}, delta map[string]interface{}) (map[string]interface{}, error) {
+	result := make(map[string]interface{}, len(old)+len(delta))
+	for key, value := range old {
+		result[key] = value
+	}
+	for key, change := range delta {
+		switch change := change.(type) {
+		case []interface{}:
+			if len(change) == 0 {
+				delete(result, key)
+			} else if len(change) == 1 {
+				result[key] = change[0]
+			} else {
+				return nil, fmt.Errorf("Unsupported JSON delta for property %q", key)
+			}
+		case map[string]interface{}:
+			oldObject, ok := result[key].(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("JSON delta for property %q doesn't match source", key)
+			}
+			newObject, err := ApplyJSONDelta(oldObject, change)
+			if err != nil {
+				return nil, err
+			}
+			result[key] = newObject
+		default:
+			result[key] = change
+		}
+	}
+	return result, nil
+}
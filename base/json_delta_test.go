@@ -0,0 +1,32 @@
+package base
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestJSONDelta(t *testing.T) {
+	var old, new map[string]interface{}
+	json.Unmarshal([]byte(`{"same": 1, "changed": "a", "removed": true, "obj": {"x": 1, "y": 2}, "list": [1, 2]}`), &old)
+	json.Unmarshal([]byte(`{"same": 1, "changed": "b", "added": {"z": 3}, "obj": {"x": 1, "y": 3}, "list": [1, 2, 3]}`), &new)
+
+	delta := CreateJSONDelta(old, new)
+	deltaJSON, _ := json.Marshal(delta)
+	assert.Equals(t, string(deltaJSON), `{"added":[{"z":3}],"changed":"b","list":[[1,2,3]],"obj":{"y":3},"removed":[]}`)
+
+	result, err := ApplyJSONDelta(old, delta)
+	assert.Equals(t, err, nil)
+	assert.DeepEquals(t, result, new)
+
+	// The source isn't modified:
+	assert.Equals(t, old["changed"], "a")
+
+	// Equal objects have an empty delta:
+	assert.Equals(t, len(CreateJSONDelta(new, new)), 0)
+
+	// A nested delta can't be applied to a non-object:
+	_, err = ApplyJSONDelta(map[string]interface{}{"obj": 1}, map[string]interface{}{"obj": map[string]interface{}{"x": 2}})
+	assert.True(t, err != nil)
+}
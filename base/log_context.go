@@ -0,0 +1,138 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package base
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Log formats
+const (
+	LogFormatText = "text" // Free text, optionally colorized (the default)
+	LogFormatJSON = "json" // One JSON object per line
+)
+
+// If true, log messages are written as JSON objects. Guarded by logLock.
+var logJSON bool
+
+func isValidLogFormat(format string) bool {
+	return format == "" || format == LogFormatText || format == LogFormatJSON
+}
+
+// Sets the format of log messages: LogFormatText or LogFormatJSON. An empty string means text.
+func SetLogFormat(format string) error {
+	if !isValidLogFormat(format) {
+		return fmt.Errorf("Unknown log format %q", format)
+	}
+	logLock.Lock()
+	defer logLock.Unlock()
+	logJSON = (format == LogFormatJSON)
+	if logJSON {
+		logger.SetFlags(0) // JSON entries have their own timestamp
+	}
+	return nil
+}
+
+// Identifies what a log message relates to: the HTTP request, database and user. Log messages
+// about a request can then be correlated, even when they're logged by a BLIP session, changes
+// feed or event handler running on behalf of that request.
+type LogContext struct {
+	SerialNumber uint64 // Serial number of the HTTP request, or 0
+	RequestID    string // Client-supplied ID of the request (its X-Request-ID header), if any
+	Database     string // Name of the database, if any
+	Username     string // Name of the (effective) user, if any
+}
+
+// Returns a prefix identifying the context in text-format log messages, like "#042: " or
+// "#042 [req-id]: ". A nil LogContext returns an empty string.
+func (lc *LogContext) textPrefix() string {
+	if lc == nil {
+		return ""
+	}
+	var prefix string
+	if lc.SerialNumber != 0 && lc.RequestID != "" {
+		prefix = fmt.Sprintf("#%03d [%s]: ", lc.SerialNumber, lc.RequestID)
+	} else if lc.SerialNumber != 0 {
+		prefix = fmt.Sprintf("#%03d: ", lc.SerialNumber)
+	} else if lc.RequestID != "" {
+		prefix = fmt.Sprintf("[%s]: ", lc.RequestID)
+	}
+	// The prefix is used in format strings:
+	return strings.Replace(prefix, "%", "%%", -1)
+}
+
+// Logs a message about a LogContext, if the key is enabled.
+func LogToCtx(ctx *LogContext, key string, format string, args ...interface{}) {
+	logLock.RLock()
+	defer logLock.RUnlock()
+	ok := logLevel <= 1 && (logStar || LogKeys[key])
+
+	if ok {
+		if logJSON {
+			level := InfoLevel
+			if strings.HasSuffix(key, "+") {
+				level = DebugLevel
+			}
+			printJSON(level, key, ctx, "", fmt.Sprintf(format, args...))
+		} else {
+			printf(fgYellow+key+": "+reset+ctx.textPrefix()+format, args...)
+		}
+	}
+}
+
+// Logs a warning about a LogContext.
+func WarnCtx(ctx *LogContext, format string, args ...interface{}) {
+	logLock.RLock()
+	ok := logLevel <= 2
+	logLock.RUnlock()
+
+	if ok {
+		logWithCaller(ctx, WarnLevel, fgRed, "WARNING", format, args...)
+	}
+}
+
+// A JSON-format log message.
+type jsonLogEntry struct {
+	Timestamp    string `json:"timestamp"`
+	Level        string `json:"level"`
+	Key          string `json:"key,omitempty"`
+	Message      string `json:"msg"`
+	Caller       string `json:"caller,omitempty"`
+	Database     string `json:"db,omitempty"`
+	SerialNumber uint64 `json:"serial,omitempty"`
+	RequestID    string `json:"request_id,omitempty"`
+	Username     string `json:"user,omitempty"`
+}
+
+// Logs a message as a line of JSON. Assumes caller is holding logLock read lock.
+func printJSON(level Level, key string, ctx *LogContext, caller string, message string) {
+	entry := jsonLogEntry{
+		Timestamp: time.Now().Format(ISO8601Format),
+		Level:     level.String(),
+		Key:       key,
+		Message:   message,
+		Caller:    caller,
+	}
+	if ctx != nil {
+		entry.Database = ctx.Database
+		entry.SerialNumber = ctx.SerialNumber
+		entry.RequestID = ctx.RequestID
+		entry.Username = ctx.Username
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		// Can't happen, since all the fields are strings or numbers
+		line = []byte(fmt.Sprintf(`{"level":"error","msg":%q}`, err.Error()))
+	}
+	logger.Print(string(line))
+}
@@ -0,0 +1,94 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package base
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+// Redirects log output to a buffer for the duration of a test; call the returned function to restore it.
+func captureLogOutput() (*bytes.Buffer, func()) {
+	var output bytes.Buffer
+	logLock.Lock()
+	oldLogger, oldLogKeys := logger, LogKeys
+	logger = log.New(&output, "", 0)
+	LogKeys = map[string]bool{"CRUD": true, "CRUD+": true}
+	logLock.Unlock()
+	return &output, func() {
+		SetLogFormat(LogFormatText)
+		logLock.Lock()
+		logger, LogKeys = oldLogger, oldLogKeys
+		logLock.Unlock()
+	}
+}
+
+func TestLogContextText(t *testing.T) {
+	output, restore := captureLogOutput()
+	defer restore()
+
+	ctx := &LogContext{SerialNumber: 42, RequestID: "abc-123", Database: "db", Username: "alice"}
+	LogToCtx(ctx, "CRUD", "Stored doc %q", "doc1")
+	LogToCtx(&LogContext{SerialNumber: 7}, "CRUD", "100%% done")
+	LogToCtx(&LogContext{RequestID: "50%"}, "CRUD", "done")
+	LogToCtx(nil, "CRUD", "no context")
+	LogToCtx(ctx, "Changes", "not enabled")
+
+	lines := strings.Split(strings.TrimSuffix(output.String(), "\n"), "\n")
+	assert.Equals(t, len(lines), 4)
+	assert.True(t, strings.HasSuffix(lines[0], `CRUD: #042 [abc-123]: Stored doc "doc1"`))
+	assert.True(t, strings.HasSuffix(lines[1], "CRUD: #007: 100% done"))
+	assert.True(t, strings.HasSuffix(lines[2], "CRUD: [50%]: done"))
+	assert.True(t, strings.HasSuffix(lines[3], "CRUD: no context"))
+}
+
+func TestLogContextJSON(t *testing.T) {
+	output, restore := captureLogOutput()
+	defer restore()
+	assert.True(t, SetLogFormat("xml") != nil)
+	assert.Equals(t, SetLogFormat(LogFormatJSON), nil)
+
+	ctx := &LogContext{SerialNumber: 42, RequestID: "abc-123", Database: "db", Username: "alice"}
+	LogToCtx(ctx, "CRUD+", "Stored doc %q", "doc1")
+	WarnCtx(ctx, "Something odd about %s", "doc2")
+	Logf("Plain %s", "message")
+
+	lines := strings.Split(strings.TrimSuffix(output.String(), "\n"), "\n")
+	assert.Equals(t, len(lines), 3)
+
+	var entry jsonLogEntry
+	assert.Equals(t, json.Unmarshal([]byte(lines[0]), &entry), nil)
+	assert.Equals(t, entry.Level, "debug")
+	assert.Equals(t, entry.Key, "CRUD+")
+	assert.Equals(t, entry.Message, `Stored doc "doc1"`)
+	assert.Equals(t, entry.Database, "db")
+	assert.Equals(t, entry.SerialNumber, uint64(42))
+	assert.Equals(t, entry.RequestID, "abc-123")
+	assert.Equals(t, entry.Username, "alice")
+	assert.True(t, entry.Timestamp != "")
+
+	entry = jsonLogEntry{}
+	assert.Equals(t, json.Unmarshal([]byte(lines[1]), &entry), nil)
+	assert.Equals(t, entry.Level, "warn")
+	assert.Equals(t, entry.Message, "Something odd about doc2")
+	assert.True(t, strings.Contains(entry.Caller, "TestLogContextJSON"))
+	assert.Equals(t, entry.RequestID, "abc-123")
+
+	entry = jsonLogEntry{}
+	assert.Equals(t, json.Unmarshal([]byte(lines[2]), &entry), nil)
+	assert.Equals(t, entry.Level, "info")
+	assert.Equals(t, entry.Message, "Plain message")
+	assert.Equals(t, entry.SerialNumber, uint64(0))
+}
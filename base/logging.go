@@ -214,6 +214,7 @@ type LogAppenderConfig struct {
 	LogFilePath *string            `json:",omitempty"`
 	LogKeys     []string           `json:",omitempty"` // Log keywords to enable
 	LogLevel    Level              `json:",omitempty"`
+	LogFormat   string             `json:",omitempty"` // "text" (the default) or "json"
 	Rotation    *LogRotationConfig `json:",omitempty"`
 }
 
@@ -266,6 +267,9 @@ func ParseLogFlag(flag string) {
 }
 
 func (config *LogAppenderConfig) ValidateLogAppender() error {
+	if !isValidLogFormat(config.LogFormat) {
+		return fmt.Errorf("Unknown LogFormat %q; must be \"text\" or \"json\"", config.LogFormat)
+	}
 	//Fail validation if an appender contains a "rotation" sub document
 	// and no "logFilePath" appender property is defined
 	if config.Rotation != nil {
@@ -423,13 +427,7 @@ func GetCallersName(depth int) string {
 
 // Logs a message to the console, but only if the corresponding key is true in LogKeys.
 func LogTo(key string, format string, args ...interface{}) {
-	logLock.RLock()
-	defer logLock.RUnlock()
-	ok := logLevel <= 1 && (logStar || LogKeys[key])
-
-	if ok {
-		printf(fgYellow+key+": "+reset+format, args...)
-	}
+	LogToCtx(nil, key, format, args...)
 }
 
 func EnableLogKey(key string) {
@@ -457,7 +455,11 @@ func Log(message string) {
 	ok := logLevel <= 1
 
 	if ok {
-		print(message)
+		if logJSON {
+			printJSON(InfoLevel, "", nil, "", message)
+		} else {
+			print(message)
+		}
 	}
 }
 
@@ -468,7 +470,11 @@ func Logf(format string, args ...interface{}) {
 	ok := logLevel <= 1
 
 	if ok {
-		printf(format, args...)
+		if logJSON {
+			printJSON(InfoLevel, "", nil, "", fmt.Sprintf(format, args...))
+		} else {
+			printf(format, args...)
+		}
 	}
 }
 
@@ -481,7 +487,7 @@ func LogError(err error) error {
 		logLock.RUnlock()
 
 		if ok {
-			logWithCaller(fgRed, "ERROR", "%v", err)
+			logWithCaller(nil, ErrorLevel, fgRed, "ERROR", "%v", err)
 		}
 	}
 	return err
@@ -494,7 +500,7 @@ func Warn(format string, args ...interface{}) {
 	logLock.RUnlock()
 
 	if ok {
-		logWithCaller(fgRed, "WARNING", format, args...)
+		logWithCaller(nil, WarnLevel, fgRed, "WARNING", format, args...)
 	}
 }
 
@@ -502,26 +508,30 @@ func Warn(format string, args ...interface{}) {
 // temporary logging calls added during development and not to be checked in, hence its
 // distinctive name (which is visible and easy to search for before committing.)
 func TEMP(format string, args ...interface{}) {
-	logWithCaller(fgYellow, "TEMP", format, args...)
+	logWithCaller(nil, InfoLevel, fgYellow, "TEMP", format, args...)
 }
 
 // Logs a warning to the console, then panics.
 func LogPanic(format string, args ...interface{}) {
-	logWithCaller(fgRed, "PANIC", format, args...)
+	logWithCaller(nil, PanicLevel, fgRed, "PANIC", format, args...)
 	panic(fmt.Sprintf(format, args...))
 }
 
 // Logs a warning to the console, then exits the process.
 func LogFatal(format string, args ...interface{}) {
-	logWithCaller(fgRed, "FATAL", format, args...)
+	logWithCaller(nil, FatalLevel, fgRed, "FATAL", format, args...)
 	os.Exit(1)
 }
 
-func logWithCaller(color string, prefix string, format string, args ...interface{}) {
+func logWithCaller(ctx *LogContext, level Level, color string, prefix string, format string, args ...interface{}) {
 	message := fmt.Sprintf(format, args...)
 	logLock.RLock()
 	defer logLock.RUnlock()
-	print(color, prefix, ": ", message, reset,
+	if logJSON {
+		printJSON(level, "", ctx, GetCallersName(2), message)
+		return
+	}
+	print(color, prefix, ": ", ctx.textPrefix(), message, reset,
 		dim, " -- ", GetCallersName(2), reset)
 }
 
@@ -571,7 +581,11 @@ func UpdateLogger(logFilePath string) {
 	//have no close() methods and we want to close old files on log rotation
 	oldLogFile := logFile
 	logFile = fo
-	logger = log.New(fo, "", log.Lmicroseconds)
+	if logJSON {
+		logger = log.New(fo, "", 0) // JSON entries have their own timestamp
+	} else {
+		logger = log.New(fo, "", log.Lmicroseconds)
+	}
 	logLock.Unlock()
 
 	//re-apply log no time flags on new logger
@@ -613,42 +627,50 @@ func NewLoggerWriter(logKey string, serialNumber uint64, req *http.Request) *Log
 func CreateRollingLogger(logConfig *LogAppenderConfig) {
 	if logConfig != nil {
 		SetLogLevel(logConfig.LogLevel.sgLevel())
+		SetLogFormat(logConfig.LogFormat)
 		ParseLogFlags(logConfig.LogKeys)
 
 		if logConfig.LogFilePath == nil {
 			return
 		}
 
-		lj := lumberjack.Logger{}
-
-		lj.Filename = *logConfig.LogFilePath
+		lj := newRollingLogWriter(*logConfig.LogFilePath, logConfig.Rotation)
 		log.Printf("Log entries will be written to the file %v", *logConfig.LogFilePath)
 
-		if rotation := logConfig.Rotation; rotation != nil {
-			if rotation.MaxSize > 0 {
-				lj.MaxSize = rotation.MaxSize // megabytes
-			}
-			if rotation.MaxAge > 0 {
-				lj.MaxAge = rotation.MaxAge
-			}
-			if rotation.MaxBackups > 0 {
-				lj.MaxBackups = rotation.MaxBackups
-			}
-			lj.LocalTime = rotation.LocalTime
-		}
-
 		//Update default GoLang logger to use new rolling logger
-		logger.SetOutput(&lj)
+		logger.SetOutput(lj)
 
 		//Update sg_replicate logger to use rolling logger
-		clog.SetOutput(&lj)
+		clog.SetOutput(lj)
 
 		//Update go-couchbase to use rolling logger
-		gcblogger := logging.NewLogger(&lj, logConfig.LogLevel.cgLevel(), logging.TEXTFORMATTER)
+		formatter := logging.TEXTFORMATTER
+		if logConfig.LogFormat == LogFormatJSON {
+			formatter = logging.JSONFORMATTER
+		}
+		gcblogger := logging.NewLogger(lj, logConfig.LogLevel.cgLevel(), formatter)
 		logging.SetLogger(gcblogger)
 	}
 }
 
+// Creates a writer to a log file that's rotated according to the rotation config (if any).
+func newRollingLogWriter(logFilePath string, rotation *LogRotationConfig) *lumberjack.Logger {
+	lj := &lumberjack.Logger{Filename: logFilePath}
+	if rotation != nil {
+		if rotation.MaxSize > 0 {
+			lj.MaxSize = rotation.MaxSize // megabytes
+		}
+		if rotation.MaxAge > 0 {
+			lj.MaxAge = rotation.MaxAge
+		}
+		if rotation.MaxBackups > 0 {
+			lj.MaxBackups = rotation.MaxBackups
+		}
+		lj.LocalTime = rotation.LocalTime
+	}
+	return lj
+}
+
 // ANSI color control escape sequences.
 // Shamelessly copied from https://github.com/sqp/godock/blob/master/libs/log/colors.go
 var (
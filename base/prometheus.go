@@ -0,0 +1,247 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package base
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Prefix of the names of all metrics exported in the Prometheus format
+const PrometheusMetricPrefix = "sgw_"
+
+// Prefix of the expvar maps whose contents are exported as Prometheus metrics
+const kExpvarMapPrefix = "syncGateway_"
+
+// Prometheus metric types
+const (
+	PrometheusCounter   = "counter"
+	PrometheusGauge     = "gauge"
+	PrometheusHistogram = "histogram"
+	PrometheusUntyped   = "untyped"
+)
+
+// Default upper bounds (in seconds) of the buckets of a LatencyHistogram
+var DefaultLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Writes metrics in the Prometheus text exposition format. Each metric's HELP and TYPE lines
+// are written before its first sample; all samples of a metric must be written together.
+type PrometheusWriter struct {
+	w         io.Writer
+	described map[string]bool
+}
+
+func NewPrometheusWriter(w io.Writer) *PrometheusWriter {
+	return &PrometheusWriter{w: w, described: map[string]bool{}}
+}
+
+// Writes a single sample. The labels are given as alternating names and values.
+func (pw *PrometheusWriter) Write(name, metricType, help string, value float64, labels ...string) {
+	pw.describe(name, metricType, help)
+	pw.writeSample(name, value, labels...)
+}
+
+func (pw *PrometheusWriter) describe(name, metricType, help string) {
+	if !pw.described[name] {
+		pw.described[name] = true
+		if help != "" {
+			fmt.Fprintf(pw.w, "# HELP %s %s\n", name, help)
+		}
+		fmt.Fprintf(pw.w, "# TYPE %s %s\n", name, metricType)
+	}
+}
+
+func (pw *PrometheusWriter) writeSample(name string, value float64, labels ...string) {
+	fmt.Fprintf(pw.w, "%s%s %s\n", name, formatPrometheusLabels(labels), formatPrometheusValue(value))
+}
+
+func formatPrometheusLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", labels[i], strconv.Quote(labels[i+1])))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatPrometheusValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	}
+}
+
+var kInvalidMetricNameChars = regexp.MustCompile(`[^a-zA-Z0-9_]+`)
+
+// Converts an arbitrary string into a valid Prometheus metric name component.
+func PrometheusMetricName(name string) string {
+	return strings.Trim(kInvalidMetricNameChars.ReplaceAllString(name, "_"), "_")
+}
+
+//////// EXPVARS:
+
+// Matches expvar keys ending in a duration bin, like "lag-tap-0100ms" or "requests_0200ms"
+var kExpvarBinnedKey = regexp.MustCompile(`^(.*?)[-_]?(\d+)ms$`)
+
+// Writes the numeric contents of all the syncGateway_* expvar maps as untyped metrics named
+// sgw_<map>_<key>. Keys that are duration bins (ending in "NNNNms") become a single metric with
+// a "bin_ms" label. The sequence timing stages are written as sgw_sequence_timing_* gauges.
+func WriteExpvarMetrics(pw *PrometheusWriter) {
+	var samples []expvarSample
+	expvar.Do(func(kv expvar.KeyValue) {
+		if !strings.HasPrefix(kv.Key, kExpvarMapPrefix) {
+			return
+		}
+		if expvarMap, ok := kv.Value.(*expvar.Map); ok {
+			mapName := PrometheusMetricName(strings.TrimPrefix(kv.Key, kExpvarMapPrefix))
+			samples = appendExpvarSamples(samples, PrometheusMetricPrefix+mapName, expvarMap)
+		}
+	})
+
+	// Samples of the same metric have to be written together:
+	sort.SliceStable(samples, func(i, j int) bool {
+		return samples[i].name < samples[j].name
+	})
+	for _, sample := range samples {
+		pw.Write(sample.name, PrometheusUntyped, "", sample.value, sample.labels...)
+	}
+
+	TimingExpvars.writeMetrics(pw)
+}
+
+type expvarSample struct {
+	name   string
+	value  float64
+	labels []string
+}
+
+func appendExpvarSamples(samples []expvarSample, prefix string, expvarMap *expvar.Map) []expvarSample {
+	expvarMap.Do(func(kv expvar.KeyValue) {
+		switch value := kv.Value.(type) {
+		case *expvar.Map:
+			samples = appendExpvarSamples(samples, prefix+"_"+PrometheusMetricName(kv.Key), value)
+		default:
+			number, err := strconv.ParseFloat(kv.Value.String(), 64)
+			if err != nil {
+				return // Not a numeric value (e.g. the sequence timing map, written separately)
+			}
+			sample := expvarSample{value: number}
+			if match := kExpvarBinnedKey.FindStringSubmatch(kv.Key); match != nil && match[1] != "" {
+				bin, _ := strconv.Atoi(match[2])
+				sample.name = prefix + "_" + PrometheusMetricName(match[1])
+				sample.labels = []string{"bin_ms", strconv.Itoa(bin)}
+			} else {
+				sample.name = prefix + "_" + PrometheusMetricName(kv.Key)
+			}
+			samples = append(samples, sample)
+		}
+	})
+	return samples
+}
+
+// Returns the sequence currently being timed, and the times at which it reached each stage.
+func (s *SequenceTimingExpvar) CurrentStageTimes() (seq uint64, stages map[string]time.Time) {
+	s.lock.RLock()
+	seq = s.currentTargetSeq
+	s.lock.RUnlock()
+
+	stages = map[string]time.Time{}
+	keyPrefix := fmt.Sprintf("seq%d:", seq)
+	s.timingMap.Do(func(kv expvar.KeyValue) {
+		if strings.HasPrefix(kv.Key, keyPrefix) {
+			if nanos, err := strconv.ParseInt(kv.Value.String(), 10, 64); err == nil {
+				stages[strings.TrimPrefix(kv.Key, keyPrefix)] = time.Unix(0, nanos)
+			}
+		}
+	})
+	return seq, stages
+}
+
+func (s *SequenceTimingExpvar) writeMetrics(pw *PrometheusWriter) {
+	if s.timingMap == nil {
+		return
+	}
+	seq, stages := s.CurrentStageTimes()
+	if seq == 0 {
+		return
+	}
+	pw.Write(PrometheusMetricPrefix+"sequence_timing_sequence", PrometheusGauge,
+		"Sequence whose progress through the system is being timed", float64(seq))
+	names := make([]string, 0, len(stages))
+	for stage := range stages {
+		names = append(names, stage)
+	}
+	sort.Strings(names)
+	for _, stage := range names {
+		pw.Write(PrometheusMetricPrefix+"sequence_timing_stage_timestamp_seconds", PrometheusGauge,
+			"Time at which the timed sequence reached each stage",
+			float64(stages[stage].UnixNano())/float64(time.Second), "stage", stage)
+	}
+}
+
+//////// HISTOGRAMS:
+
+// A thread-safe histogram of durations with fixed buckets, in the form Prometheus expects.
+type LatencyHistogram struct {
+	buckets []float64 // Upper bounds of the buckets, in seconds, ascending
+	counts  []uint64  // Number of observations in each bucket (not cumulative)
+	sum     float64   // Total of all observations, in seconds
+	count   uint64    // Number of observations
+	lock    sync.Mutex
+}
+
+// Creates a histogram with the given bucket upper bounds (in seconds, ascending); if nil, uses
+// DefaultLatencyBuckets.
+func NewLatencyHistogram(buckets []float64) *LatencyHistogram {
+	if buckets == nil {
+		buckets = DefaultLatencyBuckets
+	}
+	return &LatencyHistogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *LatencyHistogram) Observe(duration time.Duration) {
+	seconds := duration.Seconds()
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.count++
+	h.sum += seconds
+	if i := sort.SearchFloat64s(h.buckets, seconds); i < len(h.buckets) {
+		h.counts[i]++
+	}
+}
+
+// Writes the histogram as the metric "name", with the given labels added to each sample.
+func (h *LatencyHistogram) WriteMetric(pw *PrometheusWriter, name, help string, labels ...string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	pw.describe(name, PrometheusHistogram, help)
+	var cumulative uint64
+	for i, bound := range h.buckets {
+		cumulative += h.counts[i]
+		pw.writeSample(name+"_bucket", float64(cumulative), append(labels, "le", formatPrometheusValue(bound))...)
+	}
+	pw.writeSample(name+"_bucket", float64(h.count), append(labels, "le", "+Inf")...)
+	pw.writeSample(name+"_sum", h.sum, labels...)
+	pw.writeSample(name+"_count", float64(h.count), labels...)
+}
@@ -0,0 +1,64 @@
+package base
+
+import (
+	"bytes"
+	"expvar"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestPrometheusWriter(t *testing.T) {
+	var out bytes.Buffer
+	pw := NewPrometheusWriter(&out)
+	pw.Write("sgw_test_total", PrometheusCounter, "A test counter", 3, "database", "db1")
+	pw.Write("sgw_test_total", PrometheusCounter, "A test counter", 4.5, "database", `d"b2`)
+	pw.Write("sgw_other", PrometheusGauge, "", 1)
+	assert.Equals(t, out.String(), `# HELP sgw_test_total A test counter
+# TYPE sgw_test_total counter
+sgw_test_total{database="db1"} 3
+sgw_test_total{database="d\"b2"} 4.5
+# TYPE sgw_other gauge
+sgw_other 1
+`)
+
+	assert.Equals(t, PrometheusMetricName("pollCount-my.channel"), "pollCount_my_channel")
+}
+
+func TestLatencyHistogram(t *testing.T) {
+	h := NewLatencyHistogram([]float64{0.1, 1})
+	h.Observe(50 * time.Millisecond)
+	h.Observe(100 * time.Millisecond)
+	h.Observe(500 * time.Millisecond)
+	h.Observe(2 * time.Second)
+
+	var out bytes.Buffer
+	h.WriteMetric(NewPrometheusWriter(&out), "sgw_latency_seconds", "Latency", "database", "db")
+	assert.Equals(t, out.String(), `# HELP sgw_latency_seconds Latency
+# TYPE sgw_latency_seconds histogram
+sgw_latency_seconds_bucket{database="db",le="0.1"} 2
+sgw_latency_seconds_bucket{database="db",le="1"} 3
+sgw_latency_seconds_bucket{database="db",le="+Inf"} 4
+sgw_latency_seconds_sum{database="db"} 2.65
+sgw_latency_seconds_count{database="db"} 4
+`)
+}
+
+func TestWriteExpvarMetrics(t *testing.T) {
+	testMap := expvar.NewMap("syncGateway_prometheusTest")
+	testMap.Add("some-count", 7)
+	testMap.Add("lag-tap-0100ms", 2)
+	testMap.Add("lag-tap-1200ms", 1)
+	testMap.Set("label", new(expvar.String))
+
+	var out bytes.Buffer
+	WriteExpvarMetrics(NewPrometheusWriter(&out))
+	metrics := out.String()
+	assert.True(t, strings.Contains(metrics, "\nsgw_prometheusTest_some_count 7\n"))
+	assert.True(t, strings.Contains(metrics, "\nsgw_prometheusTest_lag_tap{bin_ms=\"100\"} 2\n"))
+	assert.True(t, strings.Contains(metrics, "\nsgw_prometheusTest_lag_tap{bin_ms=\"1200\"} 1\n"))
+	assert.False(t, strings.Contains(metrics, "sgw_prometheusTest_label"))
+	assert.Equals(t, strings.Count(metrics, "# TYPE sgw_prometheusTest_lag_tap "), 1)
+}
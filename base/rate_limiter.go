@@ -0,0 +1,123 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package base
+
+import (
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// How often a RateLimiter forgets the keys that haven't been used lately.
+const kRateLimiterSweepInterval = time.Minute
+
+// A token-bucket rate limiter with a separate bucket per key (e.g. per user or client IP.)
+// Each bucket holds up to `burst` tokens and is refilled at `rate` tokens per second; every
+// request takes a token, and is refused if there are none.
+type RateLimiter struct {
+	rate      float64 // Tokens added to a bucket per second
+	burst     float64 // Max tokens in a bucket
+	lock      sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens  float64   // Tokens in the bucket as of `updated`
+	updated time.Time // When `tokens` was last computed
+}
+
+// Error returned when a rate limit is exceeded: a 429 status with the time after which the
+// client may retry.
+type RateLimitError struct {
+	HTTPError
+	RetryAfter time.Duration
+}
+
+// Creates a RateLimiter allowing `rate` requests per second, in bursts of up to `burst`.
+// A burst of 0 defaults to the rate, rounded up.
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	if burst <= 0 {
+		burst = int(math.Ceil(rate))
+		if burst < 1 {
+			burst = 1
+		}
+	}
+	return &RateLimiter{
+		rate:      rate,
+		burst:     float64(burst),
+		buckets:   map[string]*tokenBucket{},
+		lastSweep: time.Now(),
+	}
+}
+
+// Takes a token from the key's bucket. If it's empty, returns false and how long it will be
+// until a token is available.
+func (limiter *RateLimiter) Take(key string) (ok bool, retryAfter time.Duration) {
+	now := time.Now()
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+
+	limiter.sweep(now)
+	bucket := limiter.buckets[key]
+	if bucket == nil {
+		bucket = &tokenBucket{tokens: limiter.burst}
+		limiter.buckets[key] = bucket
+	} else {
+		elapsed := now.Sub(bucket.updated).Seconds()
+		bucket.tokens = math.Min(limiter.burst, bucket.tokens+elapsed*limiter.rate)
+	}
+	bucket.updated = now
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - bucket.tokens) / limiter.rate * float64(time.Second))
+}
+
+// Like Take, but returns a *RateLimitError if the key's bucket is empty.
+func (limiter *RateLimiter) TakeOrError(key string) error {
+	if ok, retryAfter := limiter.Take(key); !ok {
+		StatsExpvars.Add("requests_rateLimited", 1)
+		return &RateLimitError{
+			HTTPError:  HTTPError{http.StatusTooManyRequests, "Too many requests; slow down"},
+			RetryAfter: retryAfter,
+		}
+	}
+	return nil
+}
+
+// Number of keys with buckets.
+func (limiter *RateLimiter) Len() int {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	return len(limiter.buckets)
+}
+
+// Removes the buckets that have refilled since they were last used, since they're no different
+// from new ones. Must be called with the lock held.
+func (limiter *RateLimiter) sweep(now time.Time) {
+	if now.Sub(limiter.lastSweep) < kRateLimiterSweepInterval {
+		return
+	}
+	limiter.lastSweep = now
+	refillTime := time.Duration(limiter.burst / limiter.rate * float64(time.Second))
+	for key, bucket := range limiter.buckets {
+		if now.Sub(bucket.updated) >= refillTime {
+			delete(limiter.buckets, key)
+		}
+	}
+}
+
+// The value of a Retry-After header for a RateLimitError: the whole number of seconds to wait.
+func (err *RateLimitError) RetryAfterSeconds() int {
+	return int(math.Ceil(err.RetryAfter.Seconds()))
+}
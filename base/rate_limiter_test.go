@@ -0,0 +1,60 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package base
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	limiter := NewRateLimiter(20, 2)
+
+	// A burst of 2 is allowed, then the bucket is empty:
+	for i := 0; i < 2; i++ {
+		ok, _ := limiter.Take("alice")
+		assert.True(t, ok)
+	}
+	ok, retryAfter := limiter.Take("alice")
+	assert.False(t, ok)
+	assert.True(t, retryAfter > 0 && retryAfter <= 50*time.Millisecond)
+
+	// Other keys have their own buckets:
+	ok, _ = limiter.Take("bob")
+	assert.True(t, ok)
+	assert.Equals(t, limiter.Len(), 2)
+
+	// The bucket refills at the rate:
+	time.Sleep(60 * time.Millisecond)
+	ok, _ = limiter.Take("alice")
+	assert.True(t, ok)
+
+	err := limiter.TakeOrError("alice")
+	assert.True(t, err != nil)
+	status, _ := ErrorAsHTTPStatus(err)
+	assert.Equals(t, status, http.StatusTooManyRequests)
+	assert.Equals(t, err.(*RateLimitError).RetryAfterSeconds(), 1)
+}
+
+func TestRateLimiterSweep(t *testing.T) {
+	limiter := NewRateLimiter(1000, 1)
+	limiter.Take("alice")
+	limiter.Take("bob")
+	assert.Equals(t, limiter.Len(), 2)
+
+	// Buckets that have refilled are forgotten:
+	limiter.lastSweep = time.Now().Add(-kRateLimiterSweepInterval)
+	time.Sleep(10 * time.Millisecond)
+	limiter.Take("alice")
+	assert.Equals(t, limiter.Len(), 1)
+}
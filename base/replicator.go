@@ -22,6 +22,7 @@ type Replicator struct {
 type ActiveTask struct {
 	TaskType         string      `json:"type"`
 	ReplicationID    string      `json:"replication_id"`
+	Direction        string      `json:"direction,omitempty"`
 	Continuous       bool        `json:"continuous"`
 	Source           string      `json:"source"`
 	Target           string      `json:"target"`
@@ -0,0 +1,151 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package channels
+
+import (
+	"strings"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Separates the namespace from the channel name in a namespaced channel, like "acme/orders".
+// A namespace's sync function works with unqualified names; they're qualified on the way out,
+// so that one namespace can't assign docs to, or grant access to, another namespace's channels.
+const NamespaceSeparator = "/"
+
+// Separates the namespace from the role name in a namespaced role, like "acme@editor". Roles
+// granted by a namespace's sync function are qualified like its channels, so that one namespace
+// can't give a user another namespace's roles. ("/" isn't valid in a principal name.)
+const RoleNamespaceSeparator = "@"
+
+// Returns the name of a channel within a namespace.
+func NamespacedChannel(namespace, channel string) string {
+	return namespace + NamespaceSeparator + channel
+}
+
+// Returns the name of a role within a namespace.
+func NamespacedRole(namespace, role string) string {
+	return namespace + RoleNamespaceSeparator + role
+}
+
+// Returns the channel that every document in a namespace is assigned to, like "acme/*". It's
+// the namespace's counterpart of the "*" channel; granting a user access to it gives them
+// access to the whole namespace.
+func NamespaceStarChannel(namespace string) string {
+	return NamespacedChannel(namespace, UserStarChannel)
+}
+
+// Is the channel in the given namespace?
+func IsInNamespace(channel, namespace string) bool {
+	return strings.HasPrefix(channel, namespace+NamespaceSeparator)
+}
+
+// Qualifies the channels a document is assigned to, the channels granted by access(), and the
+// roles granted by role() or given channels by access(), with a namespace; and assigns the
+// document to the namespace's star channel.
+func (output *ChannelMapperOutput) AddNamespace(namespace string) {
+	output.Channels = namespacedSet(namespace, output.Channels, NamespacedChannel).Union(base.SetOf(NamespaceStarChannel(namespace)))
+	if output.Access != nil {
+		access := make(AccessMap, len(output.Access))
+		for name, channels := range output.Access {
+			if role, isRole := AccessNameToPrincipalName(name); isRole {
+				name = RoleAccessPrefix + NamespacedRole(namespace, role)
+			}
+			access[name] = namespacedSet(namespace, channels, NamespacedChannel)
+		}
+		output.Access = access
+	}
+	for name, roles := range output.Roles {
+		output.Roles[name] = namespacedSet(namespace, roles, NamespacedRole)
+	}
+}
+
+func namespacedSet(namespace string, set base.Set, qualify func(namespace, name string) string) base.Set {
+	names := make([]string, 0, len(set))
+	for name := range set {
+		names = append(names, qualify(namespace, name))
+	}
+	return base.SetFromArray(names)
+}
+
+// Returns the first channel or role name in a ChannelMapperOutput that's qualified with a
+// namespace, or "" if none. A document outside any namespace mustn't use these.
+func (output *ChannelMapperOutput) NamespacedName(isNamespace func(string) bool) string {
+	for channel := range output.Channels {
+		if strings.Contains(channel, NamespaceSeparator) {
+			return channel
+		}
+	}
+	for name, channels := range output.Access {
+		if role, isRole := AccessNameToPrincipalName(name); isRole && isNamespacedRole(role, isNamespace) {
+			return role
+		}
+		for channel := range channels {
+			if strings.Contains(channel, NamespaceSeparator) {
+				return channel
+			}
+		}
+	}
+	for _, roles := range output.Roles {
+		for role := range roles {
+			if isNamespacedRole(role, isNamespace) {
+				return role
+			}
+		}
+	}
+	return ""
+}
+
+func isNamespacedRole(role string, isNamespace func(string) bool) bool {
+	i := strings.Index(role, RoleNamespaceSeparator)
+	return i > 0 && isNamespace(role[:i])
+}
+
+// Returns the channels in a namespace, with the namespace removed from their names, as its sync
+// function sees them. The namespace's star channel becomes "*".
+func (set TimedSet) ChannelsInNamespace(namespace string) []string {
+	result := make([]string, 0, len(set))
+	for channel := range set.RestrictToNamespace(namespace) {
+		result = append(result, strings.TrimPrefix(channel, namespace+NamespaceSeparator))
+	}
+	return result
+}
+
+// Returns the roles in a namespace, with the namespace removed from their names, as its sync
+// function sees them.
+func (set TimedSet) RolesInNamespace(namespace string) TimedSet {
+	result := TimedSet{}
+	prefix := namespace + RoleNamespaceSeparator
+	for role, vbSeq := range set {
+		if strings.HasPrefix(role, prefix) {
+			result[role[len(prefix):]] = vbSeq
+		}
+	}
+	return result
+}
+
+// Restricts a set of channels available to a user to those in a namespace. The "*" channel is
+// replaced by the namespace's star channel.
+func (set TimedSet) RestrictToNamespace(namespace string) TimedSet {
+	result := make(TimedSet, len(set))
+	for channel, vbSeq := range set {
+		if channel == UserStarChannel {
+			channel = NamespaceStarChannel(namespace)
+		} else if !IsInNamespace(channel, namespace) {
+			continue
+		}
+		// The user may have access to both "*" and the namespace's star channel; use the earliest:
+		if existing, found := result[channel]; found && existing.CompareTo(vbSeq) != base.CompareGreaterThan {
+			continue
+		}
+		result[channel] = vbSeq
+	}
+	return result
+}
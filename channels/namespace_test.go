@@ -0,0 +1,83 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package channels
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestAddNamespace(t *testing.T) {
+	output := &ChannelMapperOutput{
+		Channels: base.SetOf("orders", "!"),
+		Access:   AccessMap{"alice": base.SetOf("orders"), "role:staff": base.SetOf("*")},
+		Roles:    AccessMap{"alice": base.SetOf("staff")},
+	}
+	output.AddNamespace("acme")
+	assert.DeepEquals(t, output.Channels, base.SetOf("acme/orders", "acme/!", "acme/*"))
+	assert.DeepEquals(t, output.Access["alice"], base.SetOf("acme/orders"))
+	assert.DeepEquals(t, output.Access["role:acme@staff"], base.SetOf("acme/*"))
+	assert.True(t, output.Access["role:staff"] == nil)
+	assert.DeepEquals(t, output.Roles["alice"], base.SetOf("acme@staff"))
+	assert.Equals(t, output.NamespacedName(func(ns string) bool { return ns == "acme" }), "")
+
+	// A doc with no channels is still in the namespace's star channel:
+	output = &ChannelMapperOutput{}
+	output.AddNamespace("acme")
+	assert.DeepEquals(t, output.Channels, base.SetOf("acme/*"))
+}
+
+func TestNamespacedName(t *testing.T) {
+	isNamespace := func(ns string) bool { return ns == "acme" }
+	output := &ChannelMapperOutput{
+		Channels: base.SetOf("orders"),
+		Access:   AccessMap{"alice": base.SetOf("orders"), "role:bob@example": base.SetOf("orders")},
+		Roles:    AccessMap{"alice": base.SetOf("staff", "bob@example")},
+	}
+	assert.Equals(t, output.NamespacedName(isNamespace), "")
+
+	output.Channels = base.SetOf("acme/orders")
+	assert.Equals(t, output.NamespacedName(isNamespace), "acme/orders")
+	output.Channels = nil
+	output.Access["alice"] = base.SetOf("acme/orders")
+	assert.Equals(t, output.NamespacedName(isNamespace), "acme/orders")
+	delete(output.Access, "alice")
+	output.Access["role:acme@staff"] = base.SetOf("orders")
+	assert.Equals(t, output.NamespacedName(isNamespace), "acme@staff")
+	delete(output.Access, "role:acme@staff")
+	output.Roles["alice"] = base.SetOf("acme@admin")
+	assert.Equals(t, output.NamespacedName(isNamespace), "acme@admin")
+}
+
+func TestRestrictToNamespace(t *testing.T) {
+	set := TimedSet{
+		"!":           NewVbSimpleSequence(1),
+		"acme/orders": NewVbSimpleSequence(2),
+		"globex/all":  NewVbSimpleSequence(3),
+		"*":           NewVbSimpleSequence(4),
+	}
+	assert.DeepEquals(t, set.RestrictToNamespace("acme"), TimedSet{
+		"acme/orders": NewVbSimpleSequence(2),
+		"acme/*":      NewVbSimpleSequence(4),
+	})
+	assert.Equals(t, len(set.RestrictToNamespace("initech")), 1)
+	assert.True(t, IsInNamespace("acme/orders", "acme"))
+	assert.False(t, IsInNamespace("acmeco/orders", "acme"))
+
+	// As a namespace's sync function sees them:
+	channels := set.ChannelsInNamespace("acme")
+	sort.Strings(channels)
+	assert.DeepEquals(t, channels, []string{"*", "orders"})
+	roles := TimedSet{"acme@staff": NewVbSimpleSequence(1), "globex@admin": NewVbSimpleSequence(2), "admin": NewVbSimpleSequence(3)}
+	assert.DeepEquals(t, roles.RolesInNamespace("acme"), TimedSet{"staff": NewVbSimpleSequence(1)})
+}
@@ -0,0 +1,302 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/couchbase/sync_gateway/auth"
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
+)
+
+// Sources of a user's access to a channel or role, as reported by ExplainAccess.
+const (
+	AccessSourceExplicit   = auth.GrantSourceExplicit
+	AccessSourceSync       = auth.GrantSourceSync
+	AccessSourcePublic     = auth.GrantSourcePublic
+	AccessSourceNamePrefix = "name_prefix" // Channels named after the principal, i.e. "<name>_..."
+)
+
+// Explains whether a user can see a document, and why.
+type AccessExplanation struct {
+	User        string              `json:"user"`
+	DocID       string              `json:"doc"`
+	CurrentRev  string              `json:"current_rev"`
+	Deleted     bool                `json:"deleted,omitempty"`
+	DocChannels []string            `json:"doc_channels"`         // Channels of the current revision
+	Channels    channels.ChannelMap `json:"channel_history"`      // Every channel the doc has been in, with removals
+	Revisions   []RevisionAccess    `json:"revisions"`            // Channels of each revision, newest first
+	Grants      []ChannelGrant      `json:"channel_grants"`       // Channels the user can access, and how
+	Roles       []RoleGrant         `json:"roles"`                // Roles the user has, and how
+	DocAccess   UserAccessMap       `json:"doc_access,omitempty"` // Channels the doc's sync function grants
+	DocRoles    UserAccessMap       `json:"doc_roles,omitempty"`  // Roles the doc's sync function grants
+	Matches     []ChannelGrant      `json:"matching_grants"`      // Grants of the current revision's channels
+	CanSee      bool                `json:"can_see"`              // The verdict
+	Since       uint64              `json:"since,omitempty"`      // Sequence since which the user can see the doc
+	Reason      string              `json:"reason"`               // The verdict, in words
+	UserSeq     uint64              `json:"user_sequence"`        // Sequence at which the user last changed
+	Disabled    bool                `json:"user_disabled,omitempty"`
+}
+
+// The channels of a revision, and whether the user can see it.
+type RevisionAccess struct {
+	RevID    string   `json:"rev"`
+	Deleted  bool     `json:"deleted,omitempty"`
+	Channels []string `json:"channels"`
+	CanSee   bool     `json:"can_see"`
+}
+
+// One way a user has access to a channel. A channel may be granted more than once.
+type ChannelGrant struct {
+	Channel  string `json:"channel"`
+	Source   string `json:"source"`         // One of the AccessSource constants
+	Role     string `json:"role,omitempty"` // Set if the channel is inherited from a role
+	Sequence uint64 `json:"seq"`            // Sequence at which the channel was granted
+	DocID    string `json:"doc,omitempty"`  // Doc whose sync function granted the channel
+}
+
+// One way a user has a role.
+type RoleGrant struct {
+	Role     string `json:"role"`
+	Source   string `json:"source"`        // AccessSourceExplicit or AccessSourceSync
+	Sequence uint64 `json:"seq"`           // Sequence at which the role was granted
+	DocID    string `json:"doc,omitempty"` // Doc whose sync function granted the role
+}
+
+// A row of the access or role_access view: the grants made by one doc to one principal.
+type accessViewRow struct {
+	ID    string
+	Value channels.TimedSet
+}
+
+// Explains whether the named user can see the current revision of a document, listing the doc's
+// channels and every grant the user has, with the doc ID and sequence of sync function grants.
+// The verdict comes from the same check as a GET of the doc by the user; a disabled user can't
+// see anything.
+func (context *DatabaseContext) ExplainAccess(username, docid string) (*AccessExplanation, error) {
+	user, err := context.Authenticator().GetUser(username)
+	if err != nil {
+		return nil, err
+	} else if user == nil {
+		return nil, base.HTTPErrorf(http.StatusNotFound, "No such user %q", username)
+	}
+	doc, err := context.GetDocument(docid, DocUnmarshalAll)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &AccessExplanation{
+		User:       username,
+		DocID:      docid,
+		CurrentRev: doc.CurrentRev,
+		Channels:   doc.Channels,
+		DocAccess:  doc.Access,
+		DocRoles:   doc.RoleAccess,
+		UserSeq:    user.Sequence(),
+		Disabled:   user.Disabled(),
+	}
+
+	canSee := func(channels base.Set) bool {
+		return !user.Disabled() && user.AuthorizeAnyChannel(channels) == nil
+	}
+
+	// The doc's channels, per revision:
+	var currentChannels base.Set
+	for revID, info := range doc.History {
+		if revID == doc.CurrentRev {
+			currentChannels = info.Channels
+			result.Deleted = info.Deleted
+		}
+		result.Revisions = append(result.Revisions, RevisionAccess{
+			RevID:    revID,
+			Deleted:  info.Deleted,
+			Channels: sortedChannels(info.Channels),
+			CanSee:   canSee(info.Channels),
+		})
+	}
+	sort.Slice(result.Revisions, func(i, j int) bool {
+		gi, gj := genOfRevID(result.Revisions[i].RevID), genOfRevID(result.Revisions[j].RevID)
+		if gi != gj {
+			return gi > gj
+		}
+		return result.Revisions[i].RevID > result.Revisions[j].RevID
+	})
+	result.DocChannels = sortedChannels(currentChannels)
+
+	// The user's own grants, then those of its roles:
+	if result.Grants, err = context.channelGrants(user, ""); err != nil {
+		return nil, err
+	}
+	if result.Roles, err = context.roleGrants(user); err != nil {
+		return nil, err
+	}
+	authenticator := context.Authenticator()
+	for _, roleName := range sortedChannels(user.RoleNames().AsSet()) {
+		role, err := authenticator.GetRole(roleName)
+		if err != nil {
+			return nil, err
+		} else if role == nil {
+			continue // Granted, but the role doesn't exist
+		}
+		roleGrants, err := context.channelGrants(role, roleName)
+		if err != nil {
+			return nil, err
+		}
+		result.Grants = append(result.Grants, roleGrants...)
+	}
+
+	// The verdict:
+	result.CanSee = canSee(currentChannels)
+	for _, grant := range result.Grants {
+		if currentChannels.Contains(grant.Channel) || grant.Channel == channels.UserStarChannel ||
+			(grant.Source == AccessSourceNamePrefix && hasAnyPrefix(currentChannels, strings.TrimSuffix(grant.Channel, "*"))) {
+			result.Matches = append(result.Matches, grant)
+		}
+	}
+	if result.CanSee {
+		inherited := user.InheritedChannels() // Accounts for when roles were granted, unlike CanSeeChannelSince
+		for channel := range currentChannels {
+			since := inherited[channel].Sequence
+			if since == 0 {
+				since = user.CanSeeChannelSince(channel)
+			}
+			if since > 0 && (result.Since == 0 || since < result.Since) {
+				result.Since = since
+			}
+		}
+	}
+	result.Reason = explainVerdict(result, currentChannels)
+	return result, nil
+}
+
+// Lists the channels granted to a user or role, explicitly and by sync functions. role is the
+// name of the role the grants are inherited from, or "" for the user's own grants.
+func (context *DatabaseContext) channelGrants(princ auth.Principal, role string) ([]ChannelGrant, error) {
+	var grants []ChannelGrant
+	for channel, seq := range princ.ExplicitChannels() {
+		grants = append(grants, ChannelGrant{Channel: channel, Source: AccessSourceExplicit, Role: role, Sequence: seq.Sequence})
+	}
+	key := princ.Name()
+	if role != "" {
+		key = channels.RoleAccessPrefix + key
+	}
+	rows, err := context.queryAccessView(context.accessViewName(), key)
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		for channel, seq := range row.Value {
+			grants = append(grants, ChannelGrant{Channel: channel, Source: AccessSourceSync, Role: role, Sequence: seq.Sequence, DocID: row.ID})
+		}
+	}
+	grants = append(grants, ChannelGrant{Channel: channels.DocumentStarChannel, Source: AccessSourcePublic, Role: role, Sequence: 1})
+	if princ.Name() != "" {
+		grants = append(grants, ChannelGrant{Channel: princ.Name() + "_*", Source: AccessSourceNamePrefix, Role: role, Sequence: 1})
+	}
+	sort.Slice(grants, func(i, j int) bool {
+		if grants[i].Channel != grants[j].Channel {
+			return grants[i].Channel < grants[j].Channel
+		}
+		return grants[i].Sequence < grants[j].Sequence
+	})
+	return grants, nil
+}
+
+// Lists the roles granted to a user, explicitly and by sync functions.
+func (context *DatabaseContext) roleGrants(user auth.User) ([]RoleGrant, error) {
+	var grants []RoleGrant
+	for role, seq := range user.ExplicitRoles() {
+		grants = append(grants, RoleGrant{Role: role, Source: AccessSourceExplicit, Sequence: seq.Sequence})
+	}
+	rows, err := context.queryAccessView(context.roleAccessViewName(), user.Name())
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		for role, seq := range row.Value {
+			grants = append(grants, RoleGrant{Role: role, Source: AccessSourceSync, Sequence: seq.Sequence, DocID: row.ID})
+		}
+	}
+	sort.Slice(grants, func(i, j int) bool {
+		if grants[i].Role != grants[j].Role {
+			return grants[i].Role < grants[j].Role
+		}
+		return grants[i].Sequence < grants[j].Sequence
+	})
+	return grants, nil
+}
+
+func (context *DatabaseContext) accessViewName() string {
+	if context.UseGlobalSequence() {
+		return ViewAccess
+	}
+	return ViewAccessVbSeq
+}
+
+func (context *DatabaseContext) roleAccessViewName() string {
+	if context.UseGlobalSequence() {
+		return ViewRoleAccess
+	}
+	return ViewRoleAccessVbSeq
+}
+
+// Returns the rows of the access or role_access view with the given key, i.e. the grants to a principal.
+func (context *DatabaseContext) queryAccessView(viewName string, key string) ([]accessViewRow, error) {
+	var vres struct {
+		Rows []accessViewRow
+	}
+	opts := map[string]interface{}{"stale": false, "key": key}
+	if err := context.Bucket.ViewCustom(DesignDocSyncGateway, viewName, opts, &vres); err != nil {
+		return nil, err
+	}
+	return vres.Rows, nil
+}
+
+func explainVerdict(result *AccessExplanation, currentChannels base.Set) string {
+	if result.Disabled {
+		return "User disabled: a disabled user can't see any document, whatever its grants"
+	} else if result.CanSee {
+		var names []string
+		for _, grant := range result.Matches {
+			description := fmt.Sprintf("%q (%s", grant.Channel, grant.Source)
+			if grant.DocID != "" {
+				description += fmt.Sprintf(" by doc %q", grant.DocID)
+			}
+			if grant.Role != "" {
+				description += fmt.Sprintf(", via role %q", grant.Role)
+			}
+			names = append(names, description+")")
+		}
+		return "The user can see the current revision through channel " + strings.Join(names, ", ")
+	} else if len(currentChannels) == 0 {
+		return "The current revision is in no channels, so only users with access to all channels (\"*\") can see it"
+	}
+	return "The user has no access to any of the current revision's channels"
+}
+
+// Returns true if any of the channels starts with the prefix.
+func hasAnyPrefix(set base.Set, prefix string) bool {
+	for channel := range set {
+		if strings.HasPrefix(channel, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedChannels(set base.Set) []string {
+	result := set.ToArray()
+	sort.Strings(result)
+	return result
+}
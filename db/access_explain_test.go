@@ -0,0 +1,125 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"testing"
+
+	"github.com/couchbase/sync_gateway/auth"
+	"github.com/couchbase/sync_gateway/channels"
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestExplainAccess(t *testing.T) {
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer tearDownTestDB(t, db)
+
+	db.ChannelMapper = channels.NewChannelMapper(`function(doc) {
+		channel(doc.channels);
+		if (doc.users) access(doc.users, doc.userChannels);
+		if (doc.roleUsers) role(doc.roleUsers, doc.roles);
+	}`)
+
+	authenticator := auth.NewAuthenticator(db.Bucket, db)
+	user, _ := authenticator.NewUser("naomi", "letmein", channels.SetOf("Netflix"))
+	assertNoError(t, authenticator.Save(user), "Save user")
+	role, _ := authenticator.NewRole("animefan", nil)
+	assertNoError(t, authenticator.Save(role), "Save role")
+
+	_, err := db.Put("grant-hulu", Body{"users": []string{"naomi"}, "userChannels": []string{"Hulu"}})
+	assertNoError(t, err, "Put grant-hulu")
+	_, err = db.Put("grant-role", Body{"roleUsers": []string{"naomi"}, "roles": []string{"role:animefan"}})
+	assertNoError(t, err, "Put grant-role")
+	_, err = db.Put("grant-anime", Body{"users": []string{"role:animefan"}, "userChannels": []string{"CrunchyRoll"}})
+	assertNoError(t, err, "Put grant-anime")
+
+	revID, err := db.Put("show", Body{"channels": []string{"Hulu", "Other"}})
+	assertNoError(t, err, "Put show")
+	_, err = db.Put("anime", Body{"channels": []string{"CrunchyRoll"}})
+	assertNoError(t, err, "Put anime")
+	_, err = db.Put("private", Body{"channels": []string{"naomi_private"}})
+	assertNoError(t, err, "Put private")
+	_, err = db.Put("secret", Body{"channels": []string{"Secret"}})
+	assertNoError(t, err, "Put secret")
+
+	// Visible through a channel granted by a sync function:
+	explanation, err := db.ExplainAccess("naomi", "show")
+	assertNoError(t, err, "ExplainAccess show")
+	assert.True(t, explanation.CanSee)
+	assert.Equals(t, explanation.CurrentRev, revID)
+	assert.DeepEquals(t, explanation.DocChannels, []string{"Hulu", "Other"})
+	assert.Equals(t, len(explanation.Revisions), 1)
+	assert.True(t, explanation.Revisions[0].CanSee)
+	assert.Equals(t, len(explanation.Matches), 1)
+	assert.Equals(t, explanation.Matches[0].Channel, "Hulu")
+	assert.Equals(t, explanation.Matches[0].Source, AccessSourceSync)
+	assert.Equals(t, explanation.Matches[0].DocID, "grant-hulu")
+	assert.True(t, explanation.Matches[0].Sequence > 0)
+	assert.True(t, explanation.Since > 0)
+
+	grantSources := map[string]string{}
+	for _, grant := range explanation.Grants {
+		grantSources[grant.Channel+"/"+grant.Role] = grant.Source
+	}
+	assert.Equals(t, grantSources["Netflix/"], AccessSourceExplicit)
+	assert.Equals(t, grantSources["Hulu/"], AccessSourceSync)
+	assert.Equals(t, grantSources["!/"], AccessSourcePublic)
+	assert.Equals(t, grantSources["CrunchyRoll/animefan"], AccessSourceSync)
+	assert.Equals(t, len(explanation.Roles), 1)
+	assert.Equals(t, explanation.Roles[0].Role, "animefan")
+	assert.Equals(t, explanation.Roles[0].DocID, "grant-role")
+
+	// Visible through a channel inherited from a role granted by a sync function:
+	explanation, err = db.ExplainAccess("naomi", "anime")
+	assertNoError(t, err, "ExplainAccess anime")
+	assert.True(t, explanation.CanSee)
+	assert.Equals(t, len(explanation.Matches), 1)
+	assert.Equals(t, explanation.Matches[0].Role, "animefan")
+	assert.Equals(t, explanation.Matches[0].DocID, "grant-anime")
+
+	// Visible through a channel named after the user:
+	explanation, err = db.ExplainAccess("naomi", "private")
+	assertNoError(t, err, "ExplainAccess private")
+	assert.True(t, explanation.CanSee)
+	assert.Equals(t, len(explanation.Matches), 1)
+	assert.Equals(t, explanation.Matches[0].Source, AccessSourceNamePrefix)
+
+	// Not visible:
+	explanation, err = db.ExplainAccess("naomi", "secret")
+	assertNoError(t, err, "ExplainAccess secret")
+	assert.False(t, explanation.CanSee)
+	assert.Equals(t, len(explanation.Matches), 0)
+	assert.Equals(t, explanation.Since, uint64(0))
+	assert.Equals(t, explanation.Reason, "The user has no access to any of the current revision's channels")
+
+	// The doc that makes the grants lists them:
+	explanation, err = db.ExplainAccess("naomi", "grant-hulu")
+	assertNoError(t, err, "ExplainAccess grant-hulu")
+	assert.False(t, explanation.CanSee)
+	assert.DeepEquals(t, explanation.DocAccess["naomi"].AsSet(), channels.SetOf("Hulu"))
+
+	// A disabled user can't see anything, whatever its grants:
+	user.SetDisabled(true)
+	assertNoError(t, authenticator.Save(user), "Save user")
+	explanation, err = db.ExplainAccess("naomi", "show")
+	assertNoError(t, err, "ExplainAccess show")
+	assert.False(t, explanation.CanSee)
+	assert.True(t, explanation.Disabled)
+	assert.False(t, explanation.Revisions[0].CanSee)
+	assert.Equals(t, len(explanation.Matches), 1)
+	assert.Equals(t, explanation.Since, uint64(0))
+	assert.Equals(t, explanation.Reason, "User disabled: a disabled user can't see any document, whatever its grants")
+
+	_, err = db.ExplainAccess("nobody", "show")
+	assertHTTPError(t, err, 404)
+	_, err = db.ExplainAccess("naomi", "nothing")
+	assertHTTPError(t, err, 404)
+}
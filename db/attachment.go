@@ -57,12 +57,21 @@ func (db *Database) storeAttachments(doc *document, body Body, generation int, p
 		data := meta["data"]
 		if data != nil {
 			// Attachment contains data, so store it in the db:
-			attachment, err := decodeAttachment(data)
-			if err != nil {
-				return nil, err
+			var key AttachmentKey
+			var dataLength int
+			if stored, ok := data.(*StoredAttachment); ok {
+				// Data was already streamed into the attachment store
+				key = stored.Key
+				dataLength = int(stored.Length)
+			} else {
+				attachment, err := decodeAttachment(data)
+				if err != nil {
+					return nil, err
+				}
+				key = AttachmentKey(sha1DigestKey(attachment))
+				dataLength = len(attachment)
+				newAttachmentData[key] = attachment
 			}
-			key := AttachmentKey(sha1DigestKey(attachment))
-			newAttachmentData[key] = attachment
 
 			newMeta := map[string]interface{}{
 				"stub":   true,
@@ -74,12 +83,12 @@ func (db *Database) storeAttachments(doc *document, body Body, generation int, p
 			}
 			if encoding := meta["encoding"]; encoding != nil {
 				newMeta["encoding"] = encoding
-				newMeta["encoded_length"] = len(attachment)
+				newMeta["encoded_length"] = dataLength
 				if length, ok := meta["length"].(float64); ok {
 					newMeta["length"] = length
 				}
 			} else {
-				newMeta["length"] = len(attachment)
+				newMeta["length"] = dataLength
 			}
 			atts[name] = newMeta
 
@@ -170,16 +179,15 @@ func (db *Database) loadBodyAttachments(body Body, minRevpos int, docid string)
 	return body, nil
 }
 
-// Retrieves an attachment given its key.
+// Retrieves an attachment given its key, from the database's attachment store.
 func (db *Database) GetAttachment(key AttachmentKey) ([]byte, error) {
-	v, _, err := db.Bucket.GetRaw(attachmentKeyToString(key))
-	return v, err
+	return db.AttachmentStore.GetAttachment(key)
 }
 
 // Stores a base64-encoded attachment and returns the key to get it by.
 func (db *Database) setAttachment(attachment []byte) (AttachmentKey, error) {
 	key := AttachmentKey(sha1DigestKey(attachment))
-	_, err := db.Bucket.AddRaw(attachmentKeyToString(key), 0, attachment)
+	err := db.AttachmentStore.AddAttachment(key, attachment)
 	if err == nil {
 		base.LogTo("Attach", "\tAdded attachment %q", key)
 	}
@@ -188,7 +196,7 @@ func (db *Database) setAttachment(attachment []byte) (AttachmentKey, error) {
 
 func (db *Database) setAttachments(attachments AttachmentData) error {
 	for key, data := range attachments {
-		_, err := db.Bucket.AddRaw(attachmentKeyToString(key), 0, data)
+		err := db.AttachmentStore.AddAttachment(key, data)
 		if err == nil {
 			base.LogTo("Attach", "\tAdded attachment %q", key)
 		} else {
@@ -340,6 +348,34 @@ func (db *Database) WriteRevisionAsPart(revBody Body, isError bool, compressPart
 }
 
 func ReadMultipartDocument(reader *multipart.Reader) (Body, error) {
+	return readMultipartDocument(reader, func(part io.Reader) (interface{}, *StoredAttachment, error) {
+		data, err := ioutil.ReadAll(part)
+		if err != nil {
+			return nil, nil, err
+		}
+		return data, &StoredAttachment{
+			Key:    AttachmentKey(sha1DigestKey(data)),
+			MD5Key: md5DigestKey(data),
+			Length: int64(len(data)),
+		}, nil
+	})
+}
+
+// Like ReadMultipartDocument, except that attachment parts are streamed directly into the
+// attachment store instead of being read into memory. Their "data" properties in the returned
+// body are StoredAttachments. If the document turns out to be invalid, attachments already
+// streamed are left in the store as orphans. They aren't deleted, since a concurrent request may
+// have stored the same attachment and be using it; vacuum removes them once they're old enough.
+func (db *Database) StreamMultipartDocument(reader *multipart.Reader) (Body, error) {
+	return readMultipartDocument(reader, func(part io.Reader) (interface{}, *StoredAttachment, error) {
+		stored, err := db.StoreAttachmentStream(part)
+		return stored, stored, err
+	})
+}
+
+// Reads a MIME multipart document, calling readPart to read each attachment part. readPart
+// returns the value to store as the attachment's "data", and the part's digests and length.
+func readMultipartDocument(reader *multipart.Reader, readPart func(io.Reader) (interface{}, *StoredAttachment, error)) (Body, error) {
 	// First read the main JSON document body:
 	mainPart, err := reader.NextPart()
 	if err != nil {
@@ -385,17 +421,17 @@ func ReadMultipartDocument(reader *multipart.Reader) (Body, error) {
 			}
 			return nil, err
 		}
-		data, err := ioutil.ReadAll(part)
+		data, info, err := readPart(part)
 		part.Close()
 		if err != nil {
 			return nil, err
 		}
 
 		// Look up the attachment by its digest:
-		digest := sha1DigestKey(data)
+		digest := string(info.Key)
 		name, meta := findFollowingAttachment(digest)
 		if meta == nil {
-			name, meta = findFollowingAttachment(md5DigestKey(data))
+			name, meta = findFollowingAttachment(info.MD5Key)
 			if meta == nil {
 				return nil, base.HTTPErrorf(http.StatusBadRequest,
 					"MIME part #%d doesn't match any attachment", i+2)
@@ -407,8 +443,8 @@ func ReadMultipartDocument(reader *multipart.Reader) (Body, error) {
 			length, ok = base.ToInt64(meta["length"])
 		}
 		if ok {
-			if length != int64(len(data)) {
-				return nil, base.HTTPErrorf(http.StatusBadRequest, "Attachment length mismatch for %q: read %d bytes, should be %g", name, len(data), length)
+			if length != info.Length {
+				return nil, base.HTTPErrorf(http.StatusBadRequest, "Attachment length mismatch for %q: read %d bytes, should be %d", name, info.Length, length)
 			}
 		}
 
@@ -476,12 +512,18 @@ func GenerateProofOfAttachment(attachmentData []byte) (nonce []byte, proof strin
 	if n, err := rand.Read(nonce); n < len(nonce) {
 		base.LogPanic("Failed to generate random data: %s", err)
 	}
+	proof = ProveAttachment(attachmentData, nonce)
+	return
+}
+
+// Returns the proof that the caller has the given attachment data, in response to a nonce
+// generated by GenerateProofOfAttachment.
+func ProveAttachment(attachmentData []byte, nonce []byte) (proof string) {
 	digester := sha1.New()
 	digester.Write([]byte{byte(len(nonce))})
 	digester.Write(nonce)
 	digester.Write(attachmentData)
-	proof = "sha1-" + base64.StdEncoding.EncodeToString(digester.Sum(nil))
-	return
+	return "sha1-" + base64.StdEncoding.EncodeToString(digester.Sum(nil))
 }
 
 //////// HELPERS:
@@ -0,0 +1,543 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Attachment store types, selected by the "type" of an AttachmentStoreConfig.
+const (
+	AttachmentStoreBucket     = "bucket"     // Attachments are documents in the database's bucket (the default)
+	AttachmentStoreFilesystem = "filesystem" // Attachments are files in a local directory
+	AttachmentStoreS3         = "s3"         // Attachments are objects in an S3-compatible object store
+)
+
+// Configuration of a database's attachment store, as given in the database config.
+type AttachmentStoreConfig struct {
+	Type string                   `json:"type"`           // One of the AttachmentStore* types
+	Path string                   `json:"path,omitempty"` // Directory for the filesystem store
+	S3   *S3AttachmentStoreConfig `json:"s3,omitempty"`   // Settings for the s3 store
+}
+
+// Storage for attachment bodies, addressed by their digest-based keys. Since attachments are
+// content-addressed, storing one that already exists is a no-op.
+type AttachmentStore interface {
+	// Returns the attachment's data, or a 404 error if it doesn't exist.
+	GetAttachment(key AttachmentKey) ([]byte, error)
+	// Stores an attachment.
+	AddAttachment(key AttachmentKey, data []byte) error
+	// Deletes an attachment. Deleting a nonexistent attachment is not an error.
+	DeleteAttachment(key AttachmentKey) error
+}
+
+// An AttachmentStore that can enumerate its attachments, which is required for vacuuming.
+type AttachmentLister interface {
+	// Calls the callback with the key and last-modified time of every stored attachment.
+	// Stops and returns the error if the callback returns one.
+	ForEachAttachment(callback func(key AttachmentKey, modified time.Time) error) error
+}
+
+// Creates the AttachmentStore described by the config. Returns nil for the bucket store, since
+// that's the default used by a DatabaseContext whose options don't specify a store.
+func NewAttachmentStore(config AttachmentStoreConfig) (AttachmentStore, error) {
+	switch config.Type {
+	case AttachmentStoreBucket, "":
+		return nil, nil
+	case AttachmentStoreFilesystem:
+		if config.Path == "" {
+			return nil, fmt.Errorf("Attachment store of type %q requires a path", config.Type)
+		}
+		return NewFileAttachmentStore(config.Path)
+	case AttachmentStoreS3:
+		if config.S3 == nil {
+			return nil, fmt.Errorf("Attachment store of type %q requires s3 settings", config.Type)
+		}
+		return NewS3AttachmentStore(*config.S3)
+	default:
+		return nil, fmt.Errorf("Unknown attachment store type %q", config.Type)
+	}
+}
+
+// Converts an attachment key (a digest like "sha1-<base64>") to a name that's safe to use as a
+// filename or URL path component: the base64 is made URL-safe and its padding removed.
+func attachmentKeyToName(key AttachmentKey) string {
+	name := strings.TrimRight(string(key), "=")
+	return strings.NewReplacer("+", "-", "/", "_").Replace(name)
+}
+
+// Inverse of attachmentKeyToName. Returns "" if the name isn't a valid attachment name.
+func attachmentNameToKey(name string) AttachmentKey {
+	dash := strings.IndexByte(name, '-')
+	if dash < 0 {
+		return ""
+	}
+	encoded := name[dash+1:]
+	if _, err := base64.RawURLEncoding.DecodeString(encoded); err != nil {
+		return ""
+	}
+	if pad := len(encoded) % 4; pad > 0 {
+		encoded += strings.Repeat("=", 4-pad)
+	}
+	encoded = strings.NewReplacer("-", "+", "_", "/").Replace(encoded)
+	return AttachmentKey(name[:dash+1] + encoded)
+}
+
+//////// BUCKET STORE:
+
+// Attachments larger than this are split into chunks of this size by the bucket store, to stay
+// within the bucket's maximum value size and to allow range reads without loading the whole
+// attachment.
+var AttachmentChunkSize = 1024 * 1024
+
+const (
+	kAttachmentManifestPrefix = "_sync:attm:"     // Key prefix of a chunked attachment's manifest
+	kAttachmentChunkPrefix    = "_sync:attchunk:" // Key prefix of a chunk of an attachment
+)
+
+// Describes a chunked attachment. Stored as JSON under the key "_sync:attm:<digest>".
+type attachmentManifest struct {
+	Length    int64    `json:"length"`     // Total length of the attachment
+	ChunkSize int      `json:"chunk_size"` // Length of each chunk except the last
+	Chunks    []string `json:"chunks"`     // Bucket keys of the chunks, in order
+}
+
+// Stores attachments as documents in the database's bucket. An attachment up to
+// AttachmentChunkSize is stored as a single document with the key "_sync:att:<digest>"; a larger
+// one is split into chunk documents, listed by a manifest document.
+type BucketAttachmentStore struct {
+	bucket base.Bucket
+}
+
+func NewBucketAttachmentStore(bucket base.Bucket) *BucketAttachmentStore {
+	return &BucketAttachmentStore{bucket: bucket}
+}
+
+func (store *BucketAttachmentStore) GetAttachment(key AttachmentKey) ([]byte, error) {
+	v, _, err := store.bucket.GetRaw(attachmentKeyToString(key))
+	if err != nil && base.IsDocNotFoundError(err) {
+		manifest, manifestErr := store.getManifest(key)
+		if manifestErr != nil {
+			return nil, err
+		}
+		data := make([]byte, 0, manifest.Length)
+		for _, chunkKey := range manifest.Chunks {
+			chunk, _, err := store.bucket.GetRaw(chunkKey)
+			if err != nil {
+				return nil, err
+			}
+			data = append(data, chunk...)
+		}
+		return data, nil
+	}
+	return v, err
+}
+
+func (store *BucketAttachmentStore) AddAttachment(key AttachmentKey, data []byte) error {
+	if len(data) <= AttachmentChunkSize {
+		return store.addRaw(attachmentKeyToString(key), data)
+	}
+	return store.AddAttachmentStream(NewAttachmentDigestReader(bytes.NewReader(data)))
+}
+
+// Reads the attachment a chunk at a time. Chunks are written under keys that are unique to this
+// upload, since the attachment's digest isn't known until the end; then the manifest is written.
+func (store *BucketAttachmentStore) AddAttachmentStream(reader *AttachmentDigestReader) error {
+	uploadID := base.CreateUUID()
+	manifest := attachmentManifest{ChunkSize: AttachmentChunkSize}
+	abort := func(err error) error {
+		for _, chunkKey := range manifest.Chunks {
+			store.bucket.Delete(chunkKey)
+		}
+		return err
+	}
+
+	for {
+		// A new buffer each time, since the bucket may keep a reference to the value
+		chunk := make([]byte, AttachmentChunkSize)
+		n, readErr := io.ReadFull(reader, chunk)
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			if len(manifest.Chunks) == 0 {
+				// It fits in a single document:
+				return store.addRaw(attachmentKeyToString(reader.Key()), chunk[:n])
+			}
+		} else if readErr != nil {
+			return abort(readErr)
+		}
+		if n > 0 {
+			chunkKey := fmt.Sprintf("%s%s:%d", kAttachmentChunkPrefix, uploadID, len(manifest.Chunks))
+			if err := store.bucket.SetRaw(chunkKey, 0, chunk[:n]); err != nil {
+				return abort(err)
+			}
+			manifest.Chunks = append(manifest.Chunks, chunkKey)
+			manifest.Length += int64(n)
+		}
+		if readErr != nil {
+			break
+		}
+	}
+
+	manifestKey := kAttachmentManifestPrefix + string(reader.Key())
+	added, err := store.bucket.Add(manifestKey, 0, manifest)
+	if err != nil || !added {
+		// If it wasn't added, the attachment already exists so these chunks aren't needed
+		if err == nil {
+			err = store.touch(manifestKey)
+		}
+		return abort(err)
+	}
+	return nil
+}
+
+// Adds a document unless it already exists, in which case it's touched instead.
+func (store *BucketAttachmentStore) addRaw(docKey string, data []byte) error {
+	added, err := store.bucket.AddRaw(docKey, 0, data)
+	if err == nil && !added {
+		err = store.touch(docKey)
+	}
+	return err
+}
+
+// Updates an existing attachment document's CAS, which is what ForEachAttachment reports as its
+// modification time, so that an attachment that's added again isn't vacuumed before it's used.
+func (store *BucketAttachmentStore) touch(docKey string) error {
+	_, _, err := store.bucket.GetAndTouchRaw(docKey, 0)
+	if err != nil && base.IsDocNotFoundError(err) {
+		return nil // Deleted meanwhile; the caller's data is lost, but so it would be a moment later
+	}
+	return err
+}
+
+func (store *BucketAttachmentStore) getManifest(key AttachmentKey) (*attachmentManifest, error) {
+	var manifest attachmentManifest
+	if _, err := store.bucket.Get(kAttachmentManifestPrefix+string(key), &manifest); err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+func (store *BucketAttachmentStore) OpenAttachment(key AttachmentKey, offset int64) (io.ReadCloser, int64, error) {
+	v, _, err := store.bucket.GetRaw(attachmentKeyToString(key))
+	if err == nil {
+		return openAttachmentData(v, offset)
+	} else if !base.IsDocNotFoundError(err) {
+		return nil, 0, err
+	}
+	manifest, manifestErr := store.getManifest(key)
+	if manifestErr != nil {
+		return nil, 0, err
+	}
+	if offset < 0 || offset > manifest.Length {
+		return nil, 0, base.HTTPErrorf(http.StatusRequestedRangeNotSatisfiable, "Offset beyond end of attachment")
+	}
+	reader := &chunkedAttachmentReader{
+		bucket:    store.bucket,
+		manifest:  manifest,
+		nextChunk: int(offset / int64(manifest.ChunkSize)),
+		skip:      int(offset % int64(manifest.ChunkSize)),
+	}
+	return reader, manifest.Length, nil
+}
+
+func (store *BucketAttachmentStore) DeleteAttachment(key AttachmentKey) error {
+	err := store.bucket.Delete(attachmentKeyToString(key))
+	if err != nil && base.IsDocNotFoundError(err) {
+		manifest, manifestErr := store.getManifest(key)
+		if manifestErr != nil {
+			return nil
+		}
+		if err := store.bucket.Delete(kAttachmentManifestPrefix + string(key)); err != nil {
+			return err
+		}
+		for _, chunkKey := range manifest.Chunks {
+			store.bucket.Delete(chunkKey)
+		}
+		return nil
+	}
+	return err
+}
+
+// Number of rows of the attachments view read at a time by ForEachAttachment.
+var attachmentListPageSize = 1000
+
+// Calls the callback for each attachment in the bucket, found by querying the attachments view a
+// page at a time. The modification time is the document's CAS, which on Couchbase Server 4.6+ is
+// a hybrid logical clock in nanoseconds since the epoch. Where it isn't (e.g. walrus) the time
+// isn't known, so the current time is reported, which keeps vacuum from deleting the attachment.
+func (store *BucketAttachmentStore) ForEachAttachment(callback func(key AttachmentKey, modified time.Time) error) error {
+	opts := Body{"stale": false, "limit": attachmentListPageSize}
+	for {
+		vres, err := store.bucket.View(DesignDocSyncHousekeeping, ViewAttachments, opts)
+		if err != nil {
+			return err
+		}
+		for _, row := range vres.Rows {
+			_, cas, err := store.bucket.GetRaw(row.ID)
+			if base.IsDocNotFoundError(err) {
+				continue // Deleted since the view was updated
+			} else if err != nil {
+				return err
+			}
+			key, _ := row.Key.(string)
+			if err := callback(AttachmentKey(key), casTime(cas)); err != nil {
+				return err
+			}
+		}
+		if len(vres.Rows) < attachmentListPageSize {
+			return nil
+		}
+		last := vres.Rows[len(vres.Rows)-1]
+		opts["startkey"] = last.Key
+		opts["startkey_docid"] = last.ID
+		opts["skip"] = 1
+	}
+}
+
+// CASes before this aren't timestamps, since no Couchbase Server using its clock for CAS ran then.
+var kMinTimestampCas = uint64(time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC).UnixNano())
+
+// Converts a document's CAS to the time it was last written. Overridden by tests.
+var casTime = func(cas uint64) time.Time {
+	if cas < kMinTimestampCas {
+		return time.Now()
+	}
+	return time.Unix(0, int64(cas))
+}
+
+// Reads a chunked attachment, loading one chunk at a time from the bucket.
+type chunkedAttachmentReader struct {
+	bucket    base.Bucket
+	manifest  *attachmentManifest
+	nextChunk int    // Index of the next chunk to load
+	skip      int    // Number of bytes to skip at the start of the next chunk
+	current   []byte // Unread data of the current chunk
+}
+
+func (r *chunkedAttachmentReader) Read(p []byte) (int, error) {
+	for len(r.current) == 0 {
+		if r.nextChunk >= len(r.manifest.Chunks) {
+			return 0, io.EOF
+		}
+		chunk, _, err := r.bucket.GetRaw(r.manifest.Chunks[r.nextChunk])
+		if err != nil {
+			return 0, err
+		}
+		if r.skip > len(chunk) {
+			r.skip = len(chunk)
+		}
+		r.current = chunk[r.skip:]
+		r.skip = 0
+		r.nextChunk++
+	}
+	n := copy(p, r.current)
+	r.current = r.current[n:]
+	return n, nil
+}
+
+func (r *chunkedAttachmentReader) Close() error {
+	r.current = nil
+	r.nextChunk = len(r.manifest.Chunks)
+	return nil
+}
+
+//////// FILESYSTEM STORE:
+
+// Stores attachments as files in a local (or network-mounted) directory.
+type FileAttachmentStore struct {
+	dir string
+}
+
+// Creates a FileAttachmentStore in the given directory, creating the directory if necessary.
+func NewFileAttachmentStore(dir string) (*FileAttachmentStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &FileAttachmentStore{dir: dir}, nil
+}
+
+func (store *FileAttachmentStore) path(key AttachmentKey) string {
+	return filepath.Join(store.dir, attachmentKeyToName(key))
+}
+
+func (store *FileAttachmentStore) GetAttachment(key AttachmentKey) ([]byte, error) {
+	data, err := ioutil.ReadFile(store.path(key))
+	if os.IsNotExist(err) {
+		return nil, base.HTTPErrorf(http.StatusNotFound, "missing")
+	}
+	return data, err
+}
+
+func (store *FileAttachmentStore) AddAttachment(key AttachmentKey, data []byte) error {
+	if store.touch(store.path(key)) {
+		return nil
+	}
+	return store.writeFile(bytes.NewReader(data), func() AttachmentKey { return key })
+}
+
+func (store *FileAttachmentStore) AddAttachmentStream(reader *AttachmentDigestReader) error {
+	return store.writeFile(reader, reader.Key)
+}
+
+// If the file exists, updates its modification time (so vacuum treats it as new) and returns true.
+func (store *FileAttachmentStore) touch(path string) bool {
+	now := time.Now()
+	return os.Chtimes(path, now, now) == nil
+}
+
+// Writes the data to a temporary file and then renames it into place, so a partially-written
+// attachment is never visible. The key is determined after all the data has been written.
+func (store *FileAttachmentStore) writeFile(reader io.Reader, key func() AttachmentKey) error {
+	tempFile, err := ioutil.TempFile(store.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tempFile, reader)
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		if path := store.path(key()); store.touch(path) {
+			os.Remove(tempFile.Name()) // Already stored
+		} else {
+			err = os.Rename(tempFile.Name(), path)
+		}
+	}
+	if err != nil {
+		os.Remove(tempFile.Name())
+	}
+	return err
+}
+
+func (store *FileAttachmentStore) OpenAttachment(key AttachmentKey, offset int64) (io.ReadCloser, int64, error) {
+	file, err := os.Open(store.path(key))
+	if os.IsNotExist(err) {
+		return nil, 0, base.HTTPErrorf(http.StatusNotFound, "missing")
+	} else if err != nil {
+		return nil, 0, err
+	}
+	info, err := file.Stat()
+	if err == nil && (offset < 0 || offset > info.Size()) {
+		err = base.HTTPErrorf(http.StatusRequestedRangeNotSatisfiable, "Offset beyond end of attachment")
+	}
+	if err == nil {
+		_, err = file.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	return file, info.Size(), nil
+}
+
+func (store *FileAttachmentStore) DeleteAttachment(key AttachmentKey) error {
+	err := os.Remove(store.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (store *FileAttachmentStore) ForEachAttachment(callback func(key AttachmentKey, modified time.Time) error) error {
+	infos, err := ioutil.ReadDir(store.dir)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".") {
+			continue // Skip temporary files
+		}
+		if key := attachmentNameToKey(info.Name()); key != "" {
+			if err := callback(key, info.ModTime()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//////// VACUUM:
+
+// Attachments younger than this are never vacuumed, since they may belong to a revision that's
+// still being saved.
+const kMinVacuumAttachmentAge = time.Hour
+
+// Deletes all attachments not used by any current or conflicting revision. Only supported if
+// the database's attachment store is an AttachmentLister. Returns the number of attachments deleted.
+func (db *Database) VacuumAttachments() (int, error) {
+	return db.Maintenance.Run(MaintenanceAttachmentVacuum, MaintenanceJobOptions{})
+}
+
+func (db *Database) vacuumAttachments(job *MaintenanceJob) error {
+	lister, ok := db.AttachmentStore.(AttachmentLister)
+	if !ok {
+		return base.HTTPErrorf(http.StatusNotImplemented, "Vacuum isn't supported by this database's attachment store")
+	}
+
+	// Find the attachments referenced by every leaf revision of every document:
+	referenced := map[AttachmentKey]bool{}
+	var docErr error
+	err := db.ForEachDocID(func(id IDAndRev, channels []string) bool {
+		doc, err := db.GetDocument(id.DocID, DocUnmarshalAll)
+		if err != nil {
+			if docErr == nil {
+				docErr = err
+			}
+			return false
+		}
+		for _, revid := range doc.History.GetLeaves() {
+			body, err := db.getRevision(doc, revid)
+			if err != nil {
+				continue // Body isn't available, so neither are its attachments
+			}
+			for _, value := range BodyAttachments(body) {
+				if meta, ok := value.(map[string]interface{}); ok {
+					if digest, ok := meta["digest"].(string); ok {
+						referenced[AttachmentKey(digest)] = true
+					}
+				}
+			}
+		}
+		docErr = job.step()
+		return docErr == nil
+	}, ForEachDocIDOptions{})
+	if err == nil {
+		err = docErr
+	}
+	if err != nil {
+		return err
+	}
+
+	minAge := kMinVacuumAttachmentAge
+	if oldRevAge := time.Duration(db.Options.OldRevExpirySeconds) * time.Second; oldRevAge > minAge {
+		minAge = oldRevAge // Old revision bodies may still refer to attachments
+	}
+	cutoff := time.Now().Add(-minAge)
+	return lister.ForEachAttachment(func(key AttachmentKey, modified time.Time) error {
+		unused := !referenced[key] && !modified.After(cutoff)
+		if unused && !job.options.DryRun {
+			if err := db.AttachmentStore.DeleteAttachment(key); err != nil {
+				return err
+			}
+			base.LogTo("Attach", "Vacuumed attachment %q", key)
+		}
+		return job.itemDone(unused)
+	})
+}
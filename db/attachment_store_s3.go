@@ -0,0 +1,354 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+const kDefaultS3Region = "us-east-1"
+
+// Settings for an S3AttachmentStore.
+type S3AttachmentStoreConfig struct {
+	Endpoint  string `json:"endpoint"`             // Base URL of the S3 service, e.g. "https://s3.amazonaws.com"
+	Bucket    string `json:"bucket"`               // Name of the S3 bucket
+	Region    string `json:"region,omitempty"`     // Region used for request signing; defaults to us-east-1
+	Prefix    string `json:"prefix,omitempty"`     // Prefix of the object keys, e.g. "attachments/"
+	AccessKey string `json:"access_key,omitempty"` // Access key ID; if empty, requests aren't signed
+	SecretKey string `json:"secret_key,omitempty"` // Secret access key
+}
+
+// Stores attachments as objects in an S3-compatible object store, using path-style URLs
+// ({endpoint}/{bucket}/{prefix}{name}) and AWS Signature Version 4 request signing.
+type S3AttachmentStore struct {
+	config   S3AttachmentStoreConfig
+	endpoint *url.URL
+	client   *http.Client
+}
+
+func NewS3AttachmentStore(config S3AttachmentStoreConfig) (*S3AttachmentStore, error) {
+	if config.Endpoint == "" || config.Bucket == "" {
+		return nil, fmt.Errorf("S3 attachment store requires an endpoint and a bucket")
+	}
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("Invalid S3 endpoint %q", config.Endpoint)
+	}
+	if config.Region == "" {
+		config.Region = kDefaultS3Region
+	}
+	return &S3AttachmentStore{
+		config:   config,
+		endpoint: endpoint,
+		client:   &http.Client{Timeout: 5 * time.Minute},
+	}, nil
+}
+
+func (store *S3AttachmentStore) objectKey(key AttachmentKey) string {
+	return store.config.Prefix + attachmentKeyToName(key)
+}
+
+func (store *S3AttachmentStore) GetAttachment(key AttachmentKey) ([]byte, error) {
+	response, err := store.sendRequest("GET", store.objectKey(key), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	return ioutil.ReadAll(response.Body)
+}
+
+func (store *S3AttachmentStore) AddAttachment(key AttachmentKey, data []byte) error {
+	response, err := store.sendRequest("PUT", store.objectKey(key), nil, data)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	return nil
+}
+
+// S3 needs to know an object's length before it's uploaded, and its key is only known once it's
+// been read, so the attachment is spooled to a temporary file first.
+func (store *S3AttachmentStore) AddAttachmentStream(reader *AttachmentDigestReader) error {
+	tempFile, err := ioutil.TempFile("", "sg-attachment-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+	defer tempFile.Close()
+	if _, err := io.Copy(tempFile, reader); err != nil {
+		return err
+	}
+	if _, err := tempFile.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	response, err := store.sendStreamRequest("PUT", store.objectKey(reader.Key()), nil, nil,
+		tempFile, reader.Length(), kS3UnsignedPayload)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	return nil
+}
+
+// Reads from the offset using a Range request.
+func (store *S3AttachmentStore) OpenAttachment(key AttachmentKey, offset int64) (io.ReadCloser, int64, error) {
+	var header http.Header
+	if offset > 0 {
+		header = http.Header{"Range": {fmt.Sprintf("bytes=%d-", offset)}}
+	}
+	response, err := store.sendStreamRequest("GET", store.objectKey(key), nil, header, nil, 0, sha256Hex(nil))
+	if err != nil {
+		return nil, 0, err
+	}
+	length := response.ContentLength
+	if response.StatusCode == http.StatusPartialContent {
+		// Content-Range looks like "bytes 100-199/200"
+		var start, end int64
+		if _, err := fmt.Sscanf(response.Header.Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &length); err != nil {
+			response.Body.Close()
+			return nil, 0, base.HTTPErrorf(http.StatusBadGateway, "Invalid Content-Range from attachment store")
+		}
+	} else if offset > 0 {
+		// The server ignored the Range header, so skip to the offset
+		if _, err := io.CopyN(ioutil.Discard, response.Body, offset); err != nil {
+			response.Body.Close()
+			return nil, 0, err
+		}
+	}
+	return response.Body, length, nil
+}
+
+func (store *S3AttachmentStore) DeleteAttachment(key AttachmentKey) error {
+	response, err := store.sendRequest("DELETE", store.objectKey(key), nil, nil)
+	if err != nil {
+		if base.IsDocNotFoundError(err) {
+			return nil
+		}
+		return err
+	}
+	response.Body.Close()
+	return nil
+}
+
+// Response body of a ListObjectsV2 request
+type s3ListBucketResult struct {
+	Contents []struct {
+		Key          string
+		LastModified time.Time
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func (store *S3AttachmentStore) ForEachAttachment(callback func(key AttachmentKey, modified time.Time) error) error {
+	continuationToken := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {store.config.Prefix}}
+		if continuationToken != "" {
+			query.Set("continuation-token", continuationToken)
+		}
+		response, err := store.sendRequest("GET", "", query, nil)
+		if err != nil {
+			return err
+		}
+		var result s3ListBucketResult
+		err = xml.NewDecoder(response.Body).Decode(&result)
+		response.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		for _, object := range result.Contents {
+			name := strings.TrimPrefix(object.Key, store.config.Prefix)
+			if key := attachmentNameToKey(name); key != "" {
+				if err := callback(key, object.LastModified); err != nil {
+					return err
+				}
+			}
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		continuationToken = result.NextContinuationToken
+	}
+}
+
+// Sends a signed request for an object (or for the bucket itself, if objectKey is empty).
+// A 404 or 416 status is returned as an HTTPError with that status; any other non-2xx status is
+// also an error.
+func (store *S3AttachmentStore) sendRequest(method, objectKey string, query url.Values, body []byte) (*http.Response, error) {
+	var bodyReader io.Reader
+	if body != nil {
+		bodyReader = bytes.NewReader(body)
+	}
+	return store.sendStreamRequest(method, objectKey, query, nil, bodyReader, int64(len(body)), sha256Hex(body))
+}
+
+// Like sendRequest, but with extra headers, and a body read from a stream whose length and
+// SHA-256 hash (or kS3UnsignedPayload) are given.
+func (store *S3AttachmentStore) sendStreamRequest(method, objectKey string, query url.Values, header http.Header,
+	body io.Reader, contentLength int64, payloadHash string) (*http.Response, error) {
+	path := strings.TrimSuffix(store.endpoint.Path, "/") + "/" + s3URIEncode(store.config.Bucket, false)
+	if objectKey != "" {
+		path += "/" + s3URIEncode(objectKey, false)
+	}
+	urlStr := store.endpoint.Scheme + "://" + store.endpoint.Host + path
+	if len(query) > 0 {
+		urlStr += "?" + s3CanonicalQuery(query)
+	}
+
+	request, err := http.NewRequest(method, urlStr, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		request.ContentLength = contentLength
+	}
+	for name, values := range header {
+		request.Header[name] = values
+	}
+	if store.config.AccessKey != "" {
+		signS3Request(request, path, query, payloadHash, store.config, time.Now())
+	}
+
+	response, err := store.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		response.Body.Close()
+		if response.StatusCode == http.StatusNotFound {
+			return nil, base.HTTPErrorf(http.StatusNotFound, "missing")
+		} else if response.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+			return nil, base.HTTPErrorf(http.StatusRequestedRangeNotSatisfiable, "Offset beyond end of attachment")
+		}
+		base.Warn("S3 attachment store: %s %s returned status %d", method, path, response.StatusCode)
+		return nil, base.HTTPErrorf(http.StatusBadGateway, "Attachment store returned status %d", response.StatusCode)
+	}
+	return response, nil
+}
+
+//////// AWS SIGNATURE V4:
+
+const kS3SigningAlgorithm = "AWS4-HMAC-SHA256"
+
+// Payload hash used when a request body isn't signed
+const kS3UnsignedPayload = "UNSIGNED-PAYLOAD"
+
+// Adds AWS Signature Version 4 headers to a request. All headers already set on the request are
+// signed, as well as Host, X-Amz-Date and X-Amz-Content-Sha256. The path must be the URI-encoded
+// request path, the query the request's query parameters, and payloadHash the hex SHA-256 digest
+// of the body (or kS3UnsignedPayload.)
+func signS3Request(request *http.Request, path string, query url.Values, payloadHash string, config S3AttachmentStoreConfig, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	request.Header.Set("X-Amz-Date", amzDate)
+	request.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": request.URL.Host}
+	for name, values := range request.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	headerNames := make([]string, 0, len(headers))
+	for name := range headers {
+		headerNames = append(headerNames, name)
+	}
+	sort.Strings(headerNames)
+	var canonicalHeaders bytes.Buffer
+	for _, name := range headerNames {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(headerNames, ";")
+
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		path,
+		s3CanonicalQuery(query),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + config.Region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		kS3SigningAlgorithm,
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	signingKey := hmacSHA256([]byte("AWS4"+config.SecretKey), date)
+	signingKey = hmacSHA256(signingKey, config.Region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	request.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		kS3SigningAlgorithm, config.AccessKey, scope, signedHeaders, signature))
+}
+
+// Encodes query parameters as S3 expects: sorted by name, with names and values URI-encoded.
+func s3CanonicalQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var params []string
+	for _, name := range names {
+		for _, value := range query[name] {
+			params = append(params, s3URIEncode(name, true)+"="+s3URIEncode(value, true))
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+// URI-encodes a string as S3 expects: every byte except unreserved characters is %-escaped.
+// Slashes are escaped only if encodeSlash is true.
+func s3URIEncode(str string, encodeSlash bool) string {
+	var encoded bytes.Buffer
+	for i := 0; i < len(str); i++ {
+		c := str[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			encoded.WriteByte(c)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", c)
+		}
+	}
+	return encoded.String()
+}
+
+func sha256Hex(data []byte) string {
+	digest := sha256.Sum256(data)
+	return hex.EncodeToString(digest[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,133 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/base64"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// An AttachmentStore that can read and write attachments as streams, without holding an entire
+// attachment in memory.
+type AttachmentStreamer interface {
+	// Returns a reader for an attachment's data starting at the given offset, and the attachment's
+	// total length. Returns a 404 error if the attachment doesn't exist.
+	OpenAttachment(key AttachmentKey, offset int64) (reader io.ReadCloser, length int64, err error)
+	// Stores an attachment read from a stream. Its key isn't known until the stream has been read
+	// to the end, at which point it's available from the reader's Key method.
+	AddAttachmentStream(reader *AttachmentDigestReader) error
+}
+
+// An attachment that's already been written to the attachment store, for instance by streaming
+// it from an HTTP request. It can be used as the "data" of an attachment in a body being saved,
+// in place of the attachment's contents.
+type StoredAttachment struct {
+	Key    AttachmentKey // The attachment's key, i.e. its SHA-1 digest
+	MD5Key string        // The attachment's MD5 digest, in the same format
+	Length int64         // The attachment's length in bytes
+}
+
+// An io.Reader that computes the SHA-1 and MD5 digests and the length of the data read through it.
+type AttachmentDigestReader struct {
+	reader io.Reader
+	sha1   hash.Hash
+	md5    hash.Hash
+	length int64
+}
+
+func NewAttachmentDigestReader(reader io.Reader) *AttachmentDigestReader {
+	return &AttachmentDigestReader{reader: reader, sha1: sha1.New(), md5: md5.New()}
+}
+
+func (r *AttachmentDigestReader) Read(p []byte) (n int, err error) {
+	n, err = r.reader.Read(p)
+	if n > 0 {
+		r.sha1.Write(p[:n])
+		r.md5.Write(p[:n])
+		r.length += int64(n)
+	}
+	return
+}
+
+// The attachment key (SHA-1 digest) of the data read so far.
+func (r *AttachmentDigestReader) Key() AttachmentKey {
+	return AttachmentKey("sha1-" + base64.StdEncoding.EncodeToString(r.sha1.Sum(nil)))
+}
+
+// The MD5 digest of the data read so far.
+func (r *AttachmentDigestReader) MD5Key() string {
+	return "md5-" + base64.StdEncoding.EncodeToString(r.md5.Sum(nil))
+}
+
+// The number of bytes read so far.
+func (r *AttachmentDigestReader) Length() int64 {
+	return r.length
+}
+
+// Returns true if the data read so far matches the given digest, which may be SHA-1 or MD5.
+func (r *AttachmentDigestReader) Matches(digest string) bool {
+	return digest == string(r.Key()) || digest == r.MD5Key()
+}
+
+// Reads an attachment from a stream and saves it in the attachment store, returning a
+// StoredAttachment that can be used as the attachment's data in a document body. If the store
+// isn't an AttachmentStreamer, the attachment is read into memory first.
+func (db *Database) StoreAttachmentStream(reader io.Reader) (*StoredAttachment, error) {
+	digestReader := NewAttachmentDigestReader(reader)
+	if streamer, ok := db.AttachmentStore.(AttachmentStreamer); ok {
+		if err := streamer.AddAttachmentStream(digestReader); err != nil {
+			return nil, err
+		}
+	} else {
+		data, err := ioutil.ReadAll(digestReader)
+		if err != nil {
+			return nil, err
+		}
+		if err := db.AttachmentStore.AddAttachment(digestReader.Key(), data); err != nil {
+			return nil, err
+		}
+	}
+	base.LogTo("Attach", "\tAdded streamed attachment %q (%d bytes)", digestReader.Key(), digestReader.Length())
+	return &StoredAttachment{
+		Key:    digestReader.Key(),
+		MD5Key: digestReader.MD5Key(),
+		Length: digestReader.Length(),
+	}, nil
+}
+
+// Opens an attachment for reading, starting at the given offset. Returns the reader and the
+// attachment's total length. If the store isn't an AttachmentStreamer, the attachment is read
+// into memory first.
+func (db *Database) OpenAttachment(key AttachmentKey, offset int64) (io.ReadCloser, int64, error) {
+	if streamer, ok := db.AttachmentStore.(AttachmentStreamer); ok {
+		return streamer.OpenAttachment(key, offset)
+	}
+	data, err := db.GetAttachment(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	return openAttachmentData(data, offset)
+}
+
+// Returns a reader for a byte array, starting at the given offset.
+func openAttachmentData(data []byte, offset int64) (io.ReadCloser, int64, error) {
+	if offset < 0 || offset > int64(len(data)) {
+		return nil, 0, base.HTTPErrorf(http.StatusRequestedRangeNotSatisfiable, "Offset beyond end of attachment")
+	}
+	return ioutil.NopCloser(bytes.NewReader(data[offset:])), int64(len(data)), nil
+}
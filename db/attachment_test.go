@@ -10,9 +10,13 @@
 package db
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"log"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
 	"testing"
 
 	"github.com/couchbase/sync_gateway/base"
@@ -138,3 +142,73 @@ func TestAttachmentForRejectedDocument(t *testing.T) {
 	assertTrue(t, err != nil, "Expect error when attempting to retrieve attachment document after doc is rejected.")
 
 }
+
+func TestProveAttachment(t *testing.T) {
+	data := []byte("hello world")
+	nonce, proof := GenerateProofOfAttachment(data)
+	assert.Equals(t, len(nonce), 20)
+	assert.Equals(t, ProveAttachment(data, nonce), proof)
+	assert.NotEquals(t, ProveAttachment([]byte("goodbye world"), nonce), proof)
+}
+
+// Builds a multipart/related document body with one following attachment.
+func makeMultipartDocument(t *testing.T, attachment []byte, length int) *multipart.Reader {
+	var buffer bytes.Buffer
+	writer := multipart.NewWriter(&buffer)
+	body := Body{"_attachments": map[string]interface{}{
+		"photo.jpg": map[string]interface{}{
+			"follows":      true,
+			"digest":       md5DigestKey(attachment),
+			"length":       length,
+			"content_type": "image/jpeg",
+		},
+	}}
+	assertNoError(t, writeJSONPart(writer, "application/json", body, false), "writeJSONPart")
+	part, err := writer.CreatePart(textproto.MIMEHeader{})
+	assertNoError(t, err, "CreatePart")
+	part.Write(attachment)
+	writer.Close()
+	return multipart.NewReader(&buffer, writer.Boundary())
+}
+
+func TestStreamMultipartDocument(t *testing.T) {
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer tearDownTestDB(t, db)
+
+	attachment := bytes.Repeat([]byte("JPEG"), 1000)
+	body, err := db.StreamMultipartDocument(makeMultipartDocument(t, attachment, len(attachment)))
+	assertNoError(t, err, "StreamMultipartDocument")
+
+	// The attachment has already been stored:
+	meta := BodyAttachments(body)["photo.jpg"].(map[string]interface{})
+	stored, ok := meta["data"].(*StoredAttachment)
+	assertTrue(t, ok, "Attachment data should be a StoredAttachment")
+	assert.Equals(t, string(stored.Key), sha1DigestKey(attachment))
+	assert.Equals(t, stored.Length, int64(len(attachment)))
+	data, err := db.GetAttachment(stored.Key)
+	assertNoError(t, err, "GetAttachment")
+	assert.DeepEquals(t, data, attachment)
+
+	// Saving the document replaces the data with a stub:
+	_, err = db.Put("doc1", body)
+	assertNoError(t, err, "Put")
+	gotbody, err := db.GetRev("doc1", "", false, nil)
+	assertNoError(t, err, "GetRev")
+	meta = BodyAttachments(gotbody)["photo.jpg"].(map[string]interface{})
+	assert.Equals(t, meta["digest"], sha1DigestKey(attachment))
+	length, _ := base.ToInt64(meta["length"])
+	assert.Equals(t, length, int64(len(attachment)))
+	assert.Equals(t, meta["content_type"], "image/jpeg")
+
+	// A wrong length is rejected:
+	_, err = db.StreamMultipartDocument(makeMultipartDocument(t, attachment, 12))
+	assertHTTPError(t, err, http.StatusBadRequest)
+
+	// A new attachment in a rejected document is left for vacuum, not deleted:
+	other := bytes.Repeat([]byte("PNG"), 1000)
+	_, err = db.StreamMultipartDocument(makeMultipartDocument(t, other, 12))
+	assertHTTPError(t, err, http.StatusBadRequest)
+	_, err = db.GetAttachment(AttachmentKey(sha1DigestKey(other)))
+	assertNoError(t, err, "GetAttachment of orphan")
+}
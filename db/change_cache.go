@@ -576,10 +576,21 @@ func (c *changeCache) processPrincipalDoc(docID string, docJSON []byte, isUser b
 
 	base.LogTo("Cache", "Received #%d (%q)", change.Sequence, change.DocID)
 
+	// Writes that don't change the principal's sequence (like invalidating its channels) are
+	// duplicates, which don't raise events:
+	c.lock.RLock()
+	_, duplicate := c.receivedSeqs[sequence]
+	c.lock.RUnlock()
+
 	changedChannels := c.processEntry(change)
 	if c.onChange != nil && len(changedChannels) > 0 {
 		c.onChange(changedChannels)
 	}
+
+	// Raise the principal change event here, so changes made through any node are reported:
+	if eventMgr := c.context.EventMgr; !duplicate && eventMgr != nil && eventMgr.HasHandlerForEvent(PrincipalChange) {
+		eventMgr.RaisePrincipalChangeEvent(princ.Name(), isUser, eventMgr.takePrincipalAction(sequence))
+	}
 }
 
 // Handles a newly-arrived LogEntry.
@@ -22,16 +22,18 @@ import (
 
 // Options for changes-feeds
 type ChangesOptions struct {
-	Since       SequenceID // sequence # to start _after_
-	Limit       int        // Max number of changes to return, if nonzero
-	Conflicts   bool       // Show all conflicting revision IDs, not just winning one?
-	IncludeDocs bool       // Include doc body of each change?
-	Wait        bool       // Wait for results, instead of immediately returning empty result?
-	Continuous  bool       // Run continuously until terminated?
-	Terminator  chan bool  // Caller can close this channel to terminate the feed
-	HeartbeatMs uint64     // How often to send a heartbeat to the client
-	TimeoutMs   uint64     // After this amount of time, close the longpoll connection
-	ActiveOnly  bool       // If true, only return information on non-deleted, non-removed revisions
+	Since       SequenceID    // sequence # to start _after_
+	Limit       int           // Max number of changes to return, if nonzero
+	Conflicts   bool          // Show all conflicting revision IDs, not just winning one?
+	IncludeDocs bool          // Include doc body of each change?
+	Wait        bool          // Wait for results, instead of immediately returning empty result?
+	Continuous  bool          // Run continuously until terminated?
+	Terminator  chan bool     // Caller can close this channel to terminate the feed
+	HeartbeatMs uint64        // How often to send a heartbeat to the client
+	TimeoutMs   uint64        // After this amount of time, close the longpoll connection
+	ActiveOnly  bool          // If true, only return information on non-deleted, non-removed revisions
+	Filter      ChangesFilter // If non-nil, only return changes to docs that pass this filter
+	Namespace   string        // If non-empty, only return changes in this namespace's channels; see ChangesNamespace
 }
 
 // A changes entry; Database.GetChanges returns an array of these.
@@ -100,7 +102,7 @@ func (db *Database) addDocToChangeEntry(entry *ChangeEntry, options ChangesOptio
 		// Load doc body + metadata
 		doc, err := db.GetDocument(entry.ID, DocUnmarshalAll)
 		if err != nil {
-			base.Warn("Changes feed: error getting doc %q: %v", entry.ID, err)
+			base.WarnCtx(db.LogCtx, "Changes feed: error getting doc %q: %v", entry.ID, err)
 			return
 		}
 		db.AddDocInstanceToChangeEntry(entry, doc, options)
@@ -111,7 +113,7 @@ func (db *Database) addDocToChangeEntry(entry *ChangeEntry, options ChangesOptio
 		var err error
 		doc.syncData, err = db.GetDocSyncData(entry.ID)
 		if err != nil {
-			base.Warn("Changes feed: error getting doc sync data %q: %v", entry.ID, err)
+			base.WarnCtx(db.LogCtx, "Changes feed: error getting doc sync data %q: %v", entry.ID, err)
 			return
 		}
 		db.AddDocInstanceToChangeEntry(entry, doc, options)
@@ -121,7 +123,7 @@ func (db *Database) addDocToChangeEntry(entry *ChangeEntry, options ChangesOptio
 		revID := entry.Changes[0]["rev"]
 		err := db.AddDocToChangeEntryUsingRevCache(entry, revID)
 		if err != nil {
-			base.Warn("Changes feed: error getting revision body for %q (%s): %v", entry.ID, revID, err)
+			base.WarnCtx(db.LogCtx, "Changes feed: error getting revision body for %q (%s): %v", entry.ID, revID, err)
 		}
 	}
 
@@ -153,13 +155,13 @@ func (db *Database) AddDocInstanceToChangeEntry(entry *ChangeEntry, doc *documen
 	}
 	if options.IncludeDocs {
 		if doc.Body() == nil {
-			base.Warn("AddDocInstanceToChangeEntry called with options.IncludeDocs, but doc is missing Body")
+			base.WarnCtx(db.LogCtx, "AddDocInstanceToChangeEntry called with options.IncludeDocs, but doc is missing Body")
 			return
 		}
 		var err error
 		entry.Doc, err = db.getRevFromDoc(doc, revID, false)
 		if err != nil {
-			base.Warn("Changes feed: error getting doc %q/%q: %v", doc.ID, revID, err)
+			base.WarnCtx(db.LogCtx, "Changes feed: error getting doc %q/%q: %v", doc.ID, revID, err)
 		}
 	}
 }
@@ -169,7 +171,7 @@ func (db *Database) AddDocInstanceToChangeEntry(entry *ChangeEntry, doc *documen
 func (db *Database) changesFeed(channel string, options ChangesOptions, to string) (<-chan *ChangeEntry, error) {
 	dbExpvars.Add("channelChangesFeeds", 1)
 	log, err := db.changeCache.GetChanges(channel, options)
-	base.LogTo("Changes+", "[changesFeed] Found %d changes for channel %s", len(log), channel)
+	base.LogToCtx(db.LogCtx, "Changes+", "[changesFeed] Found %d changes for channel %s", len(log), channel)
 	if err != nil {
 		return nil, err
 	}
@@ -204,10 +206,10 @@ func (db *Database) changesFeed(channel string, options ChangesOptions, to strin
 
 			change := makeChangeEntry(logEntry, seqID, channel)
 
-			base.LogTo("Changes+", "Channel feed processing seq:%v in channel %s %s", seqID, channel, to)
+			base.LogToCtx(db.LogCtx, "Changes+", "Channel feed processing seq:%v in channel %s %s", seqID, channel, to)
 			select {
 			case <-options.Terminator:
-				base.LogTo("Changes+", "Terminating channel feed %s", to)
+				base.LogToCtx(db.LogCtx, "Changes+", "Terminating channel feed %s", to)
 				return
 			case feed <- &change:
 			}
@@ -273,13 +275,17 @@ func (db *Database) MultiChangesFeed(chans base.Set, options ChangesOptions) (<-
 	}
 
 	if (options.Continuous || options.Wait) && options.Terminator == nil {
-		base.Warn("MultiChangesFeed: Terminator missing for Continuous/Wait mode")
+		base.WarnCtx(db.LogCtx, "MultiChangesFeed: Terminator missing for Continuous/Wait mode")
+	}
+	var err error
+	if options.Namespace, err = db.ChangesNamespace(options.Namespace); err != nil {
+		return nil, err
 	}
 	if db.SequenceType == IntSequenceType {
-		base.LogTo("Changes+", "Int sequence multi changes feed...")
+		base.LogToCtx(db.LogCtx, "Changes+", "Int sequence multi changes feed...")
 		return db.SimpleMultiChangesFeed(chans, options)
 	} else {
-		base.LogTo("Changes+", "Vector multi changes feed...")
+		base.LogToCtx(db.LogCtx, "Changes+", "Vector multi changes feed...")
 		return db.VectorMultiChangesFeed(chans, options)
 	}
 }
@@ -322,19 +328,19 @@ func (db *Database) checkForUserUpdates(userChangeCount uint64, changeWaiter *ch
 	if newCount > userChangeCount || !isContinuous {
 		var previousChannels channels.TimedSet
 		var newChannels base.Set
-		base.LogTo("Changes+", "MultiChangesFeed reloading user %+v", db.user)
+		base.LogToCtx(db.LogCtx, "Changes+", "MultiChangesFeed reloading user %+v", db.user)
 		userChangeCount = newCount
 
 		if db.user != nil {
 			previousChannels = db.user.InheritedChannels()
 			if err := db.ReloadUser(); err != nil {
-				base.Warn("Error reloading user %q: %v", db.user.Name(), err)
+				base.WarnCtx(db.LogCtx, "Error reloading user %q: %v", db.user.Name(), err)
 				return false, 0, nil, err
 			}
 			// check whether channels have changed
 			newChannels = db.user.GetAddedChannels(previousChannels)
 			if len(newChannels) > 0 {
-				base.LogTo("Changes+", "New channels found after user reload: %v", newChannels)
+				base.LogToCtx(db.LogCtx, "Changes+", "New channels found after user reload: %v", newChannels)
 			}
 		}
 		return true, newCount, newChannels, nil
@@ -349,12 +355,12 @@ func (db *Database) SimpleMultiChangesFeed(chans base.Set, options ChangesOption
 		to = fmt.Sprintf("  (to %s)", db.user.Name())
 	}
 
-	base.LogTo("Changes", "MultiChangesFeed(channels: %s, options: %+v) ... %s", chans, options, to)
+	base.LogToCtx(db.LogCtx, "Changes", "MultiChangesFeed(channels: %s, options: %+v) ... %s", chans, options, to)
 	output := make(chan *ChangeEntry, 50)
 
 	go func() {
 		defer func() {
-			base.LogTo("Changes", "MultiChangesFeed done %s", to)
+			base.LogToCtx(db.LogCtx, "Changes", "MultiChangesFeed done %s", to)
 			close(output)
 		}()
 
@@ -378,7 +384,7 @@ func (db *Database) SimpleMultiChangesFeed(chans base.Set, options ChangesOption
 			// included in the initial changes loop iteration, and (b) won't wake up the changeWaiter.
 			if db.user != nil {
 				if err := db.ReloadUser(); err != nil {
-					base.Warn("Error reloading user during changes initialization %q: %v", db.user.Name(), err)
+					base.WarnCtx(db.LogCtx, "Error reloading user during changes initialization %q: %v", db.user.Name(), err)
 					change := makeErrorEntry("User not found during reload - terminating changes feed")
 					output <- &change
 					return
@@ -395,6 +401,7 @@ func (db *Database) SimpleMultiChangesFeed(chans base.Set, options ChangesOption
 		} else {
 			channelsSince = channels.AtSequence(chans, 0)
 		}
+		channelsSince = restrictToNamespace(channelsSince, options.Namespace)
 
 		// For a continuous feed, initialise the lateSequenceFeeds that track late-arriving sequences
 		// to the channel caches.
@@ -410,7 +417,7 @@ func (db *Database) SimpleMultiChangesFeed(chans base.Set, options ChangesOption
 			if changeWaiter != nil {
 				changeWaiter.UpdateChannels(channelsSince)
 			}
-			base.LogTo("Changes+", "MultiChangesFeed: channels expand to %#v ... %s", channelsSince.String(), to)
+			base.LogToCtx(db.LogCtx, "Changes+", "MultiChangesFeed: channels expand to %#v ... %s", channelsSince.String(), to)
 
 			// lowSequence is used to send composite keys to clients, so that they can obtain any currently
 			// skipped sequences in a future iteration or request.
@@ -464,7 +471,7 @@ func (db *Database) SimpleMultiChangesFeed(chans base.Set, options ChangesOption
 				// Backfill required when seqAddedAt is before current sequence
 				backfillRequired := seqAddedAt > 1 && options.Since.Before(SequenceID{Seq: seqAddedAt}) && seqAddedAt <= currentCachedSequence
 				if seqAddedAt > currentCachedSequence {
-					base.LogTo("Changes+", "Grant for channel [%s] is after the current sequence - skipped for this iteration.  Grant:[%d] Current:[%d] %s", name, seqAddedAt, currentCachedSequence, to)
+					base.LogToCtx(db.LogCtx, "Changes+", "Grant for channel [%s] is after the current sequence - skipped for this iteration.  Grant:[%d] Current:[%d] %s", name, seqAddedAt, currentCachedSequence, to)
 					deferredBackfill = true
 					continue
 				}
@@ -483,7 +490,7 @@ func (db *Database) SimpleMultiChangesFeed(chans base.Set, options ChangesOption
 
 				feed, err := db.changesFeed(name, chanOpts, to)
 				if err != nil {
-					base.Warn("MultiChangesFeed got error reading changes feed %q: %v", name, err)
+					base.WarnCtx(db.LogCtx, "MultiChangesFeed got error reading changes feed %q: %v", name, err)
 					change := makeErrorEntry("Error reading changes feed - terminating changes feed")
 					output <- &change
 					return
@@ -499,7 +506,7 @@ func (db *Database) SimpleMultiChangesFeed(chans base.Set, options ChangesOption
 					if lateSequenceFeedHandler != nil {
 						latefeed, err := db.getLateFeed(lateSequenceFeedHandler)
 						if err != nil {
-							base.Warn("MultiChangesFeed got error reading late sequence feed %q: %v", name, err)
+							base.WarnCtx(db.LogCtx, "MultiChangesFeed got error reading late sequence feed %q: %v", name, err)
 						} else {
 							// Mark feed as actively used in this iteration.  Used to remove lateSequenceFeeds
 							// when the user loses channel access
@@ -584,7 +591,7 @@ func (db *Database) SimpleMultiChangesFeed(chans base.Set, options ChangesOption
 
 				// Don't send any entries later than the cached sequence at the start of this iteration
 				if currentCachedSequence < minEntry.Seq.Seq {
-					base.LogTo("Changes+", "Found sequence later than stable sequence: stable:[%d] entry:[%d] (%s)", currentCachedSequence, minEntry.Seq.Seq, minEntry.ID)
+					base.LogToCtx(db.LogCtx, "Changes+", "Found sequence later than stable sequence: stable:[%d] entry:[%d] (%s)", currentCachedSequence, minEntry.Seq.Seq, minEntry.ID)
 					postStableSeqsFound = true
 					continue
 				}
@@ -596,6 +603,11 @@ func (db *Database) SimpleMultiChangesFeed(chans base.Set, options ChangesOption
 					options.Since = minSeq
 				}
 
+				// Skip docs that don't pass the filter (if any):
+				if options.Filter != nil && !db.changeEntryPassesFilter(minEntry, options.Filter) {
+					continue
+				}
+
 				// Add the doc body or the conflicting rev IDs, if those options are set:
 				if options.IncludeDocs || options.Conflicts {
 					db.addDocToChangeEntry(minEntry, options)
@@ -606,7 +618,7 @@ func (db *Database) SimpleMultiChangesFeed(chans base.Set, options ChangesOption
 				minEntry.Seq.LowSeq = lowSequence
 
 				// Send the entry, and repeat the loop:
-				base.LogTo("Changes+", "MultiChangesFeed sending %+v %s", minEntry, to)
+				base.LogToCtx(db.LogCtx, "Changes+", "MultiChangesFeed sending %+v %s", minEntry, to)
 
 				select {
 				case <-options.Terminator:
@@ -630,7 +642,7 @@ func (db *Database) SimpleMultiChangesFeed(chans base.Set, options ChangesOption
 
 			// If nothing found, and in wait mode: wait for the db to change, then run again.
 			// First notify the reader that we're waiting by sending a nil.
-			base.LogTo("Changes+", "MultiChangesFeed waiting... %s", to)
+			base.LogToCtx(db.LogCtx, "Changes+", "MultiChangesFeed waiting... %s", to)
 			output <- nil
 
 		waitForChanges:
@@ -675,12 +687,12 @@ func (db *Database) SimpleMultiChangesFeed(chans base.Set, options ChangesOption
 			userChanged, userCounter, addedChannels, err = db.checkForUserUpdates(userCounter, changeWaiter, options.Continuous)
 			if err != nil {
 				change := makeErrorEntry("User not found during reload - terminating changes feed")
-				base.LogTo("Changes+", "User not found during reload - terminating changes feed with entry %+v", change)
+				base.LogToCtx(db.LogCtx, "Changes+", "User not found during reload - terminating changes feed with entry %+v", change)
 				output <- &change
 				return
 			}
 			if userChanged && db.user != nil {
-				channelsSince = db.user.FilterToAvailableChannels(chans)
+				channelsSince = restrictToNamespace(db.user.FilterToAvailableChannels(chans), options.Namespace)
 			}
 
 			// Clean up inactive lateSequenceFeeds (because user has lost access to the channel)
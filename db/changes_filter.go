@@ -0,0 +1,484 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+
+	sgbucket "github.com/couchbase/sg-bucket"
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Names of the built-in changes filters
+const (
+	ChangesFilterByChannel = "sync_gateway/bychannel"
+	ChangesFilterDocIDs    = "_doc_ids"
+	ChangesFilterSelector  = "_selector"
+)
+
+// A server-side filter applied to the documents in a changes feed. Entries whose document
+// doesn't pass are left out of the feed. Deleted documents are matched against their
+// tombstone body, which contains only "_id", "_rev" and "_deleted".
+type ChangesFilter interface {
+	Passes(doc Body) (bool, error)
+}
+
+// Is this a valid name for an admin-defined changes filter? Names starting with "_" are
+// reserved for built-in filters, as is "sync_gateway/bychannel".
+func IsValidChangesFilterName(name string) bool {
+	return name != "" && !strings.HasPrefix(name, "_") && name != ChangesFilterByChannel
+}
+
+// Returns the admin-defined changes filter with the given name, bound to the parameters of a
+// changes request. The filter function is called as filter(doc, req), where req.query contains
+// the request's parameters and req.userCtx describes the user (null for an admin).
+func (context *DatabaseContext) GetChangesFilter(name string, query map[string]interface{}, userCtx map[string]interface{}) (ChangesFilter, error) {
+	fn := context.Options.ChangesFilters[name]
+	if fn == nil {
+		return nil, base.HTTPErrorf(http.StatusBadRequest, "Unknown filter %q", name)
+	}
+	if query == nil {
+		query = map[string]interface{}{}
+	}
+	req := map[string]interface{}{"query": query, "userCtx": userCtx}
+	return &jsChangesFilter{fn: fn, req: req}, nil
+}
+
+// Returns true if the change entry should be sent by a feed using the given filter. Entries
+// for pseudo-docs (like _user docs) and removals always pass, since the user can't see their
+// bodies; the client still needs to know about the removal.
+func (db *Database) changeEntryPassesFilter(entry *ChangeEntry, filter ChangesFilter) bool {
+	if entry.pseudoDoc || entry.allRemoved {
+		return true
+	}
+	revID := entry.Changes[0]["rev"]
+	body, err := db.GetRevWithHistory(entry.ID, revID, 0, nil, nil, false)
+	if err != nil {
+		base.LogToCtx(db.LogCtx, "Changes+", "Changes filter: error getting %q (%s): %v", entry.ID, revID, err)
+		return false
+	}
+	passes, err := filter.Passes(body)
+	if err != nil {
+		base.WarnCtx(db.LogCtx, "Changes filter: error filtering %q: %v", entry.ID, err)
+		return false
+	}
+	return passes
+}
+
+//////// JAVASCRIPT FILTERS
+
+// A compiled JavaScript changes filter function, as configured for a database.
+type JSChangesFilterFunction struct {
+	*sgbucket.JSServer
+}
+
+func NewJSChangesFilterFunction(fnSource string) *JSChangesFilterFunction {
+	return &JSChangesFilterFunction{
+		JSServer: sgbucket.NewJSServer(fnSource, kTaskCacheSize,
+			func(fnSource string) (sgbucket.JSServerTask, error) {
+				return newJsEventTask(fnSource)
+			}),
+	}
+}
+
+// A JSChangesFilterFunction bound to the request object of a changes feed.
+type jsChangesFilter struct {
+	fn  *JSChangesFilterFunction
+	req map[string]interface{}
+}
+
+func (f *jsChangesFilter) Passes(doc Body) (bool, error) {
+	result, err := f.fn.Call(map[string]interface{}(doc), f.req)
+	if err != nil {
+		return false, err
+	}
+	return isTruthy(result), nil
+}
+
+// Interprets the result of a JavaScript function as a boolean, the way JavaScript would.
+func isTruthy(value interface{}) bool {
+	switch value := value.(type) {
+	case nil:
+		return false
+	case bool:
+		return value
+	case string:
+		return value != ""
+	case float64:
+		return value != 0
+	case int64:
+		return value != 0
+	default:
+		return true
+	}
+}
+
+//////// SELECTOR FILTER
+
+// A declarative filter that matches document properties, like CouchDB's "_selector" filter.
+// A selector is a JSON object whose keys are property paths ("address.city") or combination
+// operators ($and, $or, $nor, $not), and whose values are either a value to compare with or an
+// object of condition operators ($eq, $ne, $gt, $gte, $lt, $lte, $in, $nin, $exists, $type,
+// $size, $regex, $not).
+type selectorFilter struct {
+	matches docPredicate
+}
+
+type docPredicate func(doc map[string]interface{}) bool
+
+// Tests a property value; found is false if the property doesn't exist.
+type valuePredicate func(value interface{}, found bool) bool
+
+// Compiles a selector into a ChangesFilter. Returns a 400 error if the selector is invalid.
+func NewSelectorFilter(selector map[string]interface{}) (ChangesFilter, error) {
+	if len(selector) == 0 {
+		return nil, base.HTTPErrorf(http.StatusBadRequest, "Missing or empty 'selector'")
+	}
+	matches, err := compileSelector(selector)
+	if err != nil {
+		return nil, base.HTTPErrorf(http.StatusBadRequest, "Invalid selector: %v", err)
+	}
+	return &selectorFilter{matches: matches}, nil
+}
+
+func (f *selectorFilter) Passes(doc Body) (bool, error) {
+	return f.matches(doc), nil
+}
+
+func compileSelector(selector map[string]interface{}) (docPredicate, error) {
+	var predicates []docPredicate
+	for key, arg := range selector {
+		var predicate docPredicate
+		var err error
+		if strings.HasPrefix(key, "$") {
+			predicate, err = compileCombination(key, arg)
+		} else {
+			predicate, err = compileField(key, arg)
+		}
+		if err != nil {
+			return nil, err
+		}
+		predicates = append(predicates, predicate)
+	}
+	return func(doc map[string]interface{}) bool {
+		for _, predicate := range predicates {
+			if !predicate(doc) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+func compileCombination(operator string, arg interface{}) (docPredicate, error) {
+	if operator == "$not" {
+		subSelector, ok := arg.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("$not requires an object")
+		}
+		predicate, err := compileSelector(subSelector)
+		if err != nil {
+			return nil, err
+		}
+		return func(doc map[string]interface{}) bool { return !predicate(doc) }, nil
+	}
+
+	items, ok := arg.([]interface{})
+	if !ok || len(items) == 0 {
+		return nil, fmt.Errorf("%s requires a non-empty array", operator)
+	}
+	predicates := make([]docPredicate, 0, len(items))
+	for _, item := range items {
+		subSelector, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s requires an array of objects", operator)
+		}
+		predicate, err := compileSelector(subSelector)
+		if err != nil {
+			return nil, err
+		}
+		predicates = append(predicates, predicate)
+	}
+
+	// $and passes if all pass; $or if any pass; $nor if none pass:
+	var stopWhen, resultIfStopped bool
+	switch operator {
+	case "$and":
+		stopWhen, resultIfStopped = false, false
+	case "$or":
+		stopWhen, resultIfStopped = true, true
+	case "$nor":
+		stopWhen, resultIfStopped = true, false
+	default:
+		return nil, fmt.Errorf("unknown operator %s", operator)
+	}
+	return func(doc map[string]interface{}) bool {
+		for _, predicate := range predicates {
+			if predicate(doc) == stopWhen {
+				return resultIfStopped
+			}
+		}
+		return !resultIfStopped
+	}, nil
+}
+
+func compileField(path string, arg interface{}) (docPredicate, error) {
+	predicate, err := compileCondition(arg)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	components := strings.Split(path, ".")
+	return func(doc map[string]interface{}) bool {
+		value, found := lookupPath(doc, components)
+		return predicate(value, found)
+	}, nil
+}
+
+// Compiles the condition on a property: either an object of operators or a value to equal.
+func compileCondition(arg interface{}) (valuePredicate, error) {
+	operators, ok := arg.(map[string]interface{})
+	if !ok || !hasOperatorKeys(operators) {
+		return compileOperator("$eq", arg)
+	}
+	var predicates []valuePredicate
+	for operator, operand := range operators {
+		if !strings.HasPrefix(operator, "$") {
+			return nil, fmt.Errorf("can't mix operators and properties")
+		}
+		predicate, err := compileOperator(operator, operand)
+		if err != nil {
+			return nil, err
+		}
+		predicates = append(predicates, predicate)
+	}
+	return func(value interface{}, found bool) bool {
+		for _, predicate := range predicates {
+			if !predicate(value, found) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+func hasOperatorKeys(object map[string]interface{}) bool {
+	for key := range object {
+		if strings.HasPrefix(key, "$") {
+			return true
+		}
+	}
+	return false
+}
+
+func compileOperator(operator string, operand interface{}) (valuePredicate, error) {
+	switch operator {
+	case "$eq":
+		return func(value interface{}, found bool) bool {
+			return found && selectorValuesEqual(value, operand)
+		}, nil
+	case "$ne":
+		return func(value interface{}, found bool) bool {
+			return !found || !selectorValuesEqual(value, operand)
+		}, nil
+	case "$gt", "$gte", "$lt", "$lte":
+		if _, ok := comparableValue(operand); !ok {
+			return nil, fmt.Errorf("%s requires a number or string", operator)
+		}
+		return func(value interface{}, found bool) bool {
+			if !found {
+				return false
+			}
+			cmp, ok := compareSelectorValues(value, operand)
+			if !ok {
+				return false
+			}
+			switch operator {
+			case "$gt":
+				return cmp > 0
+			case "$gte":
+				return cmp >= 0
+			case "$lt":
+				return cmp < 0
+			default:
+				return cmp <= 0
+			}
+		}, nil
+	case "$in", "$nin":
+		items, ok := operand.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s requires an array", operator)
+		}
+		wantIn := (operator == "$in")
+		return func(value interface{}, found bool) bool {
+			if !found {
+				return !wantIn
+			}
+			for _, item := range items {
+				if selectorValuesEqual(value, item) {
+					return wantIn
+				}
+			}
+			return !wantIn
+		}, nil
+	case "$exists":
+		exists, ok := operand.(bool)
+		if !ok {
+			return nil, fmt.Errorf("$exists requires a boolean")
+		}
+		return func(value interface{}, found bool) bool {
+			return found == exists
+		}, nil
+	case "$type":
+		typeName, ok := operand.(string)
+		if !ok || !isSelectorTypeName(typeName) {
+			return nil, fmt.Errorf("$type requires one of null, boolean, number, string, array, object")
+		}
+		return func(value interface{}, found bool) bool {
+			return found && selectorTypeName(value) == typeName
+		}, nil
+	case "$size":
+		size, ok := operand.(float64)
+		if !ok {
+			return nil, fmt.Errorf("$size requires a number")
+		}
+		return func(value interface{}, found bool) bool {
+			array, ok := value.([]interface{})
+			return ok && float64(len(array)) == size
+		}, nil
+	case "$regex":
+		pattern, ok := operand.(string)
+		if !ok {
+			return nil, fmt.Errorf("$regex requires a string")
+		}
+		regex, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		return func(value interface{}, found bool) bool {
+			str, ok := value.(string)
+			return ok && regex.MatchString(str)
+		}, nil
+	case "$not":
+		predicate, err := compileCondition(operand)
+		if err != nil {
+			return nil, err
+		}
+		return func(value interface{}, found bool) bool {
+			return !predicate(value, found)
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown operator %s", operator)
+	}
+}
+
+// Looks up a property by its path components; returns false if it doesn't exist.
+func lookupPath(doc map[string]interface{}, components []string) (interface{}, bool) {
+	var value interface{} = doc
+	for _, component := range components {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			if body, isBody := value.(Body); isBody {
+				object = body
+			} else {
+				return nil, false
+			}
+		}
+		if value, ok = object[component]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// Converts a JSON number or string to a form that can be compared; returns false for other types.
+func comparableValue(value interface{}) (interface{}, bool) {
+	switch value := value.(type) {
+	case float64:
+		return value, true
+	case int:
+		return float64(value), true
+	case int64:
+		return float64(value), true
+	case uint64:
+		return float64(value), true
+	case string:
+		return value, true
+	default:
+		return nil, false
+	}
+}
+
+// Compares two numbers or two strings, returning -1, 0 or 1. Values of different types aren't
+// comparable, in which case the second return value is false.
+func compareSelectorValues(a, b interface{}) (int, bool) {
+	a, okA := comparableValue(a)
+	b, okB := comparableValue(b)
+	if !okA || !okB {
+		return 0, false
+	}
+	switch a := a.(type) {
+	case float64:
+		b, ok := b.(float64)
+		if !ok {
+			return 0, false
+		}
+		if a < b {
+			return -1, true
+		} else if a > b {
+			return 1, true
+		}
+		return 0, true
+	case string:
+		b, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(a, b), true
+	}
+	return 0, false
+}
+
+func selectorValuesEqual(a, b interface{}) bool {
+	if cmp, ok := compareSelectorValues(a, b); ok {
+		return cmp == 0
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func isSelectorTypeName(name string) bool {
+	switch name {
+	case "null", "boolean", "number", "string", "array", "object":
+		return true
+	}
+	return false
+}
+
+func selectorTypeName(value interface{}) string {
+	if _, ok := comparableValue(value); ok {
+		if _, isString := value.(string); isString {
+			return "string"
+		}
+		return "number"
+	}
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case []interface{}:
+		return "array"
+	default:
+		return "object"
+	}
+}
@@ -0,0 +1,67 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func selectorPasses(t *testing.T, selectorJSON string, doc Body) bool {
+	var selector map[string]interface{}
+	assert.Equals(t, json.Unmarshal([]byte(selectorJSON), &selector), nil)
+	filter, err := NewSelectorFilter(selector)
+	assert.Equals(t, err, nil)
+	passes, err := filter.Passes(doc)
+	assert.Equals(t, err, nil)
+	return passes
+}
+
+func TestSelectorFilter(t *testing.T) {
+	var doc Body
+	json.Unmarshal([]byte(`{"type":"order", "total":42, "tags":["a","b"],
+		"address":{"city":"Paris"}, "paid":false}`), &doc)
+
+	assert.True(t, selectorPasses(t, `{"type":"order"}`, doc))
+	assert.False(t, selectorPasses(t, `{"type":"invoice"}`, doc))
+	assert.True(t, selectorPasses(t, `{"type":"order", "total":42}`, doc))
+	assert.True(t, selectorPasses(t, `{"address.city":"Paris"}`, doc))
+	assert.False(t, selectorPasses(t, `{"address.zip":"75001"}`, doc))
+	assert.True(t, selectorPasses(t, `{"tags":["a","b"]}`, doc))
+
+	assert.True(t, selectorPasses(t, `{"total":{"$gt":40, "$lte":42}}`, doc))
+	assert.False(t, selectorPasses(t, `{"total":{"$lt":42}}`, doc))
+	assert.False(t, selectorPasses(t, `{"total":{"$gt":"40"}}`, doc)) // different types don't compare
+	assert.True(t, selectorPasses(t, `{"type":{"$gte":"o"}}`, doc))
+	assert.True(t, selectorPasses(t, `{"type":{"$ne":"invoice"}}`, doc))
+	assert.True(t, selectorPasses(t, `{"type":{"$in":["order","invoice"]}}`, doc))
+	assert.True(t, selectorPasses(t, `{"type":{"$nin":["invoice"]}}`, doc))
+	assert.True(t, selectorPasses(t, `{"missing":{"$nin":["invoice"]}}`, doc))
+	assert.True(t, selectorPasses(t, `{"paid":{"$exists":true}, "missing":{"$exists":false}}`, doc))
+	assert.True(t, selectorPasses(t, `{"tags":{"$type":"array", "$size":2}}`, doc))
+	assert.True(t, selectorPasses(t, `{"type":{"$regex":"^ord"}}`, doc))
+	assert.True(t, selectorPasses(t, `{"total":{"$not":{"$gt":50}}}`, doc))
+
+	assert.True(t, selectorPasses(t, `{"$or":[{"type":"invoice"}, {"total":42}]}`, doc))
+	assert.False(t, selectorPasses(t, `{"$and":[{"type":"order"}, {"paid":true}]}`, doc))
+	assert.True(t, selectorPasses(t, `{"$nor":[{"type":"invoice"}, {"paid":true}]}`, doc))
+	assert.False(t, selectorPasses(t, `{"$not":{"type":"order"}}`, doc))
+
+	// Invalid selectors:
+	for _, selectorJSON := range []string{`{}`, `{"total":{"$bogus":1}}`, `{"$or":[]}`, `{"$and":"x"}`,
+		`{"type":{"$regex":"("}}`, `{"total":{"$gt":true}}`, `{"type":{"$eq":1, "x":2}}`} {
+		var selector map[string]interface{}
+		assert.Equals(t, json.Unmarshal([]byte(selectorJSON), &selector), nil)
+		_, err := NewSelectorFilter(selector)
+		assert.True(t, err != nil)
+	}
+}
@@ -0,0 +1,256 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"reflect"
+	"time"
+
+	sgbucket "github.com/couchbase/sg-bucket"
+	"github.com/robertkrimen/otto"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Built-in conflict resolution policies, selected by the "type" of a ConflictResolverConfig.
+const (
+	ConflictResolverRemoteWins      = "remote_wins"           // The incoming revision wins
+	ConflictResolverLocalWins       = "local_wins"            // The existing current revision wins
+	ConflictResolverLatestTimestamp = "latest_timestamp_wins" // The revision with the latest timestamp property wins
+	ConflictResolverMerge           = "merge"                 // Top-level properties are merged; the incoming revision's win
+	ConflictResolverCustom          = "custom"                // A JavaScript function decides
+)
+
+// Property compared by the latest_timestamp_wins policy if none is configured
+const DefaultConflictTimestampProperty = "updated_at"
+
+// Configuration of a database's conflict resolver, as given in the database config.
+type ConflictResolverConfig struct {
+	Type              string `json:"type"`                         // One of the ConflictResolver* policies
+	TimestampProperty string `json:"timestamp_property,omitempty"` // Property compared by latest_timestamp_wins
+	Function          string `json:"function,omitempty"`           // JavaScript source for the custom policy
+}
+
+// A conflict between a document's current revision and an incoming revision on another branch.
+type Conflict struct {
+	LocalDocument  Body // Body of the document's current revision
+	RemoteDocument Body // Body of the incoming revision
+}
+
+// Resolves a conflict, returning the body of the winning revision. A winning body with
+// "_deleted":true resolves the conflict by deleting the document.
+type ConflictResolverFunc func(conflict Conflict) (winner Body, err error)
+
+// Creates a ConflictResolverFunc implementing the policy given in the config.
+func NewConflictResolverFunc(config ConflictResolverConfig) (ConflictResolverFunc, error) {
+	switch config.Type {
+	case ConflictResolverRemoteWins:
+		return RemoteWinsConflictResolver, nil
+	case ConflictResolverLocalWins:
+		return LocalWinsConflictResolver, nil
+	case ConflictResolverLatestTimestamp:
+		property := config.TimestampProperty
+		if property == "" {
+			property = DefaultConflictTimestampProperty
+		}
+		return func(conflict Conflict) (Body, error) {
+			return latestTimestampConflictResolver(conflict, property), nil
+		}, nil
+	case ConflictResolverMerge:
+		return MergeConflictResolver, nil
+	case ConflictResolverCustom:
+		if config.Function == "" {
+			return nil, fmt.Errorf("Conflict resolver of type %q requires a function", config.Type)
+		}
+		return NewJSConflictResolver(config.Function).Resolve, nil
+	default:
+		return nil, fmt.Errorf("Unknown conflict resolver type %q", config.Type)
+	}
+}
+
+func RemoteWinsConflictResolver(conflict Conflict) (Body, error) {
+	return conflict.RemoteDocument, nil
+}
+
+func LocalWinsConflictResolver(conflict Conflict) (Body, error) {
+	return conflict.LocalDocument, nil
+}
+
+// Merges the top-level properties of both revisions. Where both have a property, the remote
+// revision's value wins. Attachments are merged the same way, by name.
+func MergeConflictResolver(conflict Conflict) (Body, error) {
+	merged := conflict.LocalDocument.ShallowCopy()
+	for key, value := range conflict.RemoteDocument {
+		merged[key] = value
+	}
+	localAtts := BodyAttachments(conflict.LocalDocument)
+	remoteAtts := BodyAttachments(conflict.RemoteDocument)
+	if localAtts != nil && remoteAtts != nil {
+		mergedAtts := make(map[string]interface{}, len(localAtts)+len(remoteAtts))
+		for name, meta := range localAtts {
+			mergedAtts[name] = meta
+		}
+		for name, meta := range remoteAtts {
+			mergedAtts[name] = meta
+		}
+		merged["_attachments"] = mergedAtts
+	}
+	return merged, nil
+}
+
+// Picks the revision whose timestamp property is later. A revision without a valid timestamp
+// loses to one with a timestamp; if neither has one, or they're equal, the remote wins.
+func latestTimestampConflictResolver(conflict Conflict, property string) Body {
+	localTime, localOK := conflictTimestamp(conflict.LocalDocument[property])
+	remoteTime, remoteOK := conflictTimestamp(conflict.RemoteDocument[property])
+	if localOK && (!remoteOK || localTime > remoteTime) {
+		return conflict.LocalDocument
+	}
+	return conflict.RemoteDocument
+}
+
+// Interprets a timestamp property as either a number or an RFC3339 date string, returning it
+// as fractional seconds since the epoch.
+func conflictTimestamp(value interface{}) (float64, bool) {
+	switch value := value.(type) {
+	case float64:
+		return value, !math.IsNaN(value)
+	case json.Number:
+		f, err := value.Float64()
+		return f, err == nil
+	case string:
+		t, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return 0, false
+		}
+		return float64(t.UnixNano()) / float64(time.Second), true
+	default:
+		return 0, false
+	}
+}
+
+//////// JAVASCRIPT RESOLVER
+
+// A compiled JavaScript conflict resolver function.
+type jsConflictResolverTask struct {
+	sgbucket.JSRunner
+}
+
+// Compiles a JavaScript conflict resolver function to a jsConflictResolverTask object.
+func newJSConflictResolverTask(funcSource string) (sgbucket.JSServerTask, error) {
+	task := &jsConflictResolverTask{}
+	err := task.Init(funcSource)
+	if err != nil {
+		return nil, err
+	}
+
+	task.After = func(result otto.Value, err error) (interface{}, error) {
+		nativeValue, _ := result.Export()
+		return nativeValue, err
+	}
+
+	return task, nil
+}
+
+// A thread-safe wrapper around a JavaScript conflict resolver. The function is called with a
+// single argument, an object with "local" and "remote" properties containing the two revision
+// bodies, and returns the winning body. Returning null or undefined deletes the document.
+type JSConflictResolver struct {
+	*sgbucket.JSServer
+}
+
+func NewJSConflictResolver(fnSource string) *JSConflictResolver {
+	base.LogTo("CRUD+", "Creating new JSConflictResolver")
+	return &JSConflictResolver{
+		JSServer: sgbucket.NewJSServer(fnSource, kTaskCacheSize,
+			func(fnSource string) (sgbucket.JSServerTask, error) {
+				return newJSConflictResolverTask(fnSource)
+			}),
+	}
+}
+
+// Calls the resolver function. Implements ConflictResolverFunc.
+func (resolver *JSConflictResolver) Resolve(conflict Conflict) (Body, error) {
+	result, err := resolver.Call(map[string]interface{}{
+		"local":  conflict.LocalDocument,
+		"remote": conflict.RemoteDocument,
+	})
+	if err != nil {
+		base.Warn("Unexpected error invoking conflict resolver: %v", err)
+		return nil, err
+	}
+	if result == nil {
+		return Body{"_deleted": true}, nil
+	}
+
+	// The result may be one of the arguments, or a new object; either way, round-trip it
+	// through JSON to get a plain Body.
+	resultJSON, err := json.Marshal(result)
+	if err != nil {
+		return nil, err
+	}
+	var winner Body
+	if err := json.Unmarshal(resultJSON, &winner); err != nil || winner == nil {
+		return nil, base.HTTPErrorf(http.StatusInternalServerError, "Conflict resolver returned a non-object value")
+	}
+	return winner, nil
+}
+
+//////// RESOLVING CONFLICTS
+
+// Resolves a conflict between the document's current revision and a newly added incoming
+// revision on another branch, using the database's conflict resolver. The local branch is
+// tombstoned; if the winning body differs from the incoming one it's added as a new child of the
+// incoming revision. Returns the body (with "_rev" set) to be saved as the new current revision.
+// The winner has to match the document's schema, like any other body being saved.
+func (db *Database) resolveConflict(doc *document, remoteRevID string, remoteBody Body) (Body, error) {
+	localRevID := doc.CurrentRev
+	localBody, err := db.getRevision(doc, localRevID)
+	if err != nil {
+		return nil, err
+	}
+
+	conflict := Conflict{
+		LocalDocument:  stripSpecialProperties(localBody),
+		RemoteDocument: stripSpecialProperties(remoteBody),
+	}
+	winner, err := db.Options.ConflictResolver(conflict)
+	if err != nil {
+		return nil, err
+	}
+	winner = stripSpecialProperties(winner)
+	if deleted, _ := winner["_deleted"].(bool); !deleted {
+		if err := db.validateDocSchema(doc.ID, winner); err != nil {
+			return nil, err
+		}
+	}
+	base.LogTo("CRUD+", "resolveConflict(%q): resolving conflict between %s and %s", doc.ID, localRevID, remoteRevID)
+
+	// Tombstone the local branch so the document is no longer in conflict:
+	localGeneration, _ := ParseRevID(localRevID)
+	tombstoneBody := Body{"_deleted": true}
+	tombstoneRevID := createRevID(localGeneration+1, localRevID, tombstoneBody)
+	if err := doc.History.addRevision(doc.ID, RevInfo{ID: tombstoneRevID, Parent: localRevID, Deleted: true}); err != nil {
+		return nil, err
+	}
+	doc.setNonWinningRevisionBody(tombstoneRevID, []byte("{}"), db.AllowExternalRevBodyStorage())
+
+	dbExpvars.Add("conflicts_resolved", 1)
+
+	if reflect.DeepEqual(winner, conflict.RemoteDocument) {
+		remoteBody["_rev"] = remoteRevID
+		return remoteBody, nil
+	}
+
+	// The winner differs from the incoming revision, so add it as a child of that revision:
+	remoteGeneration, _ := ParseRevID(remoteRevID)
+	deleted, _ := winner["_deleted"].(bool)
+	resolvedRevID := createRevID(remoteGeneration+1, remoteRevID, winner)
+	if err := doc.History.addRevision(doc.ID, RevInfo{ID: resolvedRevID, Parent: remoteRevID, Deleted: deleted}); err != nil {
+		return nil, err
+	}
+	winner["_rev"] = resolvedRevID
+	return winner, nil
+}
@@ -0,0 +1,143 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestBuiltInConflictResolvers(t *testing.T) {
+	conflict := Conflict{
+		LocalDocument:  Body{"a": "local", "b": "local", "updated_at": "2017-10-01T12:00:00Z"},
+		RemoteDocument: Body{"a": "remote", "c": "remote", "updated_at": "2017-09-01T12:00:00Z"},
+	}
+
+	winner, err := RemoteWinsConflictResolver(conflict)
+	assertNoError(t, err, "remote wins")
+	assert.DeepEquals(t, winner, conflict.RemoteDocument)
+
+	winner, err = LocalWinsConflictResolver(conflict)
+	assertNoError(t, err, "local wins")
+	assert.DeepEquals(t, winner, conflict.LocalDocument)
+
+	winner, err = MergeConflictResolver(conflict)
+	assertNoError(t, err, "merge")
+	assert.DeepEquals(t, winner, Body{"a": "remote", "b": "local", "c": "remote", "updated_at": "2017-09-01T12:00:00Z"})
+
+	resolver, err := NewConflictResolverFunc(ConflictResolverConfig{Type: ConflictResolverLatestTimestamp})
+	assertNoError(t, err, "latest timestamp")
+	winner, _ = resolver(conflict)
+	assert.DeepEquals(t, winner, conflict.LocalDocument)
+
+	// Numeric timestamps, in a custom property; a missing timestamp always loses:
+	resolver, _ = NewConflictResolverFunc(ConflictResolverConfig{Type: ConflictResolverLatestTimestamp, TimestampProperty: "ts"})
+	winner, _ = resolver(Conflict{LocalDocument: Body{"ts": 10.0}, RemoteDocument: Body{"ts": 20.0}})
+	assert.DeepEquals(t, winner, Body{"ts": 20.0})
+	winner, _ = resolver(Conflict{LocalDocument: Body{"ts": 10.0}, RemoteDocument: Body{}})
+	assert.DeepEquals(t, winner, Body{"ts": 10.0})
+
+	_, err = NewConflictResolverFunc(ConflictResolverConfig{Type: "bogus"})
+	assert.True(t, err != nil)
+	_, err = NewConflictResolverFunc(ConflictResolverConfig{Type: ConflictResolverCustom})
+	assert.True(t, err != nil)
+}
+
+func TestMergeConflictResolverAttachments(t *testing.T) {
+	local := Body{"_attachments": map[string]interface{}{
+		"a.txt": map[string]interface{}{"digest": "sha1-a"},
+		"b.txt": map[string]interface{}{"digest": "sha1-b1"}}}
+	remote := Body{"_attachments": map[string]interface{}{
+		"b.txt": map[string]interface{}{"digest": "sha1-b2"},
+		"c.txt": map[string]interface{}{"digest": "sha1-c"}}}
+	winner, err := MergeConflictResolver(Conflict{LocalDocument: local, RemoteDocument: remote})
+	assertNoError(t, err, "merge")
+	atts := BodyAttachments(winner)
+	assert.Equals(t, len(atts), 3)
+	assert.Equals(t, atts["b.txt"].(map[string]interface{})["digest"], "sha1-b2")
+}
+
+func TestJSConflictResolver(t *testing.T) {
+	resolver := NewJSConflictResolver(`function(conflict) {
+		if (conflict.remote.n > conflict.local.n) {
+			return conflict.remote;
+		} else if (conflict.local.deleteMe) {
+			return null;
+		}
+		return {n: conflict.local.n + conflict.remote.n};
+	}`)
+
+	winner, err := resolver.Resolve(Conflict{LocalDocument: Body{"n": 1.0}, RemoteDocument: Body{"n": 2.0}})
+	assertNoError(t, err, "resolve")
+	assert.DeepEquals(t, winner, Body{"n": 2.0})
+
+	winner, err = resolver.Resolve(Conflict{LocalDocument: Body{"n": 3.0}, RemoteDocument: Body{"n": 2.0}})
+	assertNoError(t, err, "resolve")
+	assert.DeepEquals(t, winner, Body{"n": 5.0})
+
+	winner, err = resolver.Resolve(Conflict{LocalDocument: Body{"n": 3.0, "deleteMe": true}, RemoteDocument: Body{"n": 2.0}})
+	assertNoError(t, err, "resolve")
+	assert.DeepEquals(t, winner, Body{"_deleted": true})
+}
+
+func TestPutExistingRevResolvesConflicts(t *testing.T) {
+
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer tearDownTestDB(t, db)
+	db.Options.UnsupportedOptions.AllowConflicts = base.BooleanPointer(false)
+	db.Options.ConflictResolver = RemoteWinsConflictResolver
+
+	// Create revs 1 and 2 of "doc":
+	assertNoError(t, db.PutExistingRev("doc", Body{"n": 1}, []string{"1-a"}), "add 1-a")
+	assertNoError(t, db.PutExistingRev("doc", Body{"n": 2}, []string{"2-a", "1-a"}), "add 2-a")
+	assert.Equals(t, db.CheckProposedRev("doc", "2-b", "1-a"), ProposedRev_OK)
+
+	// A conflicting rev from the remote wins, and the local branch is tombstoned:
+	assertNoError(t, db.PutExistingRev("doc", Body{"n": 3}, []string{"2-b", "1-a"}), "add 2-b")
+	doc, err := db.GetDocument("doc", DocUnmarshalAll)
+	assertNoError(t, err, "get doc")
+	assert.Equals(t, doc.CurrentRev, "2-b")
+	assert.False(t, doc.hasFlag(channels.Conflict))
+	leaves := doc.History.GetLeaves()
+	assert.Equals(t, len(leaves), 2)
+	for _, leaf := range leaves {
+		if leaf != "2-b" {
+			assert.Equals(t, doc.History[leaf].Parent, "2-a")
+			assert.True(t, doc.History[leaf].Deleted)
+		}
+	}
+
+	// With local_wins, the local body is written as a child of the remote rev:
+	db.Options.ConflictResolver = LocalWinsConflictResolver
+	assertNoError(t, db.PutExistingRev("doc", Body{"n": 4}, []string{"3-c", "2-c", "1-a"}), "add 3-c")
+	doc, err = db.GetDocument("doc", DocUnmarshalAll)
+	assertNoError(t, err, "get doc")
+	generation, _ := ParseRevID(doc.CurrentRev)
+	assert.Equals(t, generation, 4)
+	assert.Equals(t, doc.History[doc.CurrentRev].Parent, "3-c")
+	body, err := db.Get("doc")
+	assertNoError(t, err, "get body")
+	assert.Equals(t, body["n"], int64(3))
+
+	// Without a resolver, the conflict is rejected as before:
+	db.Options.ConflictResolver = nil
+	err = db.PutExistingRev("doc", Body{"n": 5}, []string{"2-d", "1-a"})
+	assertHTTPError(t, err, 409)
+
+	// A winner that doesn't match the doc's schema is rejected:
+	userSchema, err := NewDocumentSchema("user", "", "^user::", map[string]interface{}{"required": []interface{}{"email"}})
+	assertNoError(t, err, "NewDocumentSchema")
+	db.Options.SchemaOptions = &SchemaOptions{Schemas: []*DocumentSchema{userSchema}}
+	db.Options.ConflictResolver = func(conflict Conflict) (Body, error) {
+		return Body{"name": "nobody"}, nil
+	}
+	assertNoError(t, db.PutExistingRev("user::a", Body{"email": "a@example.com"}, []string{"1-a"}), "add user 1-a")
+	assertNoError(t, db.PutExistingRev("user::a", Body{"email": "b@example.com"}, []string{"2-a", "1-a"}), "add user 2-a")
+	err = db.PutExistingRev("user::a", Body{"email": "c@example.com"}, []string{"2-b", "1-a"})
+	assertHTTPError(t, err, 403)
+	doc, err = db.GetDocument("user::a", DocUnmarshalAll)
+	assertNoError(t, err, "get user doc")
+	assert.Equals(t, doc.CurrentRev, "2-a")
+}
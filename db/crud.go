@@ -335,6 +335,59 @@ func (db *Database) GetRevWithHistory(docid, revid string, maxHistory int, histo
 	return body, nil
 }
 
+// Returns a delta that transforms revision fromRevID of a document into revision toRevID, for
+// use by a client that already has fromRevID. Returns nil (and no error) if a delta can't be used,
+// i.e. if either revision is missing, deleted or inaccessible to the user, or if the delta isn't
+// smaller than the full revision body. Computed deltas are kept in the revision cache.
+func (db *Database) GetDelta(docid, fromRevID, toRevID string) (*RevisionDelta, error) {
+	if !db.DeltaSyncEnabled() || fromRevID == "" || toRevID == "" || fromRevID == toRevID {
+		return nil, nil
+	}
+
+	toBody, _, toChannels, err := db.revisionCache.Get(docid, toRevID)
+	if toBody == nil || err != nil {
+		return nil, err
+	}
+	if db.user != nil && db.user.AuthorizeAnyChannel(toChannels) != nil {
+		return nil, nil
+	}
+	// The user must be able to see both revisions, even if the delta is cached, else the delta
+	// would leak the content of the one they can't:
+	fromBody, _, fromChannels, err := db.revisionCache.Get(docid, fromRevID)
+	if fromBody == nil || err != nil {
+		return nil, nil
+	}
+	if db.user != nil && db.user.AuthorizeAnyChannel(fromChannels) != nil {
+		return nil, nil
+	}
+	if delta := db.revisionCache.GetDelta(docid, fromRevID, toRevID); delta != nil {
+		return delta, nil
+	}
+
+	if toBody["_deleted"] == true || fromBody["_deleted"] == true {
+		return nil, nil
+	}
+
+	toBody = stripSpecialProperties(toBody)
+	deltaBody := Body(base.CreateJSONDelta(stripSpecialProperties(fromBody), toBody))
+	deltaJSON, err := json.Marshal(deltaBody)
+	if err != nil {
+		return nil, err
+	}
+	bodyJSON, err := json.Marshal(toBody)
+	if err != nil {
+		return nil, err
+	}
+	if len(deltaJSON) >= len(bodyJSON) {
+		base.LogTo("CRUD+", "GetDelta(%q): delta from %s to %s isn't smaller than the revision", docid, fromRevID, toRevID)
+		return nil, nil
+	}
+
+	delta := &RevisionDelta{FromRevID: fromRevID, ToRevID: toRevID, Delta: deltaBody}
+	db.revisionCache.UpdateDelta(docid, delta)
+	return delta, nil
+}
+
 // Returns the body of the active revision of a document, as well as the document's current channels
 // and the user/roles it grants channel access to.
 func (db *Database) GetDocAndActiveRev(docid string) (populatedDoc *document, body Body, err error) {
@@ -588,6 +641,12 @@ func (db *Database) Put(docid string, body Body) (newRevID string, err error) {
 		return "", base.HTTPErrorf(http.StatusBadRequest, "Invalid expiry: %v", err)
 	}
 
+	if !deleted {
+		if err := db.validateDocSchema(docid, body); err != nil {
+			return "", err
+		}
+	}
+
 	allowImport := db.UseXattrs()
 
 
@@ -652,6 +711,12 @@ func (db *Database) PutExistingRev(docid string, body Body, docHistory []string)
 		return base.HTTPErrorf(http.StatusBadRequest, "Invalid expiry: %v", err)
 	}
 
+	if !deleted {
+		if err := db.validateDocSchema(docid, body); err != nil {
+			return err
+		}
+	}
+
 	allowImport := db.UseXattrs()
 	_, err = db.updateDoc(docid, allowImport, expiry, func(doc *document) (resultBody Body, resultAttachmentData AttachmentData, updatedExpiry *uint32, resultErr error) {
 		// (Be careful: this block can be invoked multiple times if there are races!)
@@ -680,7 +745,12 @@ func (db *Database) PutExistingRev(docid string, body Body, docHistory []string)
 			return nil, nil, nil, couchbase.UpdateCancel // No new revisions to add
 		}
 
-		if !db.AllowConflicts() {
+		// If the new revision branches from a live current revision and the database has a conflict
+		// resolver, the conflict will be resolved below rather than rejected or kept:
+		resolveConflict := db.Options.ConflictResolver != nil && !deleted &&
+			doc.CurrentRev != "" && parent != doc.CurrentRev && !doc.History[doc.CurrentRev].Deleted
+
+		if !db.AllowConflicts() && !resolveConflict {
 			// Conflict-free mode: If doc exists, its current rev must be the new rev's parent, unless it's a tombstone.
 			if parent != doc.CurrentRev && doc.CurrentRev != "" {
 				if !deleted {
@@ -723,6 +793,14 @@ func (db *Database) PutExistingRev(docid string, body Body, docHistory []string)
 			return nil, nil, nil, err
 		}
 		body["_rev"] = newRev
+
+		if resolveConflict {
+			resolvedBody, err := db.resolveConflict(doc, newRev, body)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			return resolvedBody, newAttachments, nil, nil
+		}
 		return body, newAttachments, nil, nil
 	})
 	return err
@@ -758,6 +836,7 @@ func (db *Database) updateAndReturnDoc(
 	var body Body                                    // Could be returned by documentUpdateFunc
 	var storedBody Body                              // Persisted revision body, used to update rev cache
 	var changedPrincipals, changedRoleUsers []string // Could be returned by documentUpdateFunc
+	var accessChanges []AccessGrantChange            // Could be returned by documentUpdateFunc.  Grants and revocations for AccessChange events
 	var docSequence uint64                           // Must be scoped outside callback, used over multiple iterations
 	var unusedSequences []uint64                     // Must be scoped outside callback, used over multiple iterations
 	var oldBodyJSON string                           // Could be returned by documentUpdateFunc.  Stores previous revision body for use by DocumentChangeEvent
@@ -950,6 +1029,10 @@ func (db *Database) updateAndReturnDoc(
 			// Update the document struct's channel assignment and user access.
 			// (This uses the new sequence # so has to be done after updating doc.Sequence)
 			doc.updateChannels(channelSet) //FIX: Incorrect if new rev is not current!
+			accessChanges = nil
+			if db.EventMgr.HasHandlerForEvent(AccessChange) {
+				accessChanges = append(doc.Access.accessGrantChanges(access, false), doc.RoleAccess.accessGrantChanges(roles, true)...)
+			}
 			changedPrincipals = doc.Access.updateAccess(doc, access)
 			changedRoleUsers = doc.RoleAccess.updateAccess(doc, roles)
 
@@ -982,6 +1065,9 @@ func (db *Database) updateAndReturnDoc(
 		} else {
 			doc.UpdateExpiry(expiry)
 		}
+		if db.Options.ExpiryTombstones {
+			updatedExpiry = nil // The expiry_tombstones job enforces doc.Expiry, not the bucket
+		}
 
 		// Now that the document has been successfully validated, we can store any new attachments
 		db.setAttachments(newAttachments)
@@ -1001,7 +1087,7 @@ func (db *Database) updateAndReturnDoc(
 	upgradeInProgress := false
 	if !db.UseXattrs() {
 		// Update the document, storing metadata in _sync property
-		err = db.Bucket.WriteUpdate(key, expiry, func(currentValue []byte) (raw []byte, writeOpts sgbucket.WriteOptions, syncFuncExpiry *uint32, err error) {
+		err = db.Bucket.WriteUpdate(key, db.bucketExpiry(expiry), func(currentValue []byte) (raw []byte, writeOpts sgbucket.WriteOptions, syncFuncExpiry *uint32, err error) {
 			// Be careful: this block can be invoked multiple times if there are races!
 			if doc, err = unmarshalDocument(docid, currentValue); err != nil {
 				return
@@ -1031,7 +1117,7 @@ func (db *Database) updateAndReturnDoc(
 	if db.UseXattrs() || upgradeInProgress {
 		var casOut uint64
 		// Update the document, storing metadata in extended attribute
-		casOut, err = db.Bucket.WriteUpdateWithXattr(key, KSyncXattrName, expiry, existingDoc, func(currentValue []byte, currentXattr []byte, cas uint64) (raw []byte, rawXattr []byte, deleteDoc bool, syncFuncExpiry *uint32, err error) {
+		casOut, err = db.Bucket.WriteUpdateWithXattr(key, KSyncXattrName, db.bucketExpiry(expiry), existingDoc, func(currentValue []byte, currentXattr []byte, cas uint64) (raw []byte, rawXattr []byte, deleteDoc bool, syncFuncExpiry *uint32, err error) {
 			// Be careful: this block can be invoked multiple times if there are races!
 			if doc, err = unmarshalDocumentWithXattr(docid, currentValue, currentXattr, cas, DocUnmarshalAll); err != nil {
 				return
@@ -1109,7 +1195,7 @@ func (db *Database) updateAndReturnDoc(
 		// Raise event if this is not an echo from a shadow bucket
 		if !shadowerEcho {
 			if db.EventMgr.HasHandlerForEvent(DocumentChange) {
-				db.EventMgr.RaiseDocumentChangeEvent(body, oldBodyJSON, revChannels)
+				db.EventMgr.RaiseDocumentChangeEventCtx(db.LogCtx, body, oldBodyJSON, revChannels)
 			}
 		}
 	} else {
@@ -1124,14 +1210,18 @@ func (db *Database) updateAndReturnDoc(
 	doc.deleteRemovedRevisionBodies(db.Bucket)
 
 	// Mark affected users/roles as needing to recompute their channel access:
-	db.MarkPrincipalsChanged(docid, newRevID, changedPrincipals, changedRoleUsers)
+	db.MarkPrincipalsChanged(docid, newRevID, changedPrincipals, changedRoleUsers, accessChanges)
 	return docOut, newRevID, nil
 }
 
-func (db *Database) MarkPrincipalsChanged(docid string, newRevID string, changedPrincipals, changedRoleUsers []string) {
+func (db *Database) MarkPrincipalsChanged(docid string, newRevID string, changedPrincipals, changedRoleUsers []string, accessChanges []AccessGrantChange) {
 
 	reloadActiveUser := false
 
+	for _, change := range accessChanges {
+		db.EventMgr.RaiseAccessChangeEvent(docid, newRevID, change)
+	}
+
 	// Mark affected users/roles as needing to recompute their channel access:
 	if len(changedPrincipals) > 0 {
 		base.LogTo("Access", "Rev %q/%q invalidates channels of %s", docid, newRevID, changedPrincipals)
@@ -1212,11 +1302,16 @@ func (db *Database) DeleteDoc(docid string, revid string) (string, error) {
 // Purges a document from the bucket (no tombstone)
 func (db *Database) Purge(key string) error {
 
+	var err error
 	if db.UseXattrs() {
-		return db.Bucket.DeleteWithXattr(key, KSyncXattrName)
+		err = db.Bucket.DeleteWithXattr(key, KSyncXattrName)
 	} else {
-		return db.Bucket.Delete(key)
+		err = db.Bucket.Delete(key)
+	}
+	if err == nil {
+		db.EventMgr.RaiseDocumentPurgeEvent(key)
 	}
+	return err
 }
 
 //////// CHANNELS:
@@ -1239,12 +1334,32 @@ func (db *Database) getChannelsAndAccess(doc *document, body Body, revID string)
 	}
 	oldJson = string(oldJsonBytes)
 
-	if db.ChannelMapper != nil {
+	// In a namespaced database, use the sync function of the doc's namespace:
+	namespace, ns, err := db.namespaceOf(doc.ID, body, oldJson)
+	if err != nil {
+		return
+	} else if err = db.checkWriteNamespace(namespace); err != nil {
+		return
+	}
+	mapper := db.GetChannelMapper()
+	if ns != nil {
+		mapper = ns.ChannelMapper
+	} else if db.resync != nil {
+		mapper = db.resync.syncMapper(mapper)
+	}
+
+	if mapper != nil {
 		// Call the ChannelMapper:
+		userCtx := MakeUserCtx(db.user)
+		if namespace != "" {
+			userCtx = makeNamespaceUserCtx(db.user, namespace)
+		}
 		var output *channels.ChannelMapperOutput
-		output, err = db.ChannelMapper.MapToChannelsAndAccess(body, oldJson,
-			makeUserCtx(db.user))
+		output, err = mapper.MapToChannelsAndAccess(body, oldJson, userCtx)
 		if err == nil {
+			if namespace != "" {
+				output.AddNamespace(namespace)
+			}
 			result = output.Channels
 			access = output.Access
 			roles = output.Roles
@@ -1254,6 +1369,8 @@ func (db *Database) getChannelsAndAccess(doc *document, body Body, revID string)
 				base.Logf("Sync fn rejected: new=%+v  old=%s --> %s", body, oldJson, err)
 			} else if !validateAccessMap(access) || !validateRoleAccessMap(roles) {
 				err = base.HTTPErrorf(500, "Error in JS sync function")
+			} else if namespace == "" {
+				err = db.checkNotNamespaced(output)
 			}
 
 		} else {
@@ -1268,12 +1385,21 @@ func (db *Database) getChannelsAndAccess(doc *document, body Body, revID string)
 			array := base.ValueToStringArray(value)
 			result, err = channels.SetFromArray(array, channels.KeepStar)
 		}
+		if err == nil {
+			output := channels.ChannelMapperOutput{Channels: result}
+			if namespace != "" {
+				output.AddNamespace(namespace)
+				result = output.Channels
+			} else {
+				err = db.checkNotNamespaced(&output)
+			}
+		}
 	}
 	return result, access, roles, expiry, oldJson, err
 }
 
 // Creates a userCtx object to be passed to the sync function
-func makeUserCtx(user auth.User) map[string]interface{} {
+func MakeUserCtx(user auth.User) map[string]interface{} {
 	if user == nil {
 		return nil
 	}
@@ -1521,6 +1647,9 @@ func (db *Database) CheckProposedRev(docid string, revid string, parentRevID str
 	} else if parentRevID == "" && doc.History[doc.CurrentRev].Deleted {
 		// Proposed rev has no parent and doc is currently deleted; OK to add:
 		return ProposedRev_OK
+	} else if db.Options.ConflictResolver != nil && !doc.History[doc.CurrentRev].Deleted {
+		// Conflict will be resolved by the database's conflict resolver when the rev is added:
+		return ProposedRev_OK
 	} else {
 		// Parent revision mismatch, so this is a conflict:
 		return ProposedRev_Conflict
@@ -5,7 +5,9 @@ import (
 	"log"
 	"testing"
 
+	"github.com/couchbase/sync_gateway/auth"
 	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
 	"github.com/couchbaselabs/go.assert"
 )
 
@@ -352,3 +354,70 @@ func TestRevisionStoragePruneTombstone(t *testing.T) {
 	assertTrue(t, base.IsKeyNotFoundError(db.Bucket, err), "Revision should be not found")
 
 }
+
+func TestGetDelta(t *testing.T) {
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer tearDownTestDB(t, db)
+
+	rev1id, err := db.Put("doc1", Body{"greeting": "hello", "description": "a long property that doesn't change", "list": []interface{}{"a", "b"}})
+	assertNoError(t, err, "Put")
+	rev2id, err := db.Put("doc1", Body{"greeting": "goodbye", "description": "a long property that doesn't change", "_rev": rev1id})
+	assertNoError(t, err, "Put rev 2")
+
+	// Delta sync is disabled by default:
+	delta, err := db.GetDelta("doc1", rev1id, rev2id)
+	assertNoError(t, err, "GetDelta")
+	assert.True(t, delta == nil)
+
+	db.Options.DeltaSyncOptions.Enabled = true
+	delta, err = db.GetDelta("doc1", rev1id, rev2id)
+	assertNoError(t, err, "GetDelta")
+	assert.Equals(t, delta.FromRevID, rev1id)
+	assert.Equals(t, delta.ToRevID, rev2id)
+	deltaJSON, _ := json.Marshal(delta.Delta)
+	assert.Equals(t, string(deltaJSON), `{"greeting":"goodbye","list":[]}`)
+
+	// The second request is served from the revision cache:
+	cached, err := db.GetDelta("doc1", rev1id, rev2id)
+	assertNoError(t, err, "GetDelta")
+	assert.True(t, cached == delta)
+
+	// No delta from a missing revision, or to a tombstone:
+	delta, err = db.GetDelta("doc1", "1-bogus", rev2id)
+	assertNoError(t, err, "GetDelta")
+	assert.True(t, delta == nil)
+	rev3id, err := db.DeleteDoc("doc1", rev2id)
+	assertNoError(t, err, "DeleteDoc")
+	delta, err = db.GetDelta("doc1", rev2id, rev3id)
+	assertNoError(t, err, "GetDelta")
+	assert.True(t, delta == nil)
+}
+
+func TestGetDeltaAuthorization(t *testing.T) {
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer tearDownTestDB(t, db)
+	db.Options.DeltaSyncOptions.Enabled = true
+	db.ChannelMapper = channels.NewChannelMapper(`function(doc) {channel(doc.channels);}`)
+
+	rev1id, err := db.Put("doc1", Body{"secret": "swordfish", "description": "a long property that doesn't change", "channels": []string{"private"}})
+	assertNoError(t, err, "Put")
+	rev2id, err := db.Put("doc1", Body{"description": "a long property that doesn't change", "channels": []string{"public"}, "_rev": rev1id})
+	assertNoError(t, err, "Put rev 2")
+
+	// The admin's request caches the delta:
+	delta, err := db.GetDelta("doc1", rev1id, rev2id)
+	assertNoError(t, err, "GetDelta")
+	assert.True(t, delta != nil)
+
+	// A user who can't see the first revision doesn't get the cached delta from it:
+	authenticator := auth.NewAuthenticator(db.Bucket, db)
+	user, _ := authenticator.NewUser("naomi", "letmein", channels.SetOf("public"))
+	assertNoError(t, authenticator.Save(user), "Save user")
+	userDB, err := GetDatabase(db.DatabaseContext, user)
+	assertNoError(t, err, "GetDatabase")
+	delta, err = userDB.GetDelta("doc1", rev1id, rev2id)
+	assertNoError(t, err, "GetDelta")
+	assert.True(t, delta == nil)
+}
@@ -62,7 +62,8 @@ type DatabaseContext struct {
 	BucketLock         sync.RWMutex            // Control Access to the underlying bucket object
 	tapListener        changeListener          // Listens on server Tap feed -- TODO: change to mutationListener
 	sequences          *sequenceAllocator      // Source of new sequence numbers
-	ChannelMapper      *channels.ChannelMapper // Runs JS 'sync' function
+	ChannelMapper      *channels.ChannelMapper // Runs JS 'sync' function; use GetChannelMapper
+	syncFnLock         sync.RWMutex            // Protects ChannelMapper
 	StartTime          time.Time               // Timestamp when context was instantiated
 	ChangesClientStats Statistics              // Tracks stats of # of changes connections
 	RevsLimit          uint32                  // Max depth a document's revision tree can grow to
@@ -73,6 +74,7 @@ type DatabaseContext struct {
 	EventMgr           *EventManager           // Manages notification events
 	AllowEmptyPassword bool                    // Allow empty passwords?  Defaults to false
 	SequenceHasher     *sequenceHasher         // Used to generate and resolve hash values for vector clock sequences
+	AttachmentStore    AttachmentStore         // Storage for attachment bodies
 	SequenceType       SequenceType            // Type of sequences used for this DB (integer or vector clock)
 	Options            DatabaseContextOptions  // Database Context Options
 	AccessLock         sync.RWMutex            // Allows DB offline to block until synchronous calls have completed
@@ -80,6 +82,13 @@ type DatabaseContext struct {
 	ExitChanges        chan struct{}           // Active _changes feeds on the DB will close when this channel is closed
 	OIDCProviders      auth.OIDCProviderMap    // OIDC clients
 	PurgeInterval      int                     // Metadata purge interval, in hours
+	Maintenance        *MaintenanceManager     // Runs background maintenance jobs
+	resyncLock         sync.Mutex              // Protects latestResync and resyncClosed
+	latestResync       *resyncJob              // The running or latest online resync
+	resyncClosed       bool                    // Set when the database closes, to stop new resyncs
+	rateLimiters       *rateLimiters           // Rate limits on the public API, if any
+	DeadLetters        *DeadLetterStore        // Event payloads that event handlers failed to deliver
+	durableEvents      *durableEventQueue      // Delivers document change events in durable mode
 }
 
 type DatabaseContextOptions struct {
@@ -92,10 +101,26 @@ type DatabaseContextOptions struct {
 	UnsupportedOptions    UnsupportedOptions
 	TrackDocs             bool // Whether doc tracking channel should be created (used for autoImport, shadowing)
 	OIDCOptions           *auth.OIDCOptions
-	DBOnlineCallback      DBOnlineCallback // Callback function to take the DB back online
+	DBOnlineCallback      DBOnlineCallback     // Callback function to take the DB back online
+	SyncFunctionCallback  SyncFunctionCallback // Called when an online resync switches the sync function
 	ImportOptions         ImportOptions
-	EnableXattr           bool   // Use xattr for _sync
-	LocalDocExpirySecs    uint32 //The _local doc expiry time in seconds
+	EnableXattr           bool                                // Use xattr for _sync
+	LocalDocExpirySecs    uint32                              //The _local doc expiry time in seconds
+	ConflictResolver      ConflictResolverFunc                // Resolves conflicts created by PutExistingRev, if set
+	DeltaSyncOptions      DeltaSyncOptions                    // Config for sending revisions as deltas
+	AttachmentStore       AttachmentStore                     // Storage for attachment bodies; defaults to the bucket
+	ChangesFilters        map[string]*JSChangesFilterFunction // Named changes filters, by name
+	Namespaces            *NamespaceOptions                   // Partitions the database into namespaces, if set
+	SchemaOptions         *SchemaOptions                      // JSON Schemas that documents are validated against, if set
+	MaintenanceOptions    *MaintenanceOptions                 // Schedules of background maintenance jobs, if any
+	ExpiryTombstones      bool                                // Expired docs are deleted by the expiry_tombstones job, instead of by the bucket
+	PasswordPolicy        *auth.PasswordPolicy                // Password strength rules, hash cost and login lockout, if set
+	RateLimits            *RateLimitOptions                   // Rate limits on the public API, if any
+	GrantProvenance       bool                                // Principals record which docs granted their channels and roles
+}
+
+type DeltaSyncOptions struct {
+	Enabled bool // Whether revisions may be sent to clients as deltas from a revision they already have
 }
 
 type OidcTestProviderOptions struct {
@@ -123,7 +148,9 @@ type ImportOptions struct {
 // so this struct does not have to be thread-safe.
 type Database struct {
 	*DatabaseContext
-	user auth.User
+	user   auth.User
+	LogCtx *base.LogContext // Identifies the request this Database is used for, in log messages
+	resync *resyncJob       // The online resync this Database runs docs through, if any
 }
 
 var dbExpvars = expvar.NewMap("syncGateway_db")
@@ -177,6 +204,8 @@ func ConnectToBucket(spec base.BucketSpec, callback sgbucket.BucketNotifyFn) (bu
 // to come back online. A rest.ServerContext package cannot be passed since it would introduce a circular dependency
 type DBOnlineCallback func(dbContext *DatabaseContext)
 
+type SyncFunctionCallback func(dbContext *DatabaseContext, syncFn string)
+
 // Creates a new DatabaseContext on a bucket. The bucket will be closed when this context closes.
 func NewDatabaseContext(dbName string, bucket base.Bucket, autoImport bool, options DatabaseContextOptions) (*DatabaseContext, error) {
 	if err := ValidateDatabaseName(dbName); err != nil {
@@ -193,7 +222,20 @@ func NewDatabaseContext(dbName string, bucket base.Bucket, autoImport bool, opti
 	}
 	context.revisionCache = NewRevisionCache(options.RevisionCacheCapacity, context.revCacheLoader)
 
+	context.AttachmentStore = options.AttachmentStore
+	if context.AttachmentStore == nil {
+		context.AttachmentStore = NewBucketAttachmentStore(bucket)
+	}
+
 	context.EventMgr = NewEventManager()
+	context.DeadLetters = NewDeadLetterStore(bucket)
+	context.rateLimiters = newRateLimiters(options.RateLimits)
+
+	if options.GrantProvenance {
+		if err := installGrantProvenanceViews(bucket); err != nil {
+			return nil, err
+		}
+	}
 
 	var err error
 	context.sequences, err = newSequenceAllocator(bucket)
@@ -351,6 +393,8 @@ func NewDatabaseContext(dbName string, bucket base.Bucket, autoImport bool, opti
 
 	}
 
+	context.Maintenance = newMaintenanceManager(context, options.MaintenanceOptions)
+
 	return context, nil
 }
 
@@ -399,9 +443,15 @@ func (context *DatabaseContext) TapListener() changeListener {
 }
 
 func (context *DatabaseContext) Close() {
+	// Maintenance jobs may need the bucket lock to get to the point where they stop:
+	context.Maintenance.Stop()
+
 	context.BucketLock.Lock()
 	defer context.BucketLock.Unlock()
 
+	context.stopResync()
+	context.stopDurableEvents()
+	context.EventMgr.CloseHandlers()
 	context.tapListener.Stop()
 	context.changeCache.Stop()
 	context.Shadower.Stop()
@@ -475,16 +525,18 @@ func (dc *DatabaseContext) TakeDbOffline(reason string) error {
 
 func (context *DatabaseContext) Authenticator() *auth.Authenticator {
 	// Authenticators are lightweight & stateless, so it's OK to return a new one every time
-	return auth.NewAuthenticator(context.Bucket, context)
+	authenticator := auth.NewAuthenticator(context.Bucket, context)
+	authenticator.SetPasswordPolicy(context.Options.PasswordPolicy)
+	return authenticator
 }
 
 // Makes a Database object given its name and bucket.
 func GetDatabase(context *DatabaseContext, user auth.User) (*Database, error) {
-	return &Database{context, user}, nil
+	return &Database{DatabaseContext: context, user: user}, nil
 }
 
 func CreateDatabase(context *DatabaseContext) (*Database, error) {
-	return &Database{context, nil}, nil
+	return &Database{DatabaseContext: context}, nil
 }
 
 func (db *Database) SameAs(otherdb *Database) bool {
@@ -527,17 +579,21 @@ func (db *Database) DocCount() int {
 	return int(vres.Rows[0].Value.(float64))
 }
 
-func installViews(bucket base.Bucket, useXattrs bool) error {
-
-	// syncData specifies the path to Sync Gateway sync metadata used in the map function -
-	// in the document body when xattrs available, in the mobile xattr when xattrs enabled.
-	syncData := fmt.Sprintf(`var sync
+// Returns the start of a view map function that sets sync to the Sync Gateway sync metadata -
+// in the document body when xattrs available, in the mobile xattr when xattrs enabled.
+func syncDataViewScript() string {
+	return fmt.Sprintf(`var sync
 							if (meta.xattrs === undefined || meta.xattrs.%s === undefined) {
 		                        sync = doc._sync
 		                  	} else {
 		                       	sync = meta.xattrs.%s
 		                    }
 		                     `, KSyncXattrName, KSyncXattrName)
+}
+
+func installViews(bucket base.Bucket, useXattrs bool) error {
+
+	syncData := syncDataViewScript()
 
 	// View for finding every Couchbase doc (used when deleting a database)
 	// Key is docid; value is null
@@ -570,6 +626,19 @@ func installViews(bucket base.Bucket, useXattrs bool) error {
                        emit([exists, meta.id], null); } }`
 	import_map = fmt.Sprintf(import_map, syncData)
 
+	// View for expiring docs
+	// Key is expiry time (Unix); value is null
+	expiry_map := `function (doc, meta) {
+                     %s
+                     if (sync === undefined || sync.exp === undefined || meta.id.substring(0,6) == "_sync:")
+                       return;
+                     if ((sync.flags & 1) || sync.deleted)
+                       return;
+                     var exp = Date.parse(sync.exp);
+                     if (!isNaN(exp))
+                       emit(Math.floor(exp / 1000), null); }`
+	expiry_map = fmt.Sprintf(expiry_map, syncData)
+
 	// View for compaction -- finds all revision docs
 	// Key and value are ignored.
 	oldrevs_map := `function (doc, meta) {
@@ -584,6 +653,24 @@ func installViews(bucket base.Bucket, useXattrs bool) error {
                      		emit(doc.username, meta.id);}`
 	sessions_map = fmt.Sprintf(sessions_map, len(auth.SessionKeyPrefix), auth.SessionKeyPrefix)
 
+	// Dead letters view - used by DeadLetterStore.List
+	// Key is the time the letter was stored; value is the name of its event handler
+	deadletters_map := `function (doc, meta) {
+                     	var prefix = meta.id.substring(0,%d);
+                     	if (prefix == %q)
+                     		emit(doc.time, doc.handler);}`
+	deadletters_map = fmt.Sprintf(deadletters_map, len(DeadLetterKeyPrefix), DeadLetterKeyPrefix)
+
+	// Attachments view - used by BucketAttachmentStore.ForEachAttachment
+	// Key is the attachment's digest, for both single-document attachments and chunked attachments' manifests
+	attachments_map := `function (doc, meta) {
+                     	if (meta.id.substring(0,%d) == %q)
+                     		emit(meta.id.substring(%d), null);
+                     	else if (meta.id.substring(0,%d) == %q)
+                     		emit(meta.id.substring(%d), null);}`
+	attachments_map = fmt.Sprintf(attachments_map, len(attachmentKeyToString("")), attachmentKeyToString(""), len(attachmentKeyToString("")),
+		len(kAttachmentManifestPrefix), kAttachmentManifestPrefix, len(kAttachmentManifestPrefix))
+
 	// Tombstones view - used for view tombstone compaction
 	// Key is purge time; value is docid
 	tombstones_map := `function (doc, meta) {
@@ -733,12 +820,15 @@ func installViews(bucket base.Bucket, useXattrs bool) error {
 
 	designDocMap[DesignDocSyncHousekeeping] = sgbucket.DesignDoc{
 		Views: sgbucket.ViewMap{
-			ViewAllBits:    sgbucket.ViewDef{Map: allbits_map},
-			ViewAllDocs:    sgbucket.ViewDef{Map: alldocs_map, Reduce: "_count"},
-			ViewImport:     sgbucket.ViewDef{Map: import_map, Reduce: "_count"},
-			ViewOldRevs:    sgbucket.ViewDef{Map: oldrevs_map, Reduce: "_count"},
-			ViewSessions:   sgbucket.ViewDef{Map: sessions_map},
-			ViewTombstones: sgbucket.ViewDef{Map: tombstones_map},
+			ViewAllBits:     sgbucket.ViewDef{Map: allbits_map},
+			ViewAllDocs:     sgbucket.ViewDef{Map: alldocs_map, Reduce: "_count"},
+			ViewImport:      sgbucket.ViewDef{Map: import_map, Reduce: "_count"},
+			ViewOldRevs:     sgbucket.ViewDef{Map: oldrevs_map, Reduce: "_count"},
+			ViewSessions:    sgbucket.ViewDef{Map: sessions_map},
+			ViewTombstones:  sgbucket.ViewDef{Map: tombstones_map},
+			ViewExpiry:      sgbucket.ViewDef{Map: expiry_map},
+			ViewDeadLetters: sgbucket.ViewDef{Map: deadletters_map},
+			ViewAttachments: sgbucket.ViewDef{Map: attachments_map},
 		},
 		Options: &sgbucket.DesignDocOptions{
 			IndexXattrOnTombstones: true, // For ViewTombstones
@@ -917,63 +1007,24 @@ func (db *DatabaseContext) DeleteUserSessions(userName string) error {
 // removal of the document from the view index.  In the event that the document has already been purged by server, we need to recreate and delete
 // the document to accomplish the same result.
 func (db *Database) Compact() (int, error) {
-
-	// Compact should be a no-op if not running w/ xattrs
-	if !db.UseXattrs() {
-		return 0, nil
-	}
-
-	// Trigger view compaction for all tombstoned documents older than the purge interval
-	opts := Body{}
-	opts["stale"] = "ok"
-	opts["startkey"] = 1
-	purgeIntervalDuration := time.Duration(-db.PurgeInterval) * time.Hour
-	opts["endkey"] = time.Now().Add(purgeIntervalDuration).Unix()
-	vres, err := db.Bucket.View(DesignDocSyncHousekeeping, ViewTombstones, opts)
-	if err != nil {
-		base.Warn("Tombstones view returned error during compact: %v", err)
-		return 0, err
-	}
-
-	base.Logf("Compacting %d purged tombstones from view for %s ...", len(vres.Rows), db.Name)
-	purgeBody := Body{"_purged": true}
-	count := 0
-	for _, row := range vres.Rows {
-		base.LogTo("CRUD", "\tDeleting %q", row.ID)
-		// First, attempt to purge.
-		purgeErr := db.Purge(row.ID)
-		if purgeErr == nil {
-			count++
-		} else if base.IsKeyNotFoundError(db.Bucket, purgeErr) {
-			// If key no longer exists, need to add and remove to trigger removal from view
-			_, addErr := db.Bucket.Add(row.ID, 0, purgeBody)
-			if addErr != nil {
-				base.Warn("Error compacting key %s (add) - tombstone will not be compacted.  %v", row.ID, addErr)
-				continue
-			}
-			if delErr := db.Bucket.Delete(row.ID); delErr != nil {
-				base.Warn("Error compacting key %s (delete) - tombstone will not be compacted.  %v", row.ID, delErr)
-			}
-			count++
-		} else {
-			base.Warn("Error compacting key %s (purge) - tombstone will not be compacted.  %v", row.ID, purgeErr)
-		}
-	}
-	return count, nil
-}
-
-// Deletes all orphaned CouchDB attachments not used by any revisions.
-func VacuumAttachments(bucket base.Bucket) (int, error) {
-	return 0, base.HTTPErrorf(http.StatusNotImplemented, "Vacuum is temporarily out of order")
+	return db.Maintenance.Run(MaintenanceTombstonePurge, MaintenanceJobOptions{})
 }
 
 //////// SYNC FUNCTION:
 
+// Returns the mapper that runs the database's sync function, or nil if it doesn't have one.
+func (context *DatabaseContext) GetChannelMapper() *channels.ChannelMapper {
+	context.syncFnLock.RLock()
+	defer context.syncFnLock.RUnlock()
+	return context.ChannelMapper
+}
+
 // Sets the database context's sync function based on the JS code from config.
 // Returns a boolean indicating whether the function is different from the saved one.
 // If multiple gateway instances try to update the function at the same time (to the same new
 // value) only one of them will get a changed=true result.
 func (context *DatabaseContext) UpdateSyncFun(syncFun string) (changed bool, err error) {
+	context.syncFnLock.Lock()
 	if syncFun == "" {
 		context.ChannelMapper = nil
 	} else if context.ChannelMapper != nil {
@@ -981,6 +1032,7 @@ func (context *DatabaseContext) UpdateSyncFun(syncFun string) (changed bool, err
 	} else {
 		context.ChannelMapper = channels.NewChannelMapper(syncFun)
 	}
+	context.syncFnLock.Unlock()
 	if err != nil {
 		base.Warn("Error setting sync function: %s", err)
 		return
@@ -1048,130 +1100,171 @@ func (db *Database) UpdateAllDocChannels(doCurrentDocs bool, doImportDocs bool)
 	for _, row := range vres.Rows {
 		rowKey := row.Key.([]interface{})
 		docid := rowKey[1].(string)
-		key := realDocID(docid)
-
-		documentUpdateFunc := func(doc *document) (updatedDoc *document, shouldUpdate bool, updatedExpiry *uint32, err error) {
-			imported := false
-			if !doc.HasValidSyncData(db.writeSequences()) {
-				// This is a document not known to the sync gateway. Ignore or import it:
-				if !doImportDocs {
-					return nil, false, nil, couchbase.UpdateCancel
-				}
-				imported = true
-				if err = db.initializeSyncData(doc); err != nil {
-					return nil, false, nil, err
-				}
-				base.LogTo("CRUD", "\tImporting document %q --> rev %q", docid, doc.CurrentRev)
-			} else {
-				if !doCurrentDocs {
-					return nil, false, nil, couchbase.UpdateCancel
-				}
-				base.LogTo("CRUD", "\tRe-syncing document %q", docid)
-			}
-
-			// Run the sync fn over each current/leaf revision, in case there are conflicts:
-			changed := 0
-			doc.History.forEachLeaf(func(rev *RevInfo) {
-				body, _ := db.getRevFromDoc(doc, rev.ID, false)
-				channels, access, roles, syncExpiry, _, err := db.getChannelsAndAccess(doc, body, rev.ID)
-				if err != nil {
-					// Probably the validator rejected the doc
-					base.Warn("Error calling sync() on doc %q: %v", docid, err)
-					access = nil
-					channels = nil
-				}
-				rev.Channels = channels
-
-				if rev.ID == doc.CurrentRev {
-					changed = len(doc.Access.updateAccess(doc, access)) +
-						len(doc.RoleAccess.updateAccess(doc, roles)) +
-						len(doc.updateChannels(channels))
-					// Only update document expiry based on the current (active) rev
-					if syncExpiry != nil {
-						doc.UpdateExpiry(*syncExpiry)
-						updatedExpiry = syncExpiry
-					}
-				}
-			})
-			shouldUpdate = changed > 0 || imported
-			return doc, shouldUpdate, updatedExpiry, nil
-		}
-		var err error
-		if db.UseXattrs() {
-			writeUpdateFunc := func(currentValue []byte, currentXattr []byte, cas uint64) (
-				raw []byte, rawXattr []byte, deleteDoc bool, expiry *uint32, err error) {
-				// There's no scenario where a doc should from non-deleted to deleted during UpdateAllDocChannels processing,
-				// so deleteDoc is always returned as false.
-				if currentValue == nil || len(currentValue) == 0 {
-					return nil, nil, deleteDoc, nil, errors.New("Cancel update")
-				}
-				doc, err := unmarshalDocumentWithXattr(docid, currentValue, currentXattr, cas, DocUnmarshalAll)
-				if err != nil {
-					return nil, nil, deleteDoc, nil, err
-				}
-
-				updatedDoc, shouldUpdate, updatedExpiry, err := documentUpdateFunc(doc)
-				if err != nil {
-					return nil, nil, deleteDoc, nil, err
-				}
-				if shouldUpdate {
-					base.LogTo("Access", "Saving updated channels and access grants of %q", docid)
-					if updatedExpiry != nil {
-						updatedDoc.UpdateExpiry(*updatedExpiry)
-					}
-					raw, rawXattr, err = updatedDoc.MarshalWithXattr()
-					return raw, rawXattr, deleteDoc, updatedExpiry, err
-				} else {
-					return nil, nil, deleteDoc, nil, errors.New("Cancel update")
-				}
-			}
-			_, err = db.Bucket.WriteUpdateWithXattr(key, KSyncXattrName, 0, nil, writeUpdateFunc)
-		} else {
-			err = db.Bucket.Update(key, 0, func(currentValue []byte) ([]byte, *uint32, error) {
-				// Be careful: this block can be invoked multiple times if there are races!
-				if currentValue == nil {
-					return nil, nil, couchbase.UpdateCancel // someone deleted it?!
-				}
-				doc, err := unmarshalDocument(docid, currentValue)
-				if err != nil {
-					return nil, nil, err
-				}
-				updatedDoc, shouldUpdate, updatedExpiry, err := documentUpdateFunc(doc)
-				if err != nil {
-					return nil, nil, err
-				}
-				if shouldUpdate {
-					base.LogTo("Access", "Saving updated channels and access grants of %q", docid)
-					if updatedExpiry != nil {
-						updatedDoc.UpdateExpiry(*updatedExpiry)
-					}
-					updatedBytes, marshalErr := json.Marshal(updatedDoc)
-					return updatedBytes, updatedExpiry, marshalErr
-				} else {
-					return nil, nil, couchbase.UpdateCancel
-				}
-			})
-		}
-		if err == nil {
+		changed, err := db.resyncDocument(docid, doCurrentDocs, doImportDocs, false)
+		if changed {
 			changeCount++
-		} else if err != couchbase.UpdateCancel {
+		} else if err != nil {
 			base.Warn("Error updating doc %q: %v", docid, err)
 		}
 	}
 	base.Logf("Finished re-running sync function; %d docs changed", changeCount)
 
 	if changeCount > 0 {
-		// Now invalidate channel cache of all users/roles:
-		base.Log("Invalidating channel caches of users/roles...")
-		users, roles, _ := db.AllPrincipalIDs()
-		for _, name := range users {
-			db.invalUserChannels(name)
+		db.invalAllPrincipalChannels()
+	}
+	return changeCount, nil
+}
+
+// Invalidates the channel cache of all users/roles, after documents' access grants have been
+// changed by re-running the sync function.
+func (db *Database) invalAllPrincipalChannels() {
+	base.Log("Invalidating channel caches of users/roles...")
+	users, roles, _ := db.AllPrincipalIDs()
+	for _, name := range users {
+		db.invalUserChannels(name)
+	}
+	for _, name := range roles {
+		db.invalRoleChannels(name)
+	}
+}
+
+var errCancelResyncUpdate = errors.New("Cancel update")
+
+// Re-runs the sync function on a document and saves it if its channels or access grants changed
+// (or, if doImportDocs is true, if it's a document not known to the gateway, which is imported.)
+// If newSequence is true, a changed document gets a new sequence so that the channel cache and
+// changes feeds see it in its new channels; otherwise the caller must turn off channel indexing.
+// Returns true if the document was saved.
+func (db *Database) resyncDocument(docid string, doCurrentDocs, doImportDocs, newSequence bool) (bool, error) {
+	key := realDocID(docid)
+	var sequence uint64          // Sequence allocated for the doc, if newSequence
+	var unusedSequences []uint64 // Sequences allocated by earlier attempts that lost a CAS race
+
+	documentUpdateFunc := func(doc *document) (updatedDoc *document, shouldUpdate bool, updatedExpiry *uint32, err error) {
+		imported := false
+		if !doc.HasValidSyncData(db.writeSequences()) {
+			// This is a document not known to the sync gateway. Ignore or import it:
+			if !doImportDocs {
+				return nil, false, nil, couchbase.UpdateCancel
+			}
+			imported = true
+			if err = db.initializeSyncData(doc); err != nil {
+				return nil, false, nil, err
+			}
+			base.LogTo("CRUD", "\tImporting document %q --> rev %q", docid, doc.CurrentRev)
+		} else {
+			if !doCurrentDocs {
+				return nil, false, nil, couchbase.UpdateCancel
+			}
+			base.LogTo("CRUD", "\tRe-syncing document %q", docid)
+		}
+
+		// Run the sync fn over each current/leaf revision, in case there are conflicts:
+		var curChannels base.Set
+		var curAccess, curRoles channels.AccessMap
+		var curExpiry *uint32
+		doc.History.forEachLeaf(func(rev *RevInfo) {
+			body, _ := db.getRevFromDoc(doc, rev.ID, false)
+			channels, access, roles, syncExpiry, _, err := db.getChannelsAndAccess(doc, body, rev.ID)
+			if err != nil {
+				// Probably the validator rejected the doc
+				base.Warn("Error calling sync() on doc %q: %v", docid, err)
+				access = nil
+				channels = nil
+			}
+			rev.Channels = channels
+
+			if rev.ID == doc.CurrentRev {
+				curChannels, curAccess, curRoles, curExpiry = channels, access, roles, syncExpiry
+			}
+		})
+
+		// The new sequence has to be assigned before the channels and access are updated, since
+		// they record the sequence at which they changed:
+		if newSequence && doc.channelsOrAccessDiffer(curChannels, curAccess, curRoles) {
+			if err = db.assignResyncSequence(doc, &sequence, &unusedSequences); err != nil {
+				return nil, false, nil, err
+			}
 		}
-		for _, name := range roles {
-			db.invalRoleChannels(name)
+		changed := len(doc.Access.updateAccess(doc, curAccess)) +
+			len(doc.RoleAccess.updateAccess(doc, curRoles)) +
+			len(doc.updateChannels(curChannels))
+		// Only update document expiry based on the current (active) rev
+		if curExpiry != nil {
+			doc.UpdateExpiry(*curExpiry)
+			if !db.Options.ExpiryTombstones {
+				updatedExpiry = curExpiry
+			}
 		}
+		shouldUpdate = changed > 0 || imported
+		return doc, shouldUpdate, updatedExpiry, nil
 	}
-	return changeCount, nil
+	var err error
+	if db.UseXattrs() {
+		writeUpdateFunc := func(currentValue []byte, currentXattr []byte, cas uint64) (
+			raw []byte, rawXattr []byte, deleteDoc bool, expiry *uint32, err error) {
+			// There's no scenario where a doc should from non-deleted to deleted during UpdateAllDocChannels processing,
+			// so deleteDoc is always returned as false.
+			if currentValue == nil || len(currentValue) == 0 {
+				return nil, nil, deleteDoc, nil, errCancelResyncUpdate
+			}
+			doc, err := unmarshalDocumentWithXattr(docid, currentValue, currentXattr, cas, DocUnmarshalAll)
+			if err != nil {
+				return nil, nil, deleteDoc, nil, err
+			}
+
+			updatedDoc, shouldUpdate, updatedExpiry, err := documentUpdateFunc(doc)
+			if err != nil {
+				return nil, nil, deleteDoc, nil, err
+			}
+			if shouldUpdate {
+				base.LogTo("Access", "Saving updated channels and access grants of %q", docid)
+				if updatedExpiry != nil {
+					updatedDoc.UpdateExpiry(*updatedExpiry)
+				}
+				raw, rawXattr, err = updatedDoc.MarshalWithXattr()
+				return raw, rawXattr, deleteDoc, updatedExpiry, err
+			} else {
+				return nil, nil, deleteDoc, nil, errCancelResyncUpdate
+			}
+		}
+		_, err = db.Bucket.WriteUpdateWithXattr(key, KSyncXattrName, 0, nil, writeUpdateFunc)
+	} else {
+		err = db.Bucket.Update(key, 0, func(currentValue []byte) ([]byte, *uint32, error) {
+			// Be careful: this block can be invoked multiple times if there are races!
+			if currentValue == nil {
+				return nil, nil, couchbase.UpdateCancel // someone deleted it?!
+			}
+			doc, err := unmarshalDocument(docid, currentValue)
+			if err != nil {
+				return nil, nil, err
+			}
+			updatedDoc, shouldUpdate, updatedExpiry, err := documentUpdateFunc(doc)
+			if err != nil {
+				return nil, nil, err
+			}
+			if shouldUpdate {
+				base.LogTo("Access", "Saving updated channels and access grants of %q", docid)
+				if updatedExpiry != nil {
+					updatedDoc.UpdateExpiry(*updatedExpiry)
+				}
+				updatedBytes, marshalErr := json.Marshal(updatedDoc)
+				return updatedBytes, updatedExpiry, marshalErr
+			} else {
+				return nil, nil, couchbase.UpdateCancel
+			}
+		})
+	}
+	if err == nil {
+		return true, nil
+	}
+	if sequence > 0 {
+		db.sequences.releaseSequence(sequence) // Allocated, but the doc wasn't saved
+	}
+	if err == couchbase.UpdateCancel || err == errCancelResyncUpdate {
+		err = nil
+	}
+	return false, err
 }
 
 func (db *Database) invalUserRoles(username string) {
@@ -1257,6 +1350,10 @@ func (context *DatabaseContext) AllowConflicts() bool {
 	return base.DefaultAllowConflicts
 }
 
+func (context *DatabaseContext) DeltaSyncEnabled() bool {
+	return context.Options.DeltaSyncOptions.Enabled
+}
+
 //////// SEQUENCE ALLOCATION:
 
 func (context *DatabaseContext) LastSequence() (uint64, error) {
@@ -0,0 +1,124 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Prefix of the bucket keys of dead letters.
+const DeadLetterKeyPrefix = "_sync:deadletter:"
+
+// An event payload that an event handler failed to deliver, even after retrying. Dead letters
+// are kept in the bucket until they're replayed or deleted through the admin API.
+type DeadLetter struct {
+	ID          string          `json:"id"`
+	Handler     string          `json:"handler"`         // Name of the event handler that failed
+	Time        time.Time       `json:"time"`            // When it was given up on
+	Attempts    int             `json:"attempts"`        // Number of delivery attempts
+	Error       string          `json:"error"`           // Error of the last attempt
+	ContentType string          `json:"content_type"`    // MIME type of the payload
+	Payload     json.RawMessage `json:"payload"`         // The payload, which is JSON
+	Topic       string          `json:"topic,omitempty"` // Topic the payload is published to (broker)
+	Key         string          `json:"key,omitempty"`   // Key of the published message (broker)
+}
+
+// Stores dead letters in a bucket.
+type DeadLetterStore struct {
+	bucket base.Bucket
+}
+
+func NewDeadLetterStore(bucket base.Bucket) *DeadLetterStore {
+	return &DeadLetterStore{bucket: bucket}
+}
+
+func (store *DeadLetterStore) key(id string) string {
+	return DeadLetterKeyPrefix + id
+}
+
+// Saves a new dead letter, assigning its ID and time.
+func (store *DeadLetterStore) Add(letter *DeadLetter) error {
+	letter.Time = time.Now()
+	letter.ID = fmt.Sprintf("%d-%s", letter.Time.UnixNano(), base.CreateUUID()[0:8])
+	data, err := json.Marshal(letter)
+	if err != nil {
+		return err
+	}
+	added, err := store.bucket.AddRaw(store.key(letter.ID), 0, data)
+	if err == nil && !added {
+		err = base.HTTPErrorf(http.StatusConflict, "Duplicate dead letter ID")
+	}
+	if err != nil {
+		return err
+	}
+	base.LogTo("Events", "Saved dead letter %s of %s", letter.ID, letter.Handler)
+	return nil
+}
+
+// Updates a dead letter after a failed attempt to replay it.
+func (store *DeadLetterStore) Update(letter *DeadLetter) error {
+	data, err := json.Marshal(letter)
+	if err != nil {
+		return err
+	}
+	return store.bucket.SetRaw(store.key(letter.ID), 0, data)
+}
+
+// Returns a dead letter, or a 404 error.
+func (store *DeadLetterStore) Get(id string) (*DeadLetter, error) {
+	if strings.ContainsAny(id, "/:") {
+		return nil, base.HTTPErrorf(http.StatusNotFound, "missing")
+	}
+	var letter DeadLetter
+	if _, err := store.bucket.Get(store.key(id), &letter); err != nil {
+		return nil, err
+	}
+	return &letter, nil
+}
+
+// Deletes a dead letter.
+func (store *DeadLetterStore) Delete(id string) error {
+	if strings.ContainsAny(id, "/:") {
+		return base.HTTPErrorf(http.StatusNotFound, "missing")
+	}
+	return store.bucket.Delete(store.key(id))
+}
+
+// Returns the dead letters, oldest first. If handler is non-empty, only returns that handler's.
+// A limit of 0 means none.
+func (store *DeadLetterStore) List(handler string, limit int) ([]*DeadLetter, error) {
+	vres, err := store.bucket.View(DesignDocSyncHousekeeping, ViewDeadLetters, Body{"stale": false})
+	if err != nil {
+		return nil, err
+	}
+	letters := []*DeadLetter{}
+	for _, row := range vres.Rows {
+		if limit > 0 && len(letters) >= limit {
+			break
+		}
+		if handler != "" && row.Value != handler {
+			continue
+		}
+		letter, err := store.Get(strings.TrimPrefix(row.ID, DeadLetterKeyPrefix))
+		if base.IsDocNotFoundError(err) {
+			continue // Deleted since the view was updated
+		} else if err != nil {
+			return nil, err
+		}
+		letters = append(letters, letter)
+	}
+	return letters, nil
+}
@@ -14,18 +14,24 @@ import (
 const (
 	DesignDocSyncGateway      = "sync_gateway"
 	DesignDocSyncHousekeeping = "sync_housekeeping"
+	DesignDocSyncProvenance   = "sync_provenance"
 	ViewPrincipals            = "principals"
 	ViewChannels              = "channels"
 	ViewAccess                = "access"
 	ViewAccessVbSeq           = "access_vbseq"
 	ViewRoleAccess            = "role_access"
 	ViewRoleAccessVbSeq       = "role_access_vbseq"
+	ViewAccessProvenance      = "access_provenance"
+	ViewRoleAccessProvenance  = "role_access_provenance"
 	ViewAllBits               = "all_bits"
 	ViewAllDocs               = "all_docs"
 	ViewImport                = "import"
 	ViewOldRevs               = "old_revs"
 	ViewSessions              = "sessions"
 	ViewTombstones            = "tombstones"
+	ViewExpiry                = "expiry"
+	ViewDeadLetters           = "dead_letters"
+	ViewAttachments           = "attachments"
 )
 
 func isInternalDDoc(ddocName string) bool {
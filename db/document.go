@@ -18,6 +18,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"sort"
 	"strings"
 	"time"
 
@@ -508,8 +509,10 @@ func (doc *document) migrateRevisionBodies(bucket base.Bucket) error {
 	return nil
 }
 
+const kRevBodyKeyPrefix = "_sync:rb:"
+
 func generateRevBodyKey(docid, revid string) (revBodyKey string) {
-	return fmt.Sprintf("_sync:rb:%s", generateRevDigest(docid, revid))
+	return kRevBodyKeyPrefix + generateRevDigest(docid, revid)
 }
 
 func generateRevDigest(docid, revid string) string {
@@ -646,6 +649,83 @@ func (accessMap *UserAccessMap) updateAccess(doc *document, newAccess channels.A
 	return changedUsers
 }
 
+// A change to the channels, or roles, that a document grants a user or role.
+type AccessGrantChange struct {
+	Principal string   // User name, or "role:" followed by a role name
+	Roles     bool     // True if Granted and Revoked are role names, not channel names
+	Granted   []string // Newly granted
+	Revoked   []string // No longer granted
+}
+
+// Returns the grants and revocations that updateAccess would make, without changing the map.
+func (accessMap UserAccessMap) accessGrantChanges(newAccess channels.AccessMap, roles bool) (changes []AccessGrantChange) {
+	names := make([]string, 0, len(accessMap)+len(newAccess))
+	for name := range accessMap {
+		names = append(names, name)
+	}
+	for name := range newAccess {
+		if _, existed := accessMap[name]; !existed {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		var oldSet base.Set
+		if access, found := accessMap[name]; found {
+			oldSet = access.AsSet()
+		}
+		newSet := newAccess[name]
+		change := AccessGrantChange{Principal: name, Roles: roles}
+		for item := range newSet {
+			if !oldSet.Contains(item) {
+				change.Granted = append(change.Granted, item)
+			}
+		}
+		for item := range oldSet {
+			if !newSet.Contains(item) {
+				change.Revoked = append(change.Revoked, item)
+			}
+		}
+		if change.Granted != nil || change.Revoked != nil {
+			sort.Strings(change.Granted)
+			sort.Strings(change.Revoked)
+			changes = append(changes, change)
+		}
+	}
+	return changes
+}
+
+// Returns true if updateAccess would change the map, without changing it.
+func (accessMap UserAccessMap) differs(newAccess channels.AccessMap) bool {
+	for name, access := range accessMap {
+		if !access.Equals(newAccess[name]) {
+			return true
+		}
+	}
+	for name := range newAccess {
+		if _, existed := accessMap[name]; !existed {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if updating the document with the given channels and access grants would change
+// it, i.e. if updateChannels or updateAccess would report any changes.
+func (doc *document) channelsOrAccessDiffer(newChannels base.Set, newAccess, newRoles channels.AccessMap) bool {
+	for channel, removal := range doc.Channels {
+		if removal == nil && !newChannels.Contains(channel) {
+			return true
+		}
+	}
+	for channel := range newChannels {
+		if removal, exists := doc.Channels[channel]; removal != nil || !exists {
+			return true
+		}
+	}
+	return doc.Access.differs(newAccess) || doc.RoleAccess.differs(newRoles)
+}
+
 //////// MARSHALING ////////
 
 type documentRoot struct {
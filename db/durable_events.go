@@ -0,0 +1,375 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/couchbase/go-couchbase"
+	sgbucket "github.com/couchbase/sg-bucket"
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
+)
+
+// In durable event mode, document_changed events aren't queued in memory by the node that made
+// the change. Instead, the handlers are fed from the database's sequence stream (which the change
+// cache builds from the bucket's mutation feed, falling back to the changes view for older
+// sequences), and each handler's progress is checkpointed in the bucket. So every change is
+// delivered at least once, even across restarts, whichever node made it. Only the node that
+// holds the cluster-wide lease delivers events; if it goes away, another takes over when the
+// lease expires, resuming from the checkpoints.
+//
+// Since events come from the sequence stream, they're collapsed like a changes feed: the stream
+// only has a document's latest sequence, so a document updated several times between polls is
+// delivered once, in its latest state, and the intermediate revisions are never delivered.
+// Events are built from the document, so they have the revision's channels, and an OldDoc if
+// the parent revision's body is still available (it's kept for OldRevExpirySeconds.)
+//
+// Handlers that implement ReliableEventHandler report whether each event was delivered, and
+// their checkpoint never passes an event that wasn't; it's retried on the next poll. For other
+// handlers, an event counts as delivered once HandleEvent returns.
+
+const (
+	kDurableEventLeaseKey         = "_sync:eventlease"       // Key of the lease doc
+	kDurableEventCheckpointPrefix = "_sync:eventcheckpoint:" // Key prefix of handlers' checkpoints
+)
+
+const (
+	kDurableEventLeaseTime    = 30 * time.Second // How long a lease lasts unless it's renewed
+	kDurableEventPollInterval = 1 * time.Second  // How often handlers look for new changes
+	kDurableEventBatchSize    = 100              // Events delivered between checkpoints
+)
+
+// The lease doc: which node delivers events, and until when.
+type durableEventLease struct {
+	Node    string    `json:"node"`
+	Expires time.Time `json:"expires"`
+}
+
+// A handler's progress through the sequence stream, as stored in the bucket.
+type DurableEventCheckpoint struct {
+	Handler    string     `json:"handler"`     // Name of the handler
+	Since      SequenceID `json:"since"`       // Sequence of the last change delivered
+	Delivered  uint64     `json:"delivered"`   // Number of events delivered so far
+	UpdateTime time.Time  `json:"update_time"` // When the checkpoint was saved
+	cas        uint64     // CAS of the stored checkpoint, or 0 if there isn't one
+}
+
+var errDurableEventLeaseLost = errors.New("Event lease lost")
+
+// Delivers document_changed events to the handlers in durable mode.
+type durableEventQueue struct {
+	context    *DatabaseContext
+	nodeID     string         // Identifies this node in the lease doc
+	handlers   []EventHandler // The document_changed handlers
+	leaseHeld  int32          // 1 if this node holds the lease (accessed atomically)
+	terminator chan bool      // Closed to stop the queue
+	wg         sync.WaitGroup // Waits for the goroutines to stop
+}
+
+// Name of a handler, which identifies its checkpoint.
+func durableEventHandlerName(handler EventHandler) string {
+	if named, ok := handler.(interface {
+		Name() string
+	}); ok {
+		return named.Name()
+	}
+	return handler.String()
+}
+
+// Key of a handler's checkpoint. The name is hashed since it may be a long URL.
+func durableEventCheckpointKey(handlerName string) string {
+	digest := sha1.Sum([]byte(handlerName))
+	return kDurableEventCheckpointPrefix + hex.EncodeToString(digest[:])
+}
+
+// Switches document_changed events to durable mode, and starts delivering them.
+func (context *DatabaseContext) StartDurableEvents() {
+	handlers := context.EventMgr.eventHandlers[DocumentChange]
+	if len(handlers) == 0 || context.durableEvents != nil {
+		return
+	}
+	context.EventMgr.durableDocumentChanges = true
+	queue := &durableEventQueue{
+		context:    context,
+		nodeID:     base.CreateUUID(),
+		handlers:   handlers,
+		terminator: make(chan bool),
+	}
+	context.durableEvents = queue
+	base.LogTo("Events", "Starting durable delivery of document change events of %s to %d handlers", context.Name, len(handlers))
+
+	queue.wg.Add(1 + len(handlers))
+	go queue.maintainLease()
+	for _, handler := range handlers {
+		go queue.runHandler(handler)
+	}
+}
+
+// Stops delivering events, waiting for deliveries in progress to finish, and gives up the lease.
+func (queue *durableEventQueue) stop() {
+	close(queue.terminator)
+	queue.wg.Wait()
+}
+
+func (queue *durableEventQueue) stopping() bool {
+	select {
+	case <-queue.terminator:
+		return true
+	default:
+		return false
+	}
+}
+
+// Acquires or renews the lease, and releases it when the queue stops.
+func (queue *durableEventQueue) maintainLease() {
+	defer queue.wg.Done()
+	ticker := time.NewTicker(kDurableEventLeaseTime / 3)
+	defer ticker.Stop()
+	for {
+		held, err := queue.renewLease()
+		if err != nil {
+			base.Warn("Error renewing event lease of %s: %v", queue.context.Name, err)
+			held = false
+		}
+		wasHeld := atomic.SwapInt32(&queue.leaseHeld, boolToInt32(held)) == 1
+		if held && !wasHeld {
+			base.LogTo("Events", "Node %s acquired the event lease of %s", queue.nodeID, queue.context.Name)
+		} else if wasHeld && !held {
+			base.LogTo("Events", "Node %s lost the event lease of %s", queue.nodeID, queue.context.Name)
+		}
+		select {
+		case <-queue.terminator:
+			queue.releaseLease()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func boolToInt32(b bool) int32 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Takes the lease if it's free or expired, or extends it if this node holds it.
+func (queue *durableEventQueue) renewLease() (held bool, err error) {
+	expiry := base.DurationToCbsExpiry(2 * kDurableEventLeaseTime)
+	err = queue.context.Bucket.Update(kDurableEventLeaseKey, expiry, func(currentValue []byte) ([]byte, *uint32, error) {
+		// Be careful: this block can be invoked multiple times if there are races!
+		var lease durableEventLease
+		if currentValue != nil {
+			if err := json.Unmarshal(currentValue, &lease); err != nil {
+				return nil, nil, err
+			}
+		}
+		now := time.Now()
+		if lease.Node != "" && lease.Node != queue.nodeID && now.Before(lease.Expires) {
+			return nil, nil, couchbase.UpdateCancel // Another node holds it
+		}
+		lease = durableEventLease{Node: queue.nodeID, Expires: now.Add(kDurableEventLeaseTime)}
+		data, err := json.Marshal(lease)
+		return data, &expiry, err
+	})
+	if err == couchbase.UpdateCancel {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Gives up the lease, so another node can take over without waiting for it to expire.
+func (queue *durableEventQueue) releaseLease() {
+	if atomic.SwapInt32(&queue.leaseHeld, 0) == 0 {
+		return
+	}
+	err := queue.context.Bucket.Update(kDurableEventLeaseKey, 0, func(currentValue []byte) ([]byte, *uint32, error) {
+		var lease durableEventLease
+		if currentValue == nil || json.Unmarshal(currentValue, &lease) != nil || lease.Node != queue.nodeID {
+			return nil, nil, couchbase.UpdateCancel
+		}
+		lease.Expires = time.Time{}
+		data, err := json.Marshal(lease)
+		return data, nil, err
+	})
+	if err != nil && err != couchbase.UpdateCancel {
+		base.Warn("Error releasing event lease of %s: %v", queue.context.Name, err)
+	}
+}
+
+// Delivers events to a handler whenever this node holds the lease, until the queue stops.
+func (queue *durableEventQueue) runHandler(handler EventHandler) {
+	defer queue.wg.Done()
+	name := durableEventHandlerName(handler)
+	ticker := time.NewTicker(kDurableEventPollInterval)
+	defer ticker.Stop()
+	for {
+		if atomic.LoadInt32(&queue.leaseHeld) == 1 {
+			for {
+				count, err := queue.deliverBatch(handler, name)
+				if err != nil {
+					base.Warn("Error delivering durable events of %s to %s: %v", queue.context.Name, name, err)
+				}
+				if err != nil || count < kDurableEventBatchSize || queue.stopping() {
+					break
+				}
+			}
+		}
+		select {
+		case <-queue.terminator:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Delivers the next batch of changes after the handler's checkpoint, then saves the checkpoint.
+// The checkpoint is reloaded first, since another node may have advanced it while it held the
+// lease. Returns the number of changes read.
+func (queue *durableEventQueue) deliverBatch(handler EventHandler, name string) (int, error) {
+	checkpoint, err := queue.context.DurableEventCheckpoint(name)
+	if err != nil {
+		return 0, err
+	}
+	if checkpoint == nil {
+		// First run: start from the current sequence, rather than the beginning of time
+		lastSeq, err := queue.context.LastSequence()
+		if err != nil {
+			return 0, err
+		}
+		checkpoint = &DurableEventCheckpoint{Handler: name, Since: SequenceID{Seq: lastSeq}}
+		return 0, queue.saveCheckpoint(checkpoint)
+	}
+
+	db := &Database{DatabaseContext: queue.context}
+	changes, err := db.GetChanges(base.SetOf(channels.UserStarChannel), ChangesOptions{
+		Since: checkpoint.Since,
+		Limit: kDurableEventBatchSize,
+	})
+	if err != nil {
+		return 0, err
+	}
+	delivered := 0
+	for _, entry := range changes {
+		if entry.Err != nil {
+			err = entry.Err
+			break
+		}
+		if !entry.pseudoDoc && len(entry.Changes) > 0 {
+			var event *DocumentChangeEvent
+			if event, err = documentChangeEventForEntry(db, entry); err != nil {
+				break
+			} else if event != nil {
+				if reliable, ok := handler.(ReliableEventHandler); ok {
+					err = reliable.DeliverEvent(event)
+				} else {
+					handler.HandleEvent(event)
+				}
+				if err != nil {
+					break // Don't pass this event; it's retried on the next poll
+				}
+				checkpoint.Delivered++
+			}
+		}
+		checkpoint.Since = entry.Seq
+		delivered++
+		if queue.stopping() {
+			break
+		}
+	}
+	if delivered == 0 {
+		return 0, err
+	}
+	if saveErr := queue.saveCheckpoint(checkpoint); saveErr != nil {
+		return delivered, saveErr
+	}
+	return delivered, err
+}
+
+// Builds the event of a change, from the document's current revision. Returns nil if the
+// document has changed again since, as the later change will be delivered with its own sequence,
+// or if it's been purged.
+func documentChangeEventForEntry(db *Database, entry *ChangeEntry) (*DocumentChangeEvent, error) {
+	doc, err := db.GetDocument(entry.ID, DocUnmarshalAll)
+	if base.IsDocNotFoundError(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	} else if doc.Sequence > entry.Seq.Seq {
+		return nil, nil
+	}
+	revID := doc.CurrentRev
+	body, err := db.getRevFromDoc(doc, revID, false)
+	if err != nil {
+		if !base.IsDocNotFoundError(err) {
+			return nil, err
+		}
+		body = Body{"_id": doc.ID, "_rev": revID} // A deletion's body may be gone
+		if doc.History[revID].Deleted {
+			body["_deleted"] = true
+		}
+	}
+	oldJSON, err := db.getAncestorJSON(doc, revID)
+	if err != nil && !base.IsDocNotFoundError(err) {
+		return nil, err
+	}
+	return &DocumentChangeEvent{
+		Doc:      body,
+		OldDoc:   string(oldJSON),
+		Channels: doc.History[revID].Channels,
+	}, nil
+}
+
+// Saves a checkpoint, as long as this node still holds the lease and the stored checkpoint
+// hasn't changed since it was read, so a node that has lost the lease can't move it backwards.
+func (queue *durableEventQueue) saveCheckpoint(checkpoint *DurableEventCheckpoint) error {
+	if atomic.LoadInt32(&queue.leaseHeld) != 1 {
+		return errDurableEventLeaseLost
+	}
+	checkpoint.UpdateTime = time.Now()
+	data, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+	casOut, err := queue.context.Bucket.WriteCas(durableEventCheckpointKey(checkpoint.Handler), 0, 0, checkpoint.cas, data, sgbucket.Raw)
+	if err != nil {
+		return err
+	}
+	checkpoint.cas = casOut
+	return nil
+}
+
+// Returns a handler's durable event checkpoint, or nil if it has none.
+func (context *DatabaseContext) DurableEventCheckpoint(handlerName string) (*DurableEventCheckpoint, error) {
+	var checkpoint DurableEventCheckpoint
+	cas, err := context.Bucket.Get(durableEventCheckpointKey(handlerName), &checkpoint)
+	if err != nil {
+		if base.IsDocNotFoundError(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	checkpoint.cas = cas
+	return &checkpoint, nil
+}
+
+func (context *DatabaseContext) stopDurableEvents() {
+	if context.durableEvents != nil {
+		context.durableEvents.stop()
+		context.durableEvents = nil
+	}
+}
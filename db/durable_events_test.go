@@ -0,0 +1,212 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbaselabs/go.assert"
+)
+
+// Waits for the handler's durable event checkpoint to exist, or to reach a sequence.
+func waitForDurableEventCheckpoint(t *testing.T, db *Database, handlerName string, seq uint64) *DurableEventCheckpoint {
+	for i := 0; i < 100; i++ {
+		checkpoint, err := db.DurableEventCheckpoint(handlerName)
+		assertNoError(t, err, "DurableEventCheckpoint")
+		if checkpoint != nil && checkpoint.Since.Seq >= seq {
+			return checkpoint
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("Checkpoint of %s didn't reach sequence %d", handlerName, seq)
+	return nil
+}
+
+func receiveDocIDs(t *testing.T, resultChannel chan Body, count int) []string {
+	var docIDs []string
+	for len(docIDs) < count {
+		select {
+		case doc := <-resultChannel:
+			docIDs = append(docIDs, doc["_id"].(string))
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Only received %d of %d events", len(docIDs), count)
+		}
+	}
+	return docIDs
+}
+
+func TestDurableEvents(t *testing.T) {
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer tearDownTestDB(t, db)
+
+	// Changes made before durable delivery first starts aren't delivered:
+	_, err := db.Put("doc0", Body{"n": 0})
+	assertNoError(t, err, "Put")
+
+	resultChannel := make(chan Body, 10)
+	handler := &TestingHandler{HandledEvent: DocumentChange, t: t}
+	handler.SetChannel(resultChannel)
+	db.EventMgr.RegisterEventHandler(handler, DocumentChange)
+	db.StartDurableEvents()
+	waitForDurableEventCheckpoint(t, db, handler.String(), 1)
+
+	for _, docID := range []string{"doc1", "doc2", "doc3"} {
+		_, err := db.Put(docID, Body{"n": 1})
+		assertNoError(t, err, "Put")
+	}
+	assert.DeepEquals(t, receiveDocIDs(t, resultChannel, 3), []string{"doc1", "doc2", "doc3"})
+	checkpoint := waitForDurableEventCheckpoint(t, db, handler.String(), 4)
+	assert.Equals(t, checkpoint.Delivered, uint64(3))
+
+	// Changes made while delivery is stopped are delivered when it restarts:
+	db.stopDurableEvents()
+	_, err = db.Put("doc4", Body{"n": 1})
+	assertNoError(t, err, "Put")
+	select {
+	case <-resultChannel:
+		t.Fatalf("Event delivered while stopped")
+	case <-time.After(100 * time.Millisecond):
+	}
+	db.StartDurableEvents()
+	assert.DeepEquals(t, receiveDocIDs(t, resultChannel, 1), []string{"doc4"})
+	db.stopDurableEvents()
+}
+
+func TestDurableEventLease(t *testing.T) {
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer tearDownTestDB(t, db)
+
+	node1 := &durableEventQueue{context: db.DatabaseContext, nodeID: "node1"}
+	node2 := &durableEventQueue{context: db.DatabaseContext, nodeID: "node2"}
+	held, err := node1.renewLease()
+	assert.True(t, held && err == nil)
+	held, err = node2.renewLease()
+	assert.True(t, !held && err == nil)
+	held, _ = node1.renewLease()
+	assert.True(t, held)
+
+	// Once node1 releases the lease, node2 can take it:
+	node1.leaseHeld = 1
+	node1.releaseLease()
+	held, _ = node2.renewLease()
+	assert.True(t, held)
+	held, _ = node1.renewLease()
+	assert.True(t, !held)
+}
+
+// A ReliableEventHandler whose deliveries fail while failing is set.
+type flakyEventHandler struct {
+	lock     sync.Mutex
+	failing  bool
+	attempts int
+	events   []*DocumentChangeEvent
+}
+
+func (h *flakyEventHandler) HandleEvent(event Event) {
+	h.DeliverEvent(event)
+}
+
+func (h *flakyEventHandler) DeliverEvent(event Event) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.attempts++
+	if h.failing {
+		return errors.New("failing")
+	}
+	h.events = append(h.events, event.(*DocumentChangeEvent))
+	return nil
+}
+
+func (h *flakyEventHandler) String() string {
+	return "Flaky handler"
+}
+
+func (h *flakyEventHandler) setFailing(failing bool) {
+	h.lock.Lock()
+	h.failing = failing
+	h.lock.Unlock()
+}
+
+func (h *flakyEventHandler) getAttempts() int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.attempts
+}
+
+func TestDurableEventDeliveryFailure(t *testing.T) {
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer tearDownTestDB(t, db)
+
+	handler := &flakyEventHandler{failing: true}
+	db.EventMgr.RegisterEventHandler(handler, DocumentChange)
+	db.StartDurableEvents()
+	defer db.stopDurableEvents()
+	waitForDurableEventCheckpoint(t, db, handler.String(), 0)
+
+	rev1, err := db.Put("doc1", Body{"n": 1, "channels": []string{"a"}})
+	assertNoError(t, err, "Put")
+	_, err = db.Put("doc1", Body{"_rev": rev1, "n": 2, "channels": []string{"b"}})
+	assertNoError(t, err, "Put")
+
+	// The checkpoint doesn't pass an event that failed:
+	for i := 0; i < 100 && handler.getAttempts() == 0; i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	checkpoint := waitForDurableEventCheckpoint(t, db, handler.String(), 0)
+	assert.True(t, checkpoint.Since.Seq < 2)
+	assert.Equals(t, checkpoint.Delivered, uint64(0))
+
+	// Once the handler recovers, the event is delivered, with its channels and old doc:
+	handler.setFailing(false)
+	checkpoint = waitForDurableEventCheckpoint(t, db, handler.String(), 2)
+	assert.Equals(t, checkpoint.Delivered, uint64(1))
+	handler.lock.Lock()
+	defer handler.lock.Unlock()
+	assert.Equals(t, len(handler.events), 1)
+	event := handler.events[0]
+	assert.Equals(t, event.Doc["_id"], "doc1")
+	assert.Equals(t, event.Doc["n"], 2.0)
+	assert.DeepEquals(t, event.Channels, base.SetOf("b"))
+	var oldDoc Body
+	assertNoError(t, json.Unmarshal([]byte(event.OldDoc), &oldDoc), "Unmarshal OldDoc")
+	assert.Equals(t, oldDoc["n"], 1.0)
+}
+
+func TestDurableEventCheckpointConflict(t *testing.T) {
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer tearDownTestDB(t, db)
+
+	queue := &durableEventQueue{context: db.DatabaseContext, nodeID: "node1", leaseHeld: 1}
+	assertNoError(t, queue.saveCheckpoint(&DurableEventCheckpoint{Handler: "hook"}), "saveCheckpoint")
+
+	// A checkpoint can't be saved over one that changed since it was read:
+	checkpoint1, _ := db.DurableEventCheckpoint("hook")
+	checkpoint2, _ := db.DurableEventCheckpoint("hook")
+	checkpoint1.Since = SequenceID{Seq: 10}
+	assertNoError(t, queue.saveCheckpoint(checkpoint1), "saveCheckpoint")
+	checkpoint2.Since = SequenceID{Seq: 5}
+	assert.True(t, queue.saveCheckpoint(checkpoint2) != nil)
+	checkpoint, _ := db.DurableEventCheckpoint("hook")
+	assert.Equals(t, checkpoint.Since.Seq, uint64(10))
+
+	// Or once the lease is lost:
+	queue.leaseHeld = 0
+	checkpoint.Since = SequenceID{Seq: 20}
+	assert.Equals(t, queue.saveCheckpoint(checkpoint), errDurableEventLeaseLost)
+}
@@ -17,8 +17,44 @@ const (
 	DocumentChange EventType = iota
 	DBStateChange
 	UserAdd
+	PrincipalChange // A user or role was created, updated or deleted
+	AccessChange    // A document granted or revoked a user's or role's access to channels or roles
+	SessionCreate   // A login session was created
+	AuthFailure     // An authentication attempt failed
+	DocumentPurge   // A document was purged
+	DocumentExpiry  // An expired document was tombstoned
 )
 
+// Names of the event types, as used in the config and in event payloads.
+var eventTypeNames = map[EventType]string{
+	DocumentChange:  "document_changed",
+	DBStateChange:   "db_state_changed",
+	UserAdd:         "user_added",
+	PrincipalChange: "principal_changed",
+	AccessChange:    "access_changed",
+	SessionCreate:   "session_created",
+	AuthFailure:     "auth_failed",
+	DocumentPurge:   "document_purged",
+	DocumentExpiry:  "document_expired",
+}
+
+func (eventType EventType) String() string {
+	if name, found := eventTypeNames[eventType]; found {
+		return name
+	}
+	return fmt.Sprintf("EventType(%d)", eventType)
+}
+
+// Returns the event type with the given name, as used in the config.
+func EventTypeNamed(name string) (eventType EventType, found bool) {
+	for eventType, typeName := range eventTypeNames {
+		if typeName == name {
+			return eventType, true
+		}
+	}
+	return 0, false
+}
+
 // An event that can be raised during SG processing.
 type Event interface {
 	Synchronous() bool
@@ -43,6 +79,7 @@ type DocumentChangeEvent struct {
 	Doc      Body
 	OldDoc   string
 	Channels base.Set
+	LogCtx   *base.LogContext // Identifies the request that changed the document, if any
 }
 
 func (dce *DocumentChangeEvent) String() string {
@@ -69,6 +106,42 @@ func (dsce *DBStateChangeEvent) EventType() EventType {
 	return DBStateChange
 }
 
+// SimpleEvent is an event whose data is all in its JSON document: the principal, access, session,
+// auth failure, purge and expiry events. Their documents have a "type" property giving the
+// event type's name, plus:
+//
+//	principal_changed: "name", "principal_type" ("user" or "role"), "action" ("created", "updated" or "deleted")
+//	access_changed:    "doc_id", "rev", "principal", "principal_type", "access_type" ("channel" or "role"),
+//	                   "granted" and "revoked" (arrays of channel or role names)
+//	session_created:   "name", "ttl" (seconds)
+//	auth_failed:       "name" (if known), "method" (e.g. "basic", "session" or "oidc"), "client_ip"
+//	document_purged:   "doc_id"
+//	document_expired:  "doc_id"
+//
+// Principal creations and updates are raised by the change cache as they arrive on the feed, so
+// every node reports them; a node can only tell a creation from an update if it made the change
+// itself, so others report "updated". Deletions are raised by the node that made them.
+type SimpleEvent struct {
+	AsyncEvent
+	Type EventType
+	Doc  Body
+}
+
+func (se *SimpleEvent) String() string {
+	subject := se.Doc["doc_id"]
+	if subject == nil {
+		subject = se.Doc["name"]
+	}
+	if subject == nil {
+		subject = se.Doc["principal"]
+	}
+	return fmt.Sprintf("%s event for %v", se.Type, subject)
+}
+
+func (se *SimpleEvent) EventType() EventType {
+	return se.Type
+}
+
 // Javascript function handling for events
 const kTaskCacheSize = 4
 
@@ -147,6 +220,8 @@ func (ef *JSEventFunction) CallFunction(event Event) (interface{}, error) {
 		result, err = ef.Call(event.Doc, sgbucket.JSONString(event.OldDoc))
 	case *DBStateChangeEvent:
 		result, err = ef.Call(event.Doc)
+	case *SimpleEvent:
+		result, err = ef.Call(event.Doc)
 	}
 
 	if err != nil {
@@ -0,0 +1,322 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Publishes messages to a message broker (Kafka, NATS, AMQP, etc.)
+type MessagePublisher interface {
+	// Publishes a message, whose value is JSON, to a topic (or subject, or routing key.)
+	Publish(topic string, key string, value []byte) error
+	Close() error
+}
+
+// Creates a MessagePublisher connected to the broker at a URL.
+type MessageBrokerFactory func(brokerURL *url.URL, timeout time.Duration) (MessagePublisher, error)
+
+// The message broker clients, by URL scheme.
+var messageBrokers = map[string]MessageBrokerFactory{
+	"kafka-rest":       newKafkaRESTPublisher,
+	"kafka-rest+http":  newKafkaRESTPublisher,
+	"kafka-rest+https": newKafkaRESTPublisher,
+}
+
+// Registers a message broker client for a URL scheme, so it can be used by "broker" event
+// handlers. Should be called from an init function, before any database is opened.
+func RegisterMessageBroker(scheme string, factory MessageBrokerFactory) {
+	messageBrokers[scheme] = factory
+}
+
+// Matches a placeholder in a topic or key template
+var kEventTemplateRegexp = regexp.MustCompile(`\{([^{}]*)\}`)
+
+// BrokerEventHandler is an implementation of EventHandler that publishes each event's JSON
+// document to a message broker. The topic and key of each message are given by templates, in
+// which "{db}" is replaced by the database name, "{event}" by the event type, "{id}" by the
+// document ID, and "{doc.PROPERTY}" by a top-level property of the document.
+type BrokerEventHandler struct {
+	AsyncEventHandler
+	name      string
+	brokerURL string
+	dbName    string
+	topic     string
+	key       string
+	filter    *JSEventFunction
+	publisher MessagePublisher
+	retrier   *eventRetrier // Retries failed publishes, and saves dead letters
+}
+
+func newBrokerEventHandlerFromConfig(context *DatabaseContext, config *EventConfig) (EventHandler, error) {
+	timeout := time.Duration(kDefaultWebhookTimeout) * time.Second
+	if config.Timeout != nil {
+		timeout = time.Duration(*config.Timeout) * time.Second
+	}
+	return NewBrokerEventHandler(config.Broker, context.Name, config.Topic, config.Key, config.Filter, config.Name, timeout,
+		config.retryOptions(context))
+}
+
+// Creates a new broker event handler. The key template defaults to "{id}", and the name to
+// "broker:" followed by the topic template.
+func NewBrokerEventHandler(brokerURL, dbName, topic, key, filterFnString, name string, timeout time.Duration, retryOptions RetryOptions) (*BrokerEventHandler, error) {
+	if brokerURL == "" || topic == "" {
+		return nil, errors.New("broker and topic parameters must be defined for broker events.")
+	}
+	if key == "" {
+		key = "{id}"
+	}
+	for _, template := range []string{topic, key} {
+		if err := checkEventTemplate(template); err != nil {
+			return nil, err
+		}
+	}
+	parsedURL, err := url.Parse(brokerURL)
+	if err != nil {
+		return nil, err
+	}
+	factory := messageBrokers[parsedURL.Scheme]
+	if factory == nil {
+		return nil, fmt.Errorf("Unsupported message broker URL scheme %q", parsedURL.Scheme)
+	}
+	publisher, err := factory(parsedURL, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		name = "broker:" + topic
+	}
+	handler := &BrokerEventHandler{
+		name:      name,
+		brokerURL: brokerURL,
+		dbName:    dbName,
+		topic:     topic,
+		key:       key,
+		publisher: publisher,
+		retrier:   newEventRetrier(name, retryOptions),
+	}
+	if filterFnString != "" {
+		handler.filter = NewJSEventFunction(filterFnString)
+	}
+	return handler, nil
+}
+
+// Publishes the event's document to the topic, if it passes the filter function. Failed
+// publishes are retried, and dead-lettered when the retries run out.
+func (bh *BrokerEventHandler) HandleEvent(event Event) {
+	if !passesEventFilter(bh.filter, event) {
+		return
+	}
+	letter, err := bh.message(event)
+	if err != nil {
+		base.Warn("Broker event handler can't publish %s: %v", event, err)
+		bh.retrier.saveDeadLetter(letter, err)
+		return
+	} else if letter.Payload == nil {
+		base.Warn("Broker event handler invoked for unsupported event type.")
+		return
+	}
+	var logCtx *base.LogContext
+	if event, ok := event.(*DocumentChangeEvent); ok {
+		logCtx = event.LogCtx
+	}
+	bh.retrier.deliver(&eventDelivery{
+		letter:      letter,
+		description: event.String(),
+		logCtx:      logCtx,
+		send: func() (bool, error) {
+			return true, bh.publish(letter)
+		},
+	})
+}
+
+// Makes one attempt to publish an event, if it passes the filter function, and returns the error
+// if it fails. Events aren't retried or dead-lettered; that's left to the caller.
+func (bh *BrokerEventHandler) DeliverEvent(event Event) error {
+	if !passesEventFilter(bh.filter, event) {
+		return nil
+	}
+	letter, err := bh.message(event)
+	if err != nil {
+		return err
+	} else if letter.Payload == nil {
+		return fmt.Errorf("Broker event handler invoked for unsupported event type %s", event.EventType())
+	}
+	return bh.publish(letter)
+}
+
+// Saves an event that won't be handled as a dead letter, if it passes the filter function and the
+// handler has a DeadLetterStore.
+func (bh *BrokerEventHandler) DeadLetterEvent(event Event, reason error) {
+	if bh.retrier.options.DeadLetters == nil || !passesEventFilter(bh.filter, event) {
+		return
+	}
+	if letter, err := bh.message(event); letter.Payload != nil {
+		if err != nil {
+			reason = err
+		}
+		bh.retrier.saveDeadLetter(letter, reason)
+	}
+}
+
+// Publishes a dead letter's message again. On success the dead letter is deleted from the store;
+// on failure its attempt count and error are updated.
+func (bh *BrokerEventHandler) Replay(store *DeadLetterStore, letter *DeadLetter) error {
+	return replayDeadLetter(store, letter, func() error {
+		return bh.publish(*letter)
+	})
+}
+
+// Returns the message to publish for an event, as a dead letter to save if it can't be. Its
+// Payload is nil if the event type is unsupported. Returns an error if the topic template
+// expands to an empty string, since the message can't be published.
+func (bh *BrokerEventHandler) message(event Event) (DeadLetter, error) {
+	payload := eventPayload(event)
+	if payload == nil {
+		return DeadLetter{}, nil
+	}
+	value, err := json.Marshal(payload)
+	if err != nil {
+		return DeadLetter{}, err
+	}
+	letter := DeadLetter{
+		ContentType: "application/json",
+		Payload:     value,
+		Topic:       expandEventTemplate(bh.topic, bh.dbName, event, payload),
+		Key:         expandEventTemplate(bh.key, bh.dbName, event, payload),
+	}
+	if letter.Topic == "" {
+		return letter, fmt.Errorf("Topic template %q expands to an empty topic", bh.topic)
+	}
+	return letter, nil
+}
+
+func (bh *BrokerEventHandler) publish(letter DeadLetter) error {
+	if letter.Topic == "" {
+		return fmt.Errorf("Topic template %q expands to an empty topic", bh.topic)
+	}
+	if err := bh.publisher.Publish(letter.Topic, letter.Key, letter.Payload); err != nil {
+		return err
+	}
+	base.LogTo("Events+", "Broker event handler published to topic %q of %s", letter.Topic, bh.SanitizedUrl())
+	return nil
+}
+
+// Saves the publishes waiting to be retried as dead letters, then closes the broker connection.
+func (bh *BrokerEventHandler) Close() error {
+	bh.retrier.close()
+	return bh.publisher.Close()
+}
+
+// The name that identifies the handler's checkpoint, in durable event mode.
+func (bh *BrokerEventHandler) Name() string {
+	return bh.name
+}
+
+func (bh *BrokerEventHandler) String() string {
+	return fmt.Sprintf("Broker event handler [%s %s]", bh.SanitizedUrl(), bh.topic)
+}
+
+func (bh *BrokerEventHandler) SanitizedUrl() string {
+	// Credentials may have been included in the URL, in which case obscure them
+	return kBasicAuthUrlRegexp.ReplaceAllLiteralString(bh.brokerURL, "://****:****@")
+}
+
+// Returns an error if a template has an unknown placeholder.
+func checkEventTemplate(template string) error {
+	for _, match := range kEventTemplateRegexp.FindAllStringSubmatch(template, -1) {
+		name := match[1]
+		if name != "db" && name != "event" && name != "id" && !(strings.HasPrefix(name, "doc.") && len(name) > 4) {
+			return fmt.Errorf("Unknown placeholder %q in template %q", match[0], template)
+		}
+	}
+	return nil
+}
+
+// Expands the placeholders of a topic or key template. Missing document properties expand to "".
+func expandEventTemplate(template string, dbName string, event Event, payload Body) string {
+	return kEventTemplateRegexp.ReplaceAllStringFunc(template, func(match string) string {
+		name := match[1 : len(match)-1]
+		var value interface{}
+		switch {
+		case name == "db":
+			return dbName
+		case name == "event":
+			return event.EventType().String()
+		case name == "id":
+			value = payload["_id"]
+		case strings.HasPrefix(name, "doc."):
+			value = payload[name[4:]]
+		}
+		if value == nil {
+			return ""
+		}
+		return fmt.Sprint(value)
+	})
+}
+
+// Publishes messages through a Kafka REST Proxy (v2 API). The broker URL is the proxy's, with
+// a scheme of "kafka-rest+http" (or plain "kafka-rest") or "kafka-rest+https".
+type kafkaRESTPublisher struct {
+	baseURL string
+	client  *http.Client
+}
+
+func newKafkaRESTPublisher(brokerURL *url.URL, timeout time.Duration) (MessagePublisher, error) {
+	proxyURL := *brokerURL
+	proxyURL.Scheme = "http"
+	if brokerURL.Scheme == "kafka-rest+https" {
+		proxyURL.Scheme = "https"
+	}
+	return &kafkaRESTPublisher{
+		baseURL: strings.TrimSuffix(proxyURL.String(), "/"),
+		client:  &http.Client{Timeout: timeout},
+	}, nil
+}
+
+func (p *kafkaRESTPublisher) Publish(topic string, key string, value []byte) error {
+	record := map[string]interface{}{"value": json.RawMessage(value)}
+	if key != "" {
+		record["key"] = key
+	}
+	body, err := json.Marshal(map[string]interface{}{"records": []interface{}{record}})
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Post(p.baseURL+"/topics/"+url.PathEscape(topic), "application/vnd.kafka.json.v2+json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// Ensure we're closing the response, so it can be reused
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("Kafka REST proxy response status %s", resp.Status)
+	}
+	return nil
+}
+
+func (p *kafkaRESTPublisher) Close() error {
+	return nil
+}
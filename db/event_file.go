@@ -0,0 +1,122 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// FileEventHandler is an implementation of EventHandler that appends each event to a local file,
+// as a line of JSON (NDJSON).
+type FileEventHandler struct {
+	AsyncEventHandler
+	name   string
+	path   string
+	filter *JSEventFunction
+	lock   sync.Mutex // Serializes writes to the file
+	file   *os.File
+}
+
+// A line of a FileEventHandler's file.
+type FileEventRecord struct {
+	Event string    `json:"event"` // The event type, e.g. "document_changed"
+	Time  time.Time `json:"time"`  // When the event was handled
+	Doc   Body      `json:"doc"`   // The event's JSON document
+}
+
+func newFileEventHandlerFromConfig(context *DatabaseContext, config *EventConfig) (EventHandler, error) {
+	return NewFileEventHandler(config.Path, config.Filter, config.Name)
+}
+
+// Creates a new file event handler, which appends to the file at the given path, creating it if
+// necessary. The name defaults to "file:" followed by the path.
+func NewFileEventHandler(path, filterFnString, name string) (*FileEventHandler, error) {
+	if path == "" {
+		return nil, errors.New("path parameter must be defined for file events.")
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		name = "file:" + path
+	}
+	handler := &FileEventHandler{
+		name: name,
+		path: path,
+		file: file,
+	}
+	if filterFnString != "" {
+		handler.filter = NewJSEventFunction(filterFnString)
+	}
+	return handler, nil
+}
+
+// Appends the event to the file, if it passes the filter function.
+func (fh *FileEventHandler) HandleEvent(event Event) {
+	if err := fh.DeliverEvent(event); err != nil {
+		base.Warn("Error writing %s to %s: %v", event, fh.path, err)
+	}
+}
+
+// Like HandleEvent, but returns an error if the event couldn't be written.
+func (fh *FileEventHandler) DeliverEvent(event Event) error {
+	if !passesEventFilter(fh.filter, event) {
+		return nil
+	}
+	payload := eventPayload(event)
+	if payload == nil {
+		return fmt.Errorf("File event handler invoked for unsupported event type %s", event.EventType())
+	}
+	line, err := json.Marshal(FileEventRecord{
+		Event: event.EventType().String(),
+		Time:  time.Now(),
+		Doc:   payload,
+	})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	fh.lock.Lock()
+	defer fh.lock.Unlock()
+	if fh.file == nil {
+		return errors.New("File event handler is closed")
+	}
+	_, err = fh.file.Write(line)
+	return err
+}
+
+func (fh *FileEventHandler) Close() error {
+	fh.lock.Lock()
+	defer fh.lock.Unlock()
+	if fh.file == nil {
+		return nil
+	}
+	err := fh.file.Close()
+	fh.file = nil
+	return err
+}
+
+// The name that identifies the handler's checkpoint, in durable event mode.
+func (fh *FileEventHandler) Name() string {
+	return fh.name
+}
+
+func (fh *FileEventHandler) String() string {
+	return fmt.Sprintf("File event handler [%s]", fh.path)
+}
@@ -2,6 +2,9 @@ package db
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -10,6 +13,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"regexp"
+	"sync"
 	"time"
 )
 
@@ -19,25 +23,150 @@ type EventHandler interface {
 	String() string
 }
 
+// Implemented by event handlers that can tell whether an event was delivered. Durable event
+// delivery uses this instead of HandleEvent, and retries events that return an error.
+type ReliableEventHandler interface {
+	DeliverEvent(event Event) error
+}
+
+// Implemented by event handlers that can save an event they won't get to handle as a dead letter,
+// such as when the event queue is full or the database is closing.
+type DeadLetterHandler interface {
+	DeadLetterEvent(event Event, reason error)
+}
+
+// Configuration of an event handler, as given in the database config's "event_handlers".
+// Which properties apply depends on the handler type.
+type EventConfig struct {
+	HandlerType        string            `json:"handler"`                         // Handler type
+	Url                string            `json:"url,omitempty"`                   // Url (webhook)
+	Filter             string            `json:"filter,omitempty"`                // Filter function (any)
+	Timeout            *uint64           `json:"timeout,omitempty"`               // Timeout (webhook, broker)
+	Name               string            `json:"name,omitempty"`                  // Name identifying dead letters and checkpoints (any)
+	Headers            map[string]string `json:"headers,omitempty"`               // Extra HTTP headers (webhook)
+	HMACSecret         string            `json:"hmac_secret,omitempty"`           // Key for signing payloads with HMAC-SHA256 (webhook)
+	MaxRetries         int               `json:"max_retries,omitempty"`           // Retries of a failed post (webhook, broker)
+	RetryIntervalMs    uint32            `json:"retry_interval_ms,omitempty"`     // Delay before the first retry, doubled each time (webhook, broker)
+	MaxRetryIntervalMs uint32            `json:"max_retry_interval_ms,omitempty"` // Max delay between retries (webhook, broker)
+	BatchSize          int               `json:"batch_size,omitempty"`            // Max document changes per post (webhook)
+	BatchIntervalMs    uint32            `json:"batch_interval_ms,omitempty"`     // Max time to wait for a batch to fill (webhook)
+	DeadLetters        bool              `json:"dead_letters,omitempty"`          // Save undeliverable payloads in the bucket (webhook, broker)
+	Broker             string            `json:"broker,omitempty"`                // URL of the message broker (broker)
+	Topic              string            `json:"topic,omitempty"`                 // Topic template (broker)
+	Key                string            `json:"key,omitempty"`                   // Message key template (broker)
+	Path               string            `json:"path,omitempty"`                  // Path of the file to append to (file)
+}
+
+// The retry options of a handler's config.
+func (config *EventConfig) retryOptions(context *DatabaseContext) RetryOptions {
+	options := RetryOptions{
+		MaxRetries:       config.MaxRetries,
+		RetryInterval:    time.Duration(config.RetryIntervalMs) * time.Millisecond,
+		MaxRetryInterval: time.Duration(config.MaxRetryIntervalMs) * time.Millisecond,
+	}
+	if config.DeadLetters {
+		options.DeadLetters = context.DeadLetters
+	}
+	return options
+}
+
+// Creates an EventHandler of a database from its config.
+type EventHandlerFactory func(context *DatabaseContext, config *EventConfig) (EventHandler, error)
+
+// The event handler types, by the name used in the config's "handler" property.
+var eventHandlerTypes = map[string]EventHandlerFactory{
+	"webhook": newWebhookFromConfig,
+	"broker":  newBrokerEventHandlerFromConfig,
+	"file":    newFileEventHandlerFromConfig,
+}
+
+// Registers a type of event handler, so it can be used in database configs. Should be called
+// from an init function, before any database is opened.
+func RegisterEventHandlerType(handlerType string, factory EventHandlerFactory) {
+	eventHandlerTypes[handlerType] = factory
+}
+
+// Creates an event handler from its config, using the factory registered for its type.
+func NewEventHandler(context *DatabaseContext, config *EventConfig) (EventHandler, error) {
+	factory := eventHandlerTypes[config.HandlerType]
+	if factory == nil {
+		return nil, fmt.Errorf("Unknown event handler type %s", config.HandlerType)
+	}
+	return factory(context, config)
+}
+
+// Calls a handler's filter function, if it has one, to determine whether it should handle an event.
+func passesEventFilter(filter *JSEventFunction, event Event) bool {
+	if filter == nil {
+		return true
+	}
+	success, err := filter.CallValidateFunction(event)
+	if err != nil {
+		base.Warn("Error calling event handler filter function: %v", err)
+	}
+	return success
+}
+
+// The JSON document that an event handler publishes for an event, or nil if it's an unsupported
+// type of event.
+func eventPayload(event Event) Body {
+	switch event := event.(type) {
+	case *DocumentChangeEvent:
+		return event.Doc
+	case *DBStateChangeEvent:
+		return event.Doc
+	case *SimpleEvent:
+		return event.Doc
+	default:
+		return nil
+	}
+}
+
 type AsyncEventHandler struct{}
 
 // Webhook is an implementation of EventHandler that sends an asynchronous HTTP POST
 type Webhook struct {
 	AsyncEventHandler
-	url     string
-	filter  *JSEventFunction
-	timeout time.Duration
-	client  *http.Client
+	url        string
+	filter     *JSEventFunction
+	timeout    time.Duration
+	client     *http.Client
+	options    WebhookOptions
+	batchLock  sync.Mutex
+	batch      []Body        // DocumentChangeEvent docs waiting to be posted together
+	batchTimer *time.Timer   // Posts the batch when BatchInterval has passed
+	retrier    *eventRetrier // Retries failed posts, and saves dead letters
+}
+
+// Optional behaviors of a Webhook.
+type WebhookOptions struct {
+	RetryOptions                    // Retries of failed POSTs, and dead letters
+	Name          string            // Identifies the webhook's dead letters; defaults to the sanitized URL
+	Headers       map[string]string // Extra HTTP headers to send
+	HMACSecret    string            // If set, the payload's HMAC-SHA256 is sent in an X-SG-Signature header
+	BatchSize     int               // If > 1, POSTs up to this many DocumentChangeEvents' docs as a JSON array (not in durable mode)
+	BatchInterval time.Duration     // Max time a doc waits for its batch to fill up
 }
 
 // default HTTP post timeout
 const kDefaultWebhookTimeout = 60
 
+// Default of WebhookOptions.BatchInterval
+const kDefaultWebhookBatchInterval = 1 * time.Second
+
+// Name of the HTTP header containing the HMAC signature of a webhook's payload
+const WebhookSignatureHeader = "X-SG-Signature"
+
 // used to match the HTTP basic auth component of a URL
 var kBasicAuthUrlRegexp = regexp.MustCompilePOSIX(`:\/\/[^:/]+:[^@/]+@`)
 
 // Creates a new webhook handler based on the url and filter function.
 func NewWebhook(url string, filterFnString string, timeout *uint64) (*Webhook, error) {
+	return NewWebhookWithOptions(url, filterFnString, timeout, WebhookOptions{})
+}
+
+// Creates a new webhook handler based on the url, filter function and options.
+func NewWebhookWithOptions(url string, filterFnString string, timeout *uint64, options WebhookOptions) (*Webhook, error) {
 
 	var err error
 
@@ -47,7 +176,15 @@ func NewWebhook(url string, filterFnString string, timeout *uint64) (*Webhook, e
 	}
 
 	wh := &Webhook{
-		url: url,
+		url:     url,
+		options: options,
+	}
+	if wh.options.Name == "" {
+		wh.options.Name = wh.SanitizedUrl()
+	}
+	wh.retrier = newEventRetrier(wh.options.Name, wh.options.RetryOptions)
+	if wh.options.BatchInterval <= 0 {
+		wh.options.BatchInterval = kDefaultWebhookBatchInterval
 	}
 	if filterFnString != "" {
 		wh.filter = NewJSEventFunction(filterFnString)
@@ -66,37 +203,40 @@ func NewWebhook(url string, filterFnString string, timeout *uint64) (*Webhook, e
 	return wh, err
 }
 
+func newWebhookFromConfig(context *DatabaseContext, config *EventConfig) (EventHandler, error) {
+	options := WebhookOptions{
+		RetryOptions:  config.retryOptions(context),
+		Name:          config.Name,
+		Headers:       config.Headers,
+		HMACSecret:    config.HMACSecret,
+		BatchSize:     config.BatchSize,
+		BatchInterval: time.Duration(config.BatchIntervalMs) * time.Millisecond,
+	}
+	return NewWebhookWithOptions(config.Url, config.Filter, config.Timeout, options)
+}
+
 // Performs an HTTP POST to the url defined for the handler.  If a filter function is defined,
 // calls it to determine whether to POST.  The payload for the POST is depends
 // on the event type.
 func (wh *Webhook) HandleEvent(event Event) {
 
-	var payload *bytes.Buffer
-	var contentType string
-	if wh.filter != nil {
-		// If filter function is defined, use it to determine whether to post
-		success, err := wh.filter.CallValidateFunction(event)
-		if err != nil {
-			base.Warn("Error calling webhook filter function: %v", err)
-		}
-
-		// If filter returns false, cancel webhook post
-		if !success {
-			return
-		}
+	// If filter function is defined, use it to determine whether to post
+	if !passesEventFilter(wh.filter, event) {
+		return
 	}
 
 	// Different events post different content by default
+	var logCtx *base.LogContext
+	var doc Body
 	switch event := event.(type) {
 	case *DocumentChangeEvent:
-		// for DocumentChangeEvent, post document body
-		jsonOut, err := json.Marshal(event.Doc)
-		if err != nil {
-			base.Warn("Error marshalling doc for webhook post")
+		logCtx = event.LogCtx
+		// for DocumentChangeEvent, post document body, or add it to the batch
+		if wh.options.BatchSize > 1 {
+			wh.addToBatch(event.Doc)
 			return
 		}
-		contentType = "application/json"
-		payload = bytes.NewBuffer(jsonOut)
+		doc = event.Doc
 	case *DBStateChangeEvent:
 		// for DBStateChangeEvent, post JSON document with the following format
 		//{
@@ -106,38 +246,191 @@ func (wh *Webhook) HandleEvent(event Event) {
 		//	"reason":"DB started from config”,
 		//	“state”:"online"
 		//}
-		jsonOut, err := json.Marshal(event.Doc)
-		if err != nil {
-			base.Warn("Error marshalling doc for webhook post")
-			return
-		}
-		contentType = "application/json"
-		payload = bytes.NewBuffer(jsonOut)
+		doc = event.Doc
+	case *SimpleEvent:
+		// for the other event types, post the event's JSON document (see SimpleEvent)
+		doc = event.Doc
 	default:
 		base.Warn("Webhook invoked for unsupported event type.")
 		return
 	}
-	func() {
-		resp, err := wh.client.Post(wh.url, contentType, payload)
-		defer func() {
-			// Ensure we're closing the response, so it can be reused
-			if resp != nil && resp.Body != nil {
-				io.Copy(ioutil.Discard, resp.Body)
-				resp.Body.Close()
-			}
-		}()
-
-		if err != nil {
-			base.Warn("Error attempting to post %s to url %s: %s -- %+v", event.String(), wh.SanitizedUrl(), err)
-			return
-		}
+	payload, err := json.Marshal(doc)
+	if err != nil {
+		base.Warn("Error marshalling doc for webhook post")
+		return
+	}
+	wh.retrier.deliver(wh.newDelivery(payload, event.String(), logCtx))
+}
 
-		if base.LogEnabled("Events+") {
-			base.LogTo("Events+", "Webhook handler ran for event.  Payload %s posted to URL %s, got status %s",
-				payload, wh.SanitizedUrl(), resp.Status)
+// Makes one attempt to POST an event, if it passes the filter function, and returns the error if
+// it fails. Events aren't batched, retried or dead-lettered; that's left to the caller.
+func (wh *Webhook) DeliverEvent(event Event) error {
+	if !passesEventFilter(wh.filter, event) {
+		return nil
+	}
+	doc := eventPayload(event)
+	if doc == nil {
+		return fmt.Errorf("Webhook invoked for unsupported event type %s", event.EventType())
+	}
+	payload, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	var logCtx *base.LogContext
+	if event, ok := event.(*DocumentChangeEvent); ok {
+		logCtx = event.LogCtx
+	}
+	_, err = wh.post(payload, "application/json", logCtx)
+	return err
+}
+
+// Saves an event that won't be handled as a dead letter, if it passes the filter function and the
+// webhook has a DeadLetterStore.
+func (wh *Webhook) DeadLetterEvent(event Event, reason error) {
+	if wh.options.DeadLetters == nil || !passesEventFilter(wh.filter, event) {
+		return
+	}
+	var doc interface{} = eventPayload(event)
+	if doc == nil {
+		return
+	} else if _, ok := event.(*DocumentChangeEvent); ok && wh.options.BatchSize > 1 {
+		doc = []Body{eventPayload(event)} // Replay it in the format the webhook expects
+	}
+	payload, err := json.Marshal(doc)
+	if err != nil {
+		base.Warn("Error marshalling doc for webhook dead letter")
+		return
+	}
+	wh.retrier.saveDeadLetter(DeadLetter{ContentType: "application/json", Payload: payload}, reason)
+}
+
+// Adds a doc to the batch, and posts the batch if it's full. Otherwise the batch timer posts it.
+func (wh *Webhook) addToBatch(doc Body) {
+	wh.batchLock.Lock()
+	wh.batch = append(wh.batch, doc)
+	var batch []Body
+	if len(wh.batch) >= wh.options.BatchSize {
+		batch = wh.takeBatch()
+	} else if wh.batchTimer == nil {
+		wh.batchTimer = time.AfterFunc(wh.options.BatchInterval, wh.Flush)
+	}
+	wh.batchLock.Unlock()
+
+	if batch != nil {
+		wh.postBatch(batch)
+	}
+}
+
+// Removes and returns the batched docs. Must be called with batchLock held.
+func (wh *Webhook) takeBatch() []Body {
+	batch := wh.batch
+	wh.batch = nil
+	if wh.batchTimer != nil {
+		wh.batchTimer.Stop()
+		wh.batchTimer = nil
+	}
+	return batch
+}
+
+// Posts the batch now, if it's not empty.
+func (wh *Webhook) Flush() {
+	wh.batchLock.Lock()
+	batch := wh.takeBatch()
+	wh.batchLock.Unlock()
+	if len(batch) > 0 {
+		wh.postBatch(batch)
+	}
+}
+
+func (wh *Webhook) postBatch(batch []Body) {
+	payload, err := json.Marshal(batch)
+	if err != nil {
+		base.Warn("Error marshalling docs for webhook post")
+		return
+	}
+	wh.retrier.deliver(wh.newDelivery(payload, fmt.Sprintf("Batch of %d document change events", len(batch)), nil))
+}
+
+func (wh *Webhook) newDelivery(payload []byte, description string, logCtx *base.LogContext) *eventDelivery {
+	return &eventDelivery{
+		letter:      DeadLetter{ContentType: "application/json", Payload: payload},
+		description: description,
+		logCtx:      logCtx,
+		send: func() (bool, error) {
+			return wh.post(payload, "application/json", logCtx)
+		},
+	}
+}
+
+// Posts the pending batch, and saves the posts still waiting to be retried as dead letters.
+// After this, posts that fail aren't retried.
+func (wh *Webhook) Close() error {
+	wh.retrier.close()
+	wh.Flush()
+	return nil
+}
+
+// Makes one attempt to POST a payload. Returns an error if it fails, including if the response
+// status isn't 2xx; retryable is true if the failure might be temporary.
+func (wh *Webhook) post(payload []byte, contentType string, logCtx *base.LogContext) (retryable bool, err error) {
+	rq, err := http.NewRequest("POST", wh.url, bytes.NewReader(payload))
+	if err != nil {
+		return false, err
+	}
+	rq.Header.Set("Content-Type", contentType)
+	for name, value := range wh.options.Headers {
+		rq.Header.Set(name, value)
+	}
+	if wh.options.HMACSecret != "" {
+		rq.Header.Set(WebhookSignatureHeader, "sha256="+WebhookSignature(wh.options.HMACSecret, payload))
+	}
+	if logCtx != nil && logCtx.RequestID != "" {
+		// Pass on the ID of the request that caused the event:
+		rq.Header.Set("X-Request-ID", logCtx.RequestID)
+	}
+	resp, err := wh.client.Do(rq)
+	defer func() {
+		// Ensure we're closing the response, so it can be reused
+		if resp != nil && resp.Body != nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
 		}
 	}()
+	if err != nil {
+		return true, err
+	}
+
+	if base.LogEnabled("Events+") {
+		base.LogToCtx(logCtx, "Events+", "Webhook handler ran for event.  Payload %s posted to URL %s, got status %s",
+			payload, wh.SanitizedUrl(), resp.Status)
+	}
+	if resp.StatusCode >= 300 {
+		retryable = resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests ||
+			resp.StatusCode == http.StatusRequestTimeout
+		return retryable, fmt.Errorf("Webhook response status %s", resp.Status)
+	}
+	return false, nil
+}
+
+// Posts a dead letter's payload again. On success the dead letter is deleted from the store; on
+// failure its attempt count and error are updated.
+func (wh *Webhook) Replay(store *DeadLetterStore, letter *DeadLetter) error {
+	return replayDeadLetter(store, letter, func() error {
+		_, err := wh.post(letter.Payload, letter.ContentType, nil)
+		return err
+	})
+}
+
+// The name that identifies the webhook's dead letters.
+func (wh *Webhook) Name() string {
+	return wh.options.Name
+}
 
+// Returns the hex-encoded HMAC-SHA256 of a payload, as sent in the X-SG-Signature header.
+func WebhookSignature(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
 }
 
 func (wh *Webhook) String() string {
@@ -1,8 +1,21 @@
 package db
 
 import (
-	"github.com/couchbaselabs/go.assert"
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
 )
 
 func TestWebhookString(t *testing.T) {
@@ -32,3 +45,168 @@ func TestSanitizedUrl(t *testing.T) {
 	}
 	assert.Equals(t, wh.SanitizedUrl(), "https://example.com/does-not-count-as-url-embedded:basic-auth-credentials@qux")
 }
+
+func TestNewEventHandler(t *testing.T) {
+	context := &DatabaseContext{Name: "db"}
+	handler, err := NewEventHandler(context, &EventConfig{HandlerType: "webhook", Url: "http://example.com/", Name: "hook"})
+	assert.Equals(t, err, nil)
+	assert.Equals(t, handler.(*Webhook).Name(), "hook")
+
+	_, err = NewEventHandler(context, &EventConfig{HandlerType: "carrier_pigeon"})
+	assert.Equals(t, err.Error(), "Unknown event handler type carrier_pigeon")
+	_, err = NewEventHandler(context, &EventConfig{HandlerType: "broker", Broker: "kafka-rest://localhost:8082", Topic: "{nope}"})
+	assert.Equals(t, err.Error(), `Unknown placeholder "{nope}" in template "{nope}"`)
+	_, err = NewEventHandler(context, &EventConfig{HandlerType: "broker", Broker: "smoke-signals://hill", Topic: "t"})
+	assert.Equals(t, err.Error(), `Unsupported message broker URL scheme "smoke-signals"`)
+}
+
+func TestExpandEventTemplate(t *testing.T) {
+	event := &DocumentChangeEvent{Doc: Body{"_id": "doc1", "type": "order", "n": 3}}
+	assert.Equals(t, expandEventTemplate("sg.{db}.{event}.{doc.type}", "db", event, event.Doc), "sg.db.document_changed.order")
+	assert.Equals(t, expandEventTemplate("{id}-{doc.n}-{doc.missing}", "db", event, event.Doc), "doc1-3-")
+	assert.Equals(t, checkEventTemplate("{db}{event}{id}{doc.x}"), nil)
+	assert.True(t, checkEventTemplate("{doc.}") != nil)
+}
+
+// A MessagePublisher that records the messages published.
+type testPublisher struct {
+	messages chan [3]string
+}
+
+func (p *testPublisher) Publish(topic string, key string, value []byte) error {
+	p.messages <- [3]string{topic, key, string(value)}
+	return nil
+}
+
+func (p *testPublisher) Close() error {
+	return nil
+}
+
+func TestBrokerEventHandler(t *testing.T) {
+	publisher := &testPublisher{messages: make(chan [3]string, 10)}
+	RegisterMessageBroker("test", func(brokerURL *url.URL, timeout time.Duration) (MessagePublisher, error) {
+		return publisher, nil
+	})
+
+	handler, err := NewBrokerEventHandler("test://broker", "db", "{db}.{doc.type}", "", `function(doc) { return doc.type != "secret"; }`, "", time.Second, RetryOptions{})
+	assertNoError(t, err, "NewBrokerEventHandler")
+	assert.Equals(t, handler.Name(), "broker:{db}.{doc.type}")
+	handler.HandleEvent(&DocumentChangeEvent{Doc: Body{"_id": "doc1", "type": "secret"}})
+	handler.HandleEvent(&DocumentChangeEvent{Doc: Body{"_id": "doc2", "type": "order"}})
+	handler.HandleEvent(&DBStateChangeEvent{Doc: Body{"dbname": "db", "state": "online"}})
+	assert.Equals(t, <-publisher.messages, [3]string{"db.order", "doc2", `{"_id":"doc2","type":"order"}`})
+	assert.Equals(t, <-publisher.messages, [3]string{"db.", "", `{"dbname":"db","state":"online"}`})
+}
+
+// A MessagePublisher whose publishes fail until it's given enough successes.
+type flakyPublisher struct {
+	lock      sync.Mutex
+	successes int
+	topics    []string
+}
+
+func (p *flakyPublisher) Publish(topic string, key string, value []byte) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.successes == 0 {
+		return errors.New("broker unavailable")
+	}
+	p.successes--
+	p.topics = append(p.topics, topic)
+	return nil
+}
+
+func (p *flakyPublisher) Close() error {
+	return nil
+}
+
+func TestBrokerEventHandlerRetries(t *testing.T) {
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer tearDownTestDB(t, db)
+
+	publisher := &flakyPublisher{}
+	RegisterMessageBroker("flaky", func(brokerURL *url.URL, timeout time.Duration) (MessagePublisher, error) {
+		return publisher, nil
+	})
+	handler, err := NewBrokerEventHandler("flaky://broker", "db", "{doc.type}", "", "", "broker", time.Second,
+		RetryOptions{MaxRetries: 1, RetryInterval: time.Millisecond, DeadLetters: db.DeadLetters})
+	assertNoError(t, err, "NewBrokerEventHandler")
+
+	// A publish that fails is retried, then dead-lettered:
+	handler.HandleEvent(&DocumentChangeEvent{Doc: Body{"_id": "doc1", "type": "order"}})
+	var letters []*DeadLetter
+	for i := 0; i < 100 && len(letters) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		letters, _ = db.DeadLetters.List("broker", 0)
+	}
+	assert.Equals(t, len(letters), 1)
+	assert.Equals(t, letters[0].Attempts, 2)
+	assert.Equals(t, letters[0].Error, "broker unavailable")
+	assert.Equals(t, letters[0].Topic, "order")
+	assert.Equals(t, letters[0].Key, "doc1")
+
+	// A topic that expands to "" isn't published, or retried:
+	handler.HandleEvent(&DocumentChangeEvent{Doc: Body{"_id": "doc2"}})
+	letters, _ = db.DeadLetters.List("broker", 0)
+	assert.Equals(t, len(letters), 2)
+	assert.Equals(t, letters[1].Attempts, 0)
+	assert.Equals(t, letters[1].Error, `Topic template "{doc.type}" expands to an empty topic`)
+
+	// Dead letters can be replayed through the broker:
+	publisher.lock.Lock()
+	publisher.successes = 1
+	publisher.lock.Unlock()
+	db.EventMgr.RegisterEventHandler(handler, DocumentChange)
+	assert.True(t, db.EventMgr.DeadLetterReplayer("broker") == handler)
+	assertNoError(t, handler.Replay(db.DeadLetters, letters[0]), "Replay")
+	assert.True(t, handler.Replay(db.DeadLetters, letters[1]) != nil)
+	assert.DeepEquals(t, publisher.topics, []string{"order"})
+	letters, _ = db.DeadLetters.List("broker", 0)
+	assert.Equals(t, len(letters), 1)
+}
+
+func TestKafkaRESTPublisher(t *testing.T) {
+	requests := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests <- r.URL.Path + " " + r.Header.Get("Content-Type") + " " + string(body)
+	}))
+	defer server.Close()
+
+	handler, err := NewBrokerEventHandler(strings.Replace(server.URL, "http:", "kafka-rest:", 1), "db", "docs", "", "", "", time.Second, RetryOptions{})
+	assertNoError(t, err, "NewBrokerEventHandler")
+	handler.HandleEvent(&DocumentChangeEvent{Doc: Body{"_id": "doc1"}})
+	assert.Equals(t, <-requests, `/topics/docs application/vnd.kafka.json.v2+json {"records":[{"key":"doc1","value":{"_id":"doc1"}}]}`)
+}
+
+func TestFileEventHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "events")
+	assertNoError(t, err, "TempDir")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "events.ndjson")
+
+	handler, err := NewFileEventHandler(path, "", "")
+	assertNoError(t, err, "NewFileEventHandler")
+	assert.Equals(t, handler.Name(), "file:"+path)
+	handler.HandleEvent(&DocumentChangeEvent{Doc: Body{"_id": "doc1"}})
+	handler.HandleEvent(&DBStateChangeEvent{Doc: Body{"dbname": "db", "state": "offline"}})
+	assertNoError(t, handler.Close(), "Close")
+	handler.HandleEvent(&DocumentChangeEvent{Doc: Body{"_id": "doc2"}}) // ignored after closing
+
+	file, err := os.Open(path)
+	assertNoError(t, err, "Open")
+	defer file.Close()
+	var records []FileEventRecord
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record FileEventRecord
+		assertNoError(t, json.Unmarshal(scanner.Bytes(), &record), "Unmarshal")
+		records = append(records, record)
+	}
+	assert.Equals(t, len(records), 2)
+	assert.Equals(t, records[0].Event, "document_changed")
+	assert.DeepEquals(t, records[0].Doc, Body{"_id": "doc1"})
+	assert.Equals(t, records[1].Event, "db_state_changed")
+	assert.Equals(t, records[1].Doc["state"], "offline")
+}
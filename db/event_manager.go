@@ -3,6 +3,8 @@ package db
 import (
 	"errors"
 	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
+	"io"
 	"sync"
 	"time"
 )
@@ -11,22 +13,44 @@ import (
 // eventChannel to minimize time spent blocking whatever process is raising the event.
 // The event queue worker goroutine works the event channel and sends events to the appropriate handlers
 type EventManager struct {
-	activeEventTypes   map[EventType]bool
-	eventHandlers      map[EventType][]EventHandler
-	asyncEventChannel  chan Event
-	activeCountChannel chan bool
-	waitTime           int
+	activeEventTypes       map[EventType]bool
+	eventHandlers          map[EventType][]EventHandler
+	asyncEventChannel      chan Event
+	activeCountChannel     chan bool
+	waitTime               int
+	durableDocumentChanges bool              // DocumentChangeEvents come from the durable event queue instead
+	authFailureLimiter     *base.RateLimiter // Limits auth failure events, so a flood of them can't fill the queue
+	principalLock          sync.Mutex
+	principalActions       map[uint64]principalAction // Actions of principal changes made by this node, by sequence
+}
+
+// The action of a principal change made by this node, and when it was recorded.
+type principalAction struct {
+	action   string
+	recorded time.Time
 }
 
 const kMaxActiveEvents = 500 // number of events that are processed concurrently
 const kEventWaitTime = 100   // time (ms) to wait before dropping event, when event queue is full
 
+// How long a principal action is kept waiting for its sequence to arrive on the feed. Sequences
+// that never arrive (e.g. the save failed after it was recorded) are forgotten after this.
+const kPrincipalActionExpiry = 10 * time.Minute
+
+// Default rate limit of auth failure events: the rate per second, and the burst size
+const (
+	kDefaultAuthFailureEventRate  = 10
+	kDefaultAuthFailureEventBurst = 100
+)
+
 // Creates a new event manager.  Sets up the event channel for async events, and the goroutine to
 // monitor and process that channel.
 func NewEventManager() *EventManager {
 
 	em := &EventManager{
-		eventHandlers: make(map[EventType][]EventHandler, 0),
+		eventHandlers:      make(map[EventType][]EventHandler, 0),
+		authFailureLimiter: base.NewRateLimiter(kDefaultAuthFailureEventRate, kDefaultAuthFailureEventBurst),
+		principalActions:   map[uint64]principalAction{},
 	}
 	// Create channel for queued asynchronous events.
 	em.activeEventTypes = make(map[EventType]bool)
@@ -92,6 +116,48 @@ func (em *EventManager) RegisterEventHandler(handler EventHandler, eventType Eve
 	base.LogTo("Events", "Registered event handler: %v, for event type %v", handler, eventType)
 }
 
+// Returns the registered handler with the given name that can replay dead letters, or nil.
+func (em *EventManager) DeadLetterReplayer(name string) DeadLetterReplayer {
+	for _, handlers := range em.eventHandlers {
+		for _, handler := range handlers {
+			if replayer, ok := handler.(DeadLetterReplayer); ok && replayer.Name() == name {
+				return replayer
+			}
+		}
+	}
+	return nil
+}
+
+// Closes the registered handlers that hold resources, like files or broker connections. Events
+// still waiting in the queue are saved as dead letters first, by the handlers that support that.
+func (em *EventManager) CloseHandlers() {
+	for drained := false; !drained; {
+		select {
+		case event := <-em.asyncEventChannel:
+			em.deadLetterEvent(event, errEventManagerClosed)
+		default:
+			drained = true
+		}
+	}
+
+	closed := map[EventHandler]bool{}
+	for _, handlers := range em.eventHandlers {
+		for _, handler := range handlers {
+			if closer, ok := handler.(io.Closer); ok && !closed[handler] {
+				closed[handler] = true
+				if err := closer.Close(); err != nil {
+					base.Warn("Error closing event handler %v: %v", handler, err)
+				}
+			}
+		}
+	}
+}
+
+// Returns the number of asynchronous events waiting to be processed.
+func (em *EventManager) QueueLength() int {
+	return len(em.asyncEventChannel)
+}
+
 // Checks whether a handler of the given type has been registered to the event manager.
 func (em *EventManager) HasHandlerForEvent(eventType EventType) bool {
 	return em.activeEventTypes[eventType]
@@ -107,24 +173,44 @@ func (em *EventManager) raiseEvent(event Event) error {
 		case <-time.After(time.Duration(em.waitTime) * time.Millisecond):
 			// Event queue channel is full - ignore event and log error
 			base.Warn("Event queue full - discarding event: %s", event.String())
-			return errors.New("Event queue full")
+			em.deadLetterEvent(event, errEventQueueFull)
+			return errEventQueueFull
 		}
 	}
 	// TODO: handling for synchronous events
 	return nil
 }
 
+var errEventQueueFull = errors.New("Event queue full")
+var errEventManagerClosed = errors.New("Database closed before the event was handled")
+
+// Gives an event that won't be handled to those of its handlers that save dead letters.
+func (em *EventManager) deadLetterEvent(event Event, reason error) {
+	for _, handler := range em.eventHandlers[event.EventType()] {
+		if dlh, ok := handler.(DeadLetterHandler); ok {
+			dlh.DeadLetterEvent(event, reason)
+		}
+	}
+}
+
 // Raises a document change event based on the the document body and channel set.  If the
 // event manager doesn't have a listener for this event, ignores.
 func (em *EventManager) RaiseDocumentChangeEvent(body Body, oldBodyJSON string, channels base.Set) error {
+	return em.RaiseDocumentChangeEventCtx(nil, body, oldBodyJSON, channels)
+}
 
-	if !em.activeEventTypes[DocumentChange] {
+// Like RaiseDocumentChangeEvent, but the event carries the LogContext of the request that made
+// the change, so event handlers can correlate with it.
+func (em *EventManager) RaiseDocumentChangeEventCtx(logCtx *base.LogContext, body Body, oldBodyJSON string, channels base.Set) error {
+
+	if !em.activeEventTypes[DocumentChange] || em.durableDocumentChanges {
 		return nil
 	}
 	event := &DocumentChangeEvent{
 		Doc:      body,
 		OldDoc:   oldBodyJSON,
 		Channels: channels,
+		LogCtx:   logCtx,
 	}
 
 	return em.raiseEvent(event)
@@ -152,3 +238,131 @@ func (em *EventManager) RaiseDBStateChangeEvent(dbName string, state string, rea
 
 	return em.raiseEvent(event)
 }
+
+// Raises an event of one of the SimpleEvent types, if the event manager has a listener for it.
+// The event type's name is added to the document as its "type" property.
+func (em *EventManager) raiseSimpleEvent(eventType EventType, body Body) error {
+	if em == nil || !em.activeEventTypes[eventType] {
+		return nil
+	}
+	body["type"] = eventType.String()
+	return em.raiseEvent(&SimpleEvent{Type: eventType, Doc: body})
+}
+
+// Records the action ("created" or "updated") of a principal change this node is saving at a
+// sequence, for the event the change cache raises when the change arrives on the feed. It has to
+// be recorded before the principal is saved, since the change can arrive before Save returns.
+// Actions recorded longer ago than kPrincipalActionExpiry are dropped.
+func (em *EventManager) notePrincipalAction(sequence uint64, action string) {
+	if em == nil || !em.activeEventTypes[PrincipalChange] {
+		return
+	}
+	now := time.Now()
+	em.principalLock.Lock()
+	defer em.principalLock.Unlock()
+	for seq, recorded := range em.principalActions {
+		if now.Sub(recorded.recorded) > kPrincipalActionExpiry {
+			delete(em.principalActions, seq)
+		}
+	}
+	em.principalActions[sequence] = principalAction{action: action, recorded: now}
+}
+
+// Forgets the action recorded for a sequence, whose change wasn't saved after all.
+func (em *EventManager) forgetPrincipalAction(sequence uint64) {
+	if em == nil {
+		return
+	}
+	em.principalLock.Lock()
+	delete(em.principalActions, sequence)
+	em.principalLock.Unlock()
+}
+
+// Returns the action recorded by notePrincipalAction for a sequence, or "updated" if the change
+// was made by another node (the feed doesn't tell creations and updates apart.)
+func (em *EventManager) takePrincipalAction(sequence uint64) string {
+	em.principalLock.Lock()
+	defer em.principalLock.Unlock()
+	recorded, found := em.principalActions[sequence]
+	if !found {
+		return "updated"
+	}
+	delete(em.principalActions, sequence)
+	return recorded.action
+}
+
+// Raises a principal change event; action is "created", "updated" or "deleted".
+func (em *EventManager) RaisePrincipalChangeEvent(name string, isUser bool, action string) error {
+	return em.raiseSimpleEvent(PrincipalChange, Body{
+		"name":           name,
+		"principal_type": principalTypeName(isUser),
+		"action":         action,
+	})
+}
+
+// Raises an access change event for a grant or revocation of channels or roles by a document.
+func (em *EventManager) RaiseAccessChangeEvent(docID string, revID string, change AccessGrantChange) error {
+	principal, isRole := channels.AccessNameToPrincipalName(change.Principal)
+	accessType := "channel"
+	if change.Roles {
+		accessType = "role"
+	}
+	return em.raiseSimpleEvent(AccessChange, Body{
+		"doc_id":         docID,
+		"rev":            revID,
+		"principal":      principal,
+		"principal_type": principalTypeName(!isRole),
+		"access_type":    accessType,
+		"granted":        change.Granted,
+		"revoked":        change.Revoked,
+	})
+}
+
+// Raises a session creation event; ttl is the session's time to live.
+func (em *EventManager) RaiseSessionCreateEvent(username string, ttl time.Duration) error {
+	return em.raiseSimpleEvent(SessionCreate, Body{
+		"name": username,
+		"ttl":  int(ttl / time.Second),
+	})
+}
+
+// Sets the rate limit of auth failure events; see RaiseAuthFailureEvent.
+func (em *EventManager) SetAuthFailureRateLimit(rate float64, burst int) {
+	em.authFailureLimiter = base.NewRateLimiter(rate, burst)
+}
+
+// Raises an authentication failure event; method is how the client tried to authenticate.
+// These events are rate-limited, since they're raised by unauthenticated clients: a flood of
+// failed logins mustn't fill the event queue and crowd out other events. Events over the limit
+// are dropped.
+func (em *EventManager) RaiseAuthFailureEvent(username string, method string, clientIP string) error {
+	if em == nil || !em.activeEventTypes[AuthFailure] {
+		return nil
+	}
+	if ok, _ := em.authFailureLimiter.Take(""); !ok {
+		base.LogTo("Events+", "Auth failure event rate limit exceeded; dropping event of %q from %s", username, clientIP)
+		return nil
+	}
+	return em.raiseSimpleEvent(AuthFailure, Body{
+		"name":      username,
+		"method":    method,
+		"client_ip": clientIP,
+	})
+}
+
+// Raises a document purge event.
+func (em *EventManager) RaiseDocumentPurgeEvent(docID string) error {
+	return em.raiseSimpleEvent(DocumentPurge, Body{"doc_id": docID})
+}
+
+// Raises a document expiry event.
+func (em *EventManager) RaiseDocumentExpiryEvent(docID string) error {
+	return em.raiseSimpleEvent(DocumentExpiry, Body{"doc_id": docID})
+}
+
+func principalTypeName(isUser bool) string {
+	if isUser {
+		return PrincipalTypeUser
+	}
+	return PrincipalTypeRole
+}
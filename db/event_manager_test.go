@@ -4,12 +4,17 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
 	"github.com/couchbaselabs/go.assert"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"sort"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -750,3 +755,372 @@ func TestUnavailableWebhook(t *testing.T) {
 
 	time.Sleep(50 * time.Millisecond)
 }
+
+func TestWebhookRequestID(t *testing.T) {
+	requestIDs := make(chan string, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestIDs <- r.Header.Get("X-Request-ID")
+	}))
+	defer server.Close()
+
+	webhookHandler, _ := NewWebhook(server.URL, "", nil)
+	webhookHandler.HandleEvent(&DocumentChangeEvent{
+		Doc:    Body{"_id": "doc1"},
+		LogCtx: &base.LogContext{SerialNumber: 3, RequestID: "abc-123"},
+	})
+	assert.Equals(t, <-requestIDs, "abc-123")
+
+	webhookHandler.HandleEvent(&DocumentChangeEvent{Doc: Body{"_id": "doc2"}})
+	assert.Equals(t, <-requestIDs, "")
+}
+
+func TestWebhookRetries(t *testing.T) {
+	var lock sync.Mutex
+	statuses := []int{503, 429, 200}
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		w.WriteHeader(statuses[attempts])
+		attempts++
+	}))
+	defer server.Close()
+
+	webhookHandler, _ := NewWebhookWithOptions(server.URL, "", nil, WebhookOptions{
+		RetryOptions: RetryOptions{MaxRetries: 3, RetryInterval: time.Millisecond},
+	})
+	webhookHandler.HandleEvent(&DocumentChangeEvent{Doc: Body{"_id": "doc1"}})
+
+	// Retries happen on a timer, after HandleEvent returns:
+	lock.Lock()
+	assert.Equals(t, attempts, 1)
+	lock.Unlock()
+	for i := 0; i < 100; i++ {
+		lock.Lock()
+		done := attempts == 3
+		lock.Unlock()
+		if done {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	lock.Lock()
+	assert.Equals(t, attempts, 3)
+	lock.Unlock()
+}
+
+func TestWebhookDeadLetters(t *testing.T) {
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer tearDownTestDB(t, db)
+
+	var lock sync.Mutex
+	status := http.StatusBadRequest
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		attempts++
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	webhookHandler, _ := NewWebhookWithOptions(server.URL, "", nil, WebhookOptions{
+		Name:         "hook",
+		RetryOptions: RetryOptions{MaxRetries: 3, RetryInterval: time.Millisecond, DeadLetters: db.DeadLetters},
+	})
+	webhookHandler.HandleEvent(&DocumentChangeEvent{Doc: Body{"_id": "doc1"}})
+
+	// A 400 status isn't retried:
+	assert.Equals(t, attempts, 1)
+	letters, err := db.DeadLetters.List("hook", 0)
+	assertNoError(t, err, "List")
+	assert.Equals(t, len(letters), 1)
+	letter := letters[0]
+	assert.Equals(t, letter.Handler, "hook")
+	assert.Equals(t, letter.Attempts, 1)
+	assert.Equals(t, letter.Error, "Webhook response status 400 Bad Request")
+	assert.Equals(t, string(letter.Payload), `{"_id":"doc1"}`)
+	letters, _ = db.DeadLetters.List("otherhook", 0)
+	assert.Equals(t, len(letters), 0)
+
+	// Failed replays update the dead letter:
+	assert.True(t, webhookHandler.Replay(db.DeadLetters, letter) != nil)
+	letter, err = db.DeadLetters.Get(letter.ID)
+	assertNoError(t, err, "Get")
+	assert.Equals(t, letter.Attempts, 2)
+
+	// Successful replays delete it:
+	lock.Lock()
+	status = http.StatusOK
+	lock.Unlock()
+	assertNoError(t, webhookHandler.Replay(db.DeadLetters, letter), "Replay")
+	_, err = db.DeadLetters.Get(letter.ID)
+	assertHTTPError(t, err, 404)
+}
+
+func TestWebhookClose(t *testing.T) {
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer tearDownTestDB(t, db)
+
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	webhookHandler, _ := NewWebhookWithOptions(server.URL, "", nil, WebhookOptions{
+		Name:          "hook",
+		RetryOptions:  RetryOptions{MaxRetries: 3, RetryInterval: time.Hour, DeadLetters: db.DeadLetters},
+		BatchSize:     10,
+		BatchInterval: time.Hour,
+	})
+	webhookHandler.HandleEvent(&SimpleEvent{Type: PrincipalChange, Doc: Body{"name": "naomi"}})
+	webhookHandler.HandleEvent(&DocumentChangeEvent{Doc: Body{"_id": "doc1"}})
+	assert.Equals(t, atomic.LoadInt32(&attempts), int32(1))
+	letters, _ := db.DeadLetters.List("hook", 0)
+	assert.Equals(t, len(letters), 0)
+
+	// Closing posts the batch once, and saves it and the event waiting to be retried as dead letters:
+	assertNoError(t, webhookHandler.Close(), "Close")
+	assert.Equals(t, atomic.LoadInt32(&attempts), int32(2))
+	letters, err := db.DeadLetters.List("hook", 0)
+	assertNoError(t, err, "List")
+	assert.Equals(t, len(letters), 2)
+	payloads := []string{string(letters[0].Payload), string(letters[1].Payload)}
+	sort.Strings(payloads)
+	assert.DeepEquals(t, payloads, []string{`[{"_id":"doc1"}]`, `{"name":"naomi"}`})
+	for _, letter := range letters {
+		assert.Equals(t, letter.Attempts, 1)
+		assert.Equals(t, letter.Error, "Webhook response status 503 Service Unavailable")
+	}
+}
+
+func TestEventDeadLetters(t *testing.T) {
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer tearDownTestDB(t, db)
+
+	webhookHandler, _ := NewWebhookWithOptions("http://localhost:1/never", `function(doc) { return doc.keep; }`, nil,
+		WebhookOptions{Name: "hook", RetryOptions: RetryOptions{DeadLetters: db.DeadLetters}})
+
+	// This event manager isn't started, so its queue is always full:
+	em := NewEventManager()
+	em.RegisterEventHandler(webhookHandler, DocumentChange)
+	assert.Equals(t, em.RaiseDocumentChangeEvent(Body{"_id": "doc1", "keep": true}, "", nil), errEventQueueFull)
+	assert.Equals(t, em.RaiseDocumentChangeEvent(Body{"_id": "doc2", "keep": false}, "", nil), errEventQueueFull)
+	letters, err := db.DeadLetters.List("hook", 0)
+	assertNoError(t, err, "List")
+	assert.Equals(t, len(letters), 1)
+	assert.Equals(t, string(letters[0].Payload), `{"_id":"doc1","keep":true}`)
+	assert.Equals(t, letters[0].Attempts, 0)
+	assert.Equals(t, letters[0].Error, errEventQueueFull.Error())
+	assertNoError(t, db.DeadLetters.Delete(letters[0].ID), "Delete")
+
+	// Events still in the queue when the handlers are closed are dead-lettered too:
+	em.asyncEventChannel = make(chan Event, 5)
+	assertNoError(t, em.RaiseDocumentChangeEvent(Body{"_id": "doc3", "keep": true}, "", nil), "Raise")
+	em.CloseHandlers()
+	assert.Equals(t, len(em.asyncEventChannel), 0)
+	letters, _ = db.DeadLetters.List("hook", 0)
+	assert.Equals(t, len(letters), 1)
+	assert.Equals(t, string(letters[0].Payload), `{"_id":"doc3","keep":true}`)
+	assert.Equals(t, letters[0].Error, errEventManagerClosed.Error())
+}
+
+func TestWebhookBatching(t *testing.T) {
+	batches := make(chan []Body, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var batch []Body
+		json.NewDecoder(r.Body).Decode(&batch)
+		batches <- batch
+	}))
+	defer server.Close()
+
+	webhookHandler, _ := NewWebhookWithOptions(server.URL, "", nil, WebhookOptions{
+		BatchSize:     3,
+		BatchInterval: 50 * time.Millisecond,
+	})
+	for i := 0; i < 4; i++ {
+		webhookHandler.HandleEvent(&DocumentChangeEvent{Doc: Body{"_id": fmt.Sprintf("doc%d", i)}})
+	}
+	// The full batch is posted immediately, the rest after the batch interval:
+	batch := <-batches
+	assert.Equals(t, len(batch), 3)
+	assert.Equals(t, batch[0]["_id"], "doc0")
+	batch = <-batches
+	assert.Equals(t, len(batch), 1)
+	assert.Equals(t, batch[0]["_id"], "doc3")
+}
+
+func TestWebhookHeadersAndSignature(t *testing.T) {
+	requests := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests <- r
+		bodies <- body
+	}))
+	defer server.Close()
+
+	webhookHandler, _ := NewWebhookWithOptions(server.URL, "", nil, WebhookOptions{
+		Headers:    map[string]string{"Authorization": "Bearer xyzzy"},
+		HMACSecret: "s3cr3t",
+	})
+	webhookHandler.HandleEvent(&DocumentChangeEvent{Doc: Body{"_id": "doc1"}})
+	rq, body := <-requests, <-bodies
+	assert.Equals(t, rq.Header.Get("Authorization"), "Bearer xyzzy")
+	assert.Equals(t, rq.Header.Get(WebhookSignatureHeader), "sha256="+WebhookSignature("s3cr3t", body))
+	assert.Equals(t, WebhookSignature("key", []byte("The quick brown fox jumps over the lazy dog")),
+		"f7bc83f430538424b13298e6aa6fb143ef4d59a14946175997479dbc2d1a3cd8")
+}
+
+// Collects the SimpleEvents it handles.
+type simpleEventCollector struct {
+	events chan *SimpleEvent
+}
+
+func (c *simpleEventCollector) HandleEvent(event Event) {
+	if simpleEvent, ok := event.(*SimpleEvent); ok {
+		c.events <- simpleEvent
+	}
+}
+
+func (c *simpleEventCollector) String() string {
+	return "Simple event collector"
+}
+
+func (c *simpleEventCollector) next(t *testing.T) Body {
+	select {
+	case event := <-c.events:
+		return event.Doc
+	case <-time.After(5 * time.Second):
+		t.Fatalf("No event received")
+		return nil
+	}
+}
+
+func TestAccessGrantChanges(t *testing.T) {
+	accessMap := UserAccessMap{
+		"alice":      channels.AtSequence(base.SetOf("a", "b"), 1),
+		"role:staff": channels.AtSequence(base.SetOf("s"), 1),
+	}
+	changes := accessMap.accessGrantChanges(channels.AccessMap{
+		"alice": base.SetOf("b", "c"),
+		"bob":   base.SetOf("a"),
+	}, false)
+	assert.DeepEquals(t, changes, []AccessGrantChange{
+		{Principal: "alice", Granted: []string{"c"}, Revoked: []string{"a"}},
+		{Principal: "bob", Granted: []string{"a"}},
+		{Principal: "role:staff", Revoked: []string{"s"}},
+	})
+	assert.Equals(t, len(accessMap.accessGrantChanges(channels.AccessMap{
+		"alice":      base.SetOf("a", "b"),
+		"role:staff": base.SetOf("s"),
+	}, false)), 0)
+}
+
+func TestPrincipalAndAccessEvents(t *testing.T) {
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer tearDownTestDB(t, db)
+	db.ChannelMapper = channels.NewChannelMapper(`function(doc) {access(doc.users, doc.channels);}`)
+
+	collector := &simpleEventCollector{events: make(chan *SimpleEvent, 10)}
+	for _, eventType := range []EventType{PrincipalChange, AccessChange, DocumentPurge} {
+		db.EventMgr.RegisterEventHandler(collector, eventType)
+	}
+	db.EventMgr.Start(0, -1)
+
+	name := "naomi"
+	_, err := db.UpdatePrincipal(PrincipalConfig{Name: &name, Password: &name}, true, true)
+	assertNoError(t, err, "UpdatePrincipal")
+	assert.DeepEquals(t, collector.next(t), Body{"type": "principal_changed", "name": "naomi", "principal_type": "user", "action": "created"})
+
+	rev1, err := db.Put("grant", Body{"users": []string{"naomi", "role:staff"}, "channels": []string{"x", "y"}})
+	assertNoError(t, err, "Put")
+	event1, event2 := collector.next(t), collector.next(t)
+	if event1["principal"] != "naomi" {
+		event1, event2 = event2, event1
+	}
+	assert.Equals(t, event1["type"], "access_changed")
+	assert.Equals(t, event1["doc_id"], "grant")
+	assert.Equals(t, event1["rev"], rev1)
+	assert.Equals(t, event1["principal_type"], "user")
+	assert.Equals(t, event1["access_type"], "channel")
+	assert.DeepEquals(t, event1["granted"], []string{"x", "y"})
+	assert.Equals(t, event2["principal"], "staff")
+	assert.Equals(t, event2["principal_type"], "role")
+
+	_, err = db.Put("grant", Body{"_rev": rev1, "users": []string{"naomi"}, "channels": []string{"y"}})
+	assertNoError(t, err, "Put")
+	event1, event2 = collector.next(t), collector.next(t)
+	if event1["principal"] != "naomi" {
+		event1, event2 = event2, event1
+	}
+	assert.DeepEquals(t, event1["revoked"], []string{"x"})
+	assert.True(t, event1["granted"] == nil || len(event1["granted"].([]string)) == 0)
+	assert.DeepEquals(t, event2["revoked"], []string{"x", "y"})
+
+	assertNoError(t, db.Purge("grant"), "Purge")
+	assert.DeepEquals(t, collector.next(t), Body{"type": "document_purged", "doc_id": "grant"})
+
+	// Principal changes saved by another node arrive through the feed, as updates:
+	seq, err := db.sequences.nextSequence()
+	assertNoError(t, err, "nextSequence")
+	role, err := db.Authenticator().NewRole("staff", nil)
+	assertNoError(t, err, "NewRole")
+	role.SetSequence(seq)
+	assertNoError(t, db.Authenticator().Save(role), "Save")
+	assert.DeepEquals(t, collector.next(t), Body{"type": "principal_changed", "name": "staff", "principal_type": "role", "action": "updated"})
+
+	// Saves that don't change the sequence, like invalidating channels, don't raise events:
+	role, err = db.Authenticator().GetRole("staff")
+	assertNoError(t, err, "GetRole")
+	assertNoError(t, db.Authenticator().InvalidateChannels(role), "InvalidateChannels")
+	select {
+	case event := <-collector.events:
+		t.Fatalf("Unexpected event %v", event.Doc)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestAuthFailureEventRateLimit(t *testing.T) {
+	em := NewEventManager()
+	collector := &simpleEventCollector{events: make(chan *SimpleEvent, 10)}
+	em.RegisterEventHandler(collector, AuthFailure)
+	em.SetAuthFailureRateLimit(0.001, 2)
+	em.Start(0, -1)
+
+	for i := 0; i < 5; i++ {
+		assertNoError(t, em.RaiseAuthFailureEvent("naomi", "basic", "10.0.0.1"), "RaiseAuthFailureEvent")
+	}
+	collector.next(t)
+	collector.next(t)
+	select {
+	case event := <-collector.events:
+		t.Fatalf("Unexpected event %v", event.Doc)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestPrincipalActions(t *testing.T) {
+	em := NewEventManager()
+	em.RegisterEventHandler(&simpleEventCollector{events: make(chan *SimpleEvent, 10)}, PrincipalChange)
+
+	em.notePrincipalAction(1, "created")
+	em.notePrincipalAction(2, "created")
+	em.forgetPrincipalAction(2)
+	assert.Equals(t, em.takePrincipalAction(1), "created")
+	assert.Equals(t, em.takePrincipalAction(1), "updated") // Taken already
+	assert.Equals(t, em.takePrincipalAction(2), "updated") // Forgotten
+
+	// An action whose sequence never arrives expires:
+	em.notePrincipalAction(3, "created")
+	em.principalActions[3] = principalAction{action: "created", recorded: time.Now().Add(-2 * kPrincipalActionExpiry)}
+	em.notePrincipalAction(4, "created")
+	assert.Equals(t, len(em.principalActions), 1)
+	assert.Equals(t, em.takePrincipalAction(4), "created")
+}
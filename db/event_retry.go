@@ -0,0 +1,161 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"sync"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// How an event handler retries deliveries that fail, and where it saves the ones it gives up on.
+type RetryOptions struct {
+	MaxRetries       int              // How many times to retry a failed delivery
+	RetryInterval    time.Duration    // Delay before the first retry, doubled for each one after
+	MaxRetryInterval time.Duration    // Maximum delay between retries
+	DeadLetters      *DeadLetterStore // Where payloads that couldn't be delivered are saved, if set
+}
+
+// Defaults of RetryOptions
+const (
+	kDefaultRetryInterval    = 1 * time.Second
+	kDefaultMaxRetryInterval = 5 * time.Minute
+)
+
+// Implemented by event handlers whose dead letters can be replayed through the admin API.
+type DeadLetterReplayer interface {
+	Name() string
+	Replay(store *DeadLetterStore, letter *DeadLetter) error
+}
+
+// Delivers an event handler's payloads, retrying failures with exponential backoff. Retries are
+// made on timers, so the event manager's workers aren't held up waiting for them. Once a
+// delivery's retries run out, or once the retrier is closed, it's saved as a dead letter.
+type eventRetrier struct {
+	handler string // Name of the handler, which identifies its dead letters
+	options RetryOptions
+	lock    sync.Mutex
+	pending map[*eventDelivery]bool // Deliveries waiting for their next attempt
+	closed  bool                    // Once set, failed deliveries are dead-lettered, not retried
+}
+
+// A payload being delivered, and the state of its retries.
+type eventDelivery struct {
+	letter      DeadLetter                         // What's saved if delivery fails for good
+	description string                             // Describes the payload, for logging
+	logCtx      *base.LogContext                   // Context of the request that raised the event
+	send        func() (retryable bool, err error) // Makes one attempt to deliver the payload
+	delay       time.Duration                      // Delay before the next retry
+	lastErr     error                              // Error of the last attempt
+	timer       *time.Timer                        // Makes the next attempt
+}
+
+func newEventRetrier(handler string, options RetryOptions) *eventRetrier {
+	if options.RetryInterval <= 0 {
+		options.RetryInterval = kDefaultRetryInterval
+	}
+	if options.MaxRetryInterval <= 0 {
+		options.MaxRetryInterval = kDefaultMaxRetryInterval
+	}
+	return &eventRetrier{handler: handler, options: options}
+}
+
+// Makes one attempt at a delivery. If that fails with a temporary error, the next attempt is
+// scheduled; otherwise a failed delivery is saved as a dead letter.
+func (r *eventRetrier) deliver(d *eventDelivery) {
+	if d.delay == 0 {
+		d.delay = r.options.RetryInterval
+	}
+	d.letter.Attempts++
+	retryable, err := d.send()
+	if err == nil {
+		return
+	}
+	d.lastErr = err
+	base.WarnCtx(d.logCtx, "Error delivering %s with %s: %v", d.description, r.handler, err)
+	if retryable && d.letter.Attempts <= r.options.MaxRetries && r.scheduleRetry(d) {
+		return
+	}
+	r.saveDeadLetter(d.letter, err)
+}
+
+// Schedules the next attempt of a delivery. Returns false if the retrier has been closed.
+func (r *eventRetrier) scheduleRetry(d *eventDelivery) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.closed {
+		return false
+	}
+	delay := d.delay
+	if d.delay *= 2; d.delay > r.options.MaxRetryInterval {
+		d.delay = r.options.MaxRetryInterval
+	}
+	base.LogToCtx(d.logCtx, "Events", "Retrying delivery of %s with %s in %v", d.description, r.handler, delay)
+	if r.pending == nil {
+		r.pending = map[*eventDelivery]bool{}
+	}
+	r.pending[d] = true
+	d.timer = time.AfterFunc(delay, func() { r.retry(d) })
+	return true
+}
+
+// Called by a delivery's timer to make its next attempt, unless close has already taken it.
+func (r *eventRetrier) retry(d *eventDelivery) {
+	r.lock.Lock()
+	pending := r.pending[d]
+	delete(r.pending, d)
+	r.lock.Unlock()
+	if pending {
+		r.deliver(d)
+	}
+}
+
+// Saves the deliveries waiting to be retried as dead letters. After this, deliveries that fail
+// aren't retried.
+func (r *eventRetrier) close() {
+	r.lock.Lock()
+	r.closed = true
+	pending := r.pending
+	r.pending = nil
+	r.lock.Unlock()
+
+	for d := range pending {
+		d.timer.Stop()
+		r.saveDeadLetter(d.letter, d.lastErr)
+	}
+}
+
+// Saves a payload that couldn't be delivered, if the handler has a DeadLetterStore.
+func (r *eventRetrier) saveDeadLetter(letter DeadLetter, err error) {
+	if r.options.DeadLetters == nil {
+		return
+	}
+	letter.Handler = r.handler
+	letter.Error = err.Error()
+	if err := r.options.DeadLetters.Add(&letter); err != nil {
+		base.Warn("Error saving dead letter of %s: %v", r.handler, err)
+	}
+}
+
+// Makes one attempt to deliver a dead letter again. On success the dead letter is deleted from
+// the store; on failure its attempt count and error are updated.
+func replayDeadLetter(store *DeadLetterStore, letter *DeadLetter, send func() error) error {
+	if err := send(); err != nil {
+		letter.Attempts++
+		letter.Error = err.Error()
+		if updateErr := store.Update(letter); updateErr != nil {
+			base.Warn("Error updating dead letter %s: %v", letter.ID, updateErr)
+		}
+		return err
+	}
+	base.LogTo("Events", "Replayed dead letter %s of %s", letter.ID, letter.Handler)
+	return store.Delete(letter.ID)
+}
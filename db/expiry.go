@@ -0,0 +1,183 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
+)
+
+// A document's expiry is normally set on the document in the bucket, and the server removes the
+// document when it expires, without a trace in the _changes feed. If the ExpiryTombstones option
+// is set, the expiry is only recorded in the document's sync metadata, and the expiry_tombstones
+// maintenance job deletes expired documents by adding a tombstone revision, which replicates.
+
+// Schedule of the expiry_tombstones maintenance job, if ExpiryTombstones is set and the config
+// doesn't give one.
+const DefaultExpiryTombstonesSchedule = "* * * * *" // Every minute
+
+// A document's expiry, as reported by the admin API.
+type DocExpiry struct {
+	DocID  string     `json:"id"`
+	Expiry *time.Time `json:"expiry"` // nil if the doc doesn't expire
+}
+
+// Returns the expiry to set on a document in the bucket, given its expiry.
+func (context *DatabaseContext) bucketExpiry(expiry uint32) uint32 {
+	if context.Options.ExpiryTombstones {
+		return 0 // The expiry_tombstones job enforces the expiry instead
+	}
+	return expiry
+}
+
+// Returns a document's expiry.
+func (db *Database) GetDocExpiry(docid string) (*DocExpiry, error) {
+	doc, err := db.GetDocument(docid, DocUnmarshalSync)
+	if err != nil {
+		return nil, err
+	} else if doc.hasFlag(channels.Deleted) {
+		return nil, base.HTTPErrorf(http.StatusNotFound, "deleted")
+	}
+	return &DocExpiry{DocID: docid, Expiry: doc.Expiry}, nil
+}
+
+// Sets a document's expiry, in Couchbase Server expiry format, without creating a new revision.
+// An expiry of 0 clears it.
+func (db *Database) SetDocExpiry(docid string, expiry uint32) (*DocExpiry, error) {
+	key := realDocID(docid)
+	if key == "" {
+		return nil, base.HTTPErrorf(400, "Invalid doc ID")
+	}
+	bucketExpiry := db.bucketExpiry(expiry)
+
+	var result *DocExpiry
+	updateExpiry := func(doc *document) error {
+		if !doc.HasValidSyncData(db.writeSequences()) {
+			return base.HTTPErrorf(http.StatusNotFound, "Not imported")
+		} else if doc.hasFlag(channels.Deleted) {
+			return base.HTTPErrorf(http.StatusNotFound, "deleted")
+		}
+		doc.UpdateExpiry(expiry)
+		result = &DocExpiry{DocID: docid, Expiry: doc.Expiry}
+		return nil
+	}
+
+	var err error
+	if db.UseXattrs() {
+		_, err = db.Bucket.WriteUpdateWithXattr(key, KSyncXattrName, bucketExpiry, nil, func(currentValue []byte, currentXattr []byte, cas uint64) (
+			raw []byte, rawXattr []byte, deleteDoc bool, expiry *uint32, err error) {
+			// Be careful: this block can be invoked multiple times if there are races!
+			if len(currentValue) == 0 {
+				return nil, nil, false, nil, base.HTTPErrorf(http.StatusNotFound, "missing")
+			}
+			doc, err := unmarshalDocumentWithXattr(docid, currentValue, currentXattr, cas, DocUnmarshalAll)
+			if err != nil {
+				return nil, nil, false, nil, err
+			}
+			if err = updateExpiry(doc); err != nil {
+				return nil, nil, false, nil, err
+			}
+			raw, rawXattr, err = doc.MarshalWithXattr()
+			return raw, rawXattr, false, &bucketExpiry, err
+		})
+	} else {
+		err = db.Bucket.Update(key, bucketExpiry, func(currentValue []byte) ([]byte, *uint32, error) {
+			// Be careful: this block can be invoked multiple times if there are races!
+			if currentValue == nil {
+				return nil, nil, base.HTTPErrorf(http.StatusNotFound, "missing")
+			}
+			doc, err := unmarshalDocument(docid, currentValue)
+			if err != nil {
+				return nil, nil, err
+			}
+			if err = updateExpiry(doc); err != nil {
+				return nil, nil, err
+			}
+			raw, err := json.Marshal(doc)
+			return raw, &bucketExpiry, err
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	base.LogTo("CRUD", "Set expiry of %q to %v", docid, result.Expiry)
+	return result, nil
+}
+
+// Returns the (non-deleted) documents whose expiry is in the time range [start, end], ordered by
+// expiry. A zero start or end time leaves that end of the range open; a limit of 0 means none.
+func (db *Database) QueryExpiringDocs(start, end time.Time, limit int) ([]DocExpiry, error) {
+	opts := Body{"stale": false}
+	if !start.IsZero() {
+		opts["startkey"] = start.Unix()
+	}
+	if !end.IsZero() {
+		opts["endkey"] = end.Unix()
+	}
+	if limit > 0 {
+		opts["limit"] = limit
+	}
+	vres, err := db.Bucket.View(DesignDocSyncHousekeeping, ViewExpiry, opts)
+	if err != nil {
+		return nil, err
+	}
+	docs := make([]DocExpiry, 0, len(vres.Rows))
+	for _, row := range vres.Rows {
+		seconds, _ := base.ToInt64(row.Key)
+		expiry := time.Unix(seconds, 0)
+		docs = append(docs, DocExpiry{DocID: row.ID, Expiry: &expiry})
+	}
+	return docs, nil
+}
+
+// Deletes expired documents by adding tombstone revisions; the expiry_tombstones maintenance job.
+func (db *Database) tombstoneExpiredDocs(job *MaintenanceJob) error {
+	expired, err := db.QueryExpiringDocs(time.Time{}, time.Now(), 0)
+	if err != nil {
+		return err
+	}
+	base.Logf("Tombstoning %d expired documents in %s ...", len(expired), db.Name)
+	for _, entry := range expired {
+		if err := job.itemDone(db.tombstoneExpiredDoc(entry.DocID, job.options.DryRun)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Deletes a document if it has expired. Returns whether it was (or in a dry run, would have been)
+// deleted.
+func (db *Database) tombstoneExpiredDoc(docid string, dryRun bool) bool {
+	doc, err := db.GetDocument(docid, DocUnmarshalSync)
+	if err != nil {
+		if !base.IsDocNotFoundError(err) {
+			base.Warn("Error getting expired doc %q: %v", docid, err)
+		}
+		return false
+	}
+	// The view may be out of date, so check the doc's current expiry:
+	if doc.hasFlag(channels.Deleted) || doc.Expiry == nil || doc.Expiry.After(time.Now()) {
+		return false
+	}
+	if dryRun {
+		return true
+	}
+	base.LogTo("CRUD", "\tTombstoning expired doc %q", docid)
+	if _, err := db.DeleteDoc(docid, doc.CurrentRev); err != nil {
+		base.Warn("Error tombstoning expired doc %q: %v", docid, err)
+		return false
+	}
+	db.EventMgr.RaiseDocumentExpiryEvent(docid)
+	return true
+}
@@ -0,0 +1,98 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/couchbase/sync_gateway/channels"
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestDocExpiry(t *testing.T) {
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer tearDownTestDB(t, db)
+
+	inAnHour := time.Now().Add(time.Hour).Truncate(time.Second)
+	inADay := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+	rev1, err := db.Put("doc1", Body{"_exp": inAnHour.Format(time.RFC3339)})
+	assertNoError(t, err, "Put")
+	_, err = db.Put("doc2", Body{"key": "value"})
+	assertNoError(t, err, "Put")
+
+	expiry, err := db.GetDocExpiry("doc1")
+	assertNoError(t, err, "GetDocExpiry")
+	assert.True(t, expiry.Expiry.Equal(inAnHour))
+	expiry, err = db.GetDocExpiry("doc2")
+	assertNoError(t, err, "GetDocExpiry")
+	assert.True(t, expiry.Expiry == nil)
+	_, err = db.GetDocExpiry("nosuchdoc")
+	assertHTTPError(t, err, http.StatusNotFound)
+
+	// Setting the expiry doesn't create a new revision:
+	expiry, err = db.SetDocExpiry("doc2", uint32(inADay.Unix()))
+	assertNoError(t, err, "SetDocExpiry")
+	assert.True(t, expiry.Expiry.Equal(inADay))
+	_, err = db.SetDocExpiry("nosuchdoc", uint32(inADay.Unix()))
+	assertHTTPError(t, err, http.StatusNotFound)
+
+	docs, err := db.QueryExpiringDocs(time.Time{}, time.Time{}, 0)
+	assertNoError(t, err, "QueryExpiringDocs")
+	assert.Equals(t, len(docs), 2)
+	assert.Equals(t, docs[0].DocID, "doc1")
+	assert.Equals(t, docs[1].DocID, "doc2")
+	docs, err = db.QueryExpiringDocs(time.Now(), inAnHour.Add(time.Minute), 0)
+	assertNoError(t, err, "QueryExpiringDocs")
+	assert.Equals(t, len(docs), 1)
+	assert.Equals(t, docs[0].DocID, "doc1")
+	assert.True(t, docs[0].Expiry.Equal(inAnHour))
+
+	expiry, err = db.SetDocExpiry("doc1", 0)
+	assertNoError(t, err, "SetDocExpiry")
+	assert.True(t, expiry.Expiry == nil)
+	doc, err := db.GetDocument("doc1", DocUnmarshalAll)
+	assertNoError(t, err, "GetDocument")
+	assert.Equals(t, doc.CurrentRev, rev1)
+	docs, err = db.QueryExpiringDocs(time.Time{}, time.Time{}, 0)
+	assertNoError(t, err, "QueryExpiringDocs")
+	assert.Equals(t, len(docs), 1)
+}
+
+func TestExpiryTombstones(t *testing.T) {
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer tearDownTestDB(t, db)
+	db.Options.ExpiryTombstones = true
+
+	_, err := db.Put("expired", Body{"_exp": time.Now().Add(time.Hour).Format(time.RFC3339)})
+	assertNoError(t, err, "Put")
+	_, err = db.Put("later", Body{"_exp": time.Now().Add(time.Hour).Format(time.RFC3339)})
+	assertNoError(t, err, "Put")
+	_, err = db.SetDocExpiry("expired", uint32(time.Now().Add(-time.Minute).Unix()))
+	assertNoError(t, err, "SetDocExpiry")
+
+	status := runTestMaintenanceJob(t, db, MaintenanceExpiryTombstones, true)
+	assert.Equals(t, status.Purged, 1)
+	status = runTestMaintenanceJob(t, db, MaintenanceExpiryTombstones, false)
+	assert.Equals(t, status.Purged, 1)
+
+	// The expired doc was deleted by a new revision, which replicates:
+	doc, err := db.GetDocument("expired", DocUnmarshalAll)
+	assertNoError(t, err, "GetDocument")
+	assert.True(t, doc.hasFlag(channels.Deleted))
+	assert.Equals(t, doc.History[doc.CurrentRev].Deleted, true)
+	assert.True(t, doc.Expiry == nil)
+	doc, err = db.GetDocument("later", DocUnmarshalAll)
+	assertNoError(t, err, "GetDocument")
+	assert.False(t, doc.hasFlag(channels.Deleted))
+}
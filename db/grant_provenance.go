@@ -0,0 +1,220 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"fmt"
+
+	sgbucket "github.com/couchbase/sg-bucket"
+	"github.com/couchbase/sync_gateway/auth"
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
+	pkgerrors "github.com/pkg/errors"
+)
+
+// The most grants recorded on a principal, for its channels or its roles. A principal with more
+// doesn't record them, to keep its doc small; its provenance is computed when it's requested.
+var maxRecordedGrants = 1000
+
+// Computes where a User/Role's channels came from, if the database records grant provenance.
+// This is part of the ProvenanceComputer interface defined by the Authenticator.
+func (context *DatabaseContext) ComputeChannelProvenanceForPrincipal(princ auth.Principal) (auth.GrantProvenance, error) {
+	if !context.Options.GrantProvenance {
+		return nil, nil
+	}
+	provenance, err := context.channelProvenance(princ)
+	if err != nil {
+		return nil, err
+	}
+	return recordableProvenance(princ.Name(), "channels", provenance), nil
+}
+
+// Computes where a User's roles came from, if the database records grant provenance.
+// This is part of the ProvenanceComputer interface defined by the Authenticator.
+func (context *DatabaseContext) ComputeRoleProvenanceForUser(user auth.User) (auth.GrantProvenance, error) {
+	if !context.Options.GrantProvenance {
+		return nil, nil
+	}
+	provenance, err := context.roleProvenance(user)
+	if err != nil {
+		return nil, err
+	}
+	return recordableProvenance(user.Name(), "roles", provenance), nil
+}
+
+// Returns the provenance to record on a principal, or nil if it has too many grants.
+func recordableProvenance(name string, what string, provenance auth.GrantProvenance) auth.GrantProvenance {
+	if n := provenance.Len(); n > maxRecordedGrants {
+		base.LogTo("Access", "Not recording provenance of %d grants of %s to %q (limit is %d)", n, what, name, maxRecordedGrants)
+		return nil
+	}
+	return provenance
+}
+
+// Returns where a principal's channels came from, including for a user those inherited from its
+// roles, and for a user where its roles came from (else nil.) The provenance recorded on the
+// principals is used if there is any, else it's computed.
+func (context *DatabaseContext) GrantProvenance(princ auth.Principal) (channelProvenance auth.GrantProvenance, roleProvenance auth.GrantProvenance, err error) {
+	if channelProvenance, err = context.ownChannelProvenance(princ); err != nil {
+		return nil, nil, err
+	}
+	user, ok := princ.(auth.User)
+	if !ok {
+		return channelProvenance, nil, nil
+	}
+
+	if roleProvenance = user.RoleProvenance(); roleProvenance == nil {
+		if roleProvenance, err = context.roleProvenance(user); err != nil {
+			return nil, nil, err
+		}
+	}
+	authenticator := context.Authenticator()
+	for roleName := range user.RoleNames() {
+		role, err := authenticator.GetRole(roleName)
+		if err != nil {
+			return nil, nil, err
+		} else if role == nil {
+			continue // Granted, but the role doesn't exist
+		}
+		inherited, err := context.ownChannelProvenance(role)
+		if err != nil {
+			return nil, nil, err
+		}
+		channelProvenance.AddFromRole(inherited, roleName)
+	}
+	channelProvenance.Sort()
+	return channelProvenance, roleProvenance, nil
+}
+
+// Returns where a principal's own channels came from, recorded or computed.
+func (context *DatabaseContext) ownChannelProvenance(princ auth.Principal) (auth.GrantProvenance, error) {
+	if provenance := princ.ChannelProvenance(); provenance != nil {
+		// Copy it, since inherited grants may be added to it
+		result := auth.GrantProvenance{}
+		result.AddFromRole(provenance, "")
+		return result, nil
+	}
+	return context.channelProvenance(princ)
+}
+
+func (context *DatabaseContext) channelProvenance(princ auth.Principal) (auth.GrantProvenance, error) {
+	key := princ.Name()
+	if _, ok := princ.(auth.User); !ok {
+		key = channels.RoleAccessPrefix + key // Roles are identified in access view by a "role:" prefix
+	}
+	provenance, err := context.syncFnGrantProvenance(ViewAccessProvenance, context.accessViewName(), key)
+	if err != nil {
+		return nil, err
+	}
+	for channel, seq := range princ.ExplicitChannels() {
+		provenance.Add(channel, auth.Grant{Source: auth.GrantSourceExplicit, Sequence: seq.Sequence})
+	}
+	provenance.Add(channels.DocumentStarChannel, auth.Grant{Source: auth.GrantSourcePublic, Sequence: 1})
+	provenance.Sort()
+	return provenance, nil
+}
+
+func (context *DatabaseContext) roleProvenance(user auth.User) (auth.GrantProvenance, error) {
+	provenance, err := context.syncFnGrantProvenance(ViewRoleAccessProvenance, context.roleAccessViewName(), user.Name())
+	if err != nil {
+		return nil, err
+	}
+	for role, seq := range user.ExplicitRoles() {
+		provenance.Add(role, auth.Grant{Source: auth.GrantSourceExplicit, Sequence: seq.Sequence})
+	}
+	provenance.Sort()
+	return provenance, nil
+}
+
+// Returns the grants made to a principal by sync functions. If the database records grant
+// provenance they come from the access_provenance or role_access_provenance view, with the
+// revision of each granting doc that was current when the view indexed it; that isn't
+// necessarily the revision whose sync function made the grant. Otherwise they come from the
+// access or role_access view, without revisions.
+func (context *DatabaseContext) syncFnGrantProvenance(provenanceViewName string, accessViewName string, key string) (auth.GrantProvenance, error) {
+	provenance := auth.GrantProvenance{}
+	if !context.Options.GrantProvenance {
+		rows, err := context.queryAccessView(accessViewName, key)
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			for name, seq := range row.Value {
+				provenance.Add(name, auth.Grant{Source: auth.GrantSourceSync, DocID: row.ID, Sequence: seq.Sequence})
+			}
+		}
+		return provenance, nil
+	}
+
+	var vres struct {
+		Rows []struct {
+			ID    string
+			Value struct {
+				Rev    string
+				Grants channels.TimedSet
+			}
+		}
+	}
+	opts := map[string]interface{}{"stale": false, "key": key}
+	if err := context.Bucket.ViewCustom(DesignDocSyncProvenance, provenanceViewName, opts, &vres); err != nil {
+		return nil, err
+	}
+	for _, row := range vres.Rows {
+		for name, seq := range row.Value.Grants {
+			provenance.Add(name, auth.Grant{Source: auth.GrantSourceSync, DocID: row.ID, RevID: row.Value.Rev, Sequence: seq.Sequence})
+		}
+	}
+	return provenance, nil
+}
+
+// Installs the views of grant provenance, in their own design doc so that databases that don't
+// record provenance don't pay to index them.
+func installGrantProvenanceViews(bucket base.Bucket) error {
+	// Views on sync.access and sync.role_access, used by syncFnGrantProvenance.
+	// Key is principal name; value is {rev: the doc's current revision, grants: name->firstSequence}
+	provenance_map := `function (doc, meta) {
+	                    %s
+	                    if (sync === undefined || meta.id.substring(0,6) == "_sync:")
+	                        return;
+	                    var access = sync.%s;
+	                    if (access) {
+	                        for (var name in access) {
+	                            emit(name, {rev: sync.rev, grants: access[name]});
+	                        }
+	                    }
+	               }`
+	syncData := syncDataViewScript()
+	designDoc := sgbucket.DesignDoc{
+		Views: sgbucket.ViewMap{
+			ViewAccessProvenance:     sgbucket.ViewDef{Map: fmt.Sprintf(provenance_map, syncData, "access")},
+			ViewRoleAccessProvenance: sgbucket.ViewDef{Map: fmt.Sprintf(provenance_map, syncData, "role_access")},
+		},
+		Options: &sgbucket.DesignDocOptions{
+			IndexXattrOnTombstones: true,
+		},
+	}
+
+	sleeper := base.CreateDoublingSleeperFunc(
+		11, //MaxNumRetries approx 10 seconds total retry duration
+		5,  //InitialRetrySleepTimeMS
+	)
+	worker := func() (shouldRetry bool, err error, value interface{}) {
+		err = bucket.PutDDoc(DesignDocSyncProvenance, designDoc)
+		if err != nil {
+			base.Warn("Error installing Couchbase design doc: %v", err)
+		}
+		return err != nil, err, nil
+	}
+	description := fmt.Sprintf("Attempt to install Couchbase design doc bucket : %v", DesignDocSyncProvenance)
+	if err, _ := base.RetryLoop(description, worker, sleeper); err != nil {
+		return pkgerrors.Wrapf(err, "Error installing Couchbase Design doc: %v", DesignDocSyncProvenance)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"testing"
+
+	"github.com/couchbase/sync_gateway/auth"
+	"github.com/couchbase/sync_gateway/channels"
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestGrantProvenance(t *testing.T) {
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer tearDownTestDB(t, db)
+
+	db.ChannelMapper = channels.NewChannelMapper(`function(doc) {
+		if (doc.users) access(doc.users, doc.userChannels);
+		if (doc.roleUsers) role(doc.roleUsers, doc.roles);
+	}`)
+
+	authenticator := auth.NewAuthenticator(db.Bucket, db)
+	user, _ := authenticator.NewUser("naomi", "letmein", channels.SetOf("Netflix"))
+	assertNoError(t, authenticator.Save(user), "Save user")
+	role, _ := authenticator.NewRole("animefan", nil)
+	assertNoError(t, authenticator.Save(role), "Save role")
+
+	huluRev, err := db.Put("grant-hulu", Body{"users": []string{"naomi"}, "userChannels": []string{"Hulu"}})
+	assertNoError(t, err, "Put grant-hulu")
+	roleRev, err := db.Put("grant-role", Body{"roleUsers": []string{"naomi"}, "roles": []string{"role:animefan"}})
+	assertNoError(t, err, "Put grant-role")
+	_, err = db.Put("grant-anime", Body{"users": []string{"role:animefan"}, "userChannels": []string{"CrunchyRoll"}})
+	assertNoError(t, err, "Put grant-anime")
+
+	// Not recorded by default, but computed on request, without revisions:
+	user, err = authenticator.GetUser("naomi")
+	assertNoError(t, err, "GetUser")
+	assert.True(t, user.ChannelProvenance() == nil)
+	assert.True(t, user.RoleProvenance() == nil)
+
+	channelProvenance, roleProvenance, err := db.GrantProvenance(user)
+	assertNoError(t, err, "GrantProvenance")
+	assert.Equals(t, len(channelProvenance["Hulu"]), 1)
+	assert.Equals(t, channelProvenance["Hulu"][0].Source, auth.GrantSourceSync)
+	assert.Equals(t, channelProvenance["Hulu"][0].DocID, "grant-hulu")
+	assert.Equals(t, channelProvenance["Hulu"][0].RevID, "")
+	assert.Equals(t, channelProvenance["Netflix"][0].Source, auth.GrantSourceExplicit)
+	assert.Equals(t, channelProvenance["!"][0].Source, auth.GrantSourcePublic)
+	assert.Equals(t, channelProvenance["CrunchyRoll"][0].Role, "animefan")
+	assert.Equals(t, channelProvenance["CrunchyRoll"][0].DocID, "grant-anime")
+	assert.Equals(t, len(roleProvenance["animefan"]), 1)
+	assert.Equals(t, roleProvenance["animefan"][0].DocID, "grant-role")
+	assert.Equals(t, roleProvenance["animefan"][0].RevID, "")
+
+	// Recorded on the principals when enabled, with the granting docs' current revisions:
+	db.Options.GrantProvenance = true
+	assertNoError(t, installGrantProvenanceViews(db.Bucket), "installGrantProvenanceViews")
+	assertNoError(t, authenticator.InvalidateChannels(user), "InvalidateChannels")
+	assertNoError(t, authenticator.InvalidateRoles(user), "InvalidateRoles")
+	user, err = authenticator.GetUser("naomi")
+	assertNoError(t, err, "GetUser")
+	assert.Equals(t, user.ChannelProvenance()["Hulu"][0].DocID, "grant-hulu")
+	assert.Equals(t, user.ChannelProvenance()["Hulu"][0].RevID, huluRev)
+	assert.Equals(t, user.ChannelProvenance()["Netflix"][0].Source, auth.GrantSourceExplicit)
+	assert.True(t, user.ChannelProvenance()["CrunchyRoll"] == nil) // Inherited grants are recorded on the role
+	assert.Equals(t, user.RoleProvenance()["animefan"][0].DocID, "grant-role")
+	assert.Equals(t, user.RoleProvenance()["animefan"][0].RevID, roleRev)
+
+	// A new grant invalidates the user's channels, so the provenance is recomputed:
+	_, err = db.Put("grant-hbo", Body{"users": []string{"naomi"}, "userChannels": []string{"HBO", "Hulu"}})
+	assertNoError(t, err, "Put grant-hbo")
+	user, err = authenticator.GetUser("naomi")
+	assertNoError(t, err, "GetUser")
+	assert.Equals(t, user.ChannelProvenance()["HBO"][0].DocID, "grant-hbo")
+	assert.Equals(t, len(user.ChannelProvenance()["Hulu"]), 2)
+
+	channelProvenance, _, err = db.GrantProvenance(user)
+	assertNoError(t, err, "GrantProvenance")
+	assert.Equals(t, channelProvenance["CrunchyRoll"][0].Role, "animefan")
+	assert.Equals(t, len(channelProvenance["Hulu"]), 2)
+
+	// Too many grants to record, so they're computed on request:
+	defer func(max int) { maxRecordedGrants = max }(maxRecordedGrants)
+	maxRecordedGrants = 3
+	assertNoError(t, authenticator.InvalidateChannels(user), "InvalidateChannels")
+	user, err = authenticator.GetUser("naomi")
+	assertNoError(t, err, "GetUser")
+	assert.True(t, user.ChannelProvenance() == nil)
+	assert.Equals(t, user.RoleProvenance()["animefan"][0].DocID, "grant-role")
+
+	channelProvenance, _, err = db.GrantProvenance(user)
+	assertNoError(t, err, "GrantProvenance")
+	assert.Equals(t, channelProvenance["HBO"][0].DocID, "grant-hbo")
+	assert.Equals(t, len(channelProvenance["Hulu"]), 2)
+}
@@ -164,8 +164,8 @@ func (db *Database) importDoc(docid string, body Body, isDelete bool, existingDo
 		}
 
 		// If there's a filter function defined, evaluate to determine whether we should import this doc
-		if db.DatabaseContext.Options.ImportOptions.ImportFilter != nil {
-			shouldImport, err := db.DatabaseContext.Options.ImportOptions.ImportFilter.EvaluateFunction(body)
+		if importFilter := db.importFilterFor(docid, body); importFilter != nil {
+			shouldImport, err := importFilter.EvaluateFunction(body)
 			if err != nil {
 				base.LogTo("Import+", "Error returned for doc %s while evaluating import function - will not be imported.", docid)
 				return nil, nil, updatedExpiry, base.ErrImportCancelledFilter
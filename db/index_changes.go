@@ -56,6 +56,7 @@ func (db *Database) VectorMultiChangesFeed(chans base.Set, options ChangesOption
 		} else {
 			channelsSince = channels.AtSequence(chans, 0)
 		}
+		channelsSince = restrictToNamespace(channelsSince, options.Namespace)
 
 		if options.Wait {
 			options.Wait = false
@@ -154,6 +155,12 @@ func (db *Database) VectorMultiChangesFeed(chans base.Set, options ChangesOption
 					continue
 				}
 
+				// Skip docs that don't pass the filter (if any), after noting their sequence:
+				if options.Filter != nil && !db.changeEntryPassesFilter(minEntry, options.Filter) {
+					cumulativeClock.SetMaxSequence(minEntry.Seq.vbNo, minEntry.Seq.Seq)
+					continue
+				}
+
 				// Add the doc body or the conflicting rev IDs, if those options are set:
 				if options.IncludeDocs || options.Conflicts {
 					db.addDocToChangeEntry(minEntry, options)
@@ -259,6 +266,7 @@ func (db *Database) VectorMultiChangesFeed(chans base.Set, options ChangesOption
 			userChanged, userCounter, addedChannels, err = db.checkForUserUpdatesSince(userCounter, changeWaiter, options.Continuous, channelsSince, options.Since.Clock)
 			if userChanged && db.user != nil {
 				channelsSince, secondaryTriggers = db.user.FilterToAvailableChannelsForSince(chans, getChangesClock(options.Since))
+				channelsSince = restrictToNamespace(channelsSince, options.Namespace)
 			}
 			if err != nil {
 				change := makeErrorEntry("User not found during reload - terminating changes feed")
@@ -0,0 +1,660 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	sgbucket "github.com/couchbase/sg-bucket"
+	"github.com/couchbase/sync_gateway/auth"
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Background maintenance jobs purge data the database no longer needs. They run on demand, via
+// the admin API, or on a cron-like schedule given in the config. A job works through its items
+// in batches, optionally pausing between batches to limit its load on the bucket, and can be
+// paused, resumed or cancelled while it runs. In a dry run it only counts what it would purge.
+type MaintenanceJobType string
+
+const (
+	MaintenanceTombstonePurge   = MaintenanceJobType("tombstone_purge")         // Tombstones older than the metadata purge interval
+	MaintenanceRevBackupCleanup = MaintenanceJobType("revision_backup_cleanup") // Revision backups no document needs
+	MaintenanceSessionCleanup   = MaintenanceJobType("session_cleanup")         // Expired sessions, and those of deleted users
+	MaintenanceAttachmentVacuum = MaintenanceJobType("attachment_vacuum")       // Attachments no revision uses
+	MaintenanceExpiryTombstones = MaintenanceJobType("expiry_tombstones")       // Expired documents, which are tombstoned
+)
+
+// All the types of maintenance job, in the order they're listed by the admin API.
+var MaintenanceJobTypes = []MaintenanceJobType{MaintenanceTombstonePurge, MaintenanceRevBackupCleanup,
+	MaintenanceSessionCleanup, MaintenanceAttachmentVacuum, MaintenanceExpiryTombstones}
+
+// The functions that do the work of each type of job.
+var maintenanceJobFuncs = map[MaintenanceJobType]func(*Database, *MaintenanceJob) error{
+	MaintenanceTombstonePurge:   (*Database).purgeTombstones,
+	MaintenanceRevBackupCleanup: (*Database).cleanUpRevisionBackups,
+	MaintenanceSessionCleanup:   (*Database).cleanUpSessions,
+	MaintenanceAttachmentVacuum: (*Database).vacuumAttachments,
+	MaintenanceExpiryTombstones: (*Database).tombstoneExpiredDocs,
+}
+
+// Is this the name of a maintenance job type?
+func IsValidMaintenanceJobType(name string) bool {
+	return maintenanceJobFuncs[MaintenanceJobType(name)] != nil
+}
+
+type MaintenanceJobState string
+
+const (
+	MaintenanceIdle      = MaintenanceJobState("idle") // Hasn't run since the database was opened
+	MaintenanceRunning   = MaintenanceJobState("running")
+	MaintenancePaused    = MaintenanceJobState("paused")
+	MaintenanceCompleted = MaintenanceJobState("completed")
+	MaintenanceCancelled = MaintenanceJobState("cancelled")
+	MaintenanceFailed    = MaintenanceJobState("failed")
+)
+
+// Number of items a job processes between pauses, if its options don't say.
+const DefaultMaintenanceBatchSize = 500
+
+type MaintenanceJobOptions struct {
+	DryRun     bool          // Only count the items that would be purged
+	BatchSize  int           // Items processed between BatchDelays; defaults to DefaultMaintenanceBatchSize
+	BatchDelay time.Duration // Pause between batches, to throttle the job
+}
+
+// Runs a type of maintenance job on a schedule.
+type MaintenanceSchedule struct {
+	Schedule *base.CronSchedule
+	Options  MaintenanceJobOptions
+}
+
+type MaintenanceOptions struct {
+	Schedules map[MaintenanceJobType]*MaintenanceSchedule // Schedules of the jobs to run automatically
+}
+
+// The status of a maintenance job, as reported by the admin API and /_active_tasks.
+type MaintenanceJobStatus struct {
+	TaskType  string              `json:"type"` // Always "maintenance"
+	Database  string              `json:"database"`
+	Job       MaintenanceJobType  `json:"job"`
+	State     MaintenanceJobState `json:"state"`
+	Scheduled bool                `json:"scheduled,omitempty"` // Started by the schedule, not the admin API
+	DryRun    bool                `json:"dry_run,omitempty"`
+	BatchSize int                 `json:"batch_size,omitempty"`
+	StartTime *time.Time          `json:"start_time,omitempty"`
+	EndTime   *time.Time          `json:"end_time,omitempty"`
+	Processed int                 `json:"processed"` // Items examined so far
+	Purged    int                 `json:"purged"`    // Items purged so far (or that would be, in a dry run)
+	Error     string              `json:"error,omitempty"`
+	NextRun   *time.Time          `json:"next_run,omitempty"` // Next scheduled run, if the job has a schedule
+}
+
+// Returned by MaintenanceJob.itemDone when the job's been cancelled.
+var errMaintenanceCancelled = errors.New("Maintenance job cancelled")
+
+// A single run of a maintenance job.
+type MaintenanceJob struct {
+	options   MaintenanceJobOptions
+	lock      sync.Mutex
+	status    MaintenanceJobStatus
+	steps     int // Units of work done, counted towards batches; see step
+	cancelled bool
+	resumed   *sync.Cond    // Signalled when the job is resumed or cancelled
+	done      chan struct{} // Closed when the job finishes
+	err       error         // The error the job failed with
+}
+
+func newMaintenanceJob(dbName string, jobType MaintenanceJobType, options MaintenanceJobOptions, scheduled bool) *MaintenanceJob {
+	if options.BatchSize <= 0 {
+		options.BatchSize = DefaultMaintenanceBatchSize
+	}
+	now := time.Now()
+	job := &MaintenanceJob{
+		options: options,
+		status: MaintenanceJobStatus{
+			TaskType:  "maintenance",
+			Database:  dbName,
+			Job:       jobType,
+			State:     MaintenanceRunning,
+			Scheduled: scheduled,
+			DryRun:    options.DryRun,
+			BatchSize: options.BatchSize,
+			StartTime: &now,
+		},
+	}
+	job.resumed = sync.NewCond(&job.lock)
+	job.done = make(chan struct{})
+	return job
+}
+
+// Returns a snapshot of the job's status.
+func (job *MaintenanceJob) Status() MaintenanceJobStatus {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	return job.status
+}
+
+func (job *MaintenanceJob) isActive() bool {
+	state := job.Status().State
+	return state == MaintenanceRunning || state == MaintenancePaused
+}
+
+// Pauses a running job; it stops before its next item.
+func (job *MaintenanceJob) Pause() error {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	if job.status.State != MaintenanceRunning || job.cancelled {
+		return base.HTTPErrorf(http.StatusConflict, "The %s job isn't running", job.status.Job)
+	}
+	job.status.State = MaintenancePaused
+	return nil
+}
+
+// Resumes a paused job.
+func (job *MaintenanceJob) Resume() error {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	if job.status.State != MaintenancePaused || job.cancelled {
+		return base.HTTPErrorf(http.StatusConflict, "The %s job isn't paused", job.status.Job)
+	}
+	job.status.State = MaintenanceRunning
+	job.resumed.Broadcast()
+	return nil
+}
+
+// Cancels a running or paused job; it stops before its next item.
+func (job *MaintenanceJob) Cancel() error {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	if (job.status.State != MaintenanceRunning && job.status.State != MaintenancePaused) || job.cancelled {
+		return base.HTTPErrorf(http.StatusConflict, "The %s job isn't running", job.status.Job)
+	}
+	job.cancelled = true
+	job.resumed.Broadcast()
+	return nil
+}
+
+// Runs the job to completion, cancellation or failure, and records the outcome.
+func (job *MaintenanceJob) run(db *Database) error {
+	jobType := job.status.Job
+	base.Logf("Starting %s maintenance job on %s (dry run: %v)", jobType, db.Name, job.options.DryRun)
+
+	err := job.checkpoint()
+	if err == nil {
+		err = maintenanceJobFuncs[jobType](db, job)
+	}
+
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	defer close(job.done)
+	now := time.Now()
+	job.status.EndTime = &now
+	if err == errMaintenanceCancelled {
+		job.status.State = MaintenanceCancelled
+		err = nil
+	} else if err != nil {
+		job.status.State = MaintenanceFailed
+		job.status.Error = err.Error()
+		base.Warn("%s maintenance job on %s failed: %v", jobType, db.Name, err)
+	} else {
+		job.status.State = MaintenanceCompleted
+	}
+	base.Logf("%s maintenance job on %s %s: examined %d, purged %d", jobType, db.Name,
+		job.status.State, job.status.Processed, job.status.Purged)
+	job.err = err
+	return err
+}
+
+// Waits for the job to finish, returning the error it failed with, if any.
+func (job *MaintenanceJob) Wait() error {
+	<-job.done
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	return job.err
+}
+
+// Records that an item has been examined, and whether it was (or in a dry run, would have been)
+// purged; then calls step.
+func (job *MaintenanceJob) itemDone(purged bool) error {
+	job.lock.Lock()
+	job.status.Processed++
+	if purged {
+		job.status.Purged++
+	}
+	job.lock.Unlock()
+	return job.step()
+}
+
+// Records a unit of work that isn't an item to purge, like reading a document to find what it
+// refers to. Pauses for the BatchDelay at the end of each batch. Blocks while the job is paused,
+// and returns errMaintenanceCancelled if it's been cancelled; the job should return that error.
+func (job *MaintenanceJob) step() error {
+	job.lock.Lock()
+	job.steps++
+	endOfBatch := job.steps%job.options.BatchSize == 0
+	job.lock.Unlock()
+
+	if endOfBatch && job.options.BatchDelay > 0 {
+		time.Sleep(job.options.BatchDelay)
+	}
+	return job.checkpoint()
+}
+
+// Blocks while the job is paused, and returns errMaintenanceCancelled if it's been cancelled.
+func (job *MaintenanceJob) checkpoint() error {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	for job.status.State == MaintenancePaused && !job.cancelled {
+		job.resumed.Wait()
+	}
+	if job.cancelled {
+		return errMaintenanceCancelled
+	}
+	return nil
+}
+
+// Deletes a doc from the bucket, unless this is a dry run. Returns whether the doc was (or would
+// have been) deleted.
+func (job *MaintenanceJob) deleteDoc(bucket base.Bucket, key string) bool {
+	if job.options.DryRun {
+		return true
+	}
+	base.LogTo("CRUD", "\tDeleting %q", key)
+	if err := bucket.Delete(key); err != nil && !base.IsDocNotFoundError(err) {
+		base.Warn("Error deleting %q: %v", key, err)
+		return false
+	}
+	return true
+}
+
+//////// MAINTENANCE MANAGER:
+
+// Starts a database's maintenance jobs, on demand or on schedule, and keeps track of them.
+type MaintenanceManager struct {
+	context   *DatabaseContext
+	schedules map[MaintenanceJobType]*MaintenanceSchedule
+	lock      sync.Mutex
+	jobs      map[MaintenanceJobType]*MaintenanceJob // The latest job of each type
+	nextRuns  map[MaintenanceJobType]time.Time       // When each scheduled job will next start
+	running   sync.WaitGroup                         // Jobs that haven't finished yet
+	stop      chan struct{}                          // Closed by Stop
+}
+
+func newMaintenanceManager(context *DatabaseContext, options *MaintenanceOptions) *MaintenanceManager {
+	m := &MaintenanceManager{
+		context:  context,
+		jobs:     map[MaintenanceJobType]*MaintenanceJob{},
+		nextRuns: map[MaintenanceJobType]time.Time{},
+		stop:     make(chan struct{}),
+	}
+	if options != nil {
+		m.schedules = options.Schedules
+		for jobType, schedule := range m.schedules {
+			go m.runSchedule(jobType, schedule)
+		}
+	}
+	return m
+}
+
+// Starts a job, unless one of the same type is already running. The job runs in the background.
+func (m *MaintenanceManager) Start(jobType MaintenanceJobType, options MaintenanceJobOptions, scheduled bool) (*MaintenanceJob, error) {
+	if maintenanceJobFuncs[jobType] == nil {
+		return nil, base.HTTPErrorf(http.StatusNotFound, "Unknown maintenance job %q", jobType)
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	select {
+	case <-m.stop:
+		return nil, base.HTTPErrorf(http.StatusServiceUnavailable, "Database is closing")
+	default:
+	}
+	if job := m.jobs[jobType]; job != nil && job.isActive() {
+		return nil, base.HTTPErrorf(http.StatusConflict, "The %s job is already running", jobType)
+	}
+
+	job := newMaintenanceJob(m.context.Name, jobType, options, scheduled)
+	m.jobs[jobType] = job
+	m.running.Add(1)
+	go func() {
+		defer m.running.Done()
+		job.run(&Database{DatabaseContext: m.context})
+	}()
+	return job, nil
+}
+
+// Starts a job, like Start, and waits for it to finish. Returns the number of items it purged.
+func (m *MaintenanceManager) Run(jobType MaintenanceJobType, options MaintenanceJobOptions) (int, error) {
+	job, err := m.Start(jobType, options, false)
+	if err != nil {
+		return 0, err
+	}
+	err = job.Wait()
+	return job.Status().Purged, err
+}
+
+// Returns the latest job of a type, or nil if there hasn't been one.
+func (m *MaintenanceManager) Job(jobType MaintenanceJobType) (*MaintenanceJob, error) {
+	if maintenanceJobFuncs[jobType] == nil {
+		return nil, base.HTTPErrorf(http.StatusNotFound, "Unknown maintenance job %q", jobType)
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.jobs[jobType], nil
+}
+
+// Returns the job of a type that's running or paused, or a 409 error if there isn't one.
+func (m *MaintenanceManager) ActiveJob(jobType MaintenanceJobType) (*MaintenanceJob, error) {
+	job, err := m.Job(jobType)
+	if err != nil {
+		return nil, err
+	} else if job == nil || !job.isActive() {
+		return nil, base.HTTPErrorf(http.StatusConflict, "The %s job isn't running", jobType)
+	}
+	return job, nil
+}
+
+// Returns the status of the latest job of a type, or an idle status if there hasn't been one.
+func (m *MaintenanceManager) Status(jobType MaintenanceJobType) (MaintenanceJobStatus, error) {
+	job, err := m.Job(jobType)
+	if err != nil {
+		return MaintenanceJobStatus{}, err
+	}
+	var status MaintenanceJobStatus
+	if job != nil {
+		status = job.Status()
+	} else {
+		status = MaintenanceJobStatus{TaskType: "maintenance", Database: m.context.Name, Job: jobType, State: MaintenanceIdle}
+	}
+	m.lock.Lock()
+	if next, found := m.nextRuns[jobType]; found {
+		status.NextRun = &next
+	}
+	m.lock.Unlock()
+	return status, nil
+}
+
+// Returns the status of every type of job.
+func (m *MaintenanceManager) AllStatus() []MaintenanceJobStatus {
+	statuses := make([]MaintenanceJobStatus, 0, len(MaintenanceJobTypes))
+	for _, jobType := range MaintenanceJobTypes {
+		status, _ := m.Status(jobType)
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// Returns the status of the jobs that are running or paused.
+func (m *MaintenanceManager) ActiveTasks() []MaintenanceJobStatus {
+	var tasks []MaintenanceJobStatus
+	for _, status := range m.AllStatus() {
+		if status.State == MaintenanceRunning || status.State == MaintenancePaused {
+			tasks = append(tasks, status)
+		}
+	}
+	return tasks
+}
+
+// Stops the schedules, cancels any running jobs, and waits for them to finish. Mustn't be called
+// with the database's BucketLock held, since the jobs may need it to get to their next item.
+func (m *MaintenanceManager) Stop() {
+	m.lock.Lock()
+	select {
+	case <-m.stop:
+		m.lock.Unlock()
+		return
+	default:
+		close(m.stop)
+	}
+	for _, job := range m.jobs {
+		job.Cancel()
+	}
+	m.lock.Unlock()
+	m.running.Wait()
+}
+
+func (m *MaintenanceManager) runSchedule(jobType MaintenanceJobType, schedule *MaintenanceSchedule) {
+	for {
+		next := schedule.Schedule.Next(time.Now())
+		if next.IsZero() {
+			base.Warn("Schedule %q of the %s job on %s never runs", schedule.Schedule, jobType, m.context.Name)
+			return
+		}
+		m.lock.Lock()
+		m.nextRuns[jobType] = next
+		m.lock.Unlock()
+
+		timer := time.NewTimer(next.Sub(time.Now()))
+		select {
+		case <-timer.C:
+			if atomic.LoadUint32(&m.context.State) != DBOnline {
+				base.LogTo("CRUD", "Skipping scheduled %s job: database %s isn't online", jobType, m.context.Name)
+			} else if _, err := m.Start(jobType, schedule.Options, true); err != nil {
+				base.Warn("Couldn't start scheduled %s job on %s: %v", jobType, m.context.Name, err)
+			}
+		case <-m.stop:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+//////// JOBS:
+
+// Purges tombstones older than the metadata purge interval; see Compact.
+func (db *Database) purgeTombstones(job *MaintenanceJob) error {
+	// Compact should be a no-op if not running w/ xattrs
+	if !db.UseXattrs() {
+		return nil
+	}
+
+	// Trigger view compaction for all tombstoned documents older than the purge interval
+	opts := Body{}
+	opts["stale"] = "ok"
+	opts["startkey"] = 1
+	purgeIntervalDuration := time.Duration(-db.PurgeInterval) * time.Hour
+	opts["endkey"] = time.Now().Add(purgeIntervalDuration).Unix()
+	vres, err := db.Bucket.View(DesignDocSyncHousekeeping, ViewTombstones, opts)
+	if err != nil {
+		base.Warn("Tombstones view returned error during compact: %v", err)
+		return err
+	}
+
+	base.Logf("Compacting %d purged tombstones from view for %s ...", len(vres.Rows), db.Name)
+	for _, row := range vres.Rows {
+		purged := job.options.DryRun
+		if !purged {
+			purged = db.purgeTombstone(row.ID)
+		}
+		if err := job.itemDone(purged); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *Database) purgeTombstone(docID string) bool {
+	base.LogTo("CRUD", "\tDeleting %q", docID)
+	// First, attempt to purge.
+	purgeErr := db.Purge(docID)
+	if purgeErr == nil {
+		return true
+	} else if !base.IsKeyNotFoundError(db.Bucket, purgeErr) {
+		base.Warn("Error compacting key %s (purge) - tombstone will not be compacted.  %v", docID, purgeErr)
+		return false
+	}
+	// If key no longer exists, need to add and remove to trigger removal from view
+	if _, addErr := db.Bucket.Add(docID, 0, Body{"_purged": true}); addErr != nil {
+		base.Warn("Error compacting key %s (add) - tombstone will not be compacted.  %v", docID, addErr)
+		return false
+	}
+	if delErr := db.Bucket.Delete(docID); delErr != nil {
+		base.Warn("Error compacting key %s (delete) - tombstone will not be compacted.  %v", docID, delErr)
+	}
+	return true
+}
+
+// External revision bodies younger than this are never cleaned up. A body is saved before the
+// document revision that refers to it, so a new one can look like an orphan to a job that read
+// the document before the revision was saved.
+const kMinRevBodyCleanupAge = time.Hour
+
+// Deletes revision backups that no document needs any more: old revision bodies saved by
+// backupAncestorRevs whose revision has been pruned or whose document has been purged, and
+// externally stored revision bodies that aren't in any document's revision tree. (Both are
+// normally removed by expiry or when their revision is, but can be left behind.)
+func (db *Database) cleanUpRevisionBackups(job *MaintenanceJob) error {
+	// Old revision bodies:
+	err := db.forEachViewRow(ViewOldRevs, Body{"reduce": false}, func(row *sgbucket.ViewRow) error {
+		obsolete := false
+		if docID, revID, ok := parseOldRevisionKey(row.ID); ok {
+			doc, err := db.GetDocument(docID, DocUnmarshalAll)
+			if err == nil {
+				obsolete = doc.History[revID] == nil
+			} else if base.IsDocNotFoundError(err) {
+				obsolete = true
+			} else {
+				return err
+			}
+		}
+		return job.itemDone(obsolete && job.deleteDoc(db.Bucket, row.ID))
+	})
+	if err != nil {
+		return err
+	}
+
+	// External revision bodies; first find the ones still in use, by reading every document
+	// (including deleted ones, whose conflicting revisions may have external bodies):
+	referenced := map[string]bool{}
+	allDocsOpts := Body{"reduce": false, "startkey": []interface{}{true}, "endkey": []interface{}{true, map[string]interface{}{}}}
+	err = db.forEachViewRow(ViewImport, allDocsOpts, func(row *sgbucket.ViewRow) error {
+		doc, err := db.GetDocument(row.ID, DocUnmarshalAll)
+		if err != nil {
+			if base.IsDocNotFoundError(err) {
+				return nil // Purged since the view was updated
+			}
+			return err
+		}
+		for _, info := range doc.History {
+			if info.BodyKey != "" {
+				referenced[info.BodyKey] = true
+			}
+		}
+		return job.step()
+	})
+	if err != nil {
+		return err
+	}
+
+	cutoff := time.Now().Add(-kMinRevBodyCleanupAge)
+	bodyOpts := Body{"startkey": kRevBodyKeyPrefix, "endkey": kRevBodyKeyPrefix + "\uffff"}
+	return db.forEachViewRow(ViewAllBits, bodyOpts, func(row *sgbucket.ViewRow) error {
+		if referenced[row.ID] {
+			return job.itemDone(false)
+		}
+		_, cas, err := db.Bucket.GetRaw(row.ID)
+		if base.IsDocNotFoundError(err) {
+			return nil // Deleted since the view was updated
+		} else if err != nil {
+			return err
+		}
+		orphan := !casTime(cas).After(cutoff)
+		return job.itemDone(orphan && job.deleteDoc(db.Bucket, row.ID))
+	})
+}
+
+// Number of rows forEachViewRow reads from a view at a time. Overridden by tests.
+var maintenanceViewPageSize = 1000
+
+// Calls the callback for each row of a housekeeping view, querying it a page at a time, and
+// stops at the first error the callback returns. The first query brings the view's index up to
+// date; the rest use the index as it is, so that a long scan doesn't keep waiting on the indexer.
+func (db *Database) forEachViewRow(viewName string, opts Body, callback func(*sgbucket.ViewRow) error) error {
+	opts["stale"] = false
+	opts["limit"] = maintenanceViewPageSize
+	for {
+		vres, err := db.Bucket.View(DesignDocSyncHousekeeping, viewName, opts)
+		if err != nil {
+			return err
+		}
+		for _, row := range vres.Rows {
+			if err := callback(row); err != nil {
+				return err
+			}
+		}
+		if len(vres.Rows) < maintenanceViewPageSize {
+			return nil
+		}
+		last := vres.Rows[len(vres.Rows)-1]
+		opts["startkey"] = last.Key
+		opts["startkey_docid"] = last.ID
+		opts["skip"] = 1
+		opts["stale"] = "ok"
+	}
+}
+
+// Parses a key created by oldRevisionKey. Doc IDs may contain colons but revision IDs don't.
+func parseOldRevisionKey(key string) (docID, revID string, ok bool) {
+	if !strings.HasPrefix(key, kOldRevisionKeyPrefix) {
+		return "", "", false
+	}
+	rest := key[len(kOldRevisionKeyPrefix):]
+	i := strings.LastIndex(rest, ":")
+	if i < 0 {
+		return "", "", false
+	}
+	rest, revID = rest[:i], rest[i+1:]
+	i = strings.LastIndex(rest, ":")
+	if i < 0 {
+		return "", "", false
+	}
+	if revLen, err := strconv.Atoi(rest[i+1:]); err != nil || revLen != len(revID) {
+		return "", "", false
+	}
+	return rest[:i], revID, true
+}
+
+// Deletes login sessions that have expired, or whose user has been deleted or disabled.
+// Couchbase Server expires session docs by itself, but other buckets may not.
+func (db *Database) cleanUpSessions(job *MaintenanceJob) error {
+	vres, err := db.Bucket.View(DesignDocSyncHousekeeping, ViewSessions, Body{"stale": false})
+	if err != nil {
+		return err
+	}
+	authenticator := db.Authenticator()
+	now := time.Now()
+	for _, row := range vres.Rows {
+		docID, _ := row.Value.(string)
+		var session auth.LoginSession
+		if _, err := db.Bucket.Get(docID, &session); err != nil {
+			if base.IsDocNotFoundError(err) {
+				continue // Already gone
+			}
+			return err
+		}
+		obsolete := session.Expiration.Before(now)
+		if !obsolete {
+			user, err := authenticator.GetUser(session.Username)
+			if err != nil {
+				return err
+			}
+			obsolete = user == nil || user.Disabled()
+		}
+		if err := job.itemDone(obsolete && job.deleteDoc(db.Bucket, docID)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
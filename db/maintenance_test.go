@@ -0,0 +1,236 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/couchbase/sync_gateway/auth"
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
+	"github.com/couchbaselabs/go.assert"
+)
+
+func runTestMaintenanceJob(t *testing.T, db *Database, jobType MaintenanceJobType, dryRun bool) MaintenanceJobStatus {
+	job := newMaintenanceJob(db.Name, jobType, MaintenanceJobOptions{DryRun: dryRun, BatchSize: 2}, false)
+	assertNoError(t, job.run(db), "run maintenance job")
+	status := job.Status()
+	assert.Equals(t, status.State, MaintenanceCompleted)
+	return status
+}
+
+func TestMaintenanceSessionCleanup(t *testing.T) {
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer tearDownTestDB(t, db)
+
+	authenticator := db.Authenticator()
+	user, _ := authenticator.NewUser("alice", "letmein", channels.SetOf("ABC"))
+	assertNoError(t, authenticator.Save(user), "Save user")
+	current, err := authenticator.CreateSession("alice", time.Hour)
+	assertNoError(t, err, "CreateSession")
+	expired := auth.LoginSession{ID: "expired", Username: "alice", Expiration: time.Now().Add(-time.Minute), Ttl: time.Hour}
+	assertNoError(t, db.Bucket.Set(auth.SessionKeyPrefix+expired.ID, 0, expired), "Set expired session")
+	orphan := auth.LoginSession{ID: "orphan", Username: "bob", Expiration: time.Now().Add(time.Hour), Ttl: time.Hour}
+	assertNoError(t, db.Bucket.Set(auth.SessionKeyPrefix+orphan.ID, 0, orphan), "Set orphan session")
+
+	// A dry run only counts:
+	status := runTestMaintenanceJob(t, db, MaintenanceSessionCleanup, true)
+	assert.Equals(t, status.Processed, 3)
+	assert.Equals(t, status.Purged, 2)
+	session, err := authenticator.GetSession("expired")
+	assertNoError(t, err, "GetSession")
+	assert.True(t, session != nil)
+
+	status = runTestMaintenanceJob(t, db, MaintenanceSessionCleanup, false)
+	assert.Equals(t, status.Purged, 2)
+	for _, sessionID := range []string{"expired", "orphan"} {
+		_, _, err = db.Bucket.GetRaw(auth.SessionKeyPrefix + sessionID)
+		assert.True(t, base.IsDocNotFoundError(err))
+	}
+	session, err = authenticator.GetSession(current.ID)
+	assertNoError(t, err, "GetSession")
+	assert.Equals(t, session.Username, "alice")
+}
+
+func TestMaintenanceRevisionBodyCleanup(t *testing.T) {
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer tearDownTestDB(t, db)
+
+	// Create a conflict, so that the non-winning 2-a's large body is stored externally:
+	largeProperty := base.CreateProperty(1000)
+	assertNoError(t, db.PutExistingRev("doc1", Body{"version": "1a"}, []string{"1-a"}), "add 1-a")
+	assertNoError(t, db.PutExistingRev("doc1", Body{"key1": largeProperty, "version": "2a"}, []string{"2-a", "1-a"}), "add 2-a")
+	assertNoError(t, db.PutExistingRev("doc1", Body{"key1": largeProperty, "version": "2b"}, []string{"2-b", "1-a"}), "add 2-b")
+	usedKey := generateRevBodyKey("doc1", "2-a")
+	_, _, err := db.Bucket.GetRaw(usedKey)
+	assertNoError(t, err, "GetRaw external revision body")
+
+	// An external body that no document refers to, as if its document had been purged, and one
+	// that's too new to clean up, since its document may not have been saved yet:
+	orphanKey := generateRevBodyKey("purged", "2-a")
+	assertNoError(t, db.Bucket.SetRaw(orphanKey, 0, []byte(`{"version":"2a"}`)), "SetRaw")
+	newKey := generateRevBodyKey("saving", "2-a")
+	assertNoError(t, db.Bucket.SetRaw(newKey, 0, []byte(`{"version":"2a"}`)), "SetRaw")
+
+	// Walrus's CAS isn't a timestamp, so treat every CAS up to the orphan's as long ago:
+	_, orphanCas, err := db.Bucket.GetRaw(orphanKey)
+	assertNoError(t, err, "GetRaw orphan")
+	defer func(fn func(uint64) time.Time) { casTime = fn }(casTime)
+	casTime = func(cas uint64) time.Time {
+		if cas <= orphanCas {
+			return time.Now().Add(-2 * kMinRevBodyCleanupAge)
+		}
+		return time.Now()
+	}
+
+	// Read the views a page at a time:
+	defer func(pageSize int) { maintenanceViewPageSize = pageSize }(maintenanceViewPageSize)
+	maintenanceViewPageSize = 1
+
+	status := runTestMaintenanceJob(t, db, MaintenanceRevBackupCleanup, true)
+	assert.Equals(t, status.Purged, 1)
+	_, _, err = db.Bucket.GetRaw(orphanKey)
+	assertNoError(t, err, "GetRaw orphan after dry run")
+
+	status = runTestMaintenanceJob(t, db, MaintenanceRevBackupCleanup, false)
+	assert.Equals(t, status.Purged, 1)
+	_, _, err = db.Bucket.GetRaw(orphanKey)
+	assert.True(t, base.IsDocNotFoundError(err))
+	for _, key := range []string{usedKey, newKey} {
+		_, _, err = db.Bucket.GetRaw(key)
+		assertNoError(t, err, "GetRaw external revision body")
+	}
+}
+
+func TestParseOldRevisionKey(t *testing.T) {
+	docID, revID, ok := parseOldRevisionKey(oldRevisionKey("user:alice", "12-abcdef"))
+	assert.True(t, ok)
+	assert.Equals(t, docID, "user:alice")
+	assert.Equals(t, revID, "12-abcdef")
+
+	for _, key := range []string{"_sync:rev:doc", "_sync:rev:doc:3:1-abc", "_sync:rb:doc:5:1-abc", "doc:5:1-abc"} {
+		_, _, ok = parseOldRevisionKey(key)
+		assert.False(t, ok)
+	}
+}
+
+func TestMaintenanceJobControl(t *testing.T) {
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer tearDownTestDB(t, db)
+
+	// A job that processes items one at a time as the test feeds them to it, acknowledging each:
+	const testJob = MaintenanceJobType("test_job")
+	items := make(chan bool)
+	done := make(chan struct{})
+	maintenanceJobFuncs[testJob] = func(db *Database, job *MaintenanceJob) error {
+		for purge := range items {
+			err := job.itemDone(purge)
+			done <- struct{}{}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	defer delete(maintenanceJobFuncs, testJob)
+
+	manager := db.Maintenance
+	_, err := manager.Start("bogus", MaintenanceJobOptions{}, false)
+	assertHTTPError(t, err, http.StatusNotFound)
+	status, err := manager.Status(testJob)
+	assertNoError(t, err, "Status")
+	assert.Equals(t, status.State, MaintenanceIdle)
+	_, err = manager.ActiveJob(testJob)
+	assertHTTPError(t, err, http.StatusConflict)
+
+	job, err := manager.Start(testJob, MaintenanceJobOptions{DryRun: true}, false)
+	assertNoError(t, err, "Start")
+	assert.Equals(t, job.Status().BatchSize, DefaultMaintenanceBatchSize)
+	_, err = manager.Start(testJob, MaintenanceJobOptions{}, false)
+	assertHTTPError(t, err, http.StatusConflict)
+	items <- true
+	<-done
+	items <- false
+	<-done
+	active, err := manager.ActiveJob(testJob)
+	assertNoError(t, err, "ActiveJob")
+	assert.Equals(t, active, job)
+
+	// A paused job blocks after its current item until it's resumed:
+	assertNoError(t, job.Pause(), "Pause")
+	assertHTTPError(t, job.Pause(), http.StatusConflict)
+	items <- true
+	select {
+	case <-done:
+		t.Fatalf("Paused job didn't block")
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.Equals(t, job.Status().State, MaintenancePaused)
+	assertNoError(t, job.Resume(), "Resume")
+	<-done
+	status = job.Status()
+	assert.Equals(t, status.Processed, 3)
+	assert.Equals(t, status.Purged, 2)
+
+	// A cancelled job stops after its current item:
+	assertNoError(t, job.Cancel(), "Cancel")
+	items <- false
+	<-done
+	manager.Stop()
+	status = job.Status()
+	assert.Equals(t, status.State, MaintenanceCancelled)
+	assert.Equals(t, status.Processed, 4)
+	assert.True(t, status.EndTime != nil)
+	assertHTTPError(t, job.Resume(), http.StatusConflict)
+	_, err = manager.ActiveJob(testJob)
+	assertHTTPError(t, err, http.StatusConflict)
+}
+
+func TestMaintenanceJobThrottling(t *testing.T) {
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer tearDownTestDB(t, db)
+
+	// Steps that aren't items count towards batches too:
+	const testJob = MaintenanceJobType("test_job")
+	maintenanceJobFuncs[testJob] = func(db *Database, job *MaintenanceJob) error {
+		for i := 0; i < 4; i++ {
+			if err := job.step(); err != nil {
+				return err
+			}
+		}
+		return job.itemDone(true)
+	}
+	defer delete(maintenanceJobFuncs, testJob)
+
+	const delay = 20 * time.Millisecond
+	start := time.Now()
+	purged, err := db.Maintenance.Run(testJob, MaintenanceJobOptions{BatchSize: 2, BatchDelay: delay})
+	assertNoError(t, err, "Run")
+	assert.Equals(t, purged, 1)
+	assert.True(t, time.Since(start) >= 2*delay)
+
+	// Run, like Start, won't run two jobs of the same type at once:
+	release := make(chan struct{})
+	maintenanceJobFuncs[testJob] = func(db *Database, job *MaintenanceJob) error {
+		<-release
+		return nil
+	}
+	_, err = db.Maintenance.Start(testJob, MaintenanceJobOptions{}, false)
+	assertNoError(t, err, "Start")
+	_, err = db.Maintenance.Run(testJob, MaintenanceJobOptions{})
+	assertHTTPError(t, err, http.StatusConflict)
+	close(release)
+}
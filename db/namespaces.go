@@ -0,0 +1,160 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/couchbase/sync_gateway/auth"
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
+)
+
+// Partitions a database into named namespaces (tenants). Each document belongs to the namespace
+// named by one of its properties, or by the prefix of its ID. A namespace has its own sync
+// function and import filter, and its own channels: the channels its sync function assigns and
+// grants are qualified with the namespace name (see channels.NamespacedChannel.)
+type NamespaceOptions struct {
+	Property    string                // Document property naming the namespace, or
+	IDSeparator string                // Separator after the namespace name at the start of doc IDs
+	Namespaces  map[string]*Namespace // The namespaces, by name
+}
+
+type Namespace struct {
+	ChannelMapper *channels.ChannelMapper // Sync function; if nil, the "channels" property is used
+	ImportFilter  *ImportFilterFunction   // Import filter; if nil, the database's is used
+}
+
+// Is this a valid namespace name? It has to be usable in both channel and role names.
+func IsValidNamespaceName(name string) bool {
+	return name != "" && channels.IsValidChannel(name) && auth.IsValidPrincipalName(name) &&
+		!strings.Contains(name, channels.NamespaceSeparator) && !strings.Contains(name, channels.RoleNamespaceSeparator)
+}
+
+// Does the database have a namespace with this name?
+func (context *DatabaseContext) HasNamespace(name string) bool {
+	options := context.Options.Namespaces
+	return options != nil && options.Namespaces[name] != nil
+}
+
+// Returns the name of the namespace a document belongs to, or "" if none.
+func (options *NamespaceOptions) docNamespace(docID string, body Body) string {
+	if options.IDSeparator != "" {
+		if i := strings.Index(docID, options.IDSeparator); i > 0 {
+			return docID[:i]
+		}
+		return ""
+	}
+	namespace, _ := body[options.Property].(string)
+	return namespace
+}
+
+// Returns the name and settings of the namespace a document revision belongs to. Returns ""
+// and nil if namespaces aren't enabled, or the doc isn't in a namespace. Returns a 403 error
+// if the namespace doesn't exist, or differs from that of the parent revision (oldJSON).
+func (context *DatabaseContext) namespaceOf(docID string, body Body, oldJSON string) (string, *Namespace, error) {
+	options := context.Options.Namespaces
+	if options == nil {
+		return "", nil, nil
+	}
+	namespace := options.docNamespace(docID, body)
+
+	if options.Property != "" && oldJSON != "" {
+		var oldBody Body
+		if err := json.Unmarshal([]byte(oldJSON), &oldBody); err == nil {
+			oldNamespace := options.docNamespace(docID, oldBody)
+			if namespace == "" && body["_deleted"] == true {
+				namespace = oldNamespace // Tombstones don't need to repeat the namespace property
+			} else if namespace != oldNamespace {
+				return "", nil, base.HTTPErrorf(http.StatusForbidden, "Can't move a document to another namespace")
+			}
+		}
+	}
+
+	if namespace == "" {
+		return "", nil, nil
+	}
+	ns := options.Namespaces[namespace]
+	if ns == nil {
+		return "", nil, base.HTTPErrorf(http.StatusForbidden, "Unknown namespace %q", namespace)
+	}
+	return namespace, ns, nil
+}
+
+// Returns a 403 error if the database's user belongs to a namespace other than the one a document
+// being written is in, so it can't put docs into another tenant's channels. Docs outside any
+// namespace are off-limits to such a user too.
+func (db *Database) checkWriteNamespace(namespace string) error {
+	if db.user != nil && db.user.Namespace() != "" && namespace != db.user.Namespace() {
+		return base.HTTPErrorf(http.StatusForbidden, "User belongs to namespace %q", db.user.Namespace())
+	}
+	return nil
+}
+
+// In a namespaced database, returns a 403 error if the sync function output of a document that's
+// in no namespace uses a namespace's channels or roles, since anyone could create such a doc.
+func (context *DatabaseContext) checkNotNamespaced(output *channels.ChannelMapperOutput) error {
+	if context.Options.Namespaces == nil {
+		return nil
+	}
+	if name := output.NamespacedName(context.HasNamespace); name != "" {
+		return base.HTTPErrorf(http.StatusForbidden, "A document outside any namespace can't use the namespaced channel or role %q", name)
+	}
+	return nil
+}
+
+// Creates the userCtx passed to a namespace's sync function, which sees only the user's channels
+// and roles in the namespace, with the namespace removed from their names.
+func makeNamespaceUserCtx(user auth.User, namespace string) map[string]interface{} {
+	if user == nil {
+		return nil
+	}
+	return map[string]interface{}{
+		"name":     user.Name(),
+		"roles":    user.RoleNames().RolesInNamespace(namespace),
+		"channels": user.InheritedChannels().ChannelsInNamespace(namespace),
+	}
+}
+
+// Returns the import filter that applies to a document.
+func (context *DatabaseContext) importFilterFor(docID string, body Body) *ImportFilterFunction {
+	if options := context.Options.Namespaces; options != nil {
+		if ns := options.Namespaces[options.docNamespace(docID, body)]; ns != nil && ns.ImportFilter != nil {
+			return ns.ImportFilter
+		}
+	}
+	return context.Options.ImportOptions.ImportFilter
+}
+
+// Returns the namespace a changes feed is restricted to, given the one requested (if any.) A user
+// that belongs to a namespace only ever gets that namespace's changes; asking for another is a
+// 403 error. Other users, and the admin, get the requested namespace's, or all changes.
+func (db *Database) ChangesNamespace(requested string) (string, error) {
+	if db.user != nil && db.user.Namespace() != "" {
+		if requested != "" && requested != db.user.Namespace() {
+			return "", base.HTTPErrorf(http.StatusForbidden, "User belongs to namespace %q", db.user.Namespace())
+		}
+		return db.user.Namespace(), nil
+	}
+	if requested != "" && !db.HasNamespace(requested) {
+		return "", base.HTTPErrorf(http.StatusBadRequest, "Unknown namespace %q", requested)
+	}
+	return requested, nil
+}
+
+// Restricts the channels a changes feed spans to those of a namespace; see ChangesOptions.Namespace.
+func restrictToNamespace(channelsSince channels.TimedSet, namespace string) channels.TimedSet {
+	if namespace == "" {
+		return channelsSince
+	}
+	return channelsSince.RestrictToNamespace(namespace)
+}
@@ -0,0 +1,235 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"bytes"
+	"net/http"
+
+	"github.com/couchbase/sync_gateway/auth"
+	"github.com/couchbase/sync_gateway/base"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// A user or role, as exported and imported in bulk (e.g. to migrate principals between
+// databases.) Only the properties set through the admin API are included, not the channels and
+// roles granted by the sync function, which are recomputed from the documents. When a record is
+// imported over an existing principal, the properties it doesn't have are left as they are.
+type PrincipalRecord struct {
+	Type             string   `json:"type"` // "user" or "role"
+	Name             string   `json:"name"`
+	ExplicitChannels base.Set `json:"admin_channels,omitempty"`
+	// Fields below only apply to Users, not Roles:
+	ExplicitRoleNames []string `json:"admin_roles,omitempty"`
+	Email             *string  `json:"email,omitempty"`
+	Disabled          *bool    `json:"disabled,omitempty"`
+	Namespace         *string  `json:"namespace,omitempty"`
+	PasswordHash      string   `json:"password_hash,omitempty"` // bcrypt hash of the password
+	Password          *string  `json:"password,omitempty"`      // Or, on import, the password itself
+}
+
+const (
+	PrincipalTypeUser = "user"
+	PrincipalTypeRole = "role"
+)
+
+// What ImportPrincipal does with a principal that already exists.
+type PrincipalConflictMode string
+
+const (
+	PrincipalConflictUpsert = PrincipalConflictMode("upsert") // Update it
+	PrincipalConflictSkip   = PrincipalConflictMode("skip")   // Leave it alone
+	PrincipalConflictFail   = PrincipalConflictMode("fail")   // Return a 409 error
+)
+
+// Parses a conflict mode; the default is PrincipalConflictUpsert.
+func ParsePrincipalConflictMode(mode string) (PrincipalConflictMode, error) {
+	switch PrincipalConflictMode(mode) {
+	case "":
+		return PrincipalConflictUpsert, nil
+	case PrincipalConflictUpsert, PrincipalConflictSkip, PrincipalConflictFail:
+		return PrincipalConflictMode(mode), nil
+	default:
+		return "", base.HTTPErrorf(http.StatusBadRequest, "Invalid conflict mode %q; must be upsert, skip or fail", mode)
+	}
+}
+
+// The outcome of importing a principal.
+type PrincipalImportResult string
+
+const (
+	PrincipalCreated = PrincipalImportResult("created")
+	PrincipalUpdated = PrincipalImportResult("updated")
+	PrincipalSkipped = PrincipalImportResult("skipped")
+)
+
+// Returns a user or role as a PrincipalRecord, or nil if it doesn't exist.
+func (dbc *DatabaseContext) ExportPrincipal(name string, isUser bool) (*PrincipalRecord, error) {
+	princ, err := dbc.storedPrincipal(name, isUser)
+	if princ == nil || err != nil {
+		return nil, err
+	}
+
+	record := &PrincipalRecord{
+		Type:             PrincipalTypeRole,
+		Name:             name,
+		ExplicitChannels: princ.ExplicitChannels().AsSet(),
+	}
+	if user, ok := princ.(auth.User); ok {
+		record.Type = PrincipalTypeUser
+		record.ExplicitRoleNames = user.ExplicitRoles().AllChannels()
+		if email := user.Email(); email != "" {
+			record.Email = &email
+		}
+		if disabled := user.Disabled(); disabled {
+			record.Disabled = &disabled
+		}
+		if namespace := user.Namespace(); namespace != "" {
+			record.Namespace = &namespace
+		}
+		record.PasswordHash = string(user.PasswordHash())
+	}
+	return record, nil
+}
+
+// Reads a user or role as stored, or returns nil if it doesn't exist. Unlike GetPrincipal, this
+// doesn't recompute the principal's channels and roles if they've been invalidated, which would
+// query views; they'll be recomputed when the principal is next used.
+func (dbc *DatabaseContext) storedPrincipal(name string, isUser bool) (auth.Principal, error) {
+	docID := auth.RoleKeyPrefix + name
+	if isUser {
+		docID = auth.UserKeyPrefix + name
+	}
+	data, _, err := dbc.Bucket.GetRaw(docID)
+	if base.IsDocNotFoundError(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return dbc.Authenticator().UnmarshalPrincipal(data, name, 0, isUser)
+}
+
+// Creates or updates a user or role from a PrincipalRecord. If the principal exists, the mode
+// says what to do; an upsert keeps the properties the record doesn't have. In a dry run, the
+// record is only validated, and nothing is saved. A user whose password is changed is logged
+// out of its sessions.
+func (dbc *DatabaseContext) ImportPrincipal(record PrincipalRecord, mode PrincipalConflictMode, dryRun bool) (PrincipalImportResult, error) {
+	var isUser bool
+	switch record.Type {
+	case PrincipalTypeUser:
+		isUser = true
+	case PrincipalTypeRole:
+	default:
+		return "", base.HTTPErrorf(http.StatusBadRequest, "Invalid type %q; must be user or role", record.Type)
+	}
+	if record.Name == "" && !isUser {
+		return "", base.HTTPErrorf(http.StatusBadRequest, "Missing name")
+	} else if record.Name != "" && !auth.IsValidPrincipalName(record.Name) {
+		return "", base.HTTPErrorf(http.StatusBadRequest, "Invalid name %q", record.Name)
+	}
+
+	info := PrincipalConfig{
+		Name:             &record.Name,
+		ExplicitChannels: record.ExplicitChannels,
+	}
+	if isUser {
+		info.ExplicitRoleNames = record.ExplicitRoleNames
+		if record.Email != nil {
+			info.Email = *record.Email
+		}
+		if record.Disabled != nil {
+			info.Disabled = *record.Disabled
+		}
+		if record.Namespace != nil {
+			info.Namespace = *record.Namespace
+		}
+		info.Password = record.Password
+		if record.PasswordHash != "" {
+			if record.Password != nil {
+				return "", base.HTTPErrorf(http.StatusBadRequest, "Can't have both a password and a password_hash")
+			} else if _, err := bcrypt.Cost([]byte(record.PasswordHash)); err != nil {
+				return "", base.HTTPErrorf(http.StatusBadRequest, "Invalid password_hash: %v", err)
+			}
+			info.passwordHash = []byte(record.PasswordHash)
+		}
+	}
+
+	existing, err := dbc.storedPrincipal(record.Name, isUser)
+	if err != nil {
+		return "", err
+	} else if existing == nil && isUser && record.Name == "" {
+		// The guest user always exists, even if it's never been saved
+		if existing, err = dbc.Authenticator().GetUser(""); err != nil {
+			return "", err
+		}
+	}
+	exists := existing != nil
+	if exists {
+		switch mode {
+		case PrincipalConflictSkip:
+			return PrincipalSkipped, nil
+		case PrincipalConflictFail:
+			return "", base.HTTPErrorf(http.StatusConflict, "Already exists")
+		}
+
+		// Keep the properties the record doesn't have:
+		if info.ExplicitChannels == nil {
+			info.ExplicitChannels = existing.ExplicitChannels().AsSet()
+		}
+		if user, ok := existing.(auth.User); ok {
+			if record.ExplicitRoleNames == nil {
+				info.ExplicitRoleNames = user.ExplicitRoles().AllChannels()
+			}
+			if record.Email == nil {
+				info.Email = user.Email()
+			}
+			if record.Disabled == nil {
+				info.Disabled = user.Disabled()
+			}
+			if record.Namespace == nil {
+				info.Namespace = user.Namespace()
+			}
+		}
+	}
+
+	if dryRun {
+		if !exists && isUser && info.passwordHash == nil {
+			if isValid, reason := info.IsPasswordValid(dbc.AllowEmptyPassword); !isValid {
+				return "", base.HTTPErrorf(http.StatusBadRequest, reason)
+			}
+		}
+		if info.Password != nil && *info.Password != "" {
+			if err := dbc.Authenticator().CheckPasswordPolicy(*info.Password); err != nil {
+				return "", err
+			}
+		}
+	} else {
+		passwordChanged := info.Password != nil || info.passwordHash != nil
+		if user, ok := existing.(auth.User); ok && info.passwordHash != nil {
+			// Re-importing the same hash doesn't change the password
+			if bytes.Equal(user.PasswordHash(), info.passwordHash) {
+				passwordChanged = false
+			}
+		}
+		replaced, err := dbc.updatePrincipal(existing, info, isUser, true)
+		if err != nil {
+			return "", err
+		}
+		if replaced && passwordChanged {
+			if err := dbc.DeleteUserSessions(record.Name); err != nil {
+				return "", err
+			}
+		}
+	}
+	if exists {
+		return PrincipalUpdated, nil
+	}
+	return PrincipalCreated, nil
+}
@@ -0,0 +1,108 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestExportImportPrincipals(t *testing.T) {
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer tearDownTestDB(t, db)
+
+	authenticator := db.Authenticator()
+	user, _ := authenticator.NewUser("naomi", "letmein", channels.SetOf("ABC"))
+	user.SetEmail("naomi@example.com")
+	user.SetExplicitRoles(channels.TimedSet{"admins": channels.NewVbSimpleSequence(1)})
+	assertNoError(t, authenticator.Save(user), "Save user")
+	role, _ := authenticator.NewRole("admins", channels.SetOf("PBS"))
+	assertNoError(t, authenticator.Save(role), "Save role")
+
+	userRecord, err := db.ExportPrincipal("naomi", true)
+	assertNoError(t, err, "ExportPrincipal")
+	assert.Equals(t, userRecord.Type, PrincipalTypeUser)
+	assert.Equals(t, *userRecord.Email, "naomi@example.com")
+	assert.True(t, userRecord.Disabled == nil)
+	assert.DeepEquals(t, userRecord.ExplicitChannels, base.SetOf("ABC"))
+	assert.DeepEquals(t, userRecord.ExplicitRoleNames, []string{"admins"})
+	assert.True(t, userRecord.PasswordHash != "")
+	roleRecord, err := db.ExportPrincipal("admins", false)
+	assertNoError(t, err, "ExportPrincipal")
+	assert.Equals(t, roleRecord.Type, PrincipalTypeRole)
+	assert.DeepEquals(t, roleRecord.ExplicitChannels, base.SetOf("PBS"))
+	missing, err := db.ExportPrincipal("nobody", true)
+	assertNoError(t, err, "ExportPrincipal")
+	assert.True(t, missing == nil)
+
+	// Existing principals are skipped, upserted, or fail, depending on the mode:
+	result, err := db.ImportPrincipal(*roleRecord, PrincipalConflictSkip, false)
+	assertNoError(t, err, "ImportPrincipal")
+	assert.Equals(t, result, PrincipalSkipped)
+	_, err = db.ImportPrincipal(*roleRecord, PrincipalConflictFail, false)
+	assertHTTPError(t, err, http.StatusConflict)
+	roleRecord.ExplicitChannels = base.SetOf("PBS", "NBC")
+	result, err = db.ImportPrincipal(*roleRecord, PrincipalConflictUpsert, false)
+	assertNoError(t, err, "ImportPrincipal")
+	assert.Equals(t, result, PrincipalUpdated)
+	role, _ = authenticator.GetRole("admins")
+	assert.DeepEquals(t, role.ExplicitChannels().AsSet(), base.SetOf("PBS", "NBC"))
+
+	// Import the user under a new name; the password hash carries over:
+	userRecord.Name = "naomi2"
+	result, err = db.ImportPrincipal(*userRecord, PrincipalConflictUpsert, true)
+	assertNoError(t, err, "ImportPrincipal")
+	assert.Equals(t, result, PrincipalCreated)
+	user, _ = authenticator.GetUser("naomi2")
+	assert.True(t, user == nil) // Dry run
+	result, err = db.ImportPrincipal(*userRecord, PrincipalConflictUpsert, false)
+	assertNoError(t, err, "ImportPrincipal")
+	assert.Equals(t, result, PrincipalCreated)
+	user, _ = authenticator.GetUser("naomi2")
+	assert.True(t, user != nil)
+	assert.True(t, user.Authenticate("letmein"))
+	assert.False(t, user.Authenticate("wrong"))
+	assert.Equals(t, user.Email(), "naomi@example.com")
+	assert.DeepEquals(t, user.ExplicitRoles().AllChannels(), []string{"admins"})
+
+	// An upsert keeps the properties the record doesn't have, and changes those it does:
+	disabled := true
+	result, err = db.ImportPrincipal(PrincipalRecord{Type: PrincipalTypeUser, Name: "naomi2", Disabled: &disabled},
+		PrincipalConflictUpsert, false)
+	assertNoError(t, err, "ImportPrincipal")
+	assert.Equals(t, result, PrincipalUpdated)
+	user, _ = authenticator.GetUser("naomi2")
+	assert.True(t, user.Disabled())
+	assert.Equals(t, user.Email(), "naomi@example.com")
+	assert.DeepEquals(t, user.ExplicitChannels().AsSet(), base.SetOf("ABC"))
+	assert.DeepEquals(t, user.ExplicitRoles().AllChannels(), []string{"admins"})
+	assert.True(t, len(user.PasswordHash()) > 0)
+	noEmail := ""
+	result, err = db.ImportPrincipal(PrincipalRecord{Type: PrincipalTypeUser, Name: "naomi2", Email: &noEmail,
+		ExplicitChannels: base.Set{}}, PrincipalConflictUpsert, false)
+	assertNoError(t, err, "ImportPrincipal")
+	user, _ = authenticator.GetUser("naomi2")
+	assert.True(t, user.Disabled())
+	assert.Equals(t, user.Email(), "")
+	assert.Equals(t, len(user.ExplicitChannels()), 0)
+
+	// Invalid records:
+	_, err = db.ImportPrincipal(PrincipalRecord{Type: "group", Name: "x"}, PrincipalConflictUpsert, false)
+	assertHTTPError(t, err, http.StatusBadRequest)
+	_, err = db.ImportPrincipal(PrincipalRecord{Type: PrincipalTypeUser, Name: "x", PasswordHash: "xyzzy"}, PrincipalConflictUpsert, false)
+	assertHTTPError(t, err, http.StatusBadRequest)
+	_, err = db.ImportPrincipal(PrincipalRecord{Type: PrincipalTypeUser, Name: "x"}, PrincipalConflictUpsert, true)
+	assertHTTPError(t, err, http.StatusBadRequest) // No password
+}
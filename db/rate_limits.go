@@ -0,0 +1,107 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"fmt"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// A token-bucket rate limit.
+type RateLimit struct {
+	Rate  float64 `json:"rate"`            // Sustained rate, per second
+	Burst int     `json:"burst,omitempty"` // Max burst size; defaults to the rate, rounded up
+}
+
+// Rate limits on the public API of a database. Requests are limited per authenticated user and
+// per client IP address; the changes limits apply, in addition, to opening a changes feed
+// (a _changes request or a BLIP subChanges message.)
+type RateLimitOptions struct {
+	RequestsPerUser *RateLimit `json:"requests_per_user,omitempty"`
+	RequestsPerIP   *RateLimit `json:"requests_per_ip,omitempty"`
+	ChangesPerUser  *RateLimit `json:"changes_per_user,omitempty"`
+	ChangesPerIP    *RateLimit `json:"changes_per_ip,omitempty"`
+}
+
+// The kinds of rate-limited operations.
+type RateLimitKind int
+
+const (
+	RateLimitRequests = RateLimitKind(iota) // Any request
+	RateLimitChanges                        // Opening a changes feed
+)
+
+// The RateLimiters of a database, indexed by RateLimitKind. Nil entries mean no limit.
+type rateLimiters struct {
+	perUser [2]*base.RateLimiter
+	perIP   [2]*base.RateLimiter
+}
+
+// Checks that the limits' values are in range.
+func (options *RateLimitOptions) Validate() error {
+	limits := map[string]*RateLimit{
+		"requests_per_user": options.RequestsPerUser,
+		"requests_per_ip":   options.RequestsPerIP,
+		"changes_per_user":  options.ChangesPerUser,
+		"changes_per_ip":    options.ChangesPerIP,
+	}
+	for name, limit := range limits {
+		if limit != nil && (limit.Rate <= 0 || limit.Burst < 0) {
+			return fmt.Errorf("rate_limits.%s must have a rate > 0 and a burst >= 0", name)
+		}
+	}
+	return nil
+}
+
+func newRateLimiter(limit *RateLimit) *base.RateLimiter {
+	if limit == nil {
+		return nil
+	}
+	return base.NewRateLimiter(limit.Rate, limit.Burst)
+}
+
+func newRateLimiters(options *RateLimitOptions) *rateLimiters {
+	if options == nil {
+		return nil
+	}
+	limiters := &rateLimiters{}
+	limiters.perUser[RateLimitRequests] = newRateLimiter(options.RequestsPerUser)
+	limiters.perUser[RateLimitChanges] = newRateLimiter(options.ChangesPerUser)
+	limiters.perIP[RateLimitRequests] = newRateLimiter(options.RequestsPerIP)
+	limiters.perIP[RateLimitChanges] = newRateLimiter(options.ChangesPerIP)
+	return limiters
+}
+
+// Counts an operation against the client IP address's rate limit. Returns a
+// *base.RateLimitError if the limit is exceeded.
+func (context *DatabaseContext) CheckIPRateLimit(kind RateLimitKind, clientIP string) error {
+	if context.rateLimiters == nil || context.rateLimiters.perIP[kind] == nil || clientIP == "" {
+		return nil
+	}
+	if err := context.rateLimiters.perIP[kind].TakeOrError(clientIP); err != nil {
+		base.LogTo("HTTP", "Rate limit exceeded by client %s", clientIP)
+		return err
+	}
+	return nil
+}
+
+// Counts an operation against the user's rate limit. The guest user isn't limited (except by
+// IP address.) Returns a *base.RateLimitError if the limit is exceeded.
+func (context *DatabaseContext) CheckUserRateLimit(kind RateLimitKind, username string) error {
+	if context.rateLimiters == nil || context.rateLimiters.perUser[kind] == nil || username == "" {
+		return nil
+	}
+	if err := context.rateLimiters.perUser[kind].TakeOrError(username); err != nil {
+		base.LogTo("HTTP", "Rate limit exceeded by user %q", username)
+		return err
+	}
+	return nil
+}
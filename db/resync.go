@@ -0,0 +1,523 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
+)
+
+// An online resync re-runs the sync function over every document in the background, while the
+// database stays online. Changed documents get new sequences, so changes feeds pick them up.
+// If the resync is given a new sync function, it first runs that function over every document as
+// a shadow, saving nothing, while writes keep using the current function; this checks the new
+// function against the existing documents and counts those it would change. Then the database
+// switches to the new function, all at once, and every document is re-synced with it (including
+// those written during the shadow phase.) Documents keep their old channels and access until
+// they're re-synced. Progress is saved to a checkpoint doc after every batch, so a cancelled,
+// failed or interrupted resync can be resumed from where it left off.
+
+const kResyncCheckpointKey = "_sync:resync" // Key of the checkpoint of the latest online resync
+
+type ResyncState string
+
+const (
+	ResyncIdle        = ResyncState("idle") // No online resync has been run
+	ResyncRunning     = ResyncState("running")
+	ResyncCompleted   = ResyncState("completed")
+	ResyncCancelled   = ResyncState("cancelled")
+	ResyncFailed      = ResyncState("failed")
+	ResyncInterrupted = ResyncState("interrupted") // The gateway stopped while it was running
+)
+
+type ResyncPhase string
+
+const (
+	ResyncShadow = ResyncPhase("shadow") // Running the new sync function without saving anything
+	ResyncApply  = ResyncPhase("apply")  // Re-syncing docs with the database's sync function
+)
+
+// Number of documents a resync processes between checkpoints, if its options don't say.
+const DefaultResyncBatchSize = 500
+
+type ResyncOptions struct {
+	SyncFunction *string // New sync function to switch to; if nil, the current one is re-run
+	BatchSize    int     // Docs processed between checkpoints; defaults to DefaultResyncBatchSize
+	Resume       bool    // Resume the previous resync from its checkpoint, instead of starting over
+}
+
+// The status of an online resync, as reported by the admin API and /_active_tasks. This is
+// also the format of the checkpoint doc.
+type ResyncStatus struct {
+	TaskType      string      `json:"type"` // Always "resync"
+	Database      string      `json:"database"`
+	State         ResyncState `json:"state"`
+	Phase         ResyncPhase `json:"phase,omitempty"`
+	SyncFunction  *string     `json:"sync,omitempty"`          // The new sync function, if any
+	PreviousSync  *string     `json:"previous_sync,omitempty"` // The sync function the new one replaces
+	Switched      bool        `json:"switched,omitempty"`      // Has the database switched to the new function?
+	BatchSize     int         `json:"batch_size,omitempty"`
+	LastDocID     string      `json:"last_doc_id,omitempty"` // Last doc processed in this phase; the resync resumes after it
+	DocsProcessed int         `json:"docs_processed"`        // In this phase
+	DocsChanged   int         `json:"docs_changed"`
+	ShadowChanges int         `json:"shadow_changes,omitempty"` // Docs the shadow phase found the new function would change
+	DocsTotal     int         `json:"docs_total"`               // As of the latest (re)start of this phase
+	StartTime     *time.Time  `json:"start_time,omitempty"`
+	UpdateTime    *time.Time  `json:"update_time,omitempty"` // When the checkpoint was last saved
+	EndTime       *time.Time  `json:"end_time,omitempty"`
+	ETA           *time.Time  `json:"eta,omitempty"` // Estimated completion time, while running
+	Error         string      `json:"error,omitempty"`
+}
+
+// Returned by resyncJob.checkpoint when the resync's been cancelled.
+var errResyncCancelled = errors.New("Resync cancelled")
+
+// A run of an online resync.
+type resyncJob struct {
+	lock          sync.Mutex
+	status        ResyncStatus
+	mapper        *channels.ChannelMapper // Runs the new sync function in the shadow phase; nil if it's empty
+	cancelled     bool
+	runStart      time.Time     // When this phase (re)started, for estimating the ETA
+	runStartCount int           // DocsProcessed when this phase (re)started
+	done          chan struct{} // Closed when the job finishes
+}
+
+func newResyncJob(status ResyncStatus) *resyncJob {
+	job := &resyncJob{
+		status:        status,
+		runStart:      time.Now(),
+		runStartCount: status.DocsProcessed,
+		done:          make(chan struct{}),
+	}
+	if status.SyncFunction != nil && *status.SyncFunction != "" {
+		job.mapper = channels.NewChannelMapper(*status.SyncFunction)
+	}
+	return job
+}
+
+// Returns a snapshot of the job's status, with an ETA if it's running.
+func (job *resyncJob) Status() ResyncStatus {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	status := job.status
+	if status.State == ResyncRunning {
+		processed := status.DocsProcessed - job.runStartCount
+		remaining := status.DocsTotal - status.DocsProcessed
+		elapsed := time.Since(job.runStart)
+		if processed > 0 && remaining > 0 {
+			eta := time.Now().Add(time.Duration(float64(elapsed) * float64(remaining) / float64(processed)))
+			status.ETA = &eta
+		}
+	}
+	return status
+}
+
+// Returns the mapper the resync should run on docs, given the database's current one.
+func (job *resyncJob) syncMapper(current *channels.ChannelMapper) *channels.ChannelMapper {
+	if job.phase() == ResyncShadow {
+		return job.mapper
+	}
+	return current
+}
+
+func (job *resyncJob) phase() ResyncPhase {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	return job.status.Phase
+}
+
+// Moves on to the next phase, which starts from the first doc.
+func (job *resyncJob) startPhase(phase ResyncPhase) {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	job.status.Phase = phase
+	job.status.LastDocID = ""
+	job.status.DocsProcessed = 0
+	job.runStart = time.Now()
+	job.runStartCount = 0
+}
+
+func (job *resyncJob) cancel() error {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	if job.status.State != ResyncRunning || job.cancelled {
+		return base.HTTPErrorf(http.StatusConflict, "Resync isn't running")
+	}
+	job.cancelled = true
+	return nil
+}
+
+// Records a processed doc, and whether it was changed (or in the shadow phase, would be.)
+func (job *resyncJob) docDone(docID string, changed bool) {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	job.status.LastDocID = docID
+	job.status.DocsProcessed++
+	if changed && job.status.Phase == ResyncShadow {
+		job.status.ShadowChanges++
+	} else if changed {
+		job.status.DocsChanged++
+	}
+}
+
+// Saves the job's status as the checkpoint, and returns errResyncCancelled if it's been cancelled.
+func (job *resyncJob) checkpoint(bucket base.Bucket) error {
+	job.lock.Lock()
+	now := time.Now()
+	job.status.UpdateTime = &now
+	status := job.status
+	cancelled := job.cancelled
+	job.lock.Unlock()
+
+	if err := bucket.Set(kResyncCheckpointKey, 0, status); err != nil {
+		base.Warn("Error saving resync checkpoint of %s: %v", status.Database, err)
+	}
+	if cancelled {
+		return errResyncCancelled
+	}
+	return nil
+}
+
+// Runs the resync to completion, cancellation or failure, and saves the outcome to the checkpoint.
+func (job *resyncJob) run(db *Database) {
+	defer close(job.done)
+	status := job.Status()
+	base.Logf("Starting online resync of %s in the %s phase from %q (new sync function: %v)", db.Name,
+		status.Phase, status.LastDocID, status.SyncFunction != nil)
+
+	var err error
+	if status.Phase == ResyncShadow {
+		if err = db.resyncAllDocs(job); err == nil {
+			job.startPhase(ResyncApply)
+		}
+	}
+	if err == nil && status.SyncFunction != nil {
+		// Also done when resuming the apply phase, in case the database has been reopened with
+		// the sync function the resync replaced:
+		err = db.switchResyncSyncFunction(job)
+	}
+	if err == nil {
+		err = db.resyncAllDocs(job)
+	}
+	if job.Status().DocsChanged > 0 {
+		db.invalAllPrincipalChannels()
+	}
+
+	job.lock.Lock()
+	now := time.Now()
+	job.status.EndTime = &now
+	if err == errResyncCancelled {
+		job.status.State = ResyncCancelled
+	} else if err != nil {
+		job.status.State = ResyncFailed
+		job.status.Error = err.Error()
+		base.Warn("Online resync of %s failed: %v", db.Name, err)
+	} else {
+		job.status.State = ResyncCompleted
+	}
+	job.lock.Unlock()
+
+	job.checkpoint(db.Bucket)
+	status = job.Status()
+	base.Logf("Online resync of %s %s: %d of %d docs processed, %d changed", db.Name, status.State,
+		status.DocsProcessed, status.DocsTotal, status.DocsChanged)
+}
+
+// Re-syncs every doc after the checkpoint's LastDocID, in batches, saving the checkpoint after each.
+// In the shadow phase, only runs the new sync function on each doc.
+func (db *Database) resyncAllDocs(job *resyncJob) error {
+	total, err := db.countResyncDocs()
+	if err != nil {
+		return err
+	}
+	job.lock.Lock()
+	job.status.DocsTotal = total
+	batchSize := job.status.BatchSize
+	startKey := job.status.LastDocID
+	shadow := job.status.Phase == ResyncShadow
+	job.lock.Unlock()
+
+	for {
+		// The start key is inclusive, so each page after the first starts with the last doc of
+		// the previous page, which is skipped; see RepairBucket.
+		options := Body{"stale": false, "reduce": false}
+		options["startkey"] = []interface{}{true, startKey}
+		options["limit"] = batchSize + 1
+		vres, err := db.Bucket.View(DesignDocSyncHousekeeping, ViewImport, options)
+		if err != nil {
+			return err
+		}
+		numProcessed := 0
+		for _, row := range vres.Rows {
+			rowKey := row.Key.([]interface{})
+			docid := rowKey[1].(string)
+			if docid == startKey {
+				continue
+			}
+			startKey = docid
+			numProcessed++
+
+			var changed bool
+			if shadow {
+				changed, err = db.shadowResyncDocument(docid)
+			} else {
+				changed, err = db.resyncDocument(docid, true, false, true)
+			}
+			if err != nil {
+				base.Warn("Error updating doc %q: %v", docid, err)
+			}
+			job.docDone(docid, changed)
+		}
+		if err := job.checkpoint(db.Bucket); err != nil {
+			return err
+		} else if numProcessed == 0 {
+			return nil
+		}
+	}
+}
+
+// Runs the resync's new sync function on a doc's current revision without saving anything, and
+// returns whether the doc's channels or access would change.
+func (db *Database) shadowResyncDocument(docid string) (bool, error) {
+	doc, err := db.GetDocument(docid, DocUnmarshalAll)
+	if err != nil {
+		return false, err
+	}
+	body, err := db.getRevFromDoc(doc, doc.CurrentRev, false)
+	if err != nil {
+		return false, err
+	}
+	channels, access, roles, _, _, err := db.getChannelsAndAccess(doc, body, doc.CurrentRev)
+	if err != nil {
+		// Probably the validator rejected the doc; resyncDocument would remove its channels
+		base.Warn("Error calling the new sync() on doc %q: %v", docid, err)
+		channels, access, roles = nil, nil, nil
+	}
+	return doc.channelsOrAccessDiffer(channels, access, roles), nil
+}
+
+// Gives a doc being re-synced a new sequence, so that changes feeds see it in its new channels.
+// Like updateAndReturnDoc, it reuses the sequence allocated by an earlier attempt that lost a
+// CAS race if it's still greater than the doc's, or else records that one as unused.
+func (db *Database) assignResyncSequence(doc *document, sequence *uint64, unusedSequences *[]uint64) (err error) {
+	if *sequence <= doc.Sequence {
+		if *sequence > 0 {
+			base.LogTo("Cache", "resyncDocument %q: Unused sequence #%d", doc.ID, *sequence)
+			*unusedSequences = append(*unusedSequences, *sequence)
+		}
+		for {
+			if *sequence, err = db.sequences.nextSequence(); err != nil {
+				*sequence = 0
+				return err
+			}
+			if *sequence > doc.Sequence {
+				break
+			}
+			db.sequences.releaseSequence(*sequence)
+		}
+	}
+	doc.Sequence = *sequence
+	doc.UnusedSequences = *unusedSequences
+	doc.RecentSequences = append(doc.RecentSequences, *unusedSequences...)
+	doc.RecentSequences = append(doc.RecentSequences, *sequence)
+	return nil
+}
+
+// Returns the number of docs the resync will process.
+func (db *Database) countResyncDocs() (int, error) {
+	options := Body{"stale": false, "reduce": true, "startkey": []interface{}{true}}
+	vres, err := db.Bucket.View(DesignDocSyncHousekeeping, ViewImport, options)
+	if err != nil {
+		return 0, err
+	}
+	if len(vres.Rows) == 0 {
+		return 0, nil
+	}
+	count, _ := base.ToInt64(vres.Rows[0].Value)
+	return int(count), nil
+}
+
+// Switches the database to the resync's new sync function, and records that in the checkpoint and,
+// through the SyncFunctionCallback, in the database's config.
+func (db *Database) switchResyncSyncFunction(job *resyncJob) error {
+	syncFn := *job.Status().SyncFunction
+	if _, err := db.UpdateSyncFun(syncFn); err != nil {
+		return err
+	}
+	if callback := db.Options.SyncFunctionCallback; callback != nil {
+		callback(db.DatabaseContext, syncFn)
+	}
+	base.Logf("Switched %s to the resync's new sync function", db.Name)
+	job.lock.Lock()
+	job.status.Switched = true
+	job.lock.Unlock()
+	return job.checkpoint(db.Bucket)
+}
+
+//////// DATABASE API:
+
+// Starts an online resync in the background, or resumes the previous one from its checkpoint.
+func (context *DatabaseContext) StartResync(options ResyncOptions) (ResyncStatus, error) {
+	context.resyncLock.Lock()
+	defer context.resyncLock.Unlock()
+	if context.latestResync != nil && context.latestResync.Status().State == ResyncRunning {
+		return ResyncStatus{}, base.HTTPErrorf(http.StatusConflict, "Resync is already running")
+	} else if context.resyncClosed {
+		return ResyncStatus{}, base.HTTPErrorf(http.StatusServiceUnavailable, "Database is closing")
+	}
+
+	var status ResyncStatus
+	if options.Resume {
+		checkpoint, err := context.resyncCheckpoint()
+		if err != nil {
+			return ResyncStatus{}, err
+		} else if checkpoint == nil {
+			return ResyncStatus{}, base.HTTPErrorf(http.StatusNotFound, "There's no resync to resume")
+		} else if checkpoint.State == ResyncCompleted {
+			return ResyncStatus{}, base.HTTPErrorf(http.StatusConflict, "The previous resync completed")
+		} else if options.SyncFunction != nil && (checkpoint.SyncFunction == nil || *options.SyncFunction != *checkpoint.SyncFunction) {
+			return ResyncStatus{}, base.HTTPErrorf(http.StatusBadRequest, "Sync function doesn't match that of the resync being resumed")
+		}
+		status = *checkpoint
+		status.EndTime = nil
+		status.Error = ""
+		if options.BatchSize > 0 {
+			status.BatchSize = options.BatchSize
+		}
+		if status.Phase == "" {
+			status.Phase = ResyncApply
+		}
+	} else {
+		if options.SyncFunction != nil && *options.SyncFunction != "" {
+			if _, err := channels.NewSyncRunner(*options.SyncFunction); err != nil {
+				return ResyncStatus{}, base.HTTPErrorf(http.StatusBadRequest, "Invalid sync function: %v", err)
+			}
+		}
+		now := time.Now()
+		status = ResyncStatus{
+			TaskType:     "resync",
+			Database:     context.Name,
+			Phase:        ResyncApply,
+			SyncFunction: options.SyncFunction,
+			BatchSize:    options.BatchSize,
+			StartTime:    &now,
+		}
+		if options.SyncFunction != nil {
+			previous := ""
+			if mapper := context.GetChannelMapper(); mapper != nil {
+				previous = mapper.Function()
+			}
+			status.Phase = ResyncShadow
+			status.PreviousSync = &previous
+		}
+	}
+	if status.BatchSize <= 0 {
+		status.BatchSize = DefaultResyncBatchSize
+	}
+	status.State = ResyncRunning
+
+	job := newResyncJob(status)
+	context.latestResync = job
+	go job.run(&Database{DatabaseContext: context, resync: job})
+	return job.Status(), nil
+}
+
+// Returns the status of the running or latest online resync, from memory or its checkpoint.
+func (context *DatabaseContext) ResyncStatus() (ResyncStatus, error) {
+	context.resyncLock.Lock()
+	job := context.latestResync
+	context.resyncLock.Unlock()
+	if job != nil {
+		return job.Status(), nil
+	}
+	checkpoint, err := context.resyncCheckpoint()
+	if err != nil {
+		return ResyncStatus{}, err
+	} else if checkpoint == nil {
+		return ResyncStatus{TaskType: "resync", Database: context.Name, State: ResyncIdle}, nil
+	}
+	if checkpoint.State == ResyncRunning {
+		// The checkpoint was saved by a gateway that stopped before the resync finished
+		checkpoint.State = ResyncInterrupted
+	}
+	return *checkpoint, nil
+}
+
+// Cancels the running online resync; it stops after saving the checkpoint of its current batch.
+func (context *DatabaseContext) CancelResync() error {
+	context.resyncLock.Lock()
+	job := context.latestResync
+	context.resyncLock.Unlock()
+	if job == nil {
+		return base.HTTPErrorf(http.StatusConflict, "Resync isn't running")
+	}
+	return job.cancel()
+}
+
+// Returns the running online resync's status, for /_active_tasks, or nil if there isn't one.
+func (context *DatabaseContext) ActiveResync() *ResyncStatus {
+	context.resyncLock.Lock()
+	job := context.latestResync
+	context.resyncLock.Unlock()
+	if job == nil {
+		return nil
+	}
+	status := job.Status()
+	if status.State != ResyncRunning {
+		return nil
+	}
+	return &status
+}
+
+// Reads the resync checkpoint; returns nil if there isn't one.
+func (context *DatabaseContext) resyncCheckpoint() (*ResyncStatus, error) {
+	var status ResyncStatus
+	if _, err := context.Bucket.Get(kResyncCheckpointKey, &status); err != nil {
+		if base.IsDocNotFoundError(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &status, nil
+}
+
+// Returns the sync function the database should use, given the one in its config. If an online
+// resync switched the database to a new function, replacing the config's, that's the new one,
+// since the config file may not have been updated. (To go back to the old function, resync with it.)
+func (context *DatabaseContext) ResyncedSyncFunction(configSyncFn string) string {
+	checkpoint, err := context.resyncCheckpoint()
+	if err != nil {
+		base.Warn("Couldn't read the resync checkpoint of %s: %v", context.Name, err)
+		return configSyncFn
+	} else if checkpoint == nil || !checkpoint.Switched || checkpoint.PreviousSync == nil {
+		return configSyncFn
+	} else if *checkpoint.PreviousSync != configSyncFn {
+		return configSyncFn // The config has been changed since
+	}
+	return *checkpoint.SyncFunction
+}
+
+// Cancels any running online resync and waits for it to stop; called when the database closes.
+func (context *DatabaseContext) stopResync() {
+	context.resyncLock.Lock()
+	context.resyncClosed = true
+	job := context.latestResync
+	context.resyncLock.Unlock()
+	if job != nil {
+		job.cancel()
+		<-job.done
+	}
+}
@@ -0,0 +1,157 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func waitForResync(t *testing.T, db *Database) ResyncStatus {
+	db.resyncLock.Lock()
+	job := db.latestResync
+	db.resyncLock.Unlock()
+	<-job.done
+	status, err := db.ResyncStatus()
+	assertNoError(t, err, "ResyncStatus")
+	return status
+}
+
+func TestOnlineResync(t *testing.T) {
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer tearDownTestDB(t, db)
+
+	status, err := db.ResyncStatus()
+	assertNoError(t, err, "ResyncStatus")
+	assert.Equals(t, status.State, ResyncIdle)
+	_, err = db.StartResync(ResyncOptions{Resume: true})
+	assertHTTPError(t, err, http.StatusNotFound)
+	badSyncFn := `function(doc) {`
+	_, err = db.StartResync(ResyncOptions{SyncFunction: &badSyncFn})
+	assertHTTPError(t, err, http.StatusBadRequest)
+
+	var sequences []uint64
+	for i := 1; i <= 5; i++ {
+		docID := fmt.Sprintf("doc%d", i)
+		_, err := db.Put(docID, Body{"channels": "A", "group": "B"})
+		assertNoError(t, err, "Put")
+		doc, _ := db.GetDocument(docID, DocUnmarshalAll)
+		sequences = append(sequences, doc.Sequence)
+	}
+
+	// Resync with a new sync function, which moves the docs to another channel:
+	syncFn := `function(doc) {channel(doc.group);}`
+	_, err = db.StartResync(ResyncOptions{SyncFunction: &syncFn, BatchSize: 2})
+	assertNoError(t, err, "StartResync")
+	status = waitForResync(t, db)
+	assert.Equals(t, status.State, ResyncCompleted)
+	assert.Equals(t, status.Phase, ResyncApply)
+	assert.True(t, status.Switched)
+	assert.Equals(t, *status.PreviousSync, "")
+	assert.Equals(t, status.DocsTotal, 5)
+	assert.Equals(t, status.DocsProcessed, 5)
+	assert.Equals(t, status.ShadowChanges, 5)
+	assert.Equals(t, status.DocsChanged, 5)
+	assert.Equals(t, status.LastDocID, "doc5")
+	assert.True(t, db.ActiveResync() == nil)
+	for i, seq := range sequences {
+		doc, _ := db.GetDocument(fmt.Sprintf("doc%d", i+1), DocUnmarshalAll)
+		assert.True(t, doc.Sequence > seq)
+		assert.True(t, doc.Channels["A"] != nil)
+		_, inB := doc.Channels["B"]
+		assert.True(t, inB && doc.Channels["B"] == nil)
+	}
+
+	// The database has switched to the new sync function:
+	_, err = db.Put("doc6", Body{"channels": "A", "group": "B"})
+	assertNoError(t, err, "Put")
+	doc, _ := db.GetDocument("doc6", DocUnmarshalAll)
+	_, inA := doc.Channels["A"]
+	assert.False(t, inA)
+	assert.Equals(t, db.GetChannelMapper().Function(), syncFn)
+
+	// Reopening the database with the sync function the resync replaced keeps the new one, but
+	// one that's been changed since is used as is:
+	assert.Equals(t, db.ResyncedSyncFunction(""), syncFn)
+	assert.Equals(t, db.ResyncedSyncFunction(`function(doc) {}`), `function(doc) {}`)
+
+	// A completed resync can't be resumed:
+	_, err = db.StartResync(ResyncOptions{Resume: true})
+	assertHTTPError(t, err, http.StatusConflict)
+
+	// Simulate a resync that was interrupted after doc3, and resume it:
+	checkpoint := status
+	checkpoint.State = ResyncRunning
+	checkpoint.LastDocID = "doc3"
+	checkpoint.DocsProcessed = 3
+	checkpoint.DocsChanged = 0
+	syncFn = `function(doc) {channel(doc.channels);}`
+	checkpoint.SyncFunction = &syncFn
+	assertNoError(t, db.Bucket.Set(kResyncCheckpointKey, 0, checkpoint), "Set checkpoint")
+	db.latestResync = nil
+	status, err = db.ResyncStatus()
+	assertNoError(t, err, "ResyncStatus")
+	assert.Equals(t, status.State, ResyncInterrupted)
+
+	otherSyncFn := `function(doc) {}`
+	_, err = db.StartResync(ResyncOptions{Resume: true, SyncFunction: &otherSyncFn})
+	assertHTTPError(t, err, http.StatusBadRequest)
+	_, err = db.StartResync(ResyncOptions{Resume: true})
+	assertNoError(t, err, "StartResync")
+	status = waitForResync(t, db)
+	assert.Equals(t, status.State, ResyncCompleted)
+	assert.Equals(t, status.DocsProcessed, 6)
+	assert.Equals(t, status.DocsChanged, 3)
+	for i := 1; i <= 6; i++ {
+		doc, _ := db.GetDocument(fmt.Sprintf("doc%d", i), DocUnmarshalAll)
+		_, inA := doc.Channels["A"]
+		assert.Equals(t, inA && doc.Channels["A"] == nil, i > 3)
+	}
+	assertHTTPError(t, db.CancelResync(), http.StatusConflict)
+}
+
+func TestResyncShadowPhase(t *testing.T) {
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer tearDownTestDB(t, db)
+
+	for i := 1; i <= 3; i++ {
+		_, err := db.Put(fmt.Sprintf("doc%d", i), Body{"channels": "A", "group": fmt.Sprintf("G%d", i%2)})
+		assertNoError(t, err, "Put")
+	}
+
+	// The shadow phase counts the docs the new function would change, but doesn't change them:
+	syncFn := `function(doc) {channel(doc.group == "G0" ? "A" : doc.group);}`
+	job := newResyncJob(ResyncStatus{Database: db.Name, State: ResyncRunning, Phase: ResyncShadow,
+		SyncFunction: &syncFn, BatchSize: 2})
+	shadowDB := &Database{DatabaseContext: db.DatabaseContext, resync: job}
+	assertNoError(t, shadowDB.resyncAllDocs(job), "resyncAllDocs")
+	status := job.Status()
+	assert.Equals(t, status.DocsProcessed, 3)
+	assert.Equals(t, status.ShadowChanges, 2)
+	assert.Equals(t, status.DocsChanged, 0)
+	for i := 1; i <= 3; i++ {
+		doc, _ := db.GetDocument(fmt.Sprintf("doc%d", i), DocUnmarshalAll)
+		_, inA := doc.Channels["A"]
+		assert.True(t, inA && doc.Channels["A"] == nil)
+		assert.Equals(t, len(doc.Channels), 1)
+	}
+
+	// Meanwhile, writes keep using the database's sync function:
+	_, err := db.Put("doc4", Body{"channels": "A", "group": "G1"})
+	assertNoError(t, err, "Put")
+	doc, _ := db.GetDocument("doc4", DocUnmarshalAll)
+	_, inA := doc.Channels["A"]
+	assert.True(t, inA)
+}
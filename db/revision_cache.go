@@ -23,12 +23,20 @@ type RevisionCacheLoaderFunc func(id IDAndRev) (body Body, history Body, channel
 
 // The cache payload data. Stored as the Value of a list Element.
 type revCacheValue struct {
-	key      IDAndRev   // doc/rev IDs
-	body     Body       // Revision body (a pristine shallow copy)
-	history  Body       // Rev history encoded like a "_revisions" property
-	channels base.Set   // Set of channels that have access
-	err      error      // Error from loaderFunc if it failed
-	lock     sync.Mutex // Synchronizes access to this struct
+	key      IDAndRev       // doc/rev IDs
+	body     Body           // Revision body (a pristine shallow copy)
+	history  Body           // Rev history encoded like a "_revisions" property
+	channels base.Set       // Set of channels that have access
+	err      error          // Error from loaderFunc if it failed
+	delta    *RevisionDelta // Most recently computed delta from another revision to this one
+	lock     sync.Mutex     // Synchronizes access to this struct
+}
+
+// A delta from one revision of a document to another, as created by base.CreateJSONDelta.
+type RevisionDelta struct {
+	FromRevID string // Revision the delta is applied to
+	ToRevID   string // Revision the delta produces
+	Delta     Body   // The delta itself
 }
 
 // Creates a revision cache with the given capacity and an optional loader function.
@@ -98,6 +106,33 @@ func (rc *RevisionCache) Put(docid string, revid string, body Body, history Body
 	value.store(body, history, channels)
 }
 
+// Returns the cached delta from fromRevID to the given revision, or nil if there isn't one.
+// Never loads the revision into the cache.
+func (rc *RevisionCache) GetDelta(docid, fromRevID, toRevID string) *RevisionDelta {
+	value := rc.getValue(docid, toRevID, false)
+	if value != nil {
+		value.lock.Lock()
+		delta := value.delta
+		value.lock.Unlock()
+		if delta != nil && delta.FromRevID == fromRevID {
+			base.StatsExpvars.Add("deltaCache_hits", 1)
+			return delta
+		}
+	}
+	base.StatsExpvars.Add("deltaCache_misses", 1)
+	return nil
+}
+
+// Caches a delta on its target revision, replacing any delta already cached there. Does nothing
+// if the target revision isn't in the cache.
+func (rc *RevisionCache) UpdateDelta(docid string, delta *RevisionDelta) {
+	if value := rc.getValue(docid, delta.ToRevID, false); value != nil {
+		value.lock.Lock()
+		value.delta = delta
+		value.lock.Unlock()
+	}
+}
+
 func (rc *RevisionCache) getValue(docid, revid string, create bool) (value *revCacheValue) {
 	if docid == "" || revid == "" {
 		panic("RevisionCache: invalid empty doc/rev id")
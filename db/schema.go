@@ -0,0 +1,649 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Validates document bodies against JSON Schemas before they're saved. The schema for a document
+// is the first one whose Type matches the document's type property, or whose DocIDPattern
+// matches its ID. Documents that match no schema, and deletions, aren't validated.
+type SchemaOptions struct {
+	TypeProperty string            // Document property that selects a schema by its Type; defaults to "type"
+	Schemas      []*DocumentSchema // Schemas, in order of precedence
+}
+
+// A compiled JSON Schema that applies to some documents.
+type DocumentSchema struct {
+	Name         string         // Name of the schema, used in error messages
+	Type         string         // Value of the type property of documents this schema applies to
+	DocIDPattern *regexp.Regexp // Pattern matching IDs of documents this schema applies to
+	root         *schemaNode
+}
+
+// A way in which a document doesn't match its schema.
+type SchemaViolation struct {
+	Path    string `json:"path"`    // JSON Pointer to the invalid value; "" for the document itself
+	Message string `json:"message"` // What's wrong with it
+}
+
+// Compiles a JSON Schema. Supports the validation keywords of JSON Schema draft 7, except for
+// "format", "dependencies", "if"/"then"/"else" and remote "$ref"s; unknown keywords are ignored,
+// as the spec requires. Local references to "#", "#/definitions/..." and "#/$defs/..." work.
+func NewDocumentSchema(name string, docType string, docIDPattern string, schema interface{}) (*DocumentSchema, error) {
+	docSchema := &DocumentSchema{Name: name, Type: docType}
+	if docIDPattern != "" {
+		var err error
+		if docSchema.DocIDPattern, err = regexp.Compile(docIDPattern); err != nil {
+			return nil, fmt.Errorf("Schema %q: invalid doc ID pattern: %v", name, err)
+		}
+	}
+	defs := &schemaDefinitions{nodes: map[string]*schemaNode{}}
+	root, err := compileSchemaNode(schema, "#", defs)
+	if err != nil {
+		return nil, fmt.Errorf("Schema %q: %v", name, err)
+	}
+	defs.nodes["#"] = root
+	for ref := range defs.refs {
+		if defs.nodes[ref] == nil {
+			return nil, fmt.Errorf("Schema %q: unresolvable $ref %q", name, ref)
+		}
+	}
+	if err := defs.checkCycles(); err != nil {
+		return nil, fmt.Errorf("Schema %q: %v", name, err)
+	}
+	docSchema.root = root
+	return docSchema, nil
+}
+
+// Validates a document body, ignoring its special ("_"-prefixed) properties. Returns nil if valid.
+func (schema *DocumentSchema) Validate(body Body) []SchemaViolation {
+	doc := make(map[string]interface{}, len(body))
+	for key, value := range body {
+		if !strings.HasPrefix(key, "_") {
+			doc[key] = value
+		}
+	}
+	var violations []SchemaViolation
+	schema.root.validate(doc, "", &violations)
+	return violations
+}
+
+// Returns the schema that applies to a document, or nil if none.
+func (options *SchemaOptions) schemaFor(docID string, body Body) *DocumentSchema {
+	typeProperty := options.TypeProperty
+	if typeProperty == "" {
+		typeProperty = "type"
+	}
+	docType, _ := body[typeProperty].(string)
+	for _, schema := range options.Schemas {
+		if (schema.Type != "" && schema.Type == docType) ||
+			(schema.DocIDPattern != nil && schema.DocIDPattern.MatchString(docID)) {
+			return schema
+		}
+	}
+	return nil
+}
+
+// Checks a document body against its schema, if any. Returns a 403 error listing the violations
+// if it doesn't match; the violations are also in the error's "validation_errors" detail.
+func (context *DatabaseContext) validateDocSchema(docID string, body Body) error {
+	if context.Options.SchemaOptions == nil {
+		return nil
+	}
+	schema := context.Options.SchemaOptions.schemaFor(docID, body)
+	if schema == nil {
+		return nil
+	}
+	violations := schema.Validate(body)
+	if len(violations) == 0 {
+		return nil
+	}
+	messages := make([]string, len(violations))
+	for i, violation := range violations {
+		messages[i] = violation.Path + ": " + violation.Message
+	}
+	return base.HTTPErrorWithDetailsf(http.StatusForbidden,
+		map[string]interface{}{"schema": schema.Name, "validation_errors": violations},
+		"Document does not match schema %q: %s", schema.Name, strings.Join(messages, "; "))
+}
+
+//////// SCHEMA COMPILATION
+
+// The definitions a schema's "$ref"s can refer to, keyed by reference.
+type schemaDefinitions struct {
+	nodes map[string]*schemaNode
+	refs  map[string]bool // All references used, to check they exist
+	all   []*schemaNode   // Every subschema, to check for cycles
+}
+
+// Returns an error if a subschema can lead back to itself without descending into the value
+// being validated, through "$ref"s and the "allOf", "anyOf", "oneOf" and "not" keywords; e.g.
+// {"$ref": "#"} at the root, or {"allOf": [{"$ref": "#"}]}. Validating anything against such a
+// schema would recurse forever. (A "$ref" inside "properties" or "items" is fine, since each
+// level of recursion validates a smaller part of the document.)
+func (defs *schemaDefinitions) checkCycles() error {
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := map[*schemaNode]int{}
+	var visit func(node *schemaNode) *schemaNode
+	visit = func(node *schemaNode) *schemaNode {
+		switch state[node] {
+		case visiting:
+			return node
+		case visited:
+			return nil
+		}
+		state[node] = visiting
+		for _, next := range node.sameValueSubschemas() {
+			if cycle := visit(next); cycle != nil {
+				return cycle
+			}
+		}
+		state[node] = visited
+		return nil
+	}
+	for _, node := range defs.all {
+		if cycle := visit(node); cycle != nil {
+			return fmt.Errorf("%s: $ref cycle; the subschema refers back to itself", cycle.path)
+		}
+	}
+	return nil
+}
+
+// A compiled (sub)schema. Nil pointers and empty slices mean the keyword is absent.
+type schemaNode struct {
+	alwaysFails          bool   // The schema is `false`
+	path                 string // Location in the schema, for error messages
+	ref                  string
+	defs                 *schemaDefinitions
+	types                []string
+	enum                 []interface{}
+	constValue           interface{}
+	hasConst             bool
+	properties           map[string]*schemaNode
+	patternProperties    map[*regexp.Regexp]*schemaNode
+	additionalProperties *schemaNode
+	required             []string
+	minProperties        *int
+	maxProperties        *int
+	propertyNames        *schemaNode
+	items                *schemaNode
+	tupleItems           []*schemaNode
+	additionalItems      *schemaNode
+	contains             *schemaNode
+	minItems             *int
+	maxItems             *int
+	uniqueItems          bool
+	minimum              *float64
+	maximum              *float64
+	exclusiveMinimum     *float64
+	exclusiveMaximum     *float64
+	multipleOf           *float64
+	minLength            *int
+	maxLength            *int
+	pattern              *regexp.Regexp
+	allOf                []*schemaNode
+	anyOf                []*schemaNode
+	oneOf                []*schemaNode
+	not                  *schemaNode
+}
+
+func compileSchemaNode(schema interface{}, path string, defs *schemaDefinitions) (*schemaNode, error) {
+	node := &schemaNode{defs: defs, path: path}
+	defs.all = append(defs.all, node)
+	switch schema := schema.(type) {
+	case bool:
+		node.alwaysFails = !schema
+		return node, nil
+	case map[string]interface{}:
+		return node, node.compile(schema, path)
+	default:
+		return nil, fmt.Errorf("%s: a schema must be an object or boolean", path)
+	}
+}
+
+func (node *schemaNode) compile(schema map[string]interface{}, path string) (err error) {
+	sub := func(keyword string, value interface{}) (*schemaNode, error) {
+		return compileSchemaNode(value, path+"/"+keyword, node.defs)
+	}
+	subArray := func(keyword string, value interface{}) ([]*schemaNode, error) {
+		array, ok := value.([]interface{})
+		if !ok || len(array) == 0 {
+			return nil, fmt.Errorf("%s/%s: must be a non-empty array", path, keyword)
+		}
+		nodes := make([]*schemaNode, len(array))
+		for i, item := range array {
+			if nodes[i], err = compileSchemaNode(item, fmt.Sprintf("%s/%s/%d", path, keyword, i), node.defs); err != nil {
+				return nil, err
+			}
+		}
+		return nodes, nil
+	}
+	subMap := func(keyword string, value interface{}) (map[string]*schemaNode, error) {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s/%s: must be an object", path, keyword)
+		}
+		nodes := make(map[string]*schemaNode, len(object))
+		for key, item := range object {
+			if nodes[key], err = compileSchemaNode(item, path+"/"+keyword+"/"+key, node.defs); err != nil {
+				return nil, err
+			}
+		}
+		return nodes, nil
+	}
+	count := func(keyword string, value interface{}) (*int, error) {
+		n, ok := value.(float64)
+		if !ok || n < 0 || n != math.Trunc(n) {
+			return nil, fmt.Errorf("%s/%s: must be a non-negative integer", path, keyword)
+		}
+		result := int(n)
+		return &result, nil
+	}
+	number := func(keyword string, value interface{}) (*float64, error) {
+		n, ok := value.(float64)
+		if !ok {
+			return nil, fmt.Errorf("%s/%s: must be a number", path, keyword)
+		}
+		return &n, nil
+	}
+
+	for keyword, value := range schema {
+		switch keyword {
+		case "$ref":
+			ref, ok := value.(string)
+			if !ok || (ref != "#" && !strings.HasPrefix(ref, "#/definitions/") && !strings.HasPrefix(ref, "#/$defs/")) {
+				return fmt.Errorf("%s/$ref: only local references are supported", path)
+			}
+			node.ref = ref
+			if node.defs.refs == nil {
+				node.defs.refs = map[string]bool{}
+			}
+			node.defs.refs[ref] = true
+		case "definitions", "$defs":
+			var nodes map[string]*schemaNode
+			if nodes, err = subMap(keyword, value); err != nil {
+				return err
+			}
+			for name, def := range nodes {
+				node.defs.nodes["#/"+keyword+"/"+name] = def
+			}
+		case "type":
+			switch value := value.(type) {
+			case string:
+				node.types = []string{value}
+			case []interface{}:
+				for _, item := range value {
+					if typeName, ok := item.(string); ok {
+						node.types = append(node.types, typeName)
+					}
+				}
+			}
+			if len(node.types) == 0 {
+				return fmt.Errorf("%s/type: must be a type name or array of them", path)
+			}
+			for _, typeName := range node.types {
+				if typeName != "integer" && !isSelectorTypeName(typeName) {
+					return fmt.Errorf("%s/type: unknown type %q", path, typeName)
+				}
+			}
+		case "enum":
+			var ok bool
+			if node.enum, ok = value.([]interface{}); !ok {
+				return fmt.Errorf("%s/enum: must be an array", path)
+			}
+		case "const":
+			node.constValue, node.hasConst = value, true
+		case "properties":
+			node.properties, err = subMap(keyword, value)
+		case "patternProperties":
+			var nodes map[string]*schemaNode
+			if nodes, err = subMap(keyword, value); err != nil {
+				return err
+			}
+			node.patternProperties = make(map[*regexp.Regexp]*schemaNode, len(nodes))
+			for pattern, def := range nodes {
+				regex, err := regexp.Compile(pattern)
+				if err != nil {
+					return fmt.Errorf("%s/patternProperties: %v", path, err)
+				}
+				node.patternProperties[regex] = def
+			}
+		case "additionalProperties":
+			node.additionalProperties, err = sub(keyword, value)
+		case "required":
+			array, ok := value.([]interface{})
+			if !ok {
+				return fmt.Errorf("%s/required: must be an array of property names", path)
+			}
+			for _, item := range array {
+				name, ok := item.(string)
+				if !ok {
+					return fmt.Errorf("%s/required: must be an array of property names", path)
+				}
+				node.required = append(node.required, name)
+			}
+		case "minProperties":
+			node.minProperties, err = count(keyword, value)
+		case "maxProperties":
+			node.maxProperties, err = count(keyword, value)
+		case "propertyNames":
+			node.propertyNames, err = sub(keyword, value)
+		case "items":
+			if _, isArray := value.([]interface{}); isArray {
+				node.tupleItems, err = subArray(keyword, value)
+			} else {
+				node.items, err = sub(keyword, value)
+			}
+		case "additionalItems":
+			node.additionalItems, err = sub(keyword, value)
+		case "contains":
+			node.contains, err = sub(keyword, value)
+		case "minItems":
+			node.minItems, err = count(keyword, value)
+		case "maxItems":
+			node.maxItems, err = count(keyword, value)
+		case "uniqueItems":
+			node.uniqueItems, _ = value.(bool)
+		case "minimum":
+			node.minimum, err = number(keyword, value)
+		case "maximum":
+			node.maximum, err = number(keyword, value)
+		case "exclusiveMinimum":
+			node.exclusiveMinimum, err = number(keyword, value)
+		case "exclusiveMaximum":
+			node.exclusiveMaximum, err = number(keyword, value)
+		case "multipleOf":
+			if node.multipleOf, err = number(keyword, value); err == nil && *node.multipleOf <= 0 {
+				err = fmt.Errorf("%s/multipleOf: must be greater than 0", path)
+			}
+		case "minLength":
+			node.minLength, err = count(keyword, value)
+		case "maxLength":
+			node.maxLength, err = count(keyword, value)
+		case "pattern":
+			pattern, ok := value.(string)
+			if !ok {
+				return fmt.Errorf("%s/pattern: must be a string", path)
+			}
+			if node.pattern, err = regexp.Compile(pattern); err != nil {
+				return fmt.Errorf("%s/pattern: %v", path, err)
+			}
+		case "allOf":
+			node.allOf, err = subArray(keyword, value)
+		case "anyOf":
+			node.anyOf, err = subArray(keyword, value)
+		case "oneOf":
+			node.oneOf, err = subArray(keyword, value)
+		case "not":
+			node.not, err = sub(keyword, value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//////// VALIDATION
+
+// Returns true if the value matches the schema, without collecting violations.
+func (node *schemaNode) matches(value interface{}) bool {
+	var violations []SchemaViolation
+	node.validate(value, "", &violations)
+	return len(violations) == 0
+}
+
+// The subschemas that validate the same value as this one.
+func (node *schemaNode) sameValueSubschemas() []*schemaNode {
+	if node.ref != "" {
+		return []*schemaNode{node.defs.nodes[node.ref]}
+	}
+	result := make([]*schemaNode, 0, len(node.allOf)+len(node.anyOf)+len(node.oneOf)+1)
+	result = append(result, node.allOf...)
+	result = append(result, node.anyOf...)
+	result = append(result, node.oneOf...)
+	if node.not != nil {
+		result = append(result, node.not)
+	}
+	return result
+}
+
+// Validates a value, appending any violations. path is the JSON Pointer to the value.
+func (node *schemaNode) validate(value interface{}, path string, violations *[]SchemaViolation) {
+	fail := func(format string, args ...interface{}) {
+		*violations = append(*violations, SchemaViolation{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if node.alwaysFails {
+		fail("is not allowed")
+		return
+	}
+	if node.ref != "" {
+		// As in draft 7, other keywords alongside "$ref" are ignored:
+		node.defs.nodes[node.ref].validate(value, path, violations)
+		return
+	}
+
+	if len(node.types) > 0 && !matchesSchemaType(value, node.types) {
+		fail("must be of type %s", strings.Join(node.types, " or "))
+		return // Further checks would only produce noise
+	}
+	if node.enum != nil {
+		found := false
+		for _, item := range node.enum {
+			if selectorValuesEqual(value, item) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fail("must be one of the allowed values")
+		}
+	}
+	if node.hasConst && !selectorValuesEqual(value, node.constValue) {
+		fail("must be equal to %v", node.constValue)
+	}
+
+	switch value := value.(type) {
+	case map[string]interface{}:
+		node.validateObject(value, path, violations, fail)
+	case Body:
+		node.validateObject(value, path, violations, fail)
+	case []interface{}:
+		node.validateArray(value, path, violations, fail)
+	case string:
+		length := utf8.RuneCountInString(value)
+		if node.minLength != nil && length < *node.minLength {
+			fail("must be at least %d characters long", *node.minLength)
+		}
+		if node.maxLength != nil && length > *node.maxLength {
+			fail("must be at most %d characters long", *node.maxLength)
+		}
+		if node.pattern != nil && !node.pattern.MatchString(value) {
+			fail("must match the pattern %q", node.pattern.String())
+		}
+	default:
+		if n, ok := comparableValue(value); ok {
+			node.validateNumber(n.(float64), fail)
+		}
+	}
+
+	for _, sub := range node.allOf {
+		sub.validate(value, path, violations)
+	}
+	if len(node.anyOf) > 0 {
+		matched := false
+		for _, sub := range node.anyOf {
+			if sub.matches(value) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			fail("must match at least one of the schemas in anyOf")
+		}
+	}
+	if len(node.oneOf) > 0 {
+		matched := 0
+		for _, sub := range node.oneOf {
+			if sub.matches(value) {
+				matched++
+			}
+		}
+		if matched != 1 {
+			fail("must match exactly one of the schemas in oneOf, but matches %d", matched)
+		}
+	}
+	if node.not != nil && node.not.matches(value) {
+		fail("must not match the schema in not")
+	}
+}
+
+func (node *schemaNode) validateObject(object map[string]interface{}, path string, violations *[]SchemaViolation, fail func(string, ...interface{})) {
+	for _, name := range node.required {
+		if _, found := object[name]; !found {
+			*violations = append(*violations, SchemaViolation{Path: path + "/" + escapeJSONPointer(name), Message: "is required"})
+		}
+	}
+	if node.minProperties != nil && len(object) < *node.minProperties {
+		fail("must have at least %d properties", *node.minProperties)
+	}
+	if node.maxProperties != nil && len(object) > *node.maxProperties {
+		fail("must have at most %d properties", *node.maxProperties)
+	}
+
+	// Visit properties in order, so violations are reported consistently:
+	names := make([]string, 0, len(object))
+	for name := range object {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		propPath := path + "/" + escapeJSONPointer(name)
+		value := object[name]
+		if node.propertyNames != nil && !node.propertyNames.matches(name) {
+			*violations = append(*violations, SchemaViolation{Path: propPath, Message: "property name is not allowed"})
+		}
+		matched := false
+		if propSchema := node.properties[name]; propSchema != nil {
+			propSchema.validate(value, propPath, violations)
+			matched = true
+		}
+		for regex, propSchema := range node.patternProperties {
+			if regex.MatchString(name) {
+				propSchema.validate(value, propPath, violations)
+				matched = true
+			}
+		}
+		if !matched && node.additionalProperties != nil {
+			if node.additionalProperties.alwaysFails {
+				*violations = append(*violations, SchemaViolation{Path: propPath, Message: "is not an allowed property"})
+			} else {
+				node.additionalProperties.validate(value, propPath, violations)
+			}
+		}
+	}
+}
+
+func (node *schemaNode) validateArray(array []interface{}, path string, violations *[]SchemaViolation, fail func(string, ...interface{})) {
+	if node.minItems != nil && len(array) < *node.minItems {
+		fail("must have at least %d items", *node.minItems)
+	}
+	if node.maxItems != nil && len(array) > *node.maxItems {
+		fail("must have at most %d items", *node.maxItems)
+	}
+	if node.uniqueItems {
+	outer:
+		for i := 1; i < len(array); i++ {
+			for j := 0; j < i; j++ {
+				if selectorValuesEqual(array[i], array[j]) {
+					fail("must not contain duplicate items")
+					break outer
+				}
+			}
+		}
+	}
+	for i, item := range array {
+		itemPath := fmt.Sprintf("%s/%d", path, i)
+		if node.items != nil {
+			node.items.validate(item, itemPath, violations)
+		} else if i < len(node.tupleItems) {
+			node.tupleItems[i].validate(item, itemPath, violations)
+		} else if node.tupleItems != nil && node.additionalItems != nil {
+			node.additionalItems.validate(item, itemPath, violations)
+		}
+	}
+	if node.contains != nil {
+		found := false
+		for _, item := range array {
+			if node.contains.matches(item) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fail("must contain an item matching the schema in contains")
+		}
+	}
+}
+
+func (node *schemaNode) validateNumber(n float64, fail func(string, ...interface{})) {
+	if node.minimum != nil && n < *node.minimum {
+		fail("must be >= %v", *node.minimum)
+	}
+	if node.maximum != nil && n > *node.maximum {
+		fail("must be <= %v", *node.maximum)
+	}
+	if node.exclusiveMinimum != nil && n <= *node.exclusiveMinimum {
+		fail("must be > %v", *node.exclusiveMinimum)
+	}
+	if node.exclusiveMaximum != nil && n >= *node.exclusiveMaximum {
+		fail("must be < %v", *node.exclusiveMaximum)
+	}
+	if node.multipleOf != nil {
+		quotient := n / *node.multipleOf
+		if quotient != math.Trunc(quotient) {
+			fail("must be a multiple of %v", *node.multipleOf)
+		}
+	}
+}
+
+func matchesSchemaType(value interface{}, types []string) bool {
+	valueType := selectorTypeName(value)
+	for _, typeName := range types {
+		if typeName == valueType {
+			return true
+		} else if typeName == "integer" && valueType == "number" {
+			n, _ := comparableValue(value)
+			if f := n.(float64); f == math.Trunc(f) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Escapes a property name for use in a JSON Pointer (RFC 6901).
+func escapeJSONPointer(name string) string {
+	return strings.Replace(strings.Replace(name, "~", "~0", -1), "/", "~1", -1)
+}
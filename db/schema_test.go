@@ -0,0 +1,144 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+const kTestOrderSchema = `{
+	"type": "object",
+	"required": ["customer", "items"],
+	"additionalProperties": false,
+	"properties": {
+		"type": {"const": "order"},
+		"customer": {"type": "string", "minLength": 1},
+		"status": {"enum": ["new", "shipped"]},
+		"items": {"type": "array", "minItems": 1, "items": {"$ref": "#/definitions/item"}},
+		"notes": {"type": ["string", "null"], "maxLength": 10}
+	},
+	"definitions": {
+		"item": {
+			"type": "object",
+			"required": ["sku", "qty"],
+			"properties": {
+				"sku": {"type": "string", "pattern": "^[A-Z]{3}-\\d+$"},
+				"qty": {"type": "integer", "minimum": 1, "exclusiveMaximum": 100}
+			}
+		}
+	}
+}`
+
+func compileTestSchema(t *testing.T, schemaJSON string) *DocumentSchema {
+	var schema interface{}
+	assert.Equals(t, json.Unmarshal([]byte(schemaJSON), &schema), nil)
+	docSchema, err := NewDocumentSchema("order", "order", "", schema)
+	assert.Equals(t, err, nil)
+	return docSchema
+}
+
+func validateTestDoc(schema *DocumentSchema, docJSON string) []SchemaViolation {
+	var body Body
+	json.Unmarshal([]byte(docJSON), &body)
+	return schema.Validate(body)
+}
+
+func TestSchemaValidation(t *testing.T) {
+	schema := compileTestSchema(t, kTestOrderSchema)
+
+	// Valid docs; special properties are ignored:
+	assert.Equals(t, len(validateTestDoc(schema, `{"_id":"o1", "_rev":"1-a", "type":"order", "customer":"alice",
+		"items":[{"sku":"ABC-1", "qty":2}], "notes":null}`)), 0)
+	assert.Equals(t, len(validateTestDoc(schema, `{"customer":"bob", "status":"new", "items":[{"sku":"XYZ-99", "qty":99}]}`)), 0)
+
+	// Each violation is reported with the path to the value:
+	violations := validateTestDoc(schema, `{"type":"invoice", "customer":"", "status":"lost", "bogus":1,
+		"items":[{"sku":"abc", "qty":1.5}, {"qty":100}], "notes":"far too long"}`)
+	assert.DeepEquals(t, violations, []SchemaViolation{
+		{"/bogus", "is not an allowed property"},
+		{"/customer", "must be at least 1 characters long"},
+		{"/items/0/qty", "must be of type integer"},
+		{"/items/0/sku", `must match the pattern "^[A-Z]{3}-\\d+$"`},
+		{"/items/1/sku", "is required"},
+		{"/items/1/qty", "must be < 100"},
+		{"/notes", "must be at most 10 characters long"},
+		{"/status", "must be one of the allowed values"},
+		{"/type", "must be equal to order"},
+	})
+
+	violations = validateTestDoc(schema, `{"items":[]}`)
+	assert.DeepEquals(t, violations, []SchemaViolation{
+		{"/customer", "is required"},
+		{"/items", "must have at least 1 items"},
+	})
+
+	violations = validateTestDoc(schema, `{"customer":7, "items":"none"}`)
+	assert.Equals(t, len(violations), 2)
+	assert.Equals(t, violations[0].Message, "must be of type string")
+}
+
+func TestSchemaCombinators(t *testing.T) {
+	schema := compileTestSchema(t, `{
+		"properties": {
+			"id": {"oneOf": [{"type": "string"}, {"type": "integer", "multipleOf": 2}]},
+			"tags": {"type": "array", "uniqueItems": true, "contains": {"const": "main"}},
+			"color": {"anyOf": [{"const": "red"}, {"const": "blue"}], "not": {"const": "blue"}}
+		}
+	}`)
+	assert.Equals(t, len(validateTestDoc(schema, `{"id":"x", "tags":["main","b"], "color":"red"}`)), 0)
+	assert.Equals(t, len(validateTestDoc(schema, `{"id":4}`)), 0)
+	assert.Equals(t, len(validateTestDoc(schema, `{"id":3}`)), 1)
+	assert.Equals(t, len(validateTestDoc(schema, `{"tags":["a","a"]}`)), 2)
+	assert.Equals(t, len(validateTestDoc(schema, `{"color":"blue"}`)), 1)
+	assert.Equals(t, len(validateTestDoc(schema, `{"color":"green"}`)), 1)
+
+	// Invalid schemas:
+	for _, schemaJSON := range []string{`"string"`, `{"type":"float"}`, `{"minLength":-1}`,
+		`{"pattern":"("}`, `{"$ref":"http://example.com/schema"}`, `{"$ref":"#/definitions/missing"}`,
+		`{"properties":{"a":{"allOf":[]}}}`,
+		// $ref cycles that would recurse forever:
+		`{"$ref":"#"}`, `{"allOf":[{"$ref":"#"}]}`,
+		`{"definitions":{"a":{"$ref":"#/definitions/a"}}, "properties":{"x":{"$ref":"#/definitions/a"}}}`,
+		`{"$defs":{"a":{"not":{"$ref":"#/$defs/b"}}, "b":{"anyOf":[{"$ref":"#/$defs/a"}]}}}`} {
+		var schema interface{}
+		assert.Equals(t, json.Unmarshal([]byte(schemaJSON), &schema), nil)
+		_, err := NewDocumentSchema("bad", "bad", "", schema)
+		assert.True(t, err != nil)
+	}
+}
+
+func TestSchemaRecursion(t *testing.T) {
+	// Recursion is fine as long as each level descends into the document:
+	schema := compileTestSchema(t, `{
+		"definitions": {"node": {"properties": {"children": {"type": "array", "items": {"$ref": "#/definitions/node"}}},
+		                         "required": ["name"]}},
+		"allOf": [{"$ref": "#/definitions/node"}]
+	}`)
+	assert.Equals(t, len(validateTestDoc(schema, `{"name":"a", "children":[{"name":"b", "children":[{"name":"c"}]}]}`)), 0)
+	assert.Equals(t, len(validateTestDoc(schema, `{"name":"a", "children":[{"name":"b", "children":[{}]}]}`)), 1)
+}
+
+func TestSchemaSelection(t *testing.T) {
+	orderSchema := compileTestSchema(t, kTestOrderSchema)
+	userSchema, err := NewDocumentSchema("user", "", "^user::", map[string]interface{}{"required": []interface{}{"email"}})
+	assert.Equals(t, err, nil)
+	options := &SchemaOptions{Schemas: []*DocumentSchema{orderSchema, userSchema}}
+
+	assert.Equals(t, options.schemaFor("o1", Body{"type": "order"}), orderSchema)
+	assert.Equals(t, options.schemaFor("user::alice", Body{}), userSchema)
+	assert.True(t, options.schemaFor("misc", Body{"type": "note"}) == nil)
+
+	options.TypeProperty = "kind"
+	assert.True(t, options.schemaFor("o1", Body{"type": "order"}) == nil)
+	assert.Equals(t, options.schemaFor("o1", Body{"kind": "order"}), orderSchema)
+}
@@ -46,3 +46,9 @@ func (stats *Statistics) Reset() {
 	stats.totalCount = 0
 	stats.lock.Unlock()
 }
+
+func (stats *Statistics) CurrentCount() uint32 {
+	stats.lock.RLock()
+	defer stats.lock.RUnlock()
+	return stats.currentCount
+}
@@ -0,0 +1,89 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"github.com/couchbase/sync_gateway/auth"
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
+)
+
+// The outcome of running the sync function on a document without saving it.
+type SyncFnDryRunResult struct {
+	Channels  base.Set           `json:"channels"`            // Channels the doc would be assigned to
+	Access    channels.AccessMap `json:"access"`              // Channels granted to users/roles by access()
+	Roles     channels.AccessMap `json:"roles"`               // Roles granted to users by role()
+	Expiry    *uint32            `json:"expiry,omitempty"`    // Expiry set by expiry(), if any
+	Rejection *SyncFnRejection   `json:"rejection,omitempty"` // Set if the doc was rejected by reject() or require*()
+	Exception string             `json:"exception,omitempty"` // Set if the sync function threw an exception
+	Error     string             `json:"error,omitempty"`     // Set if the output is invalid, e.g. a bad principal name
+}
+
+// A rejection of a document by the sync function.
+type SyncFnRejection struct {
+	Status int    `json:"status"`
+	Reason string `json:"reason"`
+}
+
+// Runs a sync function on a document, as though it were being saved, and returns the outcome.
+// Nothing is written to the bucket. If syncFn is empty, the database's sync function is used,
+// or in a namespaced database, that of the namespace of the doc (identified by its "_id".)
+// oldBodyJSON is the JSON of the current revision, or "" for a new doc. The doc is saved as user,
+// if non-nil; else userCtx is the context of the user saving the doc, or nil for an admin.
+func (context *DatabaseContext) SyncFnDryRun(body Body, oldBodyJSON string, user auth.User, userCtx map[string]interface{}, syncFn string) *SyncFnDryRunResult {
+	result := &SyncFnDryRunResult{}
+	mapper := context.GetChannelMapper()
+	var namespace string
+	if syncFn != "" {
+		mapper = channels.NewChannelMapper(syncFn)
+	} else {
+		docID, _ := body["_id"].(string)
+		var ns *Namespace
+		var err error
+		if namespace, ns, err = context.namespaceOf(docID, body, oldBodyJSON); err != nil {
+			result.Error = err.Error()
+			return result
+		} else if ns != nil {
+			mapper = ns.ChannelMapper
+		}
+	}
+	if mapper == nil {
+		mapper = channels.NewDefaultChannelMapper()
+	}
+	if user != nil && namespace != "" {
+		userCtx = makeNamespaceUserCtx(user, namespace)
+	} else if user != nil {
+		userCtx = MakeUserCtx(user)
+	}
+
+	output, err := mapper.MapToChannelsAndAccess(body, oldBodyJSON, userCtx)
+	if err != nil {
+		result.Exception = err.Error()
+		return result
+	}
+	if namespace != "" {
+		output.AddNamespace(namespace)
+	}
+	result.Channels = output.Channels
+	result.Access = output.Access
+	result.Roles = output.Roles
+	result.Expiry = output.Expiry
+	if output.Rejection != nil {
+		status, reason := base.ErrorAsHTTPStatus(output.Rejection)
+		result.Rejection = &SyncFnRejection{Status: status, Reason: reason}
+	} else if !validateAccessMap(output.Access) || !validateRoleAccessMap(output.Roles) {
+		result.Error = "Invalid principal name in access() or role() call"
+	} else if namespace == "" && syncFn == "" {
+		if err := context.checkNotNamespaced(output); err != nil {
+			result.Error = err.Error()
+		}
+	}
+	return result
+}
@@ -1,6 +1,7 @@
 package db
 
 import (
+	"bytes"
 	"net/http"
 
 	"github.com/couchbase/sync_gateway/auth"
@@ -18,9 +19,14 @@ type PrincipalConfig struct {
 	// Fields below only apply to Users, not Roles:
 	Email             string   `json:"email,omitempty"`
 	Disabled          bool     `json:"disabled,omitempty"`
+	Namespace         string   `json:"namespace,omitempty"`
 	Password          *string  `json:"password,omitempty"`
 	ExplicitRoleNames []string `json:"admin_roles,omitempty"`
 	RoleNames         []string `json:"roles,omitempty"`
+	passwordHash      []byte   // bcrypt hash to set the password from, instead of Password; see ImportPrincipal
+	// Output only, where channels and roles came from; see GrantProvenance:
+	ChannelProvenance auth.GrantProvenance `json:"channel_provenance,omitempty"`
+	RoleProvenance    auth.GrantProvenance `json:"role_provenance,omitempty"`
 }
 
 // Check if the password in this PrincipalConfig is valid.  Only allow
@@ -73,6 +79,7 @@ func (dbc *DatabaseContext) GetPrincipal(name string, isUser bool) (info *Princi
 		info.Channels = user.InheritedChannels().AsSet()
 		info.Email = user.Email()
 		info.Disabled = user.Disabled()
+		info.Namespace = user.Namespace()
 		info.ExplicitRoleNames = user.ExplicitRoles().AllChannels()
 		info.RoleNames = user.RoleNames().AllChannels()
 	} else {
@@ -85,27 +92,41 @@ func (dbc *DatabaseContext) GetPrincipal(name string, isUser bool) (info *Princi
 func (dbc *DatabaseContext) UpdatePrincipal(newInfo PrincipalConfig, isUser bool, allowReplace bool) (replaced bool, err error) {
 	// Get the existing principal, or if this is a POST make sure there isn't one:
 	var princ auth.Principal
-	var user auth.User
 	authenticator := dbc.Authenticator()
 	if isUser {
+		var user auth.User
 		user, err = authenticator.GetUser(*newInfo.Name)
-		princ = user
+		if user != nil {
+			princ = user
+		}
 	} else {
 		princ, err = authenticator.GetRole(*newInfo.Name)
 	}
 	if err != nil {
 		return
 	}
+	return dbc.updatePrincipal(princ, newInfo, isUser, allowReplace)
+}
+
+// Updates a principal, or creates it if princ is nil, from a PrincipalConfig structure.
+func (dbc *DatabaseContext) updatePrincipal(princ auth.Principal, newInfo PrincipalConfig, isUser bool, allowReplace bool) (replaced bool, err error) {
+	var user auth.User
+	if princ != nil && isUser {
+		user = princ.(auth.User)
+	}
+	authenticator := dbc.Authenticator()
 
 	changed := false
 	replaced = (princ != nil)
 	if !replaced {
 		// If user/role didn't exist already, instantiate a new one:
 		if isUser {
-			isValid, reason := newInfo.IsPasswordValid(dbc.AllowEmptyPassword)
-			if !isValid {
-				err = base.HTTPErrorf(http.StatusBadRequest, reason)
-				return
+			if newInfo.passwordHash == nil {
+				isValid, reason := newInfo.IsPasswordValid(dbc.AllowEmptyPassword)
+				if !isValid {
+					err = base.HTTPErrorf(http.StatusBadRequest, reason)
+					return
+				}
 			}
 			user, err = authenticator.NewUser(*newInfo.Name, "", nil)
 			princ = user
@@ -127,6 +148,12 @@ func (dbc *DatabaseContext) UpdatePrincipal(newInfo PrincipalConfig, isUser bool
 		}
 	}
 
+	if isUser && newInfo.Password != nil && *newInfo.Password != "" {
+		if err = authenticator.CheckPasswordPolicy(*newInfo.Password); err != nil {
+			return
+		}
+	}
+
 	updatedChannels := princ.ExplicitChannels()
 	if updatedChannels == nil {
 		updatedChannels = ch.TimedSet{}
@@ -146,11 +173,24 @@ func (dbc *DatabaseContext) UpdatePrincipal(newInfo PrincipalConfig, isUser bool
 		if newInfo.Password != nil {
 			user.SetPassword(*newInfo.Password)
 			changed = true
+		} else if newInfo.passwordHash != nil && !bytes.Equal(newInfo.passwordHash, user.PasswordHash()) {
+			if err = user.SetPasswordHash(newInfo.passwordHash); err != nil {
+				return
+			}
+			changed = true
 		}
 		if newInfo.Disabled != user.Disabled() {
 			user.SetDisabled(newInfo.Disabled)
 			changed = true
 		}
+		if newInfo.Namespace != user.Namespace() {
+			if newInfo.Namespace != "" && !dbc.HasNamespace(newInfo.Namespace) {
+				err = base.HTTPErrorf(http.StatusBadRequest, "Unknown namespace %q", newInfo.Namespace)
+				return
+			}
+			user.SetNamespace(newInfo.Namespace)
+			changed = true
+		}
 
 		updatedRoles = user.ExplicitRoles()
 		if updatedRoles == nil {
@@ -185,7 +225,21 @@ func (dbc *DatabaseContext) UpdatePrincipal(newInfo PrincipalConfig, isUser bool
 				user.SetExplicitRoles(updatedRoles)
 			}
 		}
+		action := "created"
+		if replaced {
+			action = "updated"
+		}
+		if nextSeq > 0 {
+			// The change cache raises the event when the change arrives on the feed, which may be
+			// before Save returns:
+			dbc.EventMgr.notePrincipalAction(nextSeq, action)
+		}
 		err = authenticator.Save(princ)
+		if err != nil {
+			dbc.EventMgr.forgetPrincipalAction(nextSeq)
+		} else if nextSeq == 0 {
+			dbc.EventMgr.RaisePrincipalChangeEvent(princ.Name(), isUser, action)
+		}
 	}
 	return
 }
@@ -10,6 +10,8 @@
 package rest
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -43,6 +45,7 @@ func (h *handler) handleCreateDB() error {
 	if _, err := h.server.AddDatabaseFromConfig(config); err != nil {
 		return err
 	}
+	h.audit(base.AuditConfigChange, "", map[string]interface{}{"action": "create_db", "db": dbName})
 	return base.HTTPErrorf(http.StatusCreated, "created")
 }
 
@@ -122,6 +125,7 @@ func (h *handler) handlePutDbConfig() error {
 	h.server.lock.Lock()
 	defer h.server.lock.Unlock()
 	h.server.config.Databases[dbName] = config
+	h.audit(base.AuditConfigChange, "", map[string]interface{}{"action": "update_db_config"})
 
 	return base.HTTPErrorf(http.StatusCreated, "created")
 }
@@ -132,6 +136,7 @@ func (h *handler) handleDeleteDB() error {
 	if !h.server.RemoveDatabase(h.db.Name) {
 		return base.HTTPErrorf(http.StatusNotFound, "missing")
 	}
+	h.audit(base.AuditConfigChange, "", map[string]interface{}{"action": "delete_db"})
 	h.response.Write([]byte("{}"))
 	return nil
 }
@@ -146,6 +151,14 @@ func (h *handler) handleReplicate() error {
 		return err
 	}
 
+	var in ReplicationConfig
+	if err = json.Unmarshal(body, &in); err != nil {
+		return err
+	}
+	if in.Protocol == kBlipReplicationProtocol || (in.Cancel && h.server.blipReplicator.HasReplication(in.ReplicationId)) {
+		return h.handleBlipReplicate(in)
+	}
+
 	params, cancel, _, err := h.readReplicationParametersFromJSON(body)
 
 	if err != nil {
@@ -162,6 +175,20 @@ func (h *handler) handleReplicate() error {
 
 }
 
+// Starts or cancels an active replication using the BLIP sync protocol.
+func (h *handler) handleBlipReplicate(in ReplicationConfig) error {
+	params, cancel, err := validateBlipReplicationParameters(in, false)
+	if err != nil {
+		return err
+	}
+
+	replication, err := h.server.blipReplicator.Replicate(params, cancel)
+	if err == nil {
+		h.writeJSON(replication)
+	}
+	return err
+}
+
 type ReplicationConfig struct {
 	Source           string      `json:"source"`
 	Target           string      `json:"target"`
@@ -175,6 +202,7 @@ type ReplicationConfig struct {
 	Async            bool        `json:"async"`
 	ChangesFeedLimit *int        `json:"changes_feed_limit"`
 	ReplicationId    string      `json:"replication_id"`
+	Protocol         string      `json:"protocol,omitempty"` // "blip" for the built-in BLIP replicator
 }
 
 func (h *handler) readReplicationParametersFromJSON(jsonData []byte) (params sgreplicate.ReplicationParameters, cancel bool, localdb bool, err error) {
@@ -259,33 +287,9 @@ func validateReplicationParameters(requestParams ReplicationConfig, paramsFromCo
 				return
 			}
 
-			//The Channels may be passed as a JSON array of strings directly
-			//or embedded in a JSON object with the "channels" property and array value
-			var chanarray []interface{}
-
-			if paramsmap, ok := requestParams.QueryParams.(map[string]interface{}); ok {
-				if chanarray, ok = paramsmap["channels"].([]interface{}); !ok {
-					err = base.HTTPErrorf(http.StatusBadRequest, "/_replicate sync_gateway/bychannel filter; query_params missing channels property")
-					return
-				}
-			} else if chanarray, ok = requestParams.QueryParams.([]interface{}); ok {
-				// query params is an array and chanarray has been set, now drop out of if-then-else for processing
-			} else {
-				err = base.HTTPErrorf(http.StatusBadRequest, "/_replicate sync_gateway/bychannel filter; Bad channels array")
+			if params.Channels, err = channelsFromReplicationQueryParams(requestParams.QueryParams); err != nil {
 				return
 			}
-			if len(chanarray) > 0 {
-				channels := make([]string, len(chanarray))
-				for i := range chanarray {
-					if channel, ok := chanarray[i].(string); ok {
-						channels[i] = channel
-					} else {
-						err = base.HTTPErrorf(http.StatusBadRequest, "/_replicate sync_gateway/bychannel filter; Bad channel name")
-						return
-					}
-				}
-				params.Channels = channels
-			}
 		} else {
 			err = base.HTTPErrorf(http.StatusBadRequest, "/_replicate Unknown filter; try sync_gateway/bychannel")
 			return
@@ -307,8 +311,113 @@ func validateReplicationParameters(requestParams ReplicationConfig, paramsFromCo
 	return params, requestParams.Cancel, localdb, nil
 }
 
+// Parses the channel names out of the query_params of a sync_gateway/bychannel replication.
+func channelsFromReplicationQueryParams(queryParams interface{}) ([]string, error) {
+	//The Channels may be passed as a JSON array of strings directly
+	//or embedded in a JSON object with the "channels" property and array value
+	var chanarray []interface{}
+
+	if paramsmap, ok := queryParams.(map[string]interface{}); ok {
+		if chanarray, ok = paramsmap["channels"].([]interface{}); !ok {
+			return nil, base.HTTPErrorf(http.StatusBadRequest, "/_replicate sync_gateway/bychannel filter; query_params missing channels property")
+		}
+	} else if chanarray, ok = queryParams.([]interface{}); ok {
+		// query params is an array and chanarray has been set, now drop out of if-then-else for processing
+	} else {
+		return nil, base.HTTPErrorf(http.StatusBadRequest, "/_replicate sync_gateway/bychannel filter; Bad channels array")
+	}
+	if len(chanarray) == 0 {
+		return nil, nil
+	}
+	channels := make([]string, len(chanarray))
+	for i := range chanarray {
+		if channel, ok := chanarray[i].(string); ok {
+			channels[i] = channel
+		} else {
+			return nil, base.HTTPErrorf(http.StatusBadRequest, "/_replicate sync_gateway/bychannel filter; Bad channel name")
+		}
+	}
+	return channels, nil
+}
+
 func (h *handler) handleActiveTasks() error {
-	h.writeJSON(h.server.replicator.ActiveTasks())
+	tasks := []interface{}{}
+	for _, task := range h.server.replicator.ActiveTasks() {
+		tasks = append(tasks, task)
+	}
+	for _, task := range h.server.blipReplicator.ActiveTasks() {
+		tasks = append(tasks, task)
+	}
+	for _, dbc := range h.server.AllDatabases() {
+		for _, task := range dbc.Maintenance.ActiveTasks() {
+			tasks = append(tasks, task)
+		}
+		if task := dbc.ActiveResync(); task != nil {
+			tasks = append(tasks, task)
+		}
+	}
+	h.writeJSON(tasks)
+	return nil
+}
+
+//////// MAINTENANCE JOBS:
+
+// GET /db/_maintenance lists the status of every type of maintenance job.
+func (h *handler) handleGetMaintenance() error {
+	h.writeJSON(h.db.Maintenance.AllStatus())
+	return nil
+}
+
+// GET /db/_maintenance/{job}
+func (h *handler) handleGetMaintenanceJob() error {
+	status, err := h.db.Maintenance.Status(db.MaintenanceJobType(h.PathVar("job")))
+	if err != nil {
+		return err
+	}
+	h.writeJSON(status)
+	return nil
+}
+
+// POST /db/_maintenance/{job} starts a job, with optional dry_run, batch_size and batch_delay_ms
+// query parameters.
+func (h *handler) handleStartMaintenanceJob() error {
+	jobType := db.MaintenanceJobType(h.PathVar("job"))
+	options := db.MaintenanceJobOptions{
+		DryRun:     h.getBoolQuery("dry_run"),
+		BatchSize:  int(h.getIntQuery("batch_size", 0)),
+		BatchDelay: time.Duration(h.getIntQuery("batch_delay_ms", 0)) * time.Millisecond,
+	}
+	job, err := h.db.Maintenance.Start(jobType, options, false)
+	if err != nil {
+		return err
+	}
+	h.audit(base.AuditMaintenance, "", map[string]interface{}{"job": jobType, "dry_run": options.DryRun})
+	h.writeJSONStatus(http.StatusAccepted, job.Status())
+	return nil
+}
+
+// POST /db/_maintenance/{job}/_pause, _resume and _cancel
+func (h *handler) handlePauseMaintenanceJob() error {
+	return h.controlMaintenanceJob((*db.MaintenanceJob).Pause)
+}
+
+func (h *handler) handleResumeMaintenanceJob() error {
+	return h.controlMaintenanceJob((*db.MaintenanceJob).Resume)
+}
+
+func (h *handler) handleCancelMaintenanceJob() error {
+	return h.controlMaintenanceJob((*db.MaintenanceJob).Cancel)
+}
+
+func (h *handler) controlMaintenanceJob(action func(*db.MaintenanceJob) error) error {
+	job, err := h.db.Maintenance.ActiveJob(db.MaintenanceJobType(h.PathVar("job")))
+	if err != nil {
+		return err
+	}
+	if err := action(job); err != nil {
+		return err
+	}
+	h.writeJSON(job.Status())
 	return nil
 }
 
@@ -335,6 +444,141 @@ func (h *handler) handleGetRevTree() error {
 	return err
 }
 
+// GET /db/_expiry/{docid} returns a document's expiry.
+func (h *handler) handleGetDocExpiry() error {
+	expiry, err := h.db.GetDocExpiry(h.PathVar("docid"))
+	if err != nil {
+		return err
+	}
+	h.writeJSON(expiry)
+	return nil
+}
+
+// PUT /db/_expiry/{docid} sets a document's expiry, without creating a new revision. The body is
+// {"expiry": ...}, in any of the formats of a document's "_exp" property; null clears it.
+func (h *handler) handlePutDocExpiry() error {
+	body, err := h.readJSON()
+	if err != nil {
+		return err
+	}
+	rawExpiry, found := body["expiry"]
+	if !found {
+		return base.HTTPErrorf(http.StatusBadRequest, "Missing 'expiry' property")
+	}
+	expiry, err := base.ReflectExpiry(rawExpiry)
+	if err != nil {
+		return base.HTTPErrorf(http.StatusBadRequest, "Invalid expiry: %v", err)
+	}
+	var cbsExpiry uint32
+	if expiry != nil {
+		cbsExpiry = *expiry
+	}
+	return h.setDocExpiry(cbsExpiry)
+}
+
+// DELETE /db/_expiry/{docid} clears a document's expiry.
+func (h *handler) handleDeleteDocExpiry() error {
+	return h.setDocExpiry(0)
+}
+
+func (h *handler) setDocExpiry(expiry uint32) error {
+	result, err := h.db.SetDocExpiry(h.PathVar("docid"), expiry)
+	if err != nil {
+		return err
+	}
+	h.writeJSON(result)
+	return nil
+}
+
+// GET /db/_expiring lists the documents that expire between the "start" and "end" query
+// parameters (in any of the formats of a document's "_exp" property, both optional), soonest first.
+func (h *handler) handleGetExpiringDocs() error {
+	var window [2]time.Time
+	for i, param := range []string{"start", "end"} {
+		if value := h.getQuery(param); value != "" {
+			expiry, err := base.ReflectExpiry(value)
+			if err != nil || expiry == nil {
+				return base.HTTPErrorf(http.StatusBadRequest, "Invalid %s time", param)
+			}
+			window[i] = base.CbsExpiryToTime(*expiry)
+		}
+	}
+	docs, err := h.db.QueryExpiringDocs(window[0], window[1], int(h.getIntQuery("limit", 0)))
+	if err != nil {
+		return err
+	}
+	h.writeJSON(db.Body{"rows": docs})
+	return nil
+}
+
+// GET /db/_dead_letters lists the event payloads that webhooks failed to deliver, oldest first.
+// The "handler" query parameter limits it to one webhook's.
+func (h *handler) handleGetDeadLetters() error {
+	letters, err := h.db.DeadLetters.List(h.getQuery("handler"), int(h.getIntQuery("limit", 0)))
+	if err != nil {
+		return err
+	}
+	h.writeJSON(db.Body{"rows": letters})
+	return nil
+}
+
+// GET /db/_dead_letters/{id} returns a dead letter, including its payload.
+func (h *handler) handleGetDeadLetter() error {
+	letter, err := h.db.DeadLetters.Get(h.PathVar("id"))
+	if err != nil {
+		return err
+	}
+	h.writeJSON(letter)
+	return nil
+}
+
+// DELETE /db/_dead_letters/{id} discards a dead letter.
+func (h *handler) handleDeleteDeadLetter() error {
+	return h.db.DeadLetters.Delete(h.PathVar("id"))
+}
+
+// POST /db/_dead_letters/{id}/_replay delivers a dead letter with its event handler again,
+// deleting it if that succeeds.
+func (h *handler) handleReplayDeadLetter() error {
+	letter, err := h.db.DeadLetters.Get(h.PathVar("id"))
+	if err != nil {
+		return err
+	}
+	if err = h.replayDeadLetter(letter); err != nil {
+		return base.HTTPErrorf(http.StatusBadGateway, "Replay failed: %v", err)
+	}
+	h.writeJSON(db.Body{"ok": true, "id": letter.ID})
+	return nil
+}
+
+// POST /db/_dead_letters/_replay replays all the dead letters (or those of the handler named by
+// the "handler" query parameter), oldest first, and reports which failed.
+func (h *handler) handleReplayDeadLetters() error {
+	letters, err := h.db.DeadLetters.List(h.getQuery("handler"), int(h.getIntQuery("limit", 0)))
+	if err != nil {
+		return err
+	}
+	replayed := 0
+	failed := map[string]string{}
+	for _, letter := range letters {
+		if err := h.replayDeadLetter(letter); err != nil {
+			failed[letter.ID] = err.Error()
+		} else {
+			replayed++
+		}
+	}
+	h.writeJSON(db.Body{"replayed": replayed, "failed": failed})
+	return nil
+}
+
+func (h *handler) replayDeadLetter(letter *db.DeadLetter) error {
+	replayer := h.db.EventMgr.DeadLetterReplayer(letter.Handler)
+	if replayer == nil {
+		return fmt.Errorf("No event handler named %q", letter.Handler)
+	}
+	return replayer.Replay(h.db.DeadLetters, letter)
+}
+
 func (h *handler) handleGetLogging() error {
 	h.writeJSON(base.GetLogKeys())
 	return nil
@@ -376,8 +620,12 @@ func externalUserName(name string) string {
 }
 
 func marshalPrincipal(princ auth.Principal) ([]byte, error) {
+	return json.Marshal(principalInfo(princ))
+}
+
+func principalInfo(princ auth.Principal) *db.PrincipalConfig {
 	name := externalUserName(princ.Name())
-	info := db.PrincipalConfig{
+	info := &db.PrincipalConfig{
 		Name:             &name,
 		ExplicitChannels: princ.ExplicitChannels().AsSet(),
 	}
@@ -385,12 +633,29 @@ func marshalPrincipal(princ auth.Principal) ([]byte, error) {
 		info.Channels = user.InheritedChannels().AsSet()
 		info.Email = user.Email()
 		info.Disabled = user.Disabled()
+		info.Namespace = user.Namespace()
 		info.ExplicitRoleNames = user.ExplicitRoles().AllChannels()
 		info.RoleNames = user.RoleNames().AllChannels()
 	} else {
 		info.Channels = princ.Channels().AsSet()
 	}
-	return json.Marshal(info)
+	return info
+}
+
+// Writes a principal's info; with ?include_provenance=true it says where its channels and roles came from.
+func (h *handler) writePrincipalInfo(princ auth.Principal) error {
+	if !h.getBoolQuery("include_provenance") {
+		bytes, err := marshalPrincipal(princ)
+		h.response.Write(bytes)
+		return err
+	}
+	info := principalInfo(princ)
+	var err error
+	if info.ChannelProvenance, info.RoleProvenance, err = h.db.GrantProvenance(princ); err != nil {
+		return err
+	}
+	h.writeJSON(info)
+	return nil
 }
 
 // Handles PUT and POST for a user or a role.
@@ -423,7 +688,9 @@ func (h *handler) updatePrincipal(name string, isUser bool) error {
 	replaced, err := h.db.UpdatePrincipal(newInfo, isUser, h.rq.Method != "POST")
 	if err != nil {
 		return err
-	} else if replaced {
+	}
+	h.auditPrincipalUpdate(newInfo, isUser, replaced)
+	if replaced {
 		// on update with a new password, remove previous user sessions
 		if newInfo.Password != nil {
 			err = h.db.DeleteUserSessions(*newInfo.Name)
@@ -459,7 +726,12 @@ func (h *handler) deleteUser() error {
 		}
 		return err
 	}
-	return h.db.Authenticator().Delete(user)
+	if err = h.db.Authenticator().Delete(user); err != nil {
+		return err
+	}
+	h.audit(base.AuditUserDelete, user.Name(), nil)
+	h.db.EventMgr.RaisePrincipalChangeEvent(user.Name(), true, "deleted")
+	return nil
 }
 
 func (h *handler) deleteRole() error {
@@ -471,7 +743,12 @@ func (h *handler) deleteRole() error {
 		}
 		return err
 	}
-	return h.db.Authenticator().Delete(role)
+	if err = h.db.Authenticator().Delete(role); err != nil {
+		return err
+	}
+	h.audit(base.AuditRoleDelete, role.Name(), nil)
+	h.db.EventMgr.RaisePrincipalChangeEvent(role.Name(), false, "deleted")
+	return nil
 }
 
 func (h *handler) getUserInfo() error {
@@ -484,9 +761,24 @@ func (h *handler) getUserInfo() error {
 		return err
 	}
 
-	bytes, err := marshalPrincipal(user)
-	h.response.Write(bytes)
-	return err
+	return h.writePrincipalInfo(user)
+}
+
+// GET /db/_access_explain?user=X&doc=Y explains whether a user can see a document, and why.
+func (h *handler) handleAccessExplain() error {
+	h.assertAdminOnly()
+	username := h.getQuery("user")
+	docid := h.getQuery("doc")
+	if username == "" || docid == "" {
+		return base.HTTPErrorf(http.StatusBadRequest, "Missing \"user\" or \"doc\" parameter")
+	}
+	explanation, err := h.db.ExplainAccess(internalUserName(username), docid)
+	if err != nil {
+		return err
+	}
+	explanation.User = username
+	h.writeJSON(explanation)
+	return nil
 }
 
 func (h *handler) getRoleInfo() error {
@@ -498,9 +790,7 @@ func (h *handler) getRoleInfo() error {
 		}
 		return err
 	}
-	bytes, err := marshalPrincipal(role)
-	h.response.Write(bytes)
-	return err
+	return h.writePrincipalInfo(role)
 }
 
 func (h *handler) getUsers() error {
@@ -523,6 +813,147 @@ func (h *handler) getRoles() error {
 	return err
 }
 
+// Max number of errors listed in the response to _principals/_import
+const kMaxPrincipalImportErrors = 100
+
+// One line of the _principals/_import request body that couldn't be imported.
+type principalImportError struct {
+	Line   int    `json:"line"`
+	Name   string `json:"name,omitempty"`
+	Status int    `json:"status"`
+	Error  string `json:"error"`
+}
+
+// Response body of _principals/_import.
+type principalImportReport struct {
+	DryRun  bool                   `json:"dry_run,omitempty"`
+	Created int                    `json:"created"`
+	Updated int                    `json:"updated"`
+	Skipped int                    `json:"skipped"`
+	Failed  int                    `json:"failed"`
+	Errors  []principalImportError `json:"errors,omitempty"`
+	Aborted bool                   `json:"aborted,omitempty"` // Stopped at a conflict in "fail" mode
+}
+
+// HTTP handler for GET _principals/_export. Writes all roles, then all users, as NDJSON
+// (one PrincipalRecord per line), including password hashes.
+func (h *handler) handleExportPrincipals() error {
+	h.assertAdminOnly()
+	var exportUsers, exportRoles bool
+	switch h.getQuery("type") {
+	case "":
+		exportUsers, exportRoles = true, true
+	case db.PrincipalTypeUser:
+		exportUsers = true
+	case db.PrincipalTypeRole:
+		exportRoles = true
+	default:
+		return base.HTTPErrorf(http.StatusBadRequest, "Invalid type; must be user or role")
+	}
+
+	users, roles, err := h.db.AllPrincipalIDs()
+	if err != nil {
+		return err
+	}
+	if !exportUsers {
+		users = nil
+	}
+	if !exportRoles {
+		roles = nil
+	}
+
+	h.setHeader("Content-Type", "application/x-ndjson")
+	encoder := json.NewEncoder(h.response)
+	count := 0
+	exportAll := func(names []string, isUser bool) {
+		for _, name := range names {
+			record, err := h.db.ExportPrincipal(name, isUser)
+			if err != nil {
+				// Headers have been sent, so all we can do is log and skip it
+				base.Warn("Error exporting %q: %v", name, err)
+				continue
+			} else if record == nil {
+				continue // Deleted since AllPrincipalIDs
+			}
+			if err := encoder.Encode(record); err != nil {
+				base.Warn("Error writing exported principal %q: %v", name, err)
+				return
+			}
+			if count++; count%1000 == 0 {
+				h.flush()
+			}
+		}
+	}
+	exportAll(roles, false) // Roles first, so an import creates them before the users that have them
+	exportAll(users, true)
+	base.LogTo("HTTP", "Exported %d users and roles of %s", count, h.db.Name)
+	return nil
+}
+
+// HTTP handler for POST _principals/_import. The body is NDJSON, in the format written by
+// _principals/_export. The "conflict" query parameter says what to do with principals that
+// already exist (upsert, skip or fail); with "dry_run=true" nothing is saved.
+func (h *handler) handleImportPrincipals() error {
+	h.assertAdminOnly()
+	mode, err := db.ParsePrincipalConflictMode(h.getQuery("conflict"))
+	if err != nil {
+		return err
+	}
+	report := principalImportReport{DryRun: h.getBoolQuery("dry_run")}
+	addError := func(line int, name string, err error) {
+		report.Failed++
+		if len(report.Errors) < kMaxPrincipalImportErrors {
+			status, message := base.ErrorAsHTTPStatus(err)
+			report.Errors = append(report.Errors, principalImportError{line, name, status, message})
+		}
+	}
+
+	scanner := bufio.NewScanner(h.requestBody)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		data := bytes.TrimSpace(scanner.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+		var record db.PrincipalRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			addError(line, "", base.HTTPErrorf(http.StatusBadRequest, "Invalid JSON: %v", err))
+			continue
+		}
+		if record.Type == db.PrincipalTypeUser {
+			record.Name = internalUserName(record.Name)
+		}
+		result, err := h.db.ImportPrincipal(record, mode, report.DryRun)
+		if err != nil {
+			addError(line, record.Name, err)
+			if status, _ := base.ErrorAsHTTPStatus(err); status == http.StatusConflict && !report.DryRun {
+				report.Aborted = true
+				break
+			}
+			continue
+		}
+		switch result {
+		case db.PrincipalCreated:
+			report.Created++
+		case db.PrincipalUpdated:
+			report.Updated++
+		case db.PrincipalSkipped:
+			report.Skipped++
+		}
+		if !report.DryRun && result != db.PrincipalSkipped {
+			h.auditPrincipalImport(record, result)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return base.HTTPErrorf(http.StatusBadRequest, "Error reading request body: %v", err)
+	}
+	base.LogTo("HTTP", "Imported users and roles into %s: %+v", h.db.Name, report)
+	h.writeJSON(report)
+	return nil
+}
+
 // HTTP handler for /index
 func (h *handler) handleIndex() error {
 	base.LogTo("HTTP", "Index")
@@ -582,6 +1013,7 @@ func (h *handler) handlePurge() error {
 	h.setHeader("Cache-Control", "private, max-age=0, no-cache, no-store")
 	h.response.Write([]byte("{\"purged\":{\r\n"))
 	var first bool = true
+	purged := []string{}
 
 	for key, value := range input {
 		//For each one validate that the revision list is set to ["*"], otherwise skip doc and log warning
@@ -603,6 +1035,7 @@ func (h *handler) handlePurge() error {
 			//Attempt to delete document, if successful add to response, otherwise log warning
 			err = h.db.Purge(key)
 			if err == nil {
+				purged = append(purged, key)
 
 				if first {
 					first = false
@@ -626,6 +1059,7 @@ func (h *handler) handlePurge() error {
 
 	h.response.Write([]byte("}\n}\n"))
 	h.logStatus(http.StatusOK, message)
+	h.audit(base.AuditPurge, "", map[string]interface{}{"doc_ids": purged})
 
 	return nil
 }
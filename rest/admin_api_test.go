@@ -18,6 +18,7 @@ import (
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -1521,3 +1522,471 @@ func TestDocumentChangeReplicate(t *testing.T) {
 
 
 }
+
+func TestSyncFnTest(t *testing.T) {
+	syncFn := `function(doc, oldDoc) {
+		if (doc.owner) { requireUser(doc.owner); }
+		if (oldDoc && oldDoc.locked) { throw({forbidden: "locked"}); }
+		if (doc.bad) { null.bad(); }
+		channel(doc.channels);
+		access(doc.grantee, doc.channels);
+		role(doc.grantee, "role:editor");
+		if (doc.ttl) { expiry(doc.ttl); }
+	}`
+	rt := RestTester{SyncFn: syncFn}
+	defer rt.Close()
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_user/alice", `{"password":"letmein"}`), 201)
+
+	runTest := func(input string) (result map[string]interface{}) {
+		response := rt.SendAdminRequest("POST", "/db/_sync_test", input)
+		assertStatus(t, response, 200)
+		assert.Equals(t, json.Unmarshal(response.Body.Bytes(), &result), nil)
+		return result
+	}
+
+	// Channels, grants and expiry:
+	result := runTest(`{"doc": {"_id": "doc1", "channels": ["a", "b"], "grantee": "bob", "ttl": 60}}`)
+	assert.DeepEquals(t, result["channels"], []interface{}{"a", "b"})
+	assert.DeepEquals(t, result["access"], map[string]interface{}{"bob": []interface{}{"a", "b"}})
+	assert.DeepEquals(t, result["roles"], map[string]interface{}{"bob": []interface{}{"editor"}})
+	assert.Equals(t, result["expiry"], 60.0)
+	assert.Equals(t, result["rejection"], nil)
+
+	// Nothing was written:
+	assertStatus(t, rt.SendAdminRequest("GET", "/db/doc1", ""), 404)
+
+	// Rejection based on the old doc, and on the user:
+	result = runTest(`{"doc": {"_id": "doc1"}, "old_doc": {"_id": "doc1", "locked": true}}`)
+	assert.DeepEquals(t, result["rejection"], map[string]interface{}{"status": 403.0, "reason": "locked"})
+	result = runTest(`{"doc": {"_id": "doc1", "owner": "alice"}, "user_ctx": {"name": "bob"}}`)
+	assert.DeepEquals(t, result["rejection"], map[string]interface{}{"status": 403.0, "reason": "wrong user"})
+	result = runTest(`{"doc": {"_id": "doc1", "owner": "alice"}, "user": "alice"}`)
+	assert.Equals(t, result["rejection"], nil)
+
+	// Exceptions and invalid grants:
+	result = runTest(`{"doc": {"_id": "doc1", "bad": true}}`)
+	assert.True(t, result["exception"] != nil)
+	result = runTest(`{"doc": {"_id": "doc1", "channels": ["a"], "grantee": "bad name"}}`)
+	assert.True(t, result["error"] != nil)
+
+	// A different sync function can be tried out:
+	result = runTest(`{"doc": {"_id": "doc1", "channels": ["a"]}, "sync": "function(doc) {channel('x');}"}`)
+	assert.DeepEquals(t, result["channels"], []interface{}{"x"})
+
+	// Bad requests:
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_sync_test", `{}`), 400)
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_sync_test", `{"doc": {}, "user": "nobody"}`), 404)
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_sync_test", `{"doc": {}, "user": "alice", "user_ctx": {}}`), 400)
+}
+
+func TestMaintenanceAPI(t *testing.T) {
+	rt := RestTester{DatabaseConfig: &DbConfig{
+		Maintenance: map[string]*MaintenanceConfig{"session_cleanup": {Schedule: "@daily", BatchSize: 10}},
+	}}
+	defer rt.Close()
+
+	getStatus := func(job string) (status db.MaintenanceJobStatus) {
+		response := rt.SendAdminRequest("GET", "/db/_maintenance/"+job, "")
+		assertStatus(t, response, 200)
+		assert.Equals(t, json.Unmarshal(response.Body.Bytes(), &status), nil)
+		return status
+	}
+	waitForState := func(job string, state db.MaintenanceJobState) (status db.MaintenanceJobStatus) {
+		for i := 0; i < 100; i++ {
+			if status = getStatus(job); status.State == state {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.Equals(t, status.State, state)
+		return status
+	}
+
+	var statuses []db.MaintenanceJobStatus
+	response := rt.SendAdminRequest("GET", "/db/_maintenance", "")
+	assertStatus(t, response, 200)
+	assert.Equals(t, json.Unmarshal(response.Body.Bytes(), &statuses), nil)
+	assert.Equals(t, len(statuses), len(db.MaintenanceJobTypes))
+	for _, status := range statuses {
+		assert.Equals(t, status.State, db.MaintenanceIdle)
+	}
+	for i := 0; i < 100 && getStatus("session_cleanup").NextRun == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(t, getStatus("session_cleanup").NextRun != nil)
+	assert.True(t, getStatus("attachment_vacuum").NextRun == nil)
+
+	// An expired session, to be cleaned up:
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_user/alice", `{"password":"letmein"}`), 201)
+	expired := auth.LoginSession{ID: "expired", Username: "alice", Expiration: time.Now().Add(-time.Minute), Ttl: time.Hour}
+	assert.Equals(t, rt.Bucket().Set(auth.SessionKeyPrefix+expired.ID, 0, expired), nil)
+
+	response = rt.SendAdminRequest("POST", "/db/_maintenance/session_cleanup?dry_run=true", "")
+	assertStatus(t, response, 202)
+	status := waitForState("session_cleanup", db.MaintenanceCompleted)
+	assert.True(t, status.DryRun)
+	assert.Equals(t, status.Purged, 1)
+	_, _, err := rt.Bucket().GetRaw(auth.SessionKeyPrefix + expired.ID)
+	assert.Equals(t, err, nil)
+
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_maintenance/session_cleanup?batch_size=1", ""), 202)
+	status = waitForState("session_cleanup", db.MaintenanceCompleted)
+	assert.False(t, status.DryRun)
+	assert.Equals(t, status.BatchSize, 1)
+	assert.Equals(t, status.Purged, 1)
+	_, _, err = rt.Bucket().GetRaw(auth.SessionKeyPrefix + expired.ID)
+	assert.True(t, base.IsDocNotFoundError(err))
+
+	// Only running jobs can be paused, resumed or cancelled:
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_maintenance/session_cleanup/_pause", ""), 409)
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_maintenance/session_cleanup/_resume", ""), 409)
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_maintenance/tombstone_purge/_cancel", ""), 409)
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_maintenance/bogus", ""), 404)
+	assertStatus(t, rt.SendAdminRequest("GET", "/db/_maintenance/bogus", ""), 404)
+
+	var tasks []interface{}
+	response = rt.SendAdminRequest("GET", "/_active_tasks", "")
+	assertStatus(t, response, 200)
+	assert.Equals(t, json.Unmarshal(response.Body.Bytes(), &tasks), nil)
+
+	// Config validation:
+	badConfig := DbConfig{Maintenance: map[string]*MaintenanceConfig{"bogus": {Schedule: "@daily"}}}
+	assert.True(t, badConfig.validate() != nil)
+	badConfig = DbConfig{Maintenance: map[string]*MaintenanceConfig{"tombstone_purge": {Schedule: "every day"}}}
+	assert.True(t, badConfig.validate() != nil)
+}
+
+func TestOnlineResyncAPI(t *testing.T) {
+	rt := RestTester{SyncFn: `function(doc) {channel(doc.channels);}`}
+	defer rt.Close()
+
+	for i := 0; i < 10; i++ {
+		assertStatus(t, rt.SendAdminRequest("PUT", fmt.Sprintf("/db/doc%d", i), `{"channels":"A", "group":"B"}`), 201)
+	}
+
+	getStatus := func() (status db.ResyncStatus) {
+		response := rt.SendAdminRequest("GET", "/db/_resync", "")
+		assertStatus(t, response, 200)
+		assert.Equals(t, json.Unmarshal(response.Body.Bytes(), &status), nil)
+		return status
+	}
+	assert.Equals(t, getStatus().State, db.ResyncIdle)
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_resync?online=true&resume=true", ""), 404)
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_resync?online=true", `{"sync": "function(doc) {"}`), 400)
+
+	// The database stays online while the resync applies the new function:
+	response := rt.SendAdminRequest("POST", "/db/_resync?online=true&batch_size=3", `{"sync": "function(doc) {channel(doc.group);}"}`)
+	assertStatus(t, response, 202)
+	var status db.ResyncStatus
+	for i := 0; i < 100; i++ {
+		if status = getStatus(); status.State != db.ResyncRunning {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equals(t, status.State, db.ResyncCompleted)
+	assert.Equals(t, status.BatchSize, 3)
+	assert.Equals(t, status.DocsProcessed, 10)
+	assert.Equals(t, status.DocsChanged, 10)
+	assert.Equals(t, *status.SyncFunction, "function(doc) {channel(doc.group);}")
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_resync/_cancel", ""), 409)
+
+	// The new sync function is saved in the database's config:
+	var dbConfig DbConfig
+	response = rt.SendAdminRequest("GET", "/db/_config", "")
+	assertStatus(t, response, 200)
+	assert.Equals(t, json.Unmarshal(response.Body.Bytes(), &dbConfig), nil)
+	assert.Equals(t, *dbConfig.Sync, "function(doc) {channel(doc.group);}")
+
+	var tasks []map[string]interface{}
+	response = rt.SendAdminRequest("GET", "/_active_tasks", "")
+	assertStatus(t, response, 200)
+	assert.Equals(t, json.Unmarshal(response.Body.Bytes(), &tasks), nil)
+	for _, task := range tasks {
+		assert.NotEquals(t, task["type"], "resync")
+	}
+
+	// The offline resync still works, and re-runs the new function:
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_offline", ""), 200)
+	response = rt.SendAdminRequest("POST", "/db/_resync", "")
+	assertStatus(t, response, 200)
+	var body db.Body
+	assert.Equals(t, json.Unmarshal(response.Body.Bytes(), &body), nil)
+	assert.Equals(t, body["changes"], float64(0))
+}
+
+func TestDocExpiryAPI(t *testing.T) {
+	var rt RestTester
+	defer rt.Close()
+
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/doc1", `{"key": "value"}`), 201)
+	getExpiry := func(docID string) (expiry db.DocExpiry) {
+		response := rt.SendAdminRequest("GET", "/db/_expiry/"+docID, "")
+		assertStatus(t, response, 200)
+		assert.Equals(t, json.Unmarshal(response.Body.Bytes(), &expiry), nil)
+		return expiry
+	}
+	assert.True(t, getExpiry("doc1").Expiry == nil)
+	assertStatus(t, rt.SendAdminRequest("GET", "/db/_expiry/nosuchdoc", ""), 404)
+
+	inAnHour := time.Now().Add(time.Hour).Truncate(time.Second)
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_expiry/doc1", `{"expiry": "`+inAnHour.Format(time.RFC3339)+`"}`), 200)
+	assert.True(t, getExpiry("doc1").Expiry.Equal(inAnHour))
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_expiry/doc1", `{"expiry": "soon"}`), 400)
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_expiry/doc1", `{}`), 400)
+
+	// No new revision was created:
+	response := rt.SendAdminRequest("GET", "/db/doc1", "")
+	assertStatus(t, response, 200)
+	var body db.Body
+	assert.Equals(t, json.Unmarshal(response.Body.Bytes(), &body), nil)
+	assert.True(t, strings.HasPrefix(body["_rev"].(string), "1-"))
+
+	var result struct {
+		Rows []db.DocExpiry `json:"rows"`
+	}
+	response = rt.SendAdminRequest("GET", fmt.Sprintf("/db/_expiring?end=%d", inAnHour.Add(time.Minute).Unix()), "")
+	assertStatus(t, response, 200)
+	assert.Equals(t, json.Unmarshal(response.Body.Bytes(), &result), nil)
+	assert.Equals(t, len(result.Rows), 1)
+	assert.Equals(t, result.Rows[0].DocID, "doc1")
+	response = rt.SendAdminRequest("GET", fmt.Sprintf("/db/_expiring?start=%d", inAnHour.Add(time.Minute).Unix()), "")
+	assertStatus(t, response, 200)
+	assert.Equals(t, json.Unmarshal(response.Body.Bytes(), &result), nil)
+	assert.Equals(t, len(result.Rows), 0)
+
+	assertStatus(t, rt.SendAdminRequest("DELETE", "/db/_expiry/doc1", ""), 200)
+	assert.True(t, getExpiry("doc1").Expiry == nil)
+}
+
+func TestExportImportPrincipalsAPI(t *testing.T) {
+	var rt RestTester
+	defer rt.Close()
+
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_role/admins", `{"admin_channels":["PBS"]}`), 201)
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_user/snej", `{"email":"jens@couchbase.com", "password":"letmein", "admin_channels":["foo"], "admin_roles":["admins"]}`), 201)
+
+	// Export; roles come before users:
+	response := rt.SendAdminRequest("GET", "/db/_principals/_export", "")
+	assertStatus(t, response, 200)
+	assert.Equals(t, response.HeaderMap.Get("Content-Type"), "application/x-ndjson")
+	lines := strings.Split(strings.TrimSpace(response.Body.String()), "\n")
+	assert.Equals(t, len(lines), 2)
+	var records []db.PrincipalRecord
+	for _, line := range lines {
+		var record db.PrincipalRecord
+		assert.Equals(t, json.Unmarshal([]byte(line), &record), nil)
+		records = append(records, record)
+	}
+	assert.Equals(t, records[0].Type, "role")
+	assert.Equals(t, records[0].Name, "admins")
+	assert.Equals(t, records[1].Type, "user")
+	assert.Equals(t, records[1].Name, "snej")
+	assert.Equals(t, *records[1].Email, "jens@couchbase.com")
+	assert.True(t, records[1].PasswordHash != "")
+	response = rt.SendAdminRequest("GET", "/db/_principals/_export?type=role", "")
+	assertStatus(t, response, 200)
+	assert.Equals(t, strings.Count(response.Body.String(), "\n"), 1)
+	assertStatus(t, rt.SendAdminRequest("GET", "/db/_principals/_export?type=group", ""), 400)
+
+	// Import them back, plus a new user and a bad line:
+	exported := strings.Join(lines, "\n")
+	body := exported + "\n\n" + `{"type":"user","name":"pupshaw","password":"frank"}` + "\n" + `{"type":"user"` + "\n"
+	var report principalImportReport
+	response = rt.SendAdminRequest("POST", "/db/_principals/_import?conflict=skip&dry_run=true", body)
+	assertStatus(t, response, 200)
+	assert.Equals(t, json.Unmarshal(response.Body.Bytes(), &report), nil)
+	assert.DeepEquals(t, report, principalImportReport{DryRun: true, Created: 1, Skipped: 2, Failed: 1,
+		Errors: []principalImportError{{Line: 5, Status: 400, Error: report.Errors[0].Error}}})
+	assertStatus(t, rt.SendAdminRequest("GET", "/db/_user/pupshaw", ""), 404)
+
+	response = rt.SendAdminRequest("POST", "/db/_principals/_import?conflict=upsert", body)
+	assertStatus(t, response, 200)
+	report = principalImportReport{}
+	assert.Equals(t, json.Unmarshal(response.Body.Bytes(), &report), nil)
+	assert.Equals(t, report.Created, 1)
+	assert.Equals(t, report.Updated, 2)
+	assert.Equals(t, report.Failed, 1)
+	user, _ := rt.ServerContext().Database("db").Authenticator().GetUser("snej")
+	assert.True(t, user.Authenticate("letmein"))
+	user, _ = rt.ServerContext().Database("db").Authenticator().GetUser("pupshaw")
+	assert.True(t, user.Authenticate("frank"))
+
+	// In "fail" mode, the import stops at the first existing principal:
+	response = rt.SendAdminRequest("POST", "/db/_principals/_import?conflict=fail", exported)
+	assertStatus(t, response, 200)
+	report = principalImportReport{}
+	assert.Equals(t, json.Unmarshal(response.Body.Bytes(), &report), nil)
+	assert.True(t, report.Aborted)
+	assert.Equals(t, report.Failed, 1)
+	assert.Equals(t, report.Errors[0].Status, 409)
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_principals/_import?conflict=maybe", exported), 400)
+}
+
+func TestPasswordPolicyAPI(t *testing.T) {
+	rt := RestTester{DatabaseConfig: &DbConfig{
+		PasswordPolicy: &auth.PasswordPolicy{
+			MinLength:    8,
+			RequireDigit: true,
+			Lockout:      &auth.LockoutOptions{MaxFailures: 2},
+		},
+	}}
+	defer rt.Close()
+
+	response := rt.SendAdminRequest("PUT", "/db/_user/snej", `{"password":"letmein"}`)
+	assertStatus(t, response, 400)
+	assert.True(t, strings.Contains(response.Body.String(), "at least 8 characters"))
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_user/snej", `{"password":"letmein99"}`), 201)
+
+	// After two failed logins, the user is locked out, of basic auth too:
+	response = rt.SendRequest("POST", "/db/_session", `{"name":"snej", "password":"letmein99"}`)
+	assertStatus(t, response, 200)
+	cookie := strings.Split(response.Header().Get("Set-Cookie"), ";")[0]
+	for i := 0; i < 2; i++ {
+		assertStatus(t, rt.SendRequest("POST", "/db/_session", `{"name":"snej", "password":"wrong"}`), 401)
+	}
+	response = rt.SendRequest("POST", "/db/_session", `{"name":"snej", "password":"letmein99"}`)
+	assertStatus(t, response, 401)
+	assert.True(t, strings.Contains(response.Body.String(), "Too many failed login attempts"))
+	response = rt.SendUserRequestWithHeaders("GET", "/db/", "", nil, "snej", "letmein99")
+	assertStatus(t, response, 401)
+	assert.True(t, strings.Contains(response.Body.String(), "Too many failed login attempts"))
+
+	// Logging in again while already logged in doesn't get around the lockout:
+	response = rt.SendRequestWithHeaders("POST", "/db/_session", `{"name":"snej", "password":"letmein99"}`,
+		map[string]string{"Cookie": cookie})
+	assertStatus(t, response, 401)
+	assert.True(t, strings.Contains(response.Body.String(), "Too many failed login attempts"))
+}
+
+func TestDeadLettersAPI(t *testing.T) {
+	var lock sync.Mutex
+	status := http.StatusBadRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	rt := RestTester{DatabaseConfig: &DbConfig{
+		EventHandlers: map[string]interface{}{
+			"document_changed": []interface{}{
+				map[string]interface{}{"handler": "webhook", "name": "hook", "url": server.URL, "dead_letters": true},
+			},
+		},
+	}}
+	defer rt.Close()
+
+	// Wait for the undeliverable document changes to become dead letters:
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/doc1", `{"n":1}`), 201)
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/doc2", `{"n":2}`), 201)
+	var list struct {
+		Rows []db.DeadLetter `json:"rows"`
+	}
+	for i := 0; i < 100 && len(list.Rows) < 2; i++ {
+		time.Sleep(20 * time.Millisecond)
+		response := rt.SendAdminRequest("GET", "/db/_dead_letters?handler=hook", "")
+		assertStatus(t, response, 200)
+		json.Unmarshal(response.Body.Bytes(), &list)
+	}
+	assert.Equals(t, len(list.Rows), 2)
+	letterID := list.Rows[0].ID
+
+	var letter db.DeadLetter
+	response := rt.SendAdminRequest("GET", "/db/_dead_letters/"+letterID, "")
+	assertStatus(t, response, 200)
+	json.Unmarshal(response.Body.Bytes(), &letter)
+	assert.Equals(t, letter.Handler, "hook")
+	assert.Equals(t, letter.ContentType, "application/json")
+
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_dead_letters/"+letterID+"/_replay", ""), 502)
+	assertStatus(t, rt.SendAdminRequest("DELETE", "/db/_dead_letters/"+letterID, ""), 200)
+	assertStatus(t, rt.SendAdminRequest("GET", "/db/_dead_letters/"+letterID, ""), 404)
+
+	lock.Lock()
+	status = http.StatusOK
+	lock.Unlock()
+	response = rt.SendAdminRequest("POST", "/db/_dead_letters/_replay", "")
+	assertStatus(t, response, 200)
+	var result struct {
+		Replayed int               `json:"replayed"`
+		Failed   map[string]string `json:"failed"`
+	}
+	json.Unmarshal(response.Body.Bytes(), &result)
+	assert.Equals(t, result.Replayed, 1)
+	assert.Equals(t, len(result.Failed), 0)
+	response = rt.SendAdminRequest("GET", "/db/_dead_letters", "")
+	assert.Equals(t, response.Body.String(), `{"rows":[]}`)
+}
+
+func TestAccessExplainAPI(t *testing.T) {
+	rt := RestTester{SyncFn: `function(doc) {channel(doc.channels);}`}
+	defer rt.Close()
+
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_user/alice", `{"password":"letmein", "admin_channels":["news"]}`), 201)
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/doc1", `{"channels":["news"]}`), 201)
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/doc2", `{"channels":["sports"]}`), 201)
+
+	response := rt.SendAdminRequest("GET", "/db/_access_explain?user=alice&doc=doc1", "")
+	assertStatus(t, response, 200)
+	var explanation db.AccessExplanation
+	assert.Equals(t, json.Unmarshal(response.Body.Bytes(), &explanation), nil)
+	assert.True(t, explanation.CanSee)
+	assert.Equals(t, explanation.User, "alice")
+	assert.DeepEquals(t, explanation.DocChannels, []string{"news"})
+	assert.Equals(t, len(explanation.Matches), 1)
+	assert.Equals(t, explanation.Matches[0].Source, db.AccessSourceExplicit)
+
+	response = rt.SendAdminRequest("GET", "/db/_access_explain?user=alice&doc=doc2", "")
+	assertStatus(t, response, 200)
+	explanation = db.AccessExplanation{}
+	assert.Equals(t, json.Unmarshal(response.Body.Bytes(), &explanation), nil)
+	assert.False(t, explanation.CanSee)
+
+	// The guest user is named GUEST, as in the _user API:
+	response = rt.SendAdminRequest("GET", "/db/_access_explain?user=GUEST&doc=doc2", "")
+	assertStatus(t, response, 200)
+
+	assertStatus(t, rt.SendAdminRequest("GET", "/db/_access_explain?user=alice", ""), 400)
+	assertStatus(t, rt.SendAdminRequest("GET", "/db/_access_explain?user=bob&doc=doc1", ""), 404)
+	assertStatus(t, rt.SendAdminRequest("GET", "/db/_access_explain?user=alice&doc=doc3", ""), 404)
+}
+
+func TestPrincipalProvenanceAPI(t *testing.T) {
+	rt := RestTester{
+		SyncFn:         `function(doc) {if (doc.users) access(doc.users, doc.channels);}`,
+		DatabaseConfig: &DbConfig{GrantProvenance: true},
+	}
+	defer rt.Close()
+
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_role/staff", `{"admin_channels":["memos"]}`), 201)
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_user/alice", `{"password":"letmein", "admin_channels":["news"], "admin_roles":["staff"]}`), 201)
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/grant", `{"users":["alice"], "channels":["sports"]}`), 201)
+
+	// Provenance is only included on request:
+	response := rt.SendAdminRequest("GET", "/db/_user/alice", "")
+	assertStatus(t, response, 200)
+	var body db.Body
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.Equals(t, body["channel_provenance"], nil)
+
+	response = rt.SendAdminRequest("GET", "/db/_user/alice?include_provenance=true", "")
+	assertStatus(t, response, 200)
+	var info db.PrincipalConfig
+	assert.Equals(t, json.Unmarshal(response.Body.Bytes(), &info), nil)
+	assert.DeepEquals(t, info.Channels, base.SetOf("!", "memos", "news", "sports"))
+	assert.Equals(t, info.ChannelProvenance["news"][0].Source, auth.GrantSourceExplicit)
+	assert.Equals(t, info.ChannelProvenance["sports"][0].Source, auth.GrantSourceSync)
+	assert.Equals(t, info.ChannelProvenance["sports"][0].DocID, "grant")
+	assert.True(t, info.ChannelProvenance["sports"][0].RevID != "")
+	assert.Equals(t, info.ChannelProvenance["memos"][0].Role, "staff")
+	assert.Equals(t, info.RoleProvenance["staff"][0].Source, auth.GrantSourceExplicit)
+
+	response = rt.SendAdminRequest("GET", "/db/_role/staff?include_provenance=true", "")
+	assertStatus(t, response, 200)
+	info = db.PrincipalConfig{}
+	assert.Equals(t, json.Unmarshal(response.Body.Bytes(), &info), nil)
+	assert.Equals(t, info.ChannelProvenance["memos"][0].Source, auth.GrantSourceExplicit)
+	assert.Equals(t, len(info.RoleProvenance), 0)
+}
@@ -0,0 +1,182 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+
+	"github.com/couchbase/sync_gateway/base"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// A permission required by an admin API route. If admin authentication is enabled, each admin
+// user is granted the permissions of its roles.
+type AdminPermission string
+
+const (
+	AdminPermStats  AdminPermission = "stats"  // Read server and database status, stats and metrics
+	AdminPermUsers  AdminPermission = "users"  // Manage users, roles and sessions
+	AdminPermConfig AdminPermission = "config" // Read and change server and database configuration
+	AdminPermDocs   AdminPermission = "docs"   // Read and write documents with admin privileges
+	AdminPermDebug  AdminPermission = "debug"  // Use the profiling and debugging endpoints
+)
+
+// The built-in admin roles, and the permissions each one grants.
+var AdminRoles = map[string][]AdminPermission{
+	"monitor":       {AdminPermStats},
+	"user_manager":  {AdminPermStats, AdminPermUsers},
+	"config_editor": {AdminPermStats, AdminPermConfig},
+	"admin":         {AdminPermStats, AdminPermUsers, AdminPermConfig, AdminPermDocs, AdminPermDebug},
+}
+
+// Configuration of admin API authentication. If this is absent the admin API is unauthenticated,
+// and anyone who can reach the admin interface has full privileges.
+type AdminAuthConfig struct {
+	Users        map[string]*AdminUserConfig `json:"users"`                    // Admin users, by name
+	ClientCACert *string                     `json:"client_ca_cert,omitempty"` // Path to CA cert(s) that client certs must be signed by
+}
+
+// An admin user. It can authenticate with basic auth, or with a TLS client certificate.
+type AdminUserConfig struct {
+	Password       *string  `json:"password,omitempty"`         // Password for basic auth
+	PasswordHash   *string  `json:"password_hash,omitempty"`    // Bcrypt hash of the password, instead of the password
+	CertCommonName *string  `json:"cert_common_name,omitempty"` // Common name of a client certificate that authenticates as this user
+	Roles          []string `json:"roles"`                      // Names of the admin roles the user has
+}
+
+func (config *AdminAuthConfig) validate() error {
+	if config == nil {
+		return nil
+	}
+	if config.ClientCACert != nil && *config.ClientCACert == "" {
+		return fmt.Errorf("admin_auth: client_ca_cert must not be empty")
+	}
+	for name, user := range config.Users {
+		if user == nil || name == "" {
+			return fmt.Errorf("admin_auth: invalid user %q", name)
+		}
+		if user.Password == nil && user.PasswordHash == nil && user.CertCommonName == nil {
+			return fmt.Errorf("admin_auth: user %q needs a password, password_hash or cert_common_name", name)
+		}
+		if user.CertCommonName != nil && config.ClientCACert == nil {
+			return fmt.Errorf("admin_auth: user %q has a cert_common_name, but no client_ca_cert is configured", name)
+		}
+		for _, role := range user.Roles {
+			if AdminRoles[role] == nil {
+				return fmt.Errorf("admin_auth: user %q has unknown role %q", name, role)
+			}
+		}
+	}
+	return nil
+}
+
+// An authenticated admin user.
+type adminUser struct {
+	name        string
+	permissions map[AdminPermission]bool
+}
+
+// Returns true if the user has the given permission. The empty permission, used by routes that
+// aren't annotated with one, requires all permissions.
+func (user *adminUser) hasPermission(permission AdminPermission) bool {
+	if permission == "" {
+		for _, p := range AdminRoles["admin"] {
+			if !user.permissions[p] {
+				return false
+			}
+		}
+		return true
+	}
+	return user.permissions[permission]
+}
+
+// Authenticates requests to the admin API.
+type adminAuthenticator struct {
+	config *AdminAuthConfig
+}
+
+// Returns an adminAuthenticator for the configuration, or nil if admin auth isn't enabled.
+func newAdminAuthenticator(config *AdminAuthConfig) *adminAuthenticator {
+	if config == nil {
+		return nil
+	}
+	return &adminAuthenticator{config: config}
+}
+
+// Authenticates a request by basic auth, if a username is given, else by the request's verified
+// TLS client certificate. Returns nil if authentication fails.
+func (auth *adminAuthenticator) authenticate(rq *http.Request, username, password string) *adminUser {
+	if username != "" {
+		config := auth.config.Users[username]
+		if config == nil || !config.checkPassword(password) {
+			return nil
+		}
+		return newAdminUser(username, config)
+	}
+	if rq.TLS != nil && len(rq.TLS.VerifiedChains) > 0 && len(rq.TLS.VerifiedChains[0]) > 0 {
+		commonName := rq.TLS.VerifiedChains[0][0].Subject.CommonName
+		for name, config := range auth.config.Users {
+			if config.CertCommonName != nil && *config.CertCommonName == commonName {
+				return newAdminUser(name, config)
+			}
+		}
+	}
+	return nil
+}
+
+func (config *AdminUserConfig) checkPassword(password string) bool {
+	if config.PasswordHash != nil {
+		return bcrypt.CompareHashAndPassword([]byte(*config.PasswordHash), []byte(password)) == nil
+	} else if config.Password != nil {
+		return subtle.ConstantTimeCompare([]byte(*config.Password), []byte(password)) == 1
+	}
+	return false
+}
+
+func newAdminUser(name string, config *AdminUserConfig) *adminUser {
+	user := &adminUser{name: name, permissions: map[AdminPermission]bool{}}
+	for _, role := range config.Roles {
+		for _, permission := range AdminRoles[role] {
+			user.permissions[permission] = true
+		}
+	}
+	return user
+}
+
+// Authenticates an admin API request, and checks that the admin user has the permission the
+// handler requires. Does nothing if admin authentication isn't enabled.
+func (h *handler) checkAdminAuth() error {
+	auth := h.server.adminAuth
+	if auth == nil {
+		return nil
+	}
+	username, password := h.getBasicAuth()
+	user := auth.authenticate(h.rq, username, password)
+	if user == nil {
+		if username != "" {
+			base.Logf("Admin HTTP auth failed for username=%q", username)
+			h.audit(base.AuditAuthFailure, username, map[string]interface{}{"method": "admin"})
+		}
+		h.response.Header().Set("WWW-Authenticate", `Basic realm="Couchbase Sync Gateway Admin"`)
+		return base.HTTPErrorf(http.StatusUnauthorized, "Login required")
+	}
+	h.adminUser = user.name
+	if !user.hasPermission(h.adminPermission) {
+		h.audit(base.AuditAccessDenied, user.name, map[string]interface{}{"permission": h.adminPermission})
+		return base.HTTPErrorf(http.StatusForbidden, "Admin user %q lacks the required permission", user.name)
+	}
+	// Only requests that change state are audited, so monitoring polls don't flood the log:
+	if method := h.rq.Method; method != "GET" && method != "HEAD" && method != "OPTIONS" {
+		h.audit(base.AuditAuthSuccess, user.name, map[string]interface{}{"method": "admin"})
+	}
+	return nil
+}
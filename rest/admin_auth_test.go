@@ -0,0 +1,112 @@
+package rest
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"net/http"
+	"testing"
+
+	"github.com/couchbaselabs/go.assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func basicAuthHeader(username, password string) map[string]string {
+	return map[string]string{"Authorization": "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))}
+}
+
+func TestAdminAuthConfigValidation(t *testing.T) {
+	password := "letmein"
+	caCert := "ca.pem"
+	commonName := "ops"
+	var config *AdminAuthConfig
+	assert.Equals(t, config.validate(), nil)
+
+	config = &AdminAuthConfig{Users: map[string]*AdminUserConfig{
+		"alice": {Password: &password, Roles: []string{"monitor", "user_manager"}},
+	}}
+	assert.Equals(t, config.validate(), nil)
+
+	config.Users["alice"].Roles = []string{"superuser"}
+	assert.True(t, config.validate() != nil)
+
+	config.Users["alice"] = &AdminUserConfig{Roles: []string{"admin"}}
+	assert.True(t, config.validate() != nil)
+
+	config.Users["alice"] = &AdminUserConfig{CertCommonName: &commonName, Roles: []string{"admin"}}
+	assert.True(t, config.validate() != nil)
+	config.ClientCACert = &caCert
+	assert.Equals(t, config.validate(), nil)
+}
+
+func TestAdminAuthPermissions(t *testing.T) {
+	var rt RestTester
+	defer rt.Close()
+
+	monitorPassword, adminPassword := "monitor-pw", "admin-pw"
+	hash, _ := bcrypt.GenerateFromPassword([]byte("manager-pw"), bcrypt.MinCost)
+	managerHash := string(hash)
+	rt.ServerContext().adminAuth = newAdminAuthenticator(&AdminAuthConfig{Users: map[string]*AdminUserConfig{
+		"monitor": {Password: &monitorPassword, Roles: []string{"monitor"}},
+		"manager": {PasswordHash: &managerHash, Roles: []string{"user_manager"}},
+		"root":    {Password: &adminPassword, Roles: []string{"admin"}},
+	}})
+
+	// No credentials, or wrong ones:
+	response := rt.SendAdminRequest("GET", "/_expvar", "")
+	assertStatus(t, response, 401)
+	assert.True(t, response.Header().Get("WWW-Authenticate") != "")
+	assertStatus(t, rt.SendAdminRequestWithHeaders("GET", "/_expvar", "", basicAuthHeader("monitor", "wrong")), 401)
+	assertStatus(t, rt.SendAdminRequestWithHeaders("GET", "/_expvar", "", basicAuthHeader("nobody", "monitor-pw")), 401)
+
+	// The monitor can only read stats:
+	monitor := basicAuthHeader("monitor", "monitor-pw")
+	assertStatus(t, rt.SendAdminRequestWithHeaders("GET", "/_expvar", "", monitor), 200)
+	assertStatus(t, rt.SendAdminRequestWithHeaders("GET", "/db/", "", monitor), 200)
+	assertStatus(t, rt.SendAdminRequestWithHeaders("GET", "/db/_user/", "", monitor), 403)
+	assertStatus(t, rt.SendAdminRequestWithHeaders("PUT", "/db/doc1", `{}`, monitor), 403)
+	assertStatus(t, rt.SendAdminRequestWithHeaders("GET", "/_config", "", monitor), 403)
+
+	// The user manager can manage users, but not read documents or change config:
+	manager := basicAuthHeader("manager", "manager-pw")
+	assertStatus(t, rt.SendAdminRequestWithHeaders("PUT", "/db/_user/bob", `{"password":"letmein"}`, manager), 201)
+	assertStatus(t, rt.SendAdminRequestWithHeaders("GET", "/db/_user/bob", "", manager), 200)
+	assertStatus(t, rt.SendAdminRequestWithHeaders("GET", "/db/doc1", "", manager), 403)
+	assertStatus(t, rt.SendAdminRequestWithHeaders("POST", "/db/_offline", "", manager), 403)
+
+	// A full admin can do anything:
+	root := basicAuthHeader("root", "admin-pw")
+	assertStatus(t, rt.SendAdminRequestWithHeaders("PUT", "/db/doc1", `{}`, root), 201)
+	assertStatus(t, rt.SendAdminRequestWithHeaders("GET", "/_config", "", root), 200)
+	assertStatus(t, rt.SendAdminRequestWithHeaders("GET", "/db/_user/bob", "", root), 200)
+
+	// The public port is unaffected:
+	assertStatus(t, rt.SendRequest("GET", "/db/doc1", ""), 200)
+}
+
+func TestAdminAuthClientCert(t *testing.T) {
+	commonName, caCert := "ops-tooling", "ca.pem"
+	auth := newAdminAuthenticator(&AdminAuthConfig{
+		ClientCACert: &caCert,
+		Users: map[string]*AdminUserConfig{
+			"ops": {CertCommonName: &commonName, Roles: []string{"monitor"}},
+		},
+	})
+
+	rq, _ := http.NewRequest("GET", "https://localhost:4985/_expvar", nil)
+	assert.True(t, auth.authenticate(rq, "", "") == nil)
+
+	// The handshake has already verified the cert chain, so only the common name is checked:
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "ops-tooling"}}
+	rq.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	user := auth.authenticate(rq, "", "")
+	assert.True(t, user != nil)
+	assert.Equals(t, user.name, "ops")
+	assert.True(t, user.hasPermission(AdminPermStats))
+	assert.False(t, user.hasPermission(AdminPermDocs))
+	assert.False(t, user.hasPermission(""))
+
+	cert.Subject.CommonName = "someone-else"
+	assert.True(t, auth.authenticate(rq, "", "") == nil)
+}
@@ -22,8 +22,10 @@ import (
 	"sync/atomic"
 
 	sgbucket "github.com/couchbase/sg-bucket"
+	"github.com/couchbase/sync_gateway/auth"
 	"github.com/couchbase/sync_gateway/base"
 	"github.com/couchbase/sync_gateway/db"
+	"github.com/couchbaselabs/sync_gateway_admin_ui"
 )
 
 // HTTP handler for the root ("/")
@@ -40,6 +42,16 @@ func (h *handler) handleRoot() error {
 	return nil
 }
 
+// HTTP handler for the admin UI ("/_admin/")
+func (h *handler) handleAdminUI() error {
+	if h.server.config.AdminUI != nil {
+		http.ServeFile(h.response, h.rq, *h.server.config.AdminUI)
+	} else {
+		h.response.Write(sync_gateway_admin_ui.Admin_bundle_html())
+	}
+	return nil
+}
+
 func (h *handler) handleAllDbs() error {
 	h.writeJSON(h.server.AllDatabaseNames())
 	return nil
@@ -55,7 +67,7 @@ func (h *handler) handleCompact() error {
 }
 
 func (h *handler) handleVacuum() error {
-	attsDeleted, err := db.VacuumAttachments(h.db.Bucket)
+	attsDeleted, err := h.db.VacuumAttachments()
 	if err != nil {
 		return err
 	}
@@ -80,10 +92,13 @@ func (h *handler) handleFlush() error {
 }
 
 func (h *handler) handleResync() error {
+	if h.getBoolQuery("online") {
+		return h.handleOnlineResync()
+	}
 
 	//If the DB is already re syncing, return error to user
 	dbState := atomic.LoadUint32(&h.db.State)
-	if dbState == db.DBResyncing {
+	if dbState == db.DBResyncing || h.db.ActiveResync() != nil {
 		return base.HTTPErrorf(http.StatusServiceUnavailable, "Database _resync is already in progress")
 	}
 
@@ -104,6 +119,104 @@ func (h *handler) handleResync() error {
 	return nil
 }
 
+// POST /{db}/_resync?online=true starts re-running the sync function over all documents in the
+// background, without taking the database offline. The optional body {"sync": "..."} gives a new
+// sync function, which is first run over all documents as a shadow, then switched to and applied.
+// With resume=true, the previous online resync is resumed from its checkpoint.
+func (h *handler) handleOnlineResync() error {
+	if atomic.LoadUint32(&h.db.State) == db.DBResyncing {
+		return base.HTTPErrorf(http.StatusServiceUnavailable, "Database _resync is already in progress")
+	}
+	var input struct {
+		Sync *string `json:"sync"`
+	}
+	body, err := h.readBody()
+	if err != nil {
+		return err
+	} else if len(body) > 0 {
+		if err := json.Unmarshal(body, &input); err != nil {
+			return base.HTTPErrorf(http.StatusBadRequest, "Invalid JSON body: %v", err)
+		}
+	}
+	status, err := h.db.StartResync(db.ResyncOptions{
+		SyncFunction: input.Sync,
+		BatchSize:    int(h.getIntQuery("batch_size", 0)),
+		Resume:       h.getBoolQuery("resume"),
+	})
+	if err != nil {
+		return err
+	}
+	h.writeJSONStatus(http.StatusAccepted, status)
+	return nil
+}
+
+// GET /{db}/_resync returns the status of the running or latest online resync.
+func (h *handler) handleGetResync() error {
+	status, err := h.db.ResyncStatus()
+	if err != nil {
+		return err
+	}
+	h.writeJSON(status)
+	return nil
+}
+
+// POST /{db}/_resync/_cancel cancels the running online resync. It can be resumed later.
+func (h *handler) handleCancelResync() error {
+	if err := h.db.CancelResync(); err != nil {
+		return err
+	}
+	status, err := h.db.ResyncStatus()
+	if err != nil {
+		return err
+	}
+	h.writeJSON(status)
+	return nil
+}
+
+// POST /{db}/_sync_test runs the sync function on a document without saving it, and returns its
+// channels, access and role grants, expiry and any rejection.
+func (h *handler) handleSyncFnTest() error {
+	var input struct {
+		Doc     db.Body                `json:"doc"`      // The new revision
+		OldDoc  db.Body                `json:"old_doc"`  // The current revision, if any
+		User    *string                `json:"user"`     // Name of an existing user to save the doc as
+		UserCtx map[string]interface{} `json:"user_ctx"` // Or, a user context: {"name", "roles", "channels"}
+		Sync    string                 `json:"sync"`     // Sync function to use instead of the database's
+	}
+	if err := h.readJSONInto(&input); err != nil {
+		return err
+	}
+	if input.Doc == nil {
+		return base.HTTPErrorf(http.StatusBadRequest, "Missing \"doc\" property")
+	} else if input.User != nil && input.UserCtx != nil {
+		return base.HTTPErrorf(http.StatusBadRequest, "Only one of \"user\" and \"user_ctx\" may be given")
+	}
+
+	oldJSON := ""
+	if input.OldDoc != nil {
+		oldJSONBytes, err := json.Marshal(input.OldDoc)
+		if err != nil {
+			return err
+		}
+		oldJSON = string(oldJSONBytes)
+	}
+
+	var user auth.User
+	if input.User != nil {
+		var err error
+		user, err = h.db.Authenticator().GetUser(internalUserName(*input.User))
+		if user == nil {
+			if err == nil {
+				err = base.HTTPErrorf(http.StatusNotFound, "No such user %q", *input.User)
+			}
+			return err
+		}
+	}
+
+	h.writeJSON(h.db.SyncFnDryRun(input.Doc, oldJSON, user, input.UserCtx, input.Sync))
+	return nil
+}
+
 func (h *handler) instanceStartTime() json.Number {
 	return json.Number(strconv.FormatInt(h.db.StartTime.UnixNano()/1000, 10))
 }
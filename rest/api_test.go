@@ -20,6 +20,8 @@ import (
 	"mime"
 	"mime/multipart"
 	"net/http"
+	"os"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
@@ -77,6 +79,25 @@ func (rt *RestTester) createDoc(t *testing.T, docid string) string {
 	return revid
 }
 
+func TestRequestID(t *testing.T) {
+	var rt RestTester
+	defer rt.Close()
+
+	// The client's X-Request-ID is echoed back, minus any unsafe characters:
+	response := rt.SendRequestWithHeaders("GET", "/db/", "", map[string]string{"X-Request-ID": "abc-123"})
+	assertStatus(t, response, 200)
+	assert.Equals(t, response.Header().Get("X-Request-ID"), "abc-123")
+
+	response = rt.SendAdminRequestWithHeaders("GET", "/db/", "", map[string]string{"X-Request-ID": "abc 123%s<>"})
+	assertStatus(t, response, 200)
+	assert.Equals(t, response.Header().Get("X-Request-ID"), "abc123s")
+
+	response = rt.SendRequest("GET", "/db/", "")
+	assert.Equals(t, response.Header().Get("X-Request-ID"), "")
+
+	assert.Equals(t, len(sanitizeRequestID(strings.Repeat("x", 500))), kMaxRequestIDLength)
+}
+
 func TestDocLifecycle(t *testing.T) {
 	var rt RestTester
 	defer rt.Close()
@@ -198,6 +219,33 @@ func TestDocAttachment(t *testing.T) {
 	assert.Equals(t, response.Header().Get("Content-Type"), attachmentContentType)
 }
 
+// Add and retrieve an attachment that's stored in chunks, including a subrange spanning chunks
+func TestChunkedDocAttachment(t *testing.T) {
+	defer func(chunkSize int) { db.AttachmentChunkSize = chunkSize }(db.AttachmentChunkSize)
+	db.AttachmentChunkSize = 8
+
+	var rt RestTester
+	defer rt.Close()
+
+	attachmentBody := "this is the body of a chunked attachment"
+	response := rt.SendRequestWithHeaders("PUT", "/db/doc/attach1", attachmentBody, map[string]string{"Content-Type": "text/plain"})
+	assertStatus(t, response, 201)
+
+	response = rt.SendRequest("GET", "/db/doc/attach1", "")
+	assertStatus(t, response, 200)
+	assert.Equals(t, string(response.Body.Bytes()), attachmentBody)
+	assert.Equals(t, response.Header().Get("Content-Length"), "40")
+
+	response = rt.SendRequestWithHeaders("GET", "/db/doc/attach1", "", map[string]string{"Range": "bytes=5-20"})
+	assertStatus(t, response, 206)
+	assert.Equals(t, string(response.Body.Bytes()), "is the body of a")
+	assert.Equals(t, response.Header().Get("Content-Length"), "16")
+	assert.Equals(t, response.Header().Get("Content-Range"), "bytes 5-20/40")
+
+	response = rt.SendRequestWithHeaders("GET", "/db/doc/attach1", "", map[string]string{"Range": "bytes=50-"})
+	assertStatus(t, response, 416)
+}
+
 // Add an attachment to a document that has been removed from the users channels
 func TestDocAttachmentOnRemovedRev(t *testing.T) {
 	var rt RestTester
@@ -3297,3 +3345,146 @@ func Benchmark_RestApiPutDocPerformanceExplicitSyncFunc(b *testing.B) {
 		}
 	})
 }
+
+func TestDocumentSchemaValidation(t *testing.T) {
+	rt := RestTester{
+		DatabaseConfig: &DbConfig{
+			Schemas: &SchemasConfig{
+				Schemas: []*SchemaConfig{{
+					Name: "order",
+					Type: "order",
+					Schema: map[string]interface{}{
+						"required": []interface{}{"customer"},
+						"properties": map[string]interface{}{
+							"total": map[string]interface{}{"type": "number", "minimum": 0.0},
+						},
+					},
+				}},
+			},
+		},
+	}
+	defer rt.Close()
+
+	// Docs that don't have a schema, or match theirs, are saved:
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/note", `{"type":"note"}`), 201)
+	response := rt.SendAdminRequest("PUT", "/db/order1", `{"type":"order", "customer":"alice", "total":10}`)
+	assertStatus(t, response, 201)
+	var body db.Body
+	json.Unmarshal(response.Body.Bytes(), &body)
+	revID := body["rev"].(string)
+
+	// An invalid doc is rejected with the details:
+	response = rt.SendAdminRequest("PUT", "/db/order2", `{"type":"order", "total":-1}`)
+	assertStatus(t, response, 403)
+	body = nil
+	assert.Equals(t, json.Unmarshal(response.Body.Bytes(), &body), nil)
+	assert.Equals(t, body["schema"], "order")
+	assert.DeepEquals(t, body["validation_errors"], []interface{}{
+		map[string]interface{}{"path": "/customer", "message": "is required"},
+		map[string]interface{}{"path": "/total", "message": "must be >= 0"},
+	})
+	assert.True(t, strings.Contains(body["reason"].(string), "/total: must be >= 0"))
+
+	// Including an update, and a doc in _bulk_docs:
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/order1?rev="+revID, `{"type":"order", "customer":"alice", "total":"ten"}`), 403)
+	response = rt.SendAdminRequest("POST", "/db/_bulk_docs", `{"docs": [{"_id":"order3", "type":"order", "customer":"bob"},
+		{"_id":"order4", "type":"order"}]}`)
+	assertStatus(t, response, 201)
+	var results []map[string]interface{}
+	assert.Equals(t, json.Unmarshal(response.Body.Bytes(), &results), nil)
+	assert.Equals(t, len(results), 2)
+	assert.Equals(t, results[0]["error"], nil)
+	assert.Equals(t, results[1]["status"], 403.0)
+	assert.DeepEquals(t, results[1]["validation_errors"], []interface{}{
+		map[string]interface{}{"path": "/customer", "message": "is required"},
+	})
+
+	// Deletions aren't validated:
+	assertStatus(t, rt.SendAdminRequest("DELETE", "/db/order1?rev="+revID, ""), 200)
+}
+
+func TestRateLimits(t *testing.T) {
+	rt := RestTester{DatabaseConfig: &DbConfig{
+		RateLimits: &db.RateLimitOptions{
+			RequestsPerIP:   &db.RateLimit{Rate: 0.001, Burst: 3},
+			RequestsPerUser: &db.RateLimit{Rate: 0.001, Burst: 4},
+			ChangesPerUser:  &db.RateLimit{Rate: 0.001, Burst: 1},
+		},
+	}}
+	defer rt.Close()
+
+	for _, name := range []string{"alice", "bob"} {
+		assertStatus(t, rt.SendAdminRequest("PUT", "/db/_user/"+name, `{"password":"letmein", "admin_channels":["*"]}`), 201)
+	}
+	send := func(resource, username, clientIP string) *TestResponse {
+		rq := requestByUser("GET", resource, "", username)
+		rq.RemoteAddr = clientIP + ":12345"
+		return rt.Send(rq)
+	}
+
+	// Limit per client IP:
+	for i := 0; i < 3; i++ {
+		assertStatus(t, send("/db/", "alice", "10.0.0.1"), 200)
+	}
+	response := send("/db/", "alice", "10.0.0.1")
+	assertStatus(t, response, 429)
+	assert.True(t, response.HeaderMap.Get("Retry-After") != "")
+
+	// Limit per user:
+	assertStatus(t, send("/db/", "alice", "10.0.0.2"), 200)
+	response = send("/db/", "alice", "10.0.0.2")
+	assertStatus(t, response, 429)
+	assert.True(t, response.HeaderMap.Get("Retry-After") != "")
+
+	// Limit on changes feeds per user:
+	assertStatus(t, send("/db/_changes", "bob", "10.0.0.3"), 200)
+	assertStatus(t, send("/db/_changes", "bob", "10.0.0.3"), 429)
+
+	// The admin API isn't limited:
+	for i := 0; i < 10; i++ {
+		assertStatus(t, rt.SendAdminRequest("GET", "/db/_changes", ""), 200)
+	}
+}
+
+func TestPrincipalAndAuthEvents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "events")
+	assert.Equals(t, err, nil)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "events.ndjson")
+
+	fileHandler := []interface{}{map[string]interface{}{"handler": "file", "path": path}}
+	rt := RestTester{DatabaseConfig: &DbConfig{
+		EventHandlers: map[string]interface{}{
+			"principal_changed": fileHandler,
+			"session_created":   fileHandler,
+			"auth_failed":       fileHandler,
+		},
+	}}
+	defer rt.Close()
+
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_user/naomi", `{"password":"letmein"}`), 201)
+	assertStatus(t, rt.SendRequest("POST", "/db/_session", `{"name":"naomi", "password":"wrong"}`), 401)
+	assertStatus(t, rt.SendRequest("POST", "/db/_session", `{"name":"naomi", "password":"letmein"}`), 200)
+	assertStatus(t, rt.SendAdminRequest("DELETE", "/db/_user/naomi", ""), 200)
+
+	// Events are handled asynchronously, so wait for them, and ignore their order:
+	var events []string
+	for i := 0; i < 100 && len(events) < 4; i++ {
+		time.Sleep(20 * time.Millisecond)
+		data, _ := ioutil.ReadFile(path)
+		events = nil
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			var record db.FileEventRecord
+			if json.Unmarshal([]byte(line), &record) == nil {
+				events = append(events, fmt.Sprintf("%s %v %v %v", record.Event, record.Doc["name"], record.Doc["action"], record.Doc["method"]))
+			}
+		}
+	}
+	sort.Strings(events)
+	assert.DeepEquals(t, events, []string{
+		"auth_failed naomi <nil> session",
+		"principal_changed naomi created <nil>",
+		"principal_changed naomi deleted <nil>",
+		"session_created naomi <nil> <nil>",
+	})
+}
@@ -0,0 +1,78 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/db"
+)
+
+// Writes a security-relevant event to the audit log, if it's enabled. effectiveUser is the user
+// the action was performed as, or on, if any.
+func (h *handler) audit(event base.AuditEvent, effectiveUser string, details map[string]interface{}) {
+	if !base.AuditEnabled(event) {
+		return
+	}
+	record := base.AuditRecord{
+		Event:         event,
+		RealUser:      h.requestUsername(),
+		EffectiveUser: effectiveUser,
+		RemoteAddr:    h.rq.RemoteAddr,
+		Details:       details,
+	}
+	if h.db != nil {
+		record.Database = h.db.Name
+	} else {
+		// Authentication happens before h.db is set
+		record.Database = h.PathVar("db")
+	}
+	base.Audit(record)
+}
+
+// Audits a PUT or POST of a user or role. The details list what was set, but never the password.
+func (h *handler) auditPrincipalUpdate(info db.PrincipalConfig, isUser bool, replaced bool) {
+	event := base.AuditRoleUpdate
+	if isUser {
+		event = base.AuditUserUpdate
+	}
+	details := map[string]interface{}{"created": !replaced}
+	if info.ExplicitChannels != nil {
+		details["admin_channels"] = info.ExplicitChannels
+	}
+	if isUser {
+		if info.ExplicitRoleNames != nil {
+			details["admin_roles"] = info.ExplicitRoleNames
+		}
+		details["disabled"] = info.Disabled
+		details["password_changed"] = info.Password != nil
+	}
+	h.audit(event, *info.Name, details)
+}
+
+// Audits a user or role created or updated by _principals/_import.
+func (h *handler) auditPrincipalImport(record db.PrincipalRecord, result db.PrincipalImportResult) {
+	event := base.AuditRoleUpdate
+	isUser := record.Type == db.PrincipalTypeUser
+	if isUser {
+		event = base.AuditUserUpdate
+	}
+	details := map[string]interface{}{"created": result == db.PrincipalCreated, "imported": true}
+	if record.ExplicitChannels != nil {
+		details["admin_channels"] = record.ExplicitChannels
+	}
+	if isUser {
+		if record.ExplicitRoleNames != nil {
+			details["admin_roles"] = record.ExplicitRoleNames
+		}
+		details["disabled"] = record.Disabled
+		details["password_changed"] = record.Password != nil || record.PasswordHash != ""
+	}
+	h.audit(event, record.Name, details)
+}
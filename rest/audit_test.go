@@ -0,0 +1,142 @@
+package rest
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbaselabs/go.assert"
+)
+
+func readAuditRecords(t *testing.T, output *bytes.Buffer) []base.AuditRecord {
+	var records []base.AuditRecord
+	for _, line := range strings.Split(strings.TrimSuffix(output.String(), "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		var record base.AuditRecord
+		assert.Equals(t, json.Unmarshal([]byte(line), &record), nil)
+		records = append(records, record)
+	}
+	output.Reset()
+	return records
+}
+
+func TestAuditLog(t *testing.T) {
+	var rt RestTester
+	defer rt.Close()
+
+	var output bytes.Buffer
+	base.SetAuditLogger(base.NewAuditLogger(&output, nil))
+	defer base.SetAuditLogger(nil)
+
+	// Creating a user:
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_user/alice", `{"password":"letmein", "admin_channels":["a"]}`), 201)
+	records := readAuditRecords(t, &output)
+	assert.Equals(t, len(records), 1)
+	assert.Equals(t, records[0].Event, base.AuditUserUpdate)
+	assert.Equals(t, records[0].Database, "db")
+	assert.Equals(t, records[0].RealUser, "ADMIN")
+	assert.Equals(t, records[0].EffectiveUser, "alice")
+	assert.Equals(t, records[0].Details["created"], true)
+	assert.Equals(t, records[0].Details["password_changed"], true)
+	_, found := records[0].Details["password"]
+	assert.False(t, found)
+
+	// Successful and failed authentication:
+	assertStatus(t, rt.SendRequestWithHeaders("GET", "/db/", "", basicAuthHeader("alice", "letmein")), 200)
+	assertStatus(t, rt.SendRequestWithHeaders("GET", "/db/", "", basicAuthHeader("alice", "wrong")), 401)
+	records = readAuditRecords(t, &output)
+	assert.Equals(t, len(records), 2)
+	assert.Equals(t, records[0].Event, base.AuditAuthSuccess)
+	assert.Equals(t, records[0].RealUser, "alice")
+	assert.Equals(t, records[0].Database, "db")
+	assert.Equals(t, records[1].Event, base.AuditAuthFailure)
+	assert.Equals(t, records[1].RealUser, "")
+	assert.Equals(t, records[1].EffectiveUser, "alice")
+	assert.Equals(t, records[1].Details["method"], "basic")
+
+	// Sessions:
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_session", `{"name":"alice"}`), 200)
+	assertStatus(t, rt.SendAdminRequest("DELETE", "/db/_user/alice/_session", ""), 200)
+	records = readAuditRecords(t, &output)
+	assert.Equals(t, len(records), 2)
+	assert.Equals(t, records[0].Event, base.AuditSessionCreate)
+	assert.Equals(t, records[0].EffectiveUser, "alice")
+	assert.Equals(t, records[1].Event, base.AuditSessionDelete)
+
+	// Purge:
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/doc1", `{}`), 201)
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_purge", `{"doc1":["*"]}`), 200)
+	records = readAuditRecords(t, &output)
+	assert.Equals(t, len(records), 1)
+	assert.Equals(t, records[0].Event, base.AuditPurge)
+	assert.DeepEquals(t, records[0].Details["doc_ids"], []interface{}{"doc1"})
+
+	// Maintenance jobs:
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_maintenance/session_cleanup?dry_run=true", ""), 202)
+	records = readAuditRecords(t, &output)
+	assert.Equals(t, len(records), 1)
+	assert.Equals(t, records[0].Event, base.AuditMaintenance)
+	assert.Equals(t, records[0].Details["job"], "session_cleanup")
+	assert.Equals(t, records[0].Details["dry_run"], true)
+
+	// Deleting the user:
+	assertStatus(t, rt.SendAdminRequest("DELETE", "/db/_user/alice", ""), 200)
+	records = readAuditRecords(t, &output)
+	assert.Equals(t, len(records), 1)
+	assert.Equals(t, records[0].Event, base.AuditUserDelete)
+	assert.Equals(t, records[0].EffectiveUser, "alice")
+}
+
+func TestAuditLogEventFilter(t *testing.T) {
+	var rt RestTester
+	defer rt.Close()
+
+	var output bytes.Buffer
+	base.SetAuditLogger(base.NewAuditLogger(&output, []base.AuditEvent{base.AuditAuthFailure}))
+	defer base.SetAuditLogger(nil)
+
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_user/bob", `{"password":"letmein"}`), 201)
+	assertStatus(t, rt.SendRequestWithHeaders("GET", "/db/", "", basicAuthHeader("bob", "letmein")), 200)
+	assertStatus(t, rt.SendRequestWithHeaders("GET", "/db/", "", basicAuthHeader("bob", "nope")), 401)
+	records := readAuditRecords(t, &output)
+	assert.Equals(t, len(records), 1)
+	assert.Equals(t, records[0].Event, base.AuditAuthFailure)
+	assert.Equals(t, records[0].EffectiveUser, "bob")
+}
+
+func TestAuditLogAdminAuth(t *testing.T) {
+	var rt RestTester
+	defer rt.Close()
+
+	monitorPassword, adminPassword := "monitor-pw", "admin-pw"
+	rt.ServerContext().adminAuth = newAdminAuthenticator(&AdminAuthConfig{Users: map[string]*AdminUserConfig{
+		"monitor": {Password: &monitorPassword, Roles: []string{"monitor"}},
+		"root":    {Password: &adminPassword, Roles: []string{"admin"}},
+	}})
+
+	var output bytes.Buffer
+	base.SetAuditLogger(base.NewAuditLogger(&output, nil))
+	defer base.SetAuditLogger(nil)
+
+	// Reads, like monitoring polls, aren't audited; a request the admin user lacks the
+	// permission for is:
+	monitor := basicAuthHeader("monitor", "monitor-pw")
+	assertStatus(t, rt.SendAdminRequestWithHeaders("GET", "/_expvar", "", monitor), 200)
+	assertStatus(t, rt.SendAdminRequestWithHeaders("PUT", "/db/doc1", `{}`, monitor), 403)
+	records := readAuditRecords(t, &output)
+	assert.Equals(t, len(records), 1)
+	assert.Equals(t, records[0].Event, base.AuditAccessDenied)
+	assert.Equals(t, records[0].EffectiveUser, "monitor")
+	assert.Equals(t, records[0].Details["permission"], string(AdminPermDocs))
+
+	// Requests that change state are:
+	assertStatus(t, rt.SendAdminRequestWithHeaders("PUT", "/db/doc1", `{}`, basicAuthHeader("root", "admin-pw")), 201)
+	records = readAuditRecords(t, &output)
+	assert.Equals(t, len(records), 1)
+	assert.Equals(t, records[0].Event, base.AuditAuthSuccess)
+	assert.Equals(t, records[0].Details["method"], "admin")
+}
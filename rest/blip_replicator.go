@@ -0,0 +1,1113 @@
+package rest
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/couchbase/go-blip"
+	"golang.org/x/net/websocket"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
+	"github.com/couchbase/sync_gateway/db"
+)
+
+// Value of the "protocol" replication property that selects the built-in BLIP replicator
+// instead of sg-replicate.
+const kBlipReplicationProtocol = "blip"
+
+const (
+	kDefaultBlipReplicationBatchSize = 200
+	kBlipCheckpointInterval          = 5 * time.Second
+)
+
+// How long a one-shot pull waits for requested revisions to arrive, after the remote has sent
+// all its changes, before giving up. (A variable so tests can shorten it.)
+var blipPullRevTimeout = 2 * time.Minute
+
+// Parameters of an active replication between a local database and a remote Sync Gateway,
+// speaking the BLIP sync protocol to the remote's /_blipsync endpoint.
+type blipReplicationParams struct {
+	ReplicationID string
+	LocalDb       string   // Name of the local database
+	Remote        *url.URL // URL of the remote database, possibly including credentials
+	Push          bool     // True to push local changes to the remote, false to pull
+	Continuous    bool
+	Async         bool
+	Channels      []string // Optional channel filter
+	BatchSize     int
+}
+
+// Returns the URL of the remote database with the password removed, for logging.
+func (params blipReplicationParams) remoteForLog() string {
+	remote := *params.Remote
+	if remote.User != nil {
+		remote.User = url.User(remote.User.Username())
+	}
+	return remote.String()
+}
+
+// Returns the ID under which the replication's checkpoint is stored on the remote. It is derived
+// from the replication's parameters so that a restarted replication picks up where it left off.
+func (params blipReplicationParams) checkpointID() string {
+	direction := "pull"
+	if params.Push {
+		direction = "push"
+	}
+	remote := *params.Remote
+	remote.User = nil
+	digester := sha1.New()
+	digester.Write([]byte(params.LocalDb))
+	digester.Write([]byte{0})
+	digester.Write([]byte(remote.String()))
+	digester.Write([]byte{0})
+	digester.Write([]byte(direction))
+	digester.Write([]byte{0})
+	digester.Write([]byte(strings.Join(params.Channels, ",")))
+	return "sgr2-" + hex.EncodeToString(digester.Sum(nil))
+}
+
+// Returns the WebSocket URL of the remote database's BLIP sync endpoint.
+func (params blipReplicationParams) blipSyncURL() string {
+	remote := *params.Remote
+	remote.User = nil
+	switch remote.Scheme {
+	case "https":
+		remote.Scheme = "wss"
+	default:
+		remote.Scheme = "ws"
+	}
+	remote.Path = strings.TrimSuffix(remote.Path, "/") + "/_blipsync"
+	return remote.String()
+}
+
+func validateBlipReplicationParameters(requestParams ReplicationConfig, paramsFromConfig bool) (params blipReplicationParams, cancel bool, err error) {
+	if requestParams.CreateTarget {
+		err = base.HTTPErrorf(http.StatusBadRequest, "/_replicate create_target option is not currently supported.")
+		return
+	}
+
+	if len(requestParams.DocIds) > 0 {
+		err = base.HTTPErrorf(http.StatusBadRequest, "/_replicate doc_ids option is not currently supported.")
+		return
+	}
+
+	if requestParams.Proxy != "" {
+		err = base.HTTPErrorf(http.StatusBadRequest, "/_replicate proxy option is not currently supported.")
+		return
+	}
+
+	params.ReplicationID = requestParams.ReplicationId
+
+	//cancel parameter is only supported via the REST API
+	if requestParams.Cancel {
+		if paramsFromConfig {
+			err = base.HTTPErrorf(http.StatusBadRequest, "/_replicate cancel is invalid in Sync Gateway configuration")
+			return
+		}
+		cancel = true
+		if params.ReplicationID != "" {
+			return params, cancel, nil
+		}
+	}
+
+	sourceUrl, err := url.Parse(requestParams.Source)
+	if err != nil || requestParams.Source == "" {
+		err = base.HTTPErrorf(http.StatusBadRequest, "/_replicate source URL [%s] is invalid.", requestParams.Source)
+		return
+	}
+	targetUrl, err := url.Parse(requestParams.Target)
+	if err != nil || requestParams.Target == "" {
+		err = base.HTTPErrorf(http.StatusBadRequest, "/_replicate target URL [%s] is invalid.", requestParams.Target)
+		return
+	}
+
+	// Exactly one of the source and target must be a local database name:
+	sourceIsLocal := sourceUrl.Host == ""
+	targetIsLocal := targetUrl.Host == ""
+	if sourceIsLocal == targetIsLocal {
+		err = base.HTTPErrorf(http.StatusBadRequest, "/_replicate with protocol %q requires exactly one local database and one remote URL", kBlipReplicationProtocol)
+		return
+	}
+	if sourceIsLocal {
+		params.Push = true
+		params.LocalDb = strings.Trim(sourceUrl.Path, "/")
+		params.Remote = targetUrl
+	} else {
+		params.LocalDb = strings.Trim(targetUrl.Path, "/")
+		params.Remote = sourceUrl
+	}
+	if params.Remote.Scheme != "http" && params.Remote.Scheme != "https" {
+		err = base.HTTPErrorf(http.StatusBadRequest, "/_replicate remote URL must use http or https")
+		return
+	}
+	if err = db.ValidateDatabaseName(params.LocalDb); err != nil {
+		err = base.HTTPErrorf(http.StatusBadRequest, "/_replicate invalid local database name %q", params.LocalDb)
+		return
+	}
+
+	params.Continuous = requestParams.Continuous
+	params.Async = requestParams.Async
+	params.BatchSize = kDefaultBlipReplicationBatchSize
+	if requestParams.ChangesFeedLimit != nil && *requestParams.ChangesFeedLimit > 0 {
+		params.BatchSize = *requestParams.ChangesFeedLimit
+	}
+
+	if requestParams.Filter != "" {
+		if requestParams.Filter != "sync_gateway/bychannel" {
+			err = base.HTTPErrorf(http.StatusBadRequest, "/_replicate Unknown filter; try sync_gateway/bychannel")
+			return
+		}
+		if params.Channels, err = channelsFromReplicationQueryParams(requestParams.QueryParams); err != nil {
+			return
+		}
+	}
+
+	return params, cancel, nil
+}
+
+//////// REPLICATION MANAGER:
+
+// Manages the active BLIP replications running on this node. The sg-replicate based replications
+// are managed separately by base.Replicator.
+type blipReplicator struct {
+	sc           *ServerContext
+	replications map[string]*blipReplication
+	lock         sync.RWMutex
+}
+
+func newBlipReplicator(sc *ServerContext) *blipReplicator {
+	return &blipReplicator{
+		sc:           sc,
+		replications: make(map[string]*blipReplication),
+	}
+}
+
+// Starts or cancels a replication. A synchronous one-shot replication doesn't return until it
+// has completed.
+func (r *blipReplicator) Replicate(params blipReplicationParams, isCancel bool) (*base.ActiveTask, error) {
+	replicationID, found := r.getReplicationForParams(params)
+
+	if isCancel {
+		if !found {
+			return nil, base.HTTPErrorf(http.StatusNotFound, "No replication found matching specified parameters")
+		}
+		return r.stopReplication(replicationID)
+	}
+
+	if found {
+		return nil, base.HTTPErrorf(http.StatusConflict, "Replication already active for specified parameters")
+	}
+	if params.ReplicationID == "" {
+		params.ReplicationID = base.CreateUUID()
+	}
+
+	dbc, err := r.sc.GetDatabase(params.LocalDb)
+	if err != nil {
+		return nil, err
+	}
+
+	replication := newBlipReplication(params, dbc)
+	if !r.addReplication(replication) {
+		return nil, base.HTTPErrorf(http.StatusConflict, "Replication already active for specified parameters")
+	}
+	if err := replication.start(); err != nil {
+		r.removeReplication(params.ReplicationID)
+		return nil, err
+	}
+
+	go func() {
+		<-replication.done
+		r.removeReplication(params.ReplicationID)
+	}()
+
+	if !params.Continuous && !params.Async {
+		<-replication.done
+		return replication.activeTask(), replication.error()
+	}
+	return replication.activeTask(), nil
+}
+
+// Returns true if a replication with the given ID is running.
+func (r *blipReplicator) HasReplication(replicationID string) bool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	_, found := r.replications[replicationID]
+	return found
+}
+
+func (r *blipReplicator) ActiveTasks() (tasks []base.ActiveTask) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	tasks = make([]base.ActiveTask, 0, len(r.replications))
+	for _, replication := range r.replications {
+		tasks = append(tasks, *replication.activeTask())
+	}
+	return tasks
+}
+
+func (r *blipReplicator) StopReplications() {
+	r.lock.RLock()
+	replicationIDs := make([]string, 0, len(r.replications))
+	for replicationID := range r.replications {
+		replicationIDs = append(replicationIDs, replicationID)
+	}
+	r.lock.RUnlock()
+
+	for _, replicationID := range replicationIDs {
+		base.LogTo("Replicate", "Stopping replication %s", replicationID)
+		if _, err := r.stopReplication(replicationID); err != nil {
+			base.Warn("Error stopping replication %s.  It's possible that the replication was already stopped and this can be safely ignored. Error: %v.", replicationID, err)
+		}
+	}
+}
+
+func (r *blipReplicator) getReplicationForParams(params blipReplicationParams) (replicationID string, found bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	if params.ReplicationID != "" {
+		_, found = r.replications[params.ReplicationID]
+		return params.ReplicationID, found
+	}
+	checkpointID := params.checkpointID()
+	for knownReplicationID, replication := range r.replications {
+		if replication.checkpointID == checkpointID {
+			return knownReplicationID, true
+		}
+	}
+	return "", false
+}
+
+func (r *blipReplicator) addReplication(replication *blipReplication) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, found := r.replications[replication.params.ReplicationID]; found {
+		return false
+	}
+	r.replications[replication.params.ReplicationID] = replication
+	return true
+}
+
+func (r *blipReplicator) removeReplication(replicationID string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.replications, replicationID)
+}
+
+func (r *blipReplicator) stopReplication(replicationID string) (*base.ActiveTask, error) {
+	r.lock.RLock()
+	replication := r.replications[replicationID]
+	r.lock.RUnlock()
+	if replication == nil {
+		return nil, base.HTTPErrorf(http.StatusNotFound, "No replication found matching specified replication ID")
+	}
+	replication.stop(nil)
+	<-replication.done
+	r.removeReplication(replicationID)
+	return replication.activeTask(), nil
+}
+
+//////// REPLICATION:
+
+// Returned internally when a one-shot push has sent every change.
+var errBlipReplicationCaughtUp = errors.New("replication caught up")
+
+// The state of a checkpoint as stored on the remote via getCheckpoint/setCheckpoint.
+type blipReplicationCheckpoint struct {
+	Local  json.RawMessage `json:"local,omitempty"`  // Last local sequence pushed
+	Remote json.RawMessage `json:"remote,omitempty"` // Last remote sequence pulled
+}
+
+// An active replication, i.e. a BLIP connection opened by this gateway to a remote one.
+type blipReplication struct {
+	params       blipReplicationParams
+	checkpointID string
+	dbc          *db.DatabaseContext
+	ctx          *blipSyncContext
+	database     *db.Database
+	terminator   chan bool     // Closed to stop the replication
+	done         chan struct{} // Closed when the replication has stopped
+	stopOnce     sync.Once
+	startTime    time.Time
+
+	docsRead         uint32
+	docsWritten      uint32
+	docWriteFailures uint32
+
+	lock             sync.Mutex
+	err              error
+	checkpoint       blipReplicationCheckpoint
+	checkpointRev    string
+	checkpointDirty  bool
+	checkpointLock   sync.Mutex // Serializes setCheckpoint requests
+	pullSequences    pullSequenceTracker
+	pullProgressTime int64 // When a change or revision was last received, in UnixNano (accessed atomically)
+	pullCaughtUp     bool
+	pullFinished     chan struct{} // Closed when a one-shot pull has received everything
+	pullFinishedOnce sync.Once
+}
+
+func newBlipReplication(params blipReplicationParams, dbc *db.DatabaseContext) *blipReplication {
+	database, _ := db.GetDatabase(dbc, nil)
+	r := &blipReplication{
+		params:       params,
+		checkpointID: params.checkpointID(),
+		dbc:          dbc,
+		database:     database,
+		terminator:   make(chan bool),
+		done:         make(chan struct{}),
+		pullFinished: make(chan struct{}),
+	}
+	r.ctx = &blipSyncContext{
+		blipContext:       blip.NewContext(),
+		dbc:               dbc,
+		effectiveUsername: fmt.Sprintf(" (replication %s)", params.ReplicationID),
+	}
+	return r
+}
+
+// Connects to the remote, reads the checkpoint and starts replicating in the background.
+func (r *blipReplication) start() error {
+	base.LogTo("Replicate", "Starting BLIP %s replication %s of db %q with %s", r.direction(), r.params.ReplicationID, r.params.LocalDb, r.params.remoteForLog())
+	r.startTime = time.Now()
+
+	ctx := r.ctx
+	ctx.blipContext.DefaultHandler = ctx.notFound
+	ctx.register("getAttachment", (*blipHandler).handleGetAttachment)
+	ctx.register("proveAttachment", (*blipHandler).handleProveAttachment)
+	if !r.params.Push {
+		ctx.register("changes", r.handleChanges)
+		ctx.register("rev", r.handleRev)
+		ctx.register("norev", r.handleNoRev)
+	}
+	ctx.blipContext.Logger = func(fmt string, params ...interface{}) {
+		base.LogTo("BLIP", fmt, params...)
+	}
+	ctx.blipContext.LogMessages = base.LogEnabledExcludingLogStar("BLIP+")
+	ctx.blipContext.LogFrames = base.LogEnabledExcludingLogStar("BLIP++")
+
+	config, err := websocket.NewConfig(r.params.blipSyncURL(), r.params.remoteForLog())
+	if err != nil {
+		return base.HTTPErrorf(http.StatusBadRequest, "Invalid remote URL: %v", err)
+	}
+	config.Header = http.Header{}
+	if user := r.params.Remote.User; user != nil {
+		password, _ := user.Password()
+		config.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(user.Username()+":"+password)))
+	}
+	sender, err := ctx.blipContext.DialConfig(config)
+	if err != nil {
+		return base.HTTPErrorf(http.StatusBadGateway, "Unable to connect to %s: %v", r.params.remoteForLog(), err)
+	}
+	ctx.sender = sender
+
+	if err := r.getCheckpoint(); err != nil {
+		sender.Close()
+		return err
+	}
+
+	go r.run()
+	return nil
+}
+
+// Runs the replication until it's stopped or (if one-shot) complete.
+func (r *blipReplication) run() {
+	defer func() {
+		if panicked := recover(); panicked != nil {
+			base.Warn("*** PANIC in BLIP replication %s: %v\n%s", r.params.ReplicationID, panicked, debug.Stack())
+			r.stop(fmt.Errorf("Replication failed: %v", panicked))
+		}
+	}()
+
+	go r.saveCheckpointsPeriodically()
+
+	var err error
+	if r.params.Push {
+		err = r.push()
+		if err == errBlipReplicationCaughtUp {
+			err = nil
+		}
+	} else {
+		err = r.pull()
+	}
+	r.stop(err)
+}
+
+// Stops the replication, saving its checkpoint and closing the connection. May be called more
+// than once; only the first call has any effect.
+func (r *blipReplication) stop(err error) {
+	r.stopOnce.Do(func() {
+		r.lock.Lock()
+		r.err = err
+		r.lock.Unlock()
+		close(r.terminator)
+		if err != nil {
+			base.Warn("BLIP replication %s stopped: %v", r.params.ReplicationID, err)
+		}
+		// Save the final checkpoint, but don't wait forever if the remote has gone away:
+		saved := make(chan error, 1)
+		go func() { saved <- r.saveCheckpoint() }()
+		select {
+		case err := <-saved:
+			if err != nil {
+				base.Warn("BLIP replication %s couldn't save checkpoint: %v", r.params.ReplicationID, err)
+			}
+		case <-time.After(kBlipCheckpointInterval):
+			base.Warn("BLIP replication %s timed out saving checkpoint", r.params.ReplicationID)
+		}
+		r.ctx.sender.Close()
+		base.LogTo("Replicate", "BLIP replication %s stopped", r.params.ReplicationID)
+		close(r.done)
+	})
+}
+
+func (r *blipReplication) error() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.err
+}
+
+func (r *blipReplication) direction() string {
+	if r.params.Push {
+		return "push"
+	}
+	return "pull"
+}
+
+func (r *blipReplication) activeTask() *base.ActiveTask {
+	task := &base.ActiveTask{
+		TaskType:         "replication",
+		ReplicationID:    r.params.ReplicationID,
+		Continuous:       r.params.Continuous,
+		Direction:        r.direction(),
+		DocsRead:         atomic.LoadUint32(&r.docsRead),
+		DocsWritten:      atomic.LoadUint32(&r.docsWritten),
+		DocWriteFailures: atomic.LoadUint32(&r.docWriteFailures),
+	}
+	if r.params.Push {
+		task.Source = r.params.LocalDb
+		task.Target = r.params.remoteForLog()
+	} else {
+		task.Source = r.params.remoteForLog()
+		task.Target = r.params.LocalDb
+	}
+	r.lock.Lock()
+	if r.params.Push {
+		task.EndLastSeq = r.checkpoint.Local
+	} else {
+		task.EndLastSeq = r.checkpoint.Remote
+	}
+	r.lock.Unlock()
+	return task
+}
+
+//////// CHECKPOINTS:
+
+// Reads the replication's checkpoint from the remote.
+func (r *blipReplication) getCheckpoint() error {
+	outrq := blip.NewRequest()
+	outrq.SetProfile("getCheckpoint")
+	outrq.Properties["client"] = r.checkpointID
+	r.ctx.sender.Send(outrq)
+	response := outrq.Response()
+	if err := blipResponseError(response); err != nil {
+		if status, _ := base.ErrorAsHTTPStatus(err); status == http.StatusNotFound || status == http.StatusUnauthorized {
+			base.LogTo("Replicate", "No checkpoint found for replication %s", r.params.ReplicationID)
+			return nil // (the passive side reports a missing checkpoint as a 401)
+		}
+		return err
+	}
+	var checkpoint blipReplicationCheckpoint
+	if err := response.ReadJSONBody(&checkpoint); err != nil {
+		return err
+	}
+	r.lock.Lock()
+	r.checkpoint = checkpoint
+	r.checkpointRev = response.Properties["rev"]
+	r.lock.Unlock()
+	base.LogTo("Replicate", "Replication %s resuming from checkpoint local=%s remote=%s", r.params.ReplicationID, checkpoint.Local, checkpoint.Remote)
+	return nil
+}
+
+// Saves the replication's checkpoint to the remote, if it's changed since it was last saved.
+func (r *blipReplication) saveCheckpoint() error {
+	r.checkpointLock.Lock()
+	defer r.checkpointLock.Unlock()
+
+	r.lock.Lock()
+	if !r.checkpointDirty {
+		r.lock.Unlock()
+		return nil
+	}
+	checkpoint := r.checkpoint
+	revID := r.checkpointRev
+	r.checkpointDirty = false
+	r.lock.Unlock()
+
+	outrq := blip.NewRequest()
+	outrq.SetProfile("setCheckpoint")
+	outrq.Properties["client"] = r.checkpointID
+	if revID != "" {
+		outrq.Properties["rev"] = revID
+	}
+	outrq.SetJSONBody(checkpoint)
+	r.ctx.sender.Send(outrq)
+	response := outrq.Response()
+	if err := blipResponseError(response); err != nil {
+		r.lock.Lock()
+		r.checkpointDirty = true
+		r.lock.Unlock()
+		return err
+	}
+
+	r.lock.Lock()
+	r.checkpointRev = response.Properties["rev"]
+	r.lock.Unlock()
+	base.LogTo("Replicate+", "Replication %s saved checkpoint local=%s remote=%s", r.params.ReplicationID, checkpoint.Local, checkpoint.Remote)
+	return nil
+}
+
+func (r *blipReplication) saveCheckpointsPeriodically() {
+	ticker := time.NewTicker(kBlipCheckpointInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := r.saveCheckpoint(); err != nil {
+				base.Warn("BLIP replication %s couldn't save checkpoint: %v", r.params.ReplicationID, err)
+			}
+		case <-r.terminator:
+			return
+		}
+	}
+}
+
+func (r *blipReplication) setLocalCheckpoint(seq db.SequenceID) {
+	seqJSON, _ := json.Marshal(seq)
+	r.lock.Lock()
+	r.checkpoint.Local = seqJSON
+	r.checkpointDirty = true
+	r.lock.Unlock()
+}
+
+func (r *blipReplication) setRemoteCheckpoint(seqJSON string) {
+	r.lock.Lock()
+	r.checkpoint.Remote = json.RawMessage(seqJSON)
+	r.checkpointDirty = true
+	r.lock.Unlock()
+}
+
+//////// PUSH:
+
+// Sends local changes to the remote, starting from the checkpoint.
+func (r *blipReplication) push() error {
+	var since db.SequenceID
+	r.lock.Lock()
+	if r.checkpoint.Local != nil {
+		var err error
+		if since, err = db.ParseSequenceIDFromJSON(r.checkpoint.Local); err != nil {
+			base.Warn("BLIP replication %s has invalid local checkpoint %s; starting over", r.params.ReplicationID, r.checkpoint.Local)
+			since = db.SequenceID{}
+		}
+	}
+	r.lock.Unlock()
+
+	channelSet := channels.SetOf(channels.AllChannelWildcard)
+	if len(r.params.Channels) > 0 {
+		var err error
+		if channelSet, err = channels.SetFromArray(r.params.Channels, channels.ExpandStar); err != nil {
+			return err
+		}
+	}
+
+	options := db.ChangesOptions{
+		Since:      since,
+		Conflicts:  true,
+		Continuous: true,
+		Wait:       true,
+		Terminator: r.terminator,
+	}
+	feed, err := r.database.MultiChangesFeed(channelSet, options)
+	if err != nil {
+		return err
+	}
+
+	batch := make([]*db.ChangeEntry, 0, r.params.BatchSize)
+	for {
+		select {
+		case <-r.terminator:
+			return nil
+		case entry, ok := <-feed:
+			if !ok {
+				return nil
+			} else if entry == nil {
+				// Feed has caught up:
+				if len(batch) > 0 {
+					if err := r.pushBatch(batch); err != nil {
+						return err
+					}
+					batch = batch[0:0]
+				}
+				if !r.params.Continuous {
+					return errBlipReplicationCaughtUp
+				}
+			} else if entry.Err != nil {
+				return entry.Err
+			} else if !strings.HasPrefix(entry.ID, "_") {
+				batch = append(batch, entry)
+				if len(batch) >= r.params.BatchSize {
+					if err := r.pushBatch(batch); err != nil {
+						return err
+					}
+					batch = batch[0:0]
+				}
+			}
+		}
+	}
+}
+
+// A revision offered to the remote while pushing.
+type pushedRev struct {
+	index       int // Index of the rev's change in its batch
+	seq         db.SequenceID
+	docID       string
+	revID       string
+	parentRevID string
+	knownRevs   []string
+	deltaSrc    string // Known rev the remote will accept a delta from, if any
+}
+
+// Offers a batch of changes to the remote, sends the revisions it wants, and then advances the
+// checkpoint past the changes whose revisions were acknowledged or permanently rejected. If a
+// revision failed for another reason, such as the connection dropping, the checkpoint stops
+// before its change and the error is returned, so the replication restarts from there.
+func (r *blipReplication) pushBatch(changes []*db.ChangeEntry) error {
+	revs := make([]*pushedRev, 0, len(changes))
+	for i, change := range changes {
+		for _, item := range change.Changes {
+			revID, _ := item["rev"].(string)
+			if revID == "" {
+				continue
+			}
+			revs = append(revs, &pushedRev{index: i, seq: change.Seq, docID: change.ID, revID: revID})
+		}
+	}
+
+	wanted, err := r.proposeRevs(revs)
+	if err != nil {
+		return err
+	}
+
+	// Records a revision that failed, permanently or not:
+	var failureLock sync.Mutex
+	firstFailure := len(changes) // Index of the first change with a revision that has to be retried
+	var failureErr error
+	fail := func(rev *pushedRev, err error) {
+		atomic.AddUint32(&r.docWriteFailures, 1)
+		if isPermanentPushError(err) {
+			return
+		}
+		failureLock.Lock()
+		if rev.index < firstFailure {
+			firstFailure = rev.index
+			failureErr = err
+		}
+		failureLock.Unlock()
+	}
+
+	// Send the wanted revisions and wait for the remote to acknowledge them all:
+	bh := &blipHandler{blipSyncContext: r.ctx, db: r.database}
+	var wg sync.WaitGroup
+	for _, rev := range wanted {
+		knownRevs := make(map[string]bool, len(rev.knownRevs))
+		for _, knownRev := range rev.knownRevs {
+			knownRevs[knownRev] = true
+		}
+		outrq, atts, err := bh.makeRevisionRequest(rev.seq, rev.docID, rev.revID, knownRevs, 0, rev.deltaSrc)
+		atomic.AddUint32(&r.docsRead, 1)
+		if err != nil {
+			base.Warn("BLIP replication %s can't get doc %q/%s: %v", r.params.ReplicationID, rev.docID, rev.revID, err)
+			fail(rev, err)
+			continue
+		}
+		if atts != nil {
+			// Allow the remote to download attachments in 'atts', but only while pushing this rev
+			bh.addAllowedAttachments(atts)
+		}
+		r.ctx.sender.Send(outrq)
+		wg.Add(1)
+		go func(rev *pushedRev, outrq *blip.Message, atts map[string]interface{}) {
+			defer wg.Done()
+			if atts != nil {
+				defer bh.removeAllowedAttachments(atts)
+			}
+			if err := blipResponseError(outrq.Response()); err != nil {
+				base.Warn("BLIP replication %s: remote rejected %q/%s: %v", r.params.ReplicationID, rev.docID, rev.revID, err)
+				fail(rev, err)
+			} else {
+				atomic.AddUint32(&r.docsWritten, 1)
+			}
+		}(rev, outrq, atts)
+	}
+	wg.Wait()
+
+	if firstFailure > 0 {
+		r.setLocalCheckpoint(changes[firstFailure-1].Seq)
+	}
+	return failureErr
+}
+
+// Returns true if a revision that failed to push with this error would fail again, so it's
+// skipped instead of retried: e.g. it was rejected by the remote's sync function (403), is in
+// conflict (409), or has since been removed locally (404). Other errors, such as a dropped
+// connection or a 5xx from the remote, are temporary.
+func isPermanentPushError(err error) bool {
+	status, _ := base.ErrorAsHTTPStatus(err)
+	return status >= 400 && status < 500 && status != http.StatusRequestTimeout && status != http.StatusTooManyRequests
+}
+
+// Asks the remote which of the given revisions it wants, using "proposeChanges" if this
+// database doesn't allow conflicts, else "changes". Returns the wanted revisions.
+func (r *blipReplication) proposeRevs(revs []*pushedRev) ([]*pushedRev, error) {
+	if len(revs) == 0 {
+		return nil, nil
+	}
+	useProposeChanges := !r.database.AllowConflicts()
+
+	outrq := blip.NewRequest()
+	changeArray := make([][]interface{}, len(revs))
+	if useProposeChanges {
+		outrq.SetProfile("proposeChanges")
+		for i, rev := range revs {
+			rev.parentRevID = r.parentRevID(rev.docID, rev.revID)
+			changeArray[i] = []interface{}{rev.docID, rev.revID, rev.parentRevID}
+		}
+	} else {
+		outrq.SetProfile("changes")
+		for i, rev := range revs {
+			changeArray[i] = []interface{}{rev.seq, rev.docID, rev.revID}
+		}
+	}
+	outrq.SetJSONBody(changeArray)
+	r.ctx.sender.Send(outrq)
+	response := outrq.Response()
+	if err := blipResponseError(response); err != nil {
+		return nil, err
+	}
+
+	var answer []interface{}
+	if err := response.ReadJSONBody(&answer); err != nil {
+		return nil, err
+	}
+	base.LogTo("Replicate+", "Replication %s offered %d revs to remote", r.params.ReplicationID, len(revs))
+	deltasAccepted := response.Properties["deltas"] == "true" && r.database.DeltaSyncEnabled()
+
+	wanted := make([]*pushedRev, 0, len(revs))
+	for i, rev := range revs {
+		if useProposeChanges {
+			// Answer is an array of status codes, 0 meaning "send it"; trailing zeroes are omitted
+			if i >= len(answer) {
+				wanted = append(wanted, rev)
+			} else if status, ok := answer[i].(float64); ok && status == 0 {
+				wanted = append(wanted, rev)
+			}
+			if rev.parentRevID != "" {
+				rev.knownRevs = []string{rev.parentRevID}
+				if deltasAccepted {
+					rev.deltaSrc = rev.parentRevID
+				}
+			}
+		} else if i < len(answer) {
+			// Answer is an array of known-rev arrays, or non-arrays for revisions not wanted
+			if knownRevs, ok := answer[i].([]interface{}); ok {
+				for _, knownRev := range knownRevs {
+					if knownRevID, ok := knownRev.(string); ok {
+						rev.knownRevs = append(rev.knownRevs, knownRevID)
+					}
+				}
+				if deltasAccepted && len(rev.knownRevs) > 0 {
+					rev.deltaSrc = rev.knownRevs[0]
+				}
+				wanted = append(wanted, rev)
+			}
+		}
+	}
+	return wanted, nil
+}
+
+// Returns the parent of a local revision, or "" if it has none.
+func (r *blipReplication) parentRevID(docID, revID string) string {
+	doc, err := r.database.GetDocument(docID, db.DocUnmarshalSync)
+	if err != nil || doc == nil {
+		return ""
+	}
+	if info, found := doc.History[revID]; found {
+		return info.Parent
+	}
+	return ""
+}
+
+//////// PULL:
+
+// Subscribes to the remote's changes, starting from the checkpoint. Incoming changes and
+// revisions are handled by handleChanges and handleRev.
+func (r *blipReplication) pull() error {
+	outrq := blip.NewRequest()
+	outrq.SetProfile("subChanges")
+	r.lock.Lock()
+	if r.checkpoint.Remote != nil {
+		outrq.Properties["since"] = string(r.checkpoint.Remote)
+	}
+	r.lock.Unlock()
+	outrq.Properties["batch"] = strconv.Itoa(r.params.BatchSize)
+	if r.params.Continuous {
+		outrq.Properties["continuous"] = "true"
+	}
+	if len(r.params.Channels) > 0 {
+		outrq.Properties["filter"] = "sync_gateway/bychannel"
+		outrq.Properties["channels"] = strings.Join(r.params.Channels, ",")
+	}
+	r.notePullProgress()
+	r.ctx.sender.Send(outrq)
+	if err := blipResponseError(outrq.Response()); err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(blipPullRevTimeout / 10)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.pullFinished:
+			return nil
+		case <-r.terminator:
+			return nil
+		case <-ticker.C:
+			if pending := r.pullStalled(); pending > 0 {
+				return base.HTTPErrorf(http.StatusGatewayTimeout, "Timed out waiting for %d revisions from remote", pending)
+			}
+		}
+	}
+}
+
+func (r *blipReplication) notePullProgress() {
+	atomic.StoreInt64(&r.pullProgressTime, time.Now().UnixNano())
+}
+
+// If a one-shot pull has received every change, but has waited longer than blipPullRevTimeout
+// for the remaining revisions, returns the number of revisions it's waiting for; else 0.
+func (r *blipReplication) pullStalled() int {
+	if r.params.Continuous {
+		return 0
+	}
+	r.lock.Lock()
+	caughtUp := r.pullCaughtUp
+	r.lock.Unlock()
+	lastProgress := time.Unix(0, atomic.LoadInt64(&r.pullProgressTime))
+	if !caughtUp || time.Since(lastProgress) < blipPullRevTimeout {
+		return 0
+	}
+	return r.pullSequences.pendingCount()
+}
+
+// Handles a "changes" request from the remote, listing the revisions it has.
+func (r *blipReplication) handleChanges(bh *blipHandler, rq *blip.Message) error {
+	body, err := rq.Body()
+	if err != nil {
+		return err
+	}
+	var changeList [][]json.RawMessage
+	if err := json.Unmarshal(body, &changeList); err != nil {
+		return err
+	}
+	r.notePullProgress()
+	if len(changeList) == 0 {
+		// An empty "changes" message means the remote has sent everything
+		base.LogTo("Replicate+", "Replication %s caught up with remote", r.params.ReplicationID)
+		r.lock.Lock()
+		r.pullCaughtUp = true
+		r.lock.Unlock()
+		r.checkPullFinished()
+		return nil
+	}
+
+	answer := make([]interface{}, len(changeList))
+	for i, change := range changeList {
+		if len(change) < 3 {
+			return base.HTTPErrorf(http.StatusBadRequest, "Invalid change entry")
+		}
+		var docID, revID string
+		if err := json.Unmarshal(change[1], &docID); err != nil {
+			return err
+		}
+		if err := json.Unmarshal(change[2], &revID); err != nil {
+			return err
+		}
+		missing, possible := bh.db.RevDiff(docID, []string{revID})
+		if missing == nil {
+			answer[i] = 0
+		} else if len(possible) == 0 {
+			answer[i] = []string{}
+		} else {
+			answer[i] = possible
+		}
+		r.pullSequences.expect(string(change[0]), missing != nil)
+	}
+	r.advancePullCheckpoint()
+
+	if response := rq.Response(); response != nil {
+		if r.database.DeltaSyncEnabled() {
+			response.Properties["deltas"] = "true"
+		}
+		response.SetCompressed(true)
+		response.SetJSONBody(answer)
+	}
+	return nil
+}
+
+// Handles a "rev" request from the remote, containing a revision that was asked for.
+func (r *blipReplication) handleRev(bh *blipHandler, rq *blip.Message) error {
+	r.notePullProgress()
+	atomic.AddUint32(&r.docsRead, 1)
+	err := bh.handleAddRevision(rq)
+	if err != nil {
+		atomic.AddUint32(&r.docWriteFailures, 1)
+	} else {
+		atomic.AddUint32(&r.docsWritten, 1)
+	}
+	// A failed revision still counts as processed, else the checkpoint could never advance:
+	if seq, found := rq.Properties["sequence"]; found {
+		r.pullSequences.received(seq)
+		r.advancePullCheckpoint()
+	}
+	r.checkPullFinished()
+	return err
+}
+
+// Handles a "norev" request from the remote, saying that a revision that was asked for can't be
+// sent. Like a failed revision, it counts as processed.
+func (r *blipReplication) handleNoRev(bh *blipHandler, rq *blip.Message) error {
+	r.notePullProgress()
+	base.Warn("Replication %s: remote can't send doc %q/%s: %s %s", r.params.ReplicationID, rq.Properties["id"], rq.Properties["rev"], rq.Properties["error"], rq.Properties["reason"])
+	atomic.AddUint32(&r.docWriteFailures, 1)
+	if seq, found := rq.Properties["sequence"]; found {
+		r.pullSequences.received(seq)
+		r.advancePullCheckpoint()
+	}
+	r.checkPullFinished()
+	return nil
+}
+
+func (r *blipReplication) advancePullCheckpoint() {
+	if seq, changed := r.pullSequences.checkpoint(); changed {
+		r.setRemoteCheckpoint(seq)
+	}
+}
+
+// Ends a one-shot pull once the remote has caught up and every requested revision has arrived.
+func (r *blipReplication) checkPullFinished() {
+	if r.params.Continuous {
+		return
+	}
+	r.lock.Lock()
+	caughtUp := r.pullCaughtUp
+	r.lock.Unlock()
+	if caughtUp && r.pullSequences.pendingCount() == 0 {
+		r.pullFinishedOnce.Do(func() {
+			close(r.pullFinished)
+		})
+	}
+}
+
+// Tracks the remote sequences announced by "changes" messages, so that the pull checkpoint only
+// advances past sequences whose revisions have been received.
+type pullSequenceTracker struct {
+	lock     sync.Mutex
+	sequence []string        // Announced sequences, in the order the remote sent them
+	complete map[string]bool // Announced sequences that aren't awaiting a revision
+	pending  int             // Number of sequences awaiting a revision
+	last     string          // Latest sequence up to which everything is complete
+}
+
+// Records an announced sequence; needsRev is true if a revision was requested for it.
+func (t *pullSequenceTracker) expect(seq string, needsRev bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.complete == nil {
+		t.complete = make(map[string]bool)
+	}
+	t.sequence = append(t.sequence, seq)
+	if needsRev {
+		t.pending++
+	} else {
+		t.complete[seq] = true
+	}
+}
+
+// Records that the revision for an announced sequence has been received.
+func (t *pullSequenceTracker) received(seq string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.complete == nil {
+		t.complete = make(map[string]bool)
+	}
+	if !t.complete[seq] {
+		t.complete[seq] = true
+		if t.pending > 0 {
+			t.pending--
+		}
+	}
+}
+
+// Returns the latest sequence such that it and all prior sequences are complete, and whether that
+// has changed since the last call.
+func (t *pullSequenceTracker) checkpoint() (seq string, changed bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	n := 0
+	for n < len(t.sequence) && t.complete[t.sequence[n]] {
+		delete(t.complete, t.sequence[n])
+		t.last = t.sequence[n]
+		n++
+	}
+	t.sequence = t.sequence[n:]
+	return t.last, n > 0
+}
+
+// Returns the number of sequences still awaiting a revision.
+func (t *pullSequenceTracker) pendingCount() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.pending
+}
+
+//////// UTILITIES:
+
+// Returns an error if a BLIP response is an error response.
+func blipResponseError(response *blip.Message) error {
+	if response == nil {
+		return base.HTTPErrorf(http.StatusBadGateway, "No response from remote")
+	}
+	if response.Type() != blip.ErrorType {
+		return nil
+	}
+	status, err := strconv.Atoi(response.Properties["Error-Code"])
+	if err != nil || response.Properties["Error-Domain"] != "HTTP" {
+		status = http.StatusBadGateway
+	}
+	message, _ := response.Body()
+	return base.HTTPErrorf(status, "Remote error: %s", message)
+}
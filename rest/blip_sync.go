@@ -32,8 +32,13 @@ type blipSyncContext struct {
 	continuous         bool
 	activeOnly         bool
 	channels           base.Set
+	changesFilter      db.ChangesFilter
+	namespace          string
 	lock               sync.Mutex
 	allowedAttachments map[string]int
+	logCtx             *base.LogContext // LogContext of the HTTP request that opened the connection
+	rateLimited        bool             // Are messages subject to the database's rate limits?
+	clientIP           string           // IP address of the client, for rate limiting
 }
 
 type blipHandler struct {
@@ -43,12 +48,13 @@ type blipHandler struct {
 
 // Maps the profile (verb) of an incoming request to the method that handles it.
 var kHandlersByProfile = map[string]func(*blipHandler, *blip.Message) error{
-	"getCheckpoint": (*blipHandler).handleGetCheckpoint,
-	"setCheckpoint": (*blipHandler).handleSetCheckpoint,
-	"subChanges":    (*blipHandler).handleSubscribeToChanges,
-	"changes":       (*blipHandler).handlePushedChanges,
-	"rev":           (*blipHandler).handleAddRevision,
-	"getAttachment": (*blipHandler).handleGetAttachment,
+	"getCheckpoint":   (*blipHandler).handleGetCheckpoint,
+	"setCheckpoint":   (*blipHandler).handleSetCheckpoint,
+	"subChanges":      (*blipHandler).handleSubscribeToChanges,
+	"changes":         (*blipHandler).handlePushedChanges,
+	"rev":             (*blipHandler).handleAddRevision,
+	"getAttachment":   (*blipHandler).handleGetAttachment,
+	"proveAttachment": (*blipHandler).handleProveAttachment,
 }
 
 // HTTP handler for incoming BLIP sync WebSocket request (/db/_blipsync)
@@ -62,6 +68,9 @@ func (h *handler) handleBLIPSync() error {
 		dbc:               h.db.DatabaseContext,
 		user:              h.user,
 		effectiveUsername: h.currentEffectiveUserName(),
+		logCtx:            h.logCtx,
+		rateLimited:       h.privs != adminPrivs,
+		clientIP:          h.clientIP(),
 	}
 	ctx.blipContext.DefaultHandler = ctx.notFound
 	for profile, handlerFn := range kHandlersByProfile {
@@ -72,7 +81,7 @@ func (h *handler) handleBLIPSync() error {
 	}
 
 	ctx.blipContext.Logger = func(fmt string, params ...interface{}) {
-		base.LogTo("BLIP", fmt, params...)
+		base.LogToCtx(h.logCtx, "BLIP", fmt, params...)
 	}
 	ctx.blipContext.LogMessages = base.LogEnabledExcludingLogStar("BLIP+")
 	ctx.blipContext.LogFrames = base.LogEnabledExcludingLogStar("BLIP++")
@@ -82,7 +91,7 @@ func (h *handler) handleBLIPSync() error {
 		h.logStatus(101, "Upgraded to BLIP+WebSocket protocol")
 		defer func() {
 			conn.Close()
-			base.LogTo("HTTP+", "#%03d:     --> BLIP+WebSocket connection closed", h.serialNumber)
+			base.LogToCtx(h.logCtx, "HTTP+", "    --> BLIP+WebSocket connection closed")
 		}()
 		ctx.blipContext.WebSocketHandler()(conn)
 	}
@@ -99,30 +108,67 @@ func (h *handler) handleBLIPSync() error {
 func (ctx *blipSyncContext) register(profile string, handlerFn func(*blipHandler, *blip.Message) error) {
 	ctx.blipContext.HandlerForProfile[profile] = func(rq *blip.Message) {
 		ctx.sender = rq.Sender
-		base.LogTo("Sync", "%s %q ... %s", rq, profile, ctx.effectiveUsername)
+		base.LogToCtx(ctx.logCtx, "Sync", "%s %q ... %s", rq, profile, ctx.effectiveUsername)
 
 		db, _ := db.GetDatabase(ctx.dbc, ctx.user)
+		db.LogCtx = ctx.logCtx
 		handler := blipHandler{
 			blipSyncContext: ctx,
 			db:              db,
 		}
 
-		if err := handlerFn(&handler, rq); err != nil {
+		err := ctx.checkRateLimit(profile)
+		if err == nil {
+			err = handlerFn(&handler, rq)
+		}
+		if err != nil {
 			status, msg := base.ErrorAsHTTPStatus(err)
 			if response := rq.Response(); response != nil {
 				response.SetError("HTTP", status, msg)
+				if rateLimitErr, ok := err.(*base.RateLimitError); ok {
+					response.Properties["Retry-After"] = strconv.Itoa(rateLimitErr.RetryAfterSeconds())
+				}
+				// Structured error details, like a schema's "validation_errors", go in properties
+				// whose values are JSON, since the body holds the error message:
+				for key, value := range base.ErrorDetails(err) {
+					if valueJSON, jsonErr := json.Marshal(value); jsonErr == nil {
+						response.Properties[key] = string(valueJSON)
+					}
+				}
 			}
-			base.LogTo("Sync", "%s    --> %d %s ... %s", rq, status, msg, ctx.effectiveUsername)
+			base.LogToCtx(ctx.logCtx, "Sync", "%s    --> %d %s ... %s", rq, status, msg, ctx.effectiveUsername)
 		} else {
-			base.LogTo("Sync+", "%s    --> OK ... %s", rq, ctx.effectiveUsername)
+			base.LogToCtx(ctx.logCtx, "Sync+", "%s    --> OK ... %s", rq, ctx.effectiveUsername)
 		}
 	}
 }
 
+// Counts an incoming message against the database's rate limits; a subChanges message also
+// counts as opening a changes feed.
+func (ctx *blipSyncContext) checkRateLimit(profile string) error {
+	if !ctx.rateLimited {
+		return nil
+	}
+	kinds := []db.RateLimitKind{db.RateLimitRequests}
+	if profile == "subChanges" {
+		kinds = append(kinds, db.RateLimitChanges)
+	}
+	for _, kind := range kinds {
+		if err := ctx.dbc.CheckIPRateLimit(kind, ctx.clientIP); err != nil {
+			return err
+		} else if ctx.user != nil {
+			if err := ctx.dbc.CheckUserRateLimit(kind, ctx.user.Name()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 // Handler for unknown requests
 func (ctx *blipSyncContext) notFound(rq *blip.Message) {
-	base.LogTo("Sync", "%s %q ... %s", rq, rq.Profile(), ctx.effectiveUsername)
-	base.LogTo("Sync", "%s    --> 404 Unknown profile ... %s", rq, ctx.effectiveUsername)
+	base.LogToCtx(ctx.logCtx, "Sync", "%s %q ... %s", rq, rq.Profile(), ctx.effectiveUsername)
+	base.LogToCtx(ctx.logCtx, "Sync", "%s    --> 404 Unknown profile ... %s", rq, ctx.effectiveUsername)
 	blip.Unhandled(rq)
 }
 
@@ -178,7 +224,7 @@ func (bh *blipHandler) handleSubscribeToChanges(rq *blip.Message) error {
 	if sinceStr, found := rq.Properties["since"]; found {
 		var err error
 		if since, err = db.ParseSequenceIDFromJSON([]byte(sinceStr)); err != nil {
-			base.LogTo("Sync", "%s: Invalid sequence ID in 'since': %s ... %s", rq, sinceStr, bh.effectiveUsername)
+			base.LogToCtx(bh.logCtx, "Sync", "%s: Invalid sequence ID in 'since': %s ... %s", rq, sinceStr, bh.effectiveUsername)
 			since = db.SequenceID{}
 		}
 	}
@@ -188,6 +234,10 @@ func (bh *blipHandler) handleSubscribeToChanges(rq *blip.Message) error {
 		bh.continuous = true
 	}
 	bh.activeOnly = (rq.Properties["active_only"] == "true")
+	var err error
+	if bh.namespace, err = bh.db.ChangesNamespace(rq.Properties["namespace"]); err != nil {
+		return err
+	}
 	if filter := rq.Properties["filter"]; filter == "sync_gateway/bychannel" {
 		if channelsParam, found := rq.Properties["channels"]; !found {
 			return base.HTTPErrorf(http.StatusBadRequest, "Missing 'channels' filter parameter")
@@ -202,26 +252,57 @@ func (bh *blipHandler) handleSubscribeToChanges(rq *blip.Message) error {
 			}
 		}
 	} else if filter != "" {
-		return base.HTTPErrorf(http.StatusBadRequest, "Unknown filter; try sync_gateway/bychannel")
+		var err error
+		if bh.changesFilter, err = bh.makeChangesFilter(filter, rq.Properties); err != nil {
+			return err
+		}
+		if channelsParam, found := rq.Properties["channels"]; found {
+			if bh.channels, err = channels.SetFromArray(strings.Split(channelsParam, ","), channels.ExpandStar); err != nil {
+				return err
+			}
+		}
 	}
 	go bh.sendChanges(since)
 	return nil
 }
 
+// Creates the filter for a subChanges request using a named filter function or "_selector".
+// The selector is JSON in the "selector" property; a filter function's req.query contains all
+// the request's properties.
+func (bh *blipHandler) makeChangesFilter(filter string, properties blip.Properties) (db.ChangesFilter, error) {
+	if filter == db.ChangesFilterSelector {
+		var selector map[string]interface{}
+		if selectorParam := properties["selector"]; selectorParam != "" {
+			if err := json.Unmarshal([]byte(selectorParam), &selector); err != nil {
+				return nil, base.HTTPErrorf(http.StatusBadRequest, "Invalid 'selector' property: %v", err)
+			}
+		}
+		return db.NewSelectorFilter(selector)
+	}
+
+	query := make(map[string]interface{}, len(properties))
+	for key, value := range properties {
+		query[key] = value
+	}
+	return bh.db.GetChangesFilter(filter, query, db.MakeUserCtx(bh.user))
+}
+
 // Sends all changes since the given sequence
 func (bh *blipHandler) sendChanges(since db.SequenceID) {
 	defer func() {
 		if panicked := recover(); panicked != nil {
-			base.Warn("*** PANIC sending changes: %v\n%s", panicked, debug.Stack())
+			base.WarnCtx(bh.logCtx, "*** PANIC sending changes: %v\n%s", panicked, debug.Stack())
 		}
 	}()
 
-	base.LogTo("Sync", "Sending changes since %v ... %s", since, bh.effectiveUsername)
+	base.LogToCtx(bh.logCtx, "Sync", "Sending changes since %v ... %s", since, bh.effectiveUsername)
 	options := db.ChangesOptions{
 		Since:      since,
 		Conflicts:  true,
 		Continuous: bh.continuous,
 		ActiveOnly: bh.activeOnly,
+		Filter:     bh.changesFilter,
+		Namespace:  bh.namespace,
 		Terminator: make(chan bool),
 	}
 	defer close(options.Terminator)
@@ -241,7 +322,7 @@ func (bh *blipHandler) sendChanges(since db.SequenceID) {
 	}
 
 	generateContinuousChanges(bh.db, channelSet, options, nil, func(changes []*db.ChangeEntry) error {
-		base.LogTo("Sync+", "    Sending %d changes ... %s", len(changes), bh.effectiveUsername)
+		base.LogToCtx(bh.logCtx, "Sync+", "    Sending %d changes ... %s", len(changes), bh.effectiveUsername)
 		for _, change := range changes {
 			if !strings.HasPrefix(change.ID, "_") {
 				for _, item := range change.Changes {
@@ -278,9 +359,9 @@ func (bh *blipHandler) sendBatchOfChanges(changeArray [][]interface{}) {
 		bh.sender.Send(outrq)
 	}
 	if len(changeArray) > 0 {
-		base.LogTo("Sync", "Sent %d changes to client, from seq %v ... %s", len(changeArray), changeArray[0][0], bh.effectiveUsername)
+		base.LogToCtx(bh.logCtx, "Sync", "Sent %d changes to client, from seq %v ... %s", len(changeArray), changeArray[0][0], bh.effectiveUsername)
 	} else {
-		base.LogTo("Sync", "Sent all changes to client. ... %s", bh.effectiveUsername)
+		base.LogToCtx(bh.logCtx, "Sync", "Sent all changes to client. ... %s", bh.effectiveUsername)
 	}
 }
 
@@ -288,13 +369,13 @@ func (bh *blipHandler) sendBatchOfChanges(changeArray [][]interface{}) {
 func (bh *blipHandler) handleChangesResponse(response *blip.Message, changeArray [][]interface{}) {
 	defer func() {
 		if panicked := recover(); panicked != nil {
-			base.Warn("*** PANIC handling 'changes' response: %v\n%s", panicked, debug.Stack())
+			base.WarnCtx(bh.logCtx, "*** PANIC handling 'changes' response: %v\n%s", panicked, debug.Stack())
 		}
 	}()
 
 	var answer []interface{}
 	if err := response.ReadJSONBody(&answer); err != nil {
-		base.LogTo("Sync", "Invalid response to 'changes' message: %s -- %s ... %s", response, err, bh.effectiveUsername)
+		base.LogToCtx(bh.logCtx, "Sync", "Invalid response to 'changes' message: %s -- %s ... %s", response, err, bh.effectiveUsername)
 		return
 	}
 
@@ -303,6 +384,9 @@ func (bh *blipHandler) handleChangesResponse(response *blip.Message, changeArray
 		maxHistory = int(max)
 	}
 
+	// The client accepts revisions as deltas from the first known rev it lists:
+	deltasAccepted := response.Properties["deltas"] == "true" && bh.db.DeltaSyncEnabled()
+
 	// Maps docID --> a map containing true for revIDs known to the client
 	knownRevsByDoc := make(map[string]map[string]bool, len(answer))
 
@@ -319,15 +403,19 @@ func (bh *blipHandler) handleChangesResponse(response *blip.Message, changeArray
 				knownRevs = make(map[string]bool, len(knownRevsArray))
 				knownRevsByDoc[docID] = knownRevs
 			}
-			for _, rev := range knownRevsArray {
+			deltaSrcRevID := ""
+			for i, rev := range knownRevsArray {
 				if revID, ok := rev.(string); ok {
 					knownRevs[revID] = true
+					if i == 0 && deltasAccepted {
+						deltaSrcRevID = revID
+					}
 				} else {
-					base.LogTo("Sync", "Invalid response to 'changes' message ... %s", bh.effectiveUsername)
+					base.LogToCtx(bh.logCtx, "Sync", "Invalid response to 'changes' message ... %s", bh.effectiveUsername)
 					return
 				}
 			}
-			bh.sendRevision(seq, docID, revID, knownRevs, maxHistory)
+			bh.sendRevision(seq, docID, revID, knownRevs, maxHistory, deltaSrcRevID)
 		}
 	}
 }
@@ -342,7 +430,7 @@ func (bh *blipHandler) handlePushedChanges(rq *blip.Message) error {
 	if err := rq.ReadJSONBody(&changeList); err != nil {
 		return err
 	}
-	base.LogTo("Sync", "Received %d changes from client ... %s", len(changeList), bh.effectiveUsername)
+	base.LogToCtx(bh.logCtx, "Sync", "Received %d changes from client ... %s", len(changeList), bh.effectiveUsername)
 	if len(changeList) == 0 {
 		return nil
 	}
@@ -368,6 +456,9 @@ func (bh *blipHandler) handlePushedChanges(rq *blip.Message) error {
 	}
 	output.Write([]byte("]"))
 	response := rq.Response()
+	if bh.db.DeltaSyncEnabled() {
+		response.Properties["deltas"] = "true"
+	}
 	response.SetCompressed(true)
 	response.SetBody(output.Bytes())
 	return nil
@@ -379,7 +470,7 @@ func (bh *blipHandler) handleProposedChanges(rq *blip.Message) error {
 	if err := rq.ReadJSONBody(&changeList); err != nil {
 		return err
 	}
-	base.LogTo("Sync", "Received %d changes from client", len(changeList))
+	base.LogToCtx(bh.logCtx, "Sync", "Received %d changes from client", len(changeList))
 	if len(changeList) == 0 {
 		return nil
 	}
@@ -408,6 +499,9 @@ func (bh *blipHandler) handleProposedChanges(rq *blip.Message) error {
 	}
 	output.Write([]byte("]"))
 	response := rq.Response()
+	if bh.db.DeltaSyncEnabled() {
+		response.Properties["deltas"] = "true"
+	}
 	response.SetCompressed(true)
 	response.SetBody(output.Bytes())
 	return nil
@@ -415,14 +509,53 @@ func (bh *blipHandler) handleProposedChanges(rq *blip.Message) error {
 
 //////// DOCUMENTS:
 
-// Pushes a revision body to the client
-func (bh *blipHandler) sendRevision(seq db.SequenceID, docID string, revID string, knownRevs map[string]bool, maxHistory int) {
-	base.LogTo("Sync+", "Sending rev %q %s based on %d known ... %s", docID, revID, len(knownRevs), bh.effectiveUsername)
-	body, err := bh.db.GetRev(docID, revID, true, nil)
+// Pushes a revision body to the client. If deltaSrcRevID is non-empty, the body may be sent as a
+// delta from that revision.
+func (bh *blipHandler) sendRevision(seq db.SequenceID, docID string, revID string, knownRevs map[string]bool, maxHistory int, deltaSrcRevID string) {
+	outrq, atts, err := bh.makeRevisionRequest(seq, docID, revID, knownRevs, maxHistory, deltaSrcRevID)
 	if err != nil {
-		base.Warn("blipHandler can't get doc %q/%s: %v", docID, revID, err)
+		base.WarnCtx(bh.logCtx, "blipHandler can't get doc %q/%s: %v", docID, revID, err)
+		bh.sendNoRev(seq, docID, revID, err)
 		return
 	}
+	if atts != nil {
+		// Allow client to download attachments in 'atts', but only while pulling this rev
+		bh.addAllowedAttachments(atts)
+		bh.sender.Send(outrq)
+		go func() {
+			defer bh.removeAllowedAttachments(atts)
+			outrq.Response() // blocks till reply is received
+		}()
+	} else {
+		outrq.SetNoReply(true)
+		bh.sender.Send(outrq)
+	}
+}
+
+// Tells the peer that a revision it asked for can't be sent, so it doesn't wait for it.
+func (bh *blipHandler) sendNoRev(seq db.SequenceID, docID string, revID string, err error) {
+	status, reason := base.ErrorAsHTTPStatus(err)
+	seqJSON, _ := json.Marshal(seq)
+	outrq := blip.NewRequest()
+	outrq.SetProfile("norev")
+	outrq.Properties["id"] = docID
+	outrq.Properties["rev"] = revID
+	outrq.Properties["sequence"] = string(seqJSON)
+	outrq.Properties["error"] = strconv.Itoa(status)
+	outrq.Properties["reason"] = reason
+	outrq.SetNoReply(true)
+	bh.sender.Send(outrq)
+}
+
+// Creates a "rev" request containing a revision body, for sending to the peer. Also returns the
+// revision's attachments, if any. If deltaSrcRevID is non-empty and a smaller delta from that
+// revision is available, the request's body is the delta and its "deltaSrc" property is set.
+func (bh *blipHandler) makeRevisionRequest(seq db.SequenceID, docID string, revID string, knownRevs map[string]bool, maxHistory int, deltaSrcRevID string) (*blip.Message, map[string]interface{}, error) {
+	base.LogToCtx(bh.logCtx, "Sync+", "Sending rev %q %s based on %d known ... %s", docID, revID, len(knownRevs), bh.effectiveUsername)
+	body, err := bh.db.GetRev(docID, revID, true, nil)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	// Get the revision's history as a descending array of ancestor revIDs:
 	history := db.ParseRevisions(body)[1:]
@@ -451,19 +584,20 @@ func (bh *blipHandler) sendRevision(seq db.SequenceID, docID string, revID strin
 	if len(history) > 0 {
 		outrq.Properties["history"] = strings.Join(history, ",")
 	}
-	outrq.SetJSONBody(body)
-	if atts := db.BodyAttachments(body); atts != nil {
-		// Allow client to download attachments in 'atts', but only while pulling this rev
-		bh.addAllowedAttachments(atts)
-		bh.sender.Send(outrq)
-		go func() {
-			defer bh.removeAllowedAttachments(atts)
-			outrq.Response() // blocks till reply is received
-		}()
-	} else {
-		outrq.SetNoReply(true)
-		bh.sender.Send(outrq)
+
+	if deltaSrcRevID != "" && outrq.Properties["deleted"] == "" {
+		delta, err := bh.db.GetDelta(docID, deltaSrcRevID, revID)
+		if err != nil {
+			base.LogToCtx(bh.logCtx, "Sync+", "Can't create delta for %q %s from %s: %v ... %s", docID, revID, deltaSrcRevID, err, bh.effectiveUsername)
+		} else if delta != nil {
+			base.LogToCtx(bh.logCtx, "Sync+", "Sending rev %q %s as delta from %s ... %s", docID, revID, deltaSrcRevID, bh.effectiveUsername)
+			outrq.Properties["deltaSrc"] = deltaSrcRevID
+			outrq.SetJSONBody(delta.Delta)
+			return outrq, db.BodyAttachments(body), nil
+		}
 	}
+	outrq.SetJSONBody(body)
+	return outrq, db.BodyAttachments(body), nil
 }
 
 // Received a "rev" request, i.e. client is pushing a revision body
@@ -479,6 +613,24 @@ func (bh *blipHandler) handleAddRevision(rq *blip.Message) error {
 	if !found || !rfound {
 		return base.HTTPErrorf(http.StatusBadRequest, "Missing docID or revID")
 	}
+
+	// A body sent as a delta has to be applied to the deltaSrc revision, which I must have:
+	if deltaSrcRevID, found := rq.Properties["deltaSrc"]; found {
+		deltaSrcBody, err := bh.db.GetRev(docID, deltaSrcRevID, false, nil)
+		if err != nil || deltaSrcBody["_removed"] != nil {
+			return base.HTTPErrorf(http.StatusNotFound, "Can't fetch deltaSrc revision %s of doc %q", deltaSrcRevID, docID)
+		}
+		delete(deltaSrcBody, "_id")
+		delete(deltaSrcBody, "_rev")
+		delete(deltaSrcBody, "_revisions")
+		newBody, err := base.ApplyJSONDelta(deltaSrcBody, body)
+		if err != nil {
+			return base.HTTPErrorf(http.StatusBadRequest, "Invalid delta for doc %q: %v", docID, err)
+		}
+		base.LogToCtx(bh.logCtx, "Sync+", "Applied delta to %q from %s ... %s", docID, deltaSrcRevID, bh.effectiveUsername)
+		body = newBody
+	}
+
 	if del, found := rq.Properties["deleted"]; found && del != "0" && del != "false" {
 		body["_deleted"] = true // (PutExistingRev expects deleted flag in the body)
 	}
@@ -487,7 +639,7 @@ func (bh *blipHandler) handleAddRevision(rq *blip.Message) error {
 	if historyStr := rq.Properties["history"]; historyStr != "" {
 		history = append(history, strings.Split(historyStr, ",")...)
 	}
-	base.LogTo("Sync+", "Inserting rev %q %s history=%q, array = %#v ... %s", docID, revID, rq.Properties["history"], history, bh.effectiveUsername)
+	base.LogToCtx(bh.logCtx, "Sync+", "Inserting rev %q %s history=%q, array = %#v ... %s", docID, revID, rq.Properties["history"], history, bh.effectiveUsername)
 
 	// Look at attachments with revpos > the last common ancestor's
 	minRevpos := 1
@@ -520,13 +672,36 @@ func (bh *blipHandler) handleGetAttachment(rq *blip.Message) error {
 	if err != nil {
 		return err
 	}
-	base.LogTo("Sync+", "Sending attachment with digest=%q (%dkb) ... %s", digest, len(attachment)/1024, bh.effectiveUsername)
+	base.LogToCtx(bh.logCtx, "Sync+", "Sending attachment with digest=%q (%dkb) ... %s", digest, len(attachment)/1024, bh.effectiveUsername)
 	response := rq.Response()
 	response.SetBody(attachment)
 	response.SetCompressed(rq.Properties["compress"] == "true")
 	return nil
 }
 
+// Received a "proveAttachment" request, i.e. the peer wants proof that I have an attachment
+func (bh *blipHandler) handleProveAttachment(rq *blip.Message) error {
+	digest := rq.Properties["digest"]
+	if digest == "" {
+		return base.HTTPErrorf(http.StatusBadRequest, "Missing 'digest'")
+	}
+	nonce, err := rq.Body()
+	if err != nil {
+		return err
+	} else if len(nonce) == 0 {
+		return base.HTTPErrorf(http.StatusBadRequest, "Missing nonce")
+	}
+	if !bh.isAttachmentAllowed(digest) {
+		return base.HTTPErrorf(http.StatusForbidden, "Attachment's doc not being synced")
+	}
+	attachment, err := bh.db.GetAttachment(db.AttachmentKey(digest))
+	if err != nil {
+		return err
+	}
+	rq.Response().SetBody([]byte(db.ProveAttachment(attachment, nonce)))
+	return nil
+}
+
 // For each attachment in the revision, makes sure it's in the database, asking the client to
 // upload it if necessary. This method blocks until all the attachments have been processed.
 func (bh *blipHandler) downloadOrVerifyAttachments(body db.Body, minRevpos int) error {
@@ -537,7 +712,7 @@ func (bh *blipHandler) downloadOrVerifyAttachments(body db.Body, minRevpos int)
 				// security purposes I do need the client to _prove_ it has the data, otherwise if
 				// it knew the digest it could acquire the data by uploading a document with the
 				// claimed attachment, then downloading it.
-				base.LogTo("Sync+", "    Verifying attachment %q (digest %s)  ... %s", name, digest, bh.effectiveUsername)
+				base.LogToCtx(bh.logCtx, "Sync+", "    Verifying attachment %q (digest %s)  ... %s", name, digest, bh.effectiveUsername)
 				nonce, proof := db.GenerateProofOfAttachment(knownData)
 				outrq := blip.NewRequest()
 				outrq.Properties = map[string]string{"Profile": "proveAttachment", "digest": digest}
@@ -546,13 +721,13 @@ func (bh *blipHandler) downloadOrVerifyAttachments(body db.Body, minRevpos int)
 				if body, err := outrq.Response().Body(); err != nil {
 					return nil, err
 				} else if string(body) != proof {
-					base.LogTo("Sync+", "Error: Incorrect proof for attachment %s : I sent nonce %x, expected proof %q, got %q ... %s", digest, nonce, proof, body, bh.effectiveUsername)
+					base.LogToCtx(bh.logCtx, "Sync+", "Error: Incorrect proof for attachment %s : I sent nonce %x, expected proof %q, got %q ... %s", digest, nonce, proof, body, bh.effectiveUsername)
 					return nil, base.HTTPErrorf(http.StatusForbidden, "Incorrect proof for attachment %s", digest)
 				}
 				return nil, nil
 			} else {
 				// If I don't have the attachment, I will request it from the client:
-				base.LogTo("Sync+", "    Asking for attachment %q (digest %s)  ... %s", name, digest, bh.effectiveUsername)
+				base.LogToCtx(bh.logCtx, "Sync+", "    Asking for attachment %q (digest %s)  ... %s", name, digest, bh.effectiveUsername)
 				outrq := blip.NewRequest()
 				outrq.Properties = map[string]string{"Profile": "getAttachment", "digest": digest}
 				if isCompressible(name, meta) {
@@ -341,15 +341,19 @@ func (h *handler) handleDumpChannel() error {
 }
 
 // HTTP handler for a POST to _bulk_get
-// Request looks like POST /db/_bulk_get?revs=___&attachments=___
-// where the boolean ?revs parameter adds a revision history to each doc
-// and the boolean ?attachments parameter includes attachment bodies.
+// Request looks like POST /db/_bulk_get?revs=___&attachments=___&deltas=___
+// where the boolean ?revs parameter adds a revision history to each doc,
+// the boolean ?attachments parameter includes attachment bodies,
+// and the boolean ?deltas parameter allows revisions to be sent as deltas.
 // The body of the request is JSON and looks like:
 // {
 //   "docs": [
-//		{"id": "docid", "rev": "revid", "atts_since": [12,...]}, ...
+//		{"id": "docid", "rev": "revid", "atts_since": [12,...], "delta_src": "revid"}, ...
 // 	 ]
 // }
+// A revision sent as a delta has the properties _id, _rev, _deltaSrc (the revision the delta
+// applies to) and _delta, plus _revisions if requested. delta_src defaults to the first of
+// revs_from or atts_since.
 func (h *handler) handleBulkGet() error {
 
 	handleBulkGetStartedAt := time.Now()
@@ -357,6 +361,7 @@ func (h *handler) handleBulkGet() error {
 
 	includeAttachments := h.getBoolQuery("attachments")
 	showExp := h.getBoolQuery("show_exp")
+	deltasAccepted := h.getBoolQuery("deltas") && h.db.DeltaSyncEnabled()
 	revsLimit := 0
 	if h.getBoolQuery("revs") {
 		revsLimit = int(h.getIntQuery("revs_limit", math.MaxInt32))
@@ -393,6 +398,7 @@ func (h *handler) handleBulkGet() error {
 		for _, item := range docs {
 			var body db.Body
 			var revsFrom, attsSince []string
+			var deltaSrc string
 			var err error
 
 			doc := item.(map[string]interface{})
@@ -412,6 +418,14 @@ func (h *handler) handleBulkGet() error {
 						revsFrom = attsSince // revs_from defaults to same value as atts_since
 					}
 				}
+				if deltasAccepted {
+					deltaSrc, _ = doc["delta_src"].(string)
+					if deltaSrc == "" && len(revsFrom) > 0 {
+						deltaSrc = revsFrom[0]
+					} else if deltaSrc == "" && len(attsSince) > 0 {
+						deltaSrc = attsSince[0]
+					}
+				}
 				if !includeAttachments {
 					attsSince = nil
 				} else if attsSince == nil {
@@ -423,6 +437,10 @@ func (h *handler) handleBulkGet() error {
 				body, err = h.db.GetRevWithHistory(docid, revid, revsLimit, revsFrom, attsSince, showExp)
 			}
 
+			if err == nil && deltaSrc != "" {
+				body = h.deltaForBulkGet(docid, deltaSrc, body, includeAttachments)
+			}
+
 			if err != nil {
 				// Report error in the response for this doc:
 				status, reason := base.ErrorAsHTTPStatus(err)
@@ -441,6 +459,33 @@ func (h *handler) handleBulkGet() error {
 	return err
 }
 
+// Replaces a revision body being returned from _bulk_get with a delta from the revision deltaSrc,
+// if one is available. Attachment bodies can't be sent in a delta, so if includeAttachments is set
+// the full body is kept whenever the attachments changed.
+func (h *handler) deltaForBulkGet(docid, deltaSrc string, body db.Body, includeAttachments bool) db.Body {
+	revid, _ := body["_rev"].(string)
+	if body["_deleted"] != nil || body["_removed"] != nil || revid == deltaSrc {
+		return body
+	}
+	delta, err := h.db.GetDelta(docid, deltaSrc, revid)
+	if err != nil {
+		base.LogTo("HTTP+", "Can't create delta for %q %s from %s: %v", docid, revid, deltaSrc, err)
+		return body
+	} else if delta == nil {
+		return body
+	} else if _, found := delta.Delta["_attachments"]; found && includeAttachments {
+		return body
+	}
+
+	deltaBody := db.Body{"_id": docid, "_rev": revid, "_deltaSrc": deltaSrc, "_delta": delta.Delta}
+	for _, key := range []string{"_revisions", "_exp"} {
+		if value, found := body[key]; found {
+			deltaBody[key] = value
+		}
+	}
+	return deltaBody
+}
+
 // HTTP handler for a POST to _bulk_docs
 func (h *handler) handleBulkDocs() error {
 
@@ -519,6 +564,9 @@ func (h *handler) handleBulkDocs() error {
 			status["status"] = code
 			status["error"] = base.CouchHTTPErrorName(code)
 			status["reason"] = msg
+			for key, value := range base.ErrorDetails(err) {
+				status[key] = value
+			}
 			base.Logf("\tBulkDocs: Doc %q --> %d %s (%v)", docid, code, msg, err)
 			err = nil // wrote it to output already; not going to return it
 		} else {
@@ -104,6 +104,10 @@ func (h *handler) updateChangesOptionsFromQuery(feed *string, options *db.Change
 		options.IncludeDocs = (h.getBoolQuery("include_docs"))
 	}
 
+	if _, ok := values["namespace"]; ok {
+		options.Namespace = h.getQuery("namespace")
+	}
+
 	if _, ok := values["filter"]; ok {
 		*filter = h.getQuery("filter")
 	}
@@ -160,6 +164,9 @@ func (h *handler) updateChangesOptionsFromQuery(feed *string, options *db.Change
 func (h *handler) handleChanges() error {
 	// http://wiki.apache.org/couchdb/HTTP_database_API#Changes
 	// http://docs.couchdb.org/en/latest/api/database/changes.html
+	if err := h.checkChangesRateLimit(); err != nil {
+		return err
+	}
 	base.StatsExpvars.Add("changesFeeds_total", 1)
 	base.StatsExpvars.Add("changesFeeds_active", 1)
 	defer base.StatsExpvars.Add("changesFeeds_active", -1)
@@ -169,6 +176,7 @@ func (h *handler) handleChanges() error {
 	var filter string
 	var channelsArray []string
 	var docIdsArray []string
+	var body []byte
 
 	if h.rq.Method == "GET" {
 		// GET request has parameters in URL:
@@ -181,6 +189,7 @@ func (h *handler) handleChanges() error {
 		options.Conflicts = (h.getQuery("style") == "all_docs")
 		options.ActiveOnly = h.getBoolQuery("active_only")
 		options.IncludeDocs = (h.getBoolQuery("include_docs"))
+		options.Namespace = h.getQuery("namespace")
 		filter = h.getQuery("filter")
 		channelsParam := h.getQuery("channels")
 		if channelsParam != "" {
@@ -221,7 +230,8 @@ func (h *handler) handleChanges() error {
 
 	} else {
 		// POST request has parameters in JSON body:
-		body, err := h.readBody()
+		var err error
+		body, err = h.readBody()
 		if err != nil {
 			return err
 		}
@@ -240,11 +250,16 @@ func (h *handler) handleChanges() error {
 			to = fmt.Sprintf("  (to %s)", h.user.Name())
 		}
 
-		base.LogTo("Changes+", "Changes POST request.  URL: %v, feed: %v, options: %+v, filter: %v, bychannel: %v, docIds: %v %s",
+		base.LogToCtx(h.logCtx, "Changes+", "Changes POST request.  URL: %v, feed: %v, options: %+v, filter: %v, bychannel: %v, docIds: %v %s",
 			h.rq.URL, feed, options, filter, channelsArray, docIdsArray, to)
 
 	}
 
+	var err error
+	if options.Namespace, err = h.db.ChangesNamespace(options.Namespace); err != nil {
+		return err
+	}
+
 	// Get the channels as parameters to an imaginary "bychannel" filter.
 	// The default is all channels the user can access.
 	userChannels := ch.SetOf(ch.AllChannelWildcard)
@@ -272,7 +287,16 @@ func (h *handler) handleChanges() error {
 				return base.HTTPErrorf(http.StatusBadRequest, "Empty doc_ids list")
 			}
 		} else {
-			return base.HTTPErrorf(http.StatusBadRequest, "Unknown filter; try sync_gateway/bychannel or _doc_ids")
+			// A named filter function or _selector, optionally restricted to some channels:
+			var err error
+			if options.Filter, err = h.makeChangesFilter(filter, body); err != nil {
+				return err
+			}
+			if channelsArray != nil {
+				if userChannels, err = ch.SetFromArray(channelsArray, ch.ExpandStar); err != nil {
+					return err
+				}
+			}
 		}
 	}
 
@@ -281,7 +305,6 @@ func (h *handler) handleChanges() error {
 
 	options.Terminator = make(chan bool)
 
-	var err error
 	forceClose := false
 
 	switch feed {
@@ -348,7 +371,7 @@ func (h *handler) sendSimpleChanges(channels base.Set, options db.ChangesOptions
 		if ok {
 			closeNotify = cn.CloseNotify()
 		} else {
-			base.LogTo("Changes", "simple changes cannot get Close Notifier from ResponseWriter")
+			base.LogToCtx(h.logCtx, "Changes", "simple changes cannot get Close Notifier from ResponseWriter")
 		}
 
 		encoder := json.NewEncoder(h.response)
@@ -375,13 +398,13 @@ func (h *handler) sendSimpleChanges(channels base.Set, options db.ChangesOptions
 			case <-heartbeat:
 				_, err = h.response.Write([]byte("\n"))
 				h.flush()
-				base.LogTo("Heartbeat", "heartbeat written to _changes feed for request received %s", h.currentEffectiveUserName())
+				base.LogToCtx(h.logCtx, "Heartbeat", "heartbeat written to _changes feed for request received %s", h.currentEffectiveUserName())
 			case <-timeout:
 				message = "OK (timeout)"
 				forceClose = true
 				break loop
 			case <-closeNotify:
-				base.LogTo("Changes", "Connection lost from client: %v", h.currentEffectiveUserName())
+				base.LogToCtx(h.logCtx, "Changes", "Connection lost from client: %v", h.currentEffectiveUserName())
 				forceClose = true
 				break loop
 			case <-h.db.ExitChanges:
@@ -420,7 +443,7 @@ func (h *handler) sendChangesForDocIds(userChannels base.Set, explicitDocIds []s
 		// Fetch the document body and other metadata that lives with it:
 		populatedDoc, body, err := h.db.GetDocAndActiveRev(doc.DocID)
 		if err != nil {
-			base.LogTo("Changes", "Unable to get changes for docID %v, caused by %v", doc.DocID, err)
+			base.LogToCtx(h.logCtx, "Changes", "Unable to get changes for docID %v, caused by %v", doc.DocID, err)
 			return nil
 		}
 
@@ -564,7 +587,7 @@ func generateContinuousChanges(database *db.Database, inChannels base.Set, optio
 		if ok {
 			closeNotify = cn.CloseNotify()
 		} else {
-			base.LogTo("Changes", "continuous changes cannot get Close Notifier from ResponseWriter")
+			base.LogToCtx(database.LogCtx, "Changes", "continuous changes cannot get Close Notifier from ResponseWriter")
 		}
 	}
 
@@ -624,7 +647,7 @@ loop:
 						break collect
 					}
 				}
-				base.LogTo("Changes", "sending %d change(s)", len(entries))
+				base.LogToCtx(database.LogCtx, "Changes", "sending %d change(s)", len(entries))
 				err = send(entries)
 
 				if err == nil && waiting {
@@ -648,13 +671,13 @@ loop:
 		case <-heartbeat:
 			err = send(nil)
 			if h != nil {
-				base.LogTo("Heartbeat", "heartbeat written to _changes feed for request received %s", h.currentEffectiveUserName())
+				base.LogToCtx(database.LogCtx, "Heartbeat", "heartbeat written to _changes feed for request received %s", h.currentEffectiveUserName())
 			}
 		case <-timeout:
 			forceClose = true
 			break loop
 		case <-closeNotify:
-			base.LogTo("Changes", "Connection lost from client: %v", h.currentEffectiveUserName())
+			base.LogToCtx(database.LogCtx, "Changes", "Connection lost from client: %v", h.currentEffectiveUserName())
 			forceClose = true
 			break loop
 		case <-database.ExitChanges:
@@ -707,7 +730,7 @@ func (h *handler) sendContinuousChangesByWebSocket(inChannels base.Set, options
 		h.logStatus(101, "Upgraded to WebSocket protocol")
 		defer func() {
 			conn.Close()
-			base.LogTo("HTTP+", "#%03d:     --> WebSocket closed", h.serialNumber)
+			base.LogToCtx(h.logCtx, "HTTP+", "    --> WebSocket closed")
 		}()
 
 		// Read changes-feed options from an initial incoming WebSocket message in JSON format:
@@ -730,6 +753,7 @@ func (h *handler) sendContinuousChangesByWebSocket(inChannels base.Set, options
 		//options.Terminator will be closed automatically when
 		//changes feed completes
 		wsoptions.Terminator = options.Terminator
+		wsoptions.Filter = options.Filter
 
 		// Set up GZip compression
 		var writer *bytes.Buffer
@@ -790,6 +814,7 @@ func (h *handler) readChangesOptionsFromJSON(jsonData []byte) (feed string, opti
 		TimeoutMs      *uint64       `json:"timeout"`
 		AcceptEncoding string        `json:"accept_encoding"`
 		ActiveOnly     bool          `json:"active_only"` // Return active revisions only
+		Namespace      string        `json:"namespace"`   // Only return changes in this namespace
 	}
 	// Initialize since clock and hasher ahead of unmarshalling sequence
 	if h.db != nil && h.db.SequenceType == db.ClockSequenceType {
@@ -808,6 +833,7 @@ func (h *handler) readChangesOptionsFromJSON(jsonData []byte) (feed string, opti
 	options.ActiveOnly = input.ActiveOnly
 
 	options.IncludeDocs = input.IncludeDocs
+	options.Namespace = input.Namespace
 	filter = input.Filter
 
 	if input.Channels != "" {
@@ -837,6 +863,43 @@ func (h *handler) readChangesOptionsFromJSON(jsonData []byte) (feed string, opti
 	return
 }
 
+// Creates the filter for a _changes request using a named filter function or "_selector".
+// The selector comes from the "selector" property of a POST body, or the "selector" query
+// parameter of a GET. A filter function's req.query contains the properties of the POST body
+// and the query parameters, with the latter taking precedence.
+func (h *handler) makeChangesFilter(filter string, postBody []byte) (db.ChangesFilter, error) {
+	var bodyParams map[string]interface{}
+	if len(postBody) > 0 {
+		if err := json.Unmarshal(postBody, &bodyParams); err != nil {
+			return nil, err
+		}
+	}
+
+	if filter == db.ChangesFilterSelector {
+		var selector map[string]interface{}
+		if selectorParam := h.getQuery("selector"); selectorParam != "" {
+			if err := json.Unmarshal([]byte(selectorParam), &selector); err != nil {
+				return nil, base.HTTPErrorf(http.StatusBadRequest, "Invalid 'selector' parameter: %v", err)
+			}
+		} else if selectorProp, found := bodyParams["selector"]; found {
+			var ok bool
+			if selector, ok = selectorProp.(map[string]interface{}); !ok {
+				return nil, base.HTTPErrorf(http.StatusBadRequest, "'selector' must be an object")
+			}
+		}
+		return db.NewSelectorFilter(selector)
+	}
+
+	query := make(map[string]interface{}, len(bodyParams))
+	for key, value := range bodyParams {
+		query[key] = value
+	}
+	for key := range h.getQueryValues() {
+		query[key] = h.getQuery(key)
+	}
+	return h.db.GetChangesFilter(filter, query, db.MakeUserCtx(h.user))
+}
+
 // Helper function to read a complete message from a WebSocket
 func readWebSocketMessage(conn *websocket.Conn) ([]byte, error) {
 
@@ -1998,3 +1998,141 @@ func WriteDirectWithKey(testDb *db.DatabaseContext, key string, channelArray []s
 
 	testDb.Bucket.Add(key, 0, db.Body{"_sync": syncData, "key": key})
 }
+
+// Returns the IDs of the docs in a _changes response, skipping "_user/" entries.
+func changeIDs(t *testing.T, response *TestResponse) []string {
+	assertStatus(t, response, 200)
+	var changes struct {
+		Results []db.ChangeEntry
+	}
+	assert.Equals(t, json.Unmarshal(response.Body.Bytes(), &changes), nil)
+	ids := []string{}
+	for _, entry := range changes.Results {
+		if !strings.HasPrefix(entry.ID, "_") {
+			ids = append(ids, entry.ID)
+		}
+	}
+	return ids
+}
+
+func TestChangesCustomFilters(t *testing.T) {
+	rt := RestTester{
+		SyncFn: `function(doc) {channel(doc.channels)}`,
+		DatabaseConfig: &DbConfig{
+			ChangesFilters: map[string]string{
+				"by_type": `function(doc, req) {return doc.type == req.query.type;}`,
+				"mine":    `function(doc, req) {return req.userCtx != null && doc.owner == req.userCtx.name;}`,
+			},
+		},
+	}
+	defer rt.Close()
+
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_user/alice", `{"password":"letmein", "admin_channels":["alpha"]}`), 201)
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/doc1", `{"channels":["alpha"], "type":"order", "owner":"alice", "total":10}`), 201)
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/doc2", `{"channels":["alpha"], "type":"invoice", "owner":"bob", "total":50}`), 201)
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/doc3", `{"channels":["beta"], "type":"order", "owner":"alice", "total":99}`), 201)
+
+	// Named filter with a query parameter, via GET and POST:
+	ids := changeIDs(t, rt.SendAdminRequest("GET", "/db/_changes?filter=by_type&type=order", ""))
+	assert.DeepEquals(t, ids, []string{"doc1", "doc3"})
+	ids = changeIDs(t, rt.SendAdminRequest("POST", "/db/_changes", `{"filter":"by_type", "type":"invoice"}`))
+	assert.DeepEquals(t, ids, []string{"doc2"})
+
+	// Named filter restricted to a channel:
+	ids = changeIDs(t, rt.SendAdminRequest("GET", "/db/_changes?filter=by_type&type=order&channels=beta", ""))
+	assert.DeepEquals(t, ids, []string{"doc3"})
+
+	// Named filter using the userCtx, combined with the user's channel access:
+	ids = changeIDs(t, rt.SendRequestWithHeaders("GET", "/db/_changes?filter=mine", "", basicAuthHeader("alice", "letmein")))
+	assert.DeepEquals(t, ids, []string{"doc1"})
+
+	// _selector, via POST and GET:
+	ids = changeIDs(t, rt.SendAdminRequest("POST", "/db/_changes", `{"filter":"_selector", "selector":{"type":"order", "total":{"$gt":20}}}`))
+	assert.DeepEquals(t, ids, []string{"doc3"})
+	ids = changeIDs(t, rt.SendAdminRequest("GET", `/db/_changes?filter=_selector&selector={"$or":[{"owner":"bob"},{"total":10}]}`, ""))
+	assert.DeepEquals(t, ids, []string{"doc1", "doc2"})
+
+	// Errors:
+	assertStatus(t, rt.SendAdminRequest("GET", "/db/_changes?filter=bogus", ""), 400)
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_changes", `{"filter":"_selector"}`), 400)
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_changes", `{"filter":"_selector", "selector":{"total":{"$bogus":1}}}`), 400)
+}
+
+func TestChangesNamespaces(t *testing.T) {
+	acmeSync := `function(doc) {
+		if (doc.needs) requireAccess(doc.needs);
+		channel(doc.channels);
+		access(doc.owner, doc.channels);
+		if (doc.staff) role(doc.staff, "role:staff");
+	}`
+	globexSync := `function(doc) {channel("all"); access(doc.owner, "all");}`
+	rt := RestTester{
+		DatabaseConfig: &DbConfig{
+			Namespaces: &NamespacesConfig{
+				Property: "tenant",
+				Namespaces: map[string]*NamespaceConfig{
+					"acme":   {Sync: &acmeSync},
+					"globex": {Sync: &globexSync},
+				},
+			},
+		},
+	}
+	defer rt.Close()
+
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_user/alice", `{"password":"letmein"}`), 201)
+	response := rt.SendAdminRequest("PUT", "/db/a1", `{"tenant":"acme", "channels":["orders"], "owner":"alice"}`)
+	assertStatus(t, response, 201)
+	var body db.Body
+	json.Unmarshal(response.Body.Bytes(), &body)
+	a1Rev := body["rev"].(string)
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/a2", `{"tenant":"acme", "channels":["other"], "owner":"bob"}`), 201)
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/g1", `{"tenant":"globex", "owner":"bob"}`), 201)
+
+	// Unknown namespaces, and moving a doc to another namespace, are forbidden:
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/x1", `{"tenant":"initech"}`), 403)
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/a1?rev="+a1Rev, `{"tenant":"globex"}`), 403)
+
+	// The sync function's channels and grants are qualified with the namespace:
+	response = rt.SendAdminRequest("GET", "/db/_user/alice", "")
+	assertStatus(t, response, 200)
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.DeepEquals(t, body["all_channels"], []interface{}{"!", "acme/orders"})
+	ids := changeIDs(t, rt.SendRequestWithHeaders("GET", "/db/_changes", "", basicAuthHeader("alice", "letmein")))
+	assert.DeepEquals(t, ids, []string{"a1"})
+
+	// A feed restricted to a namespace:
+	assert.DeepEquals(t, changeIDs(t, rt.SendAdminRequest("GET", "/db/_changes?namespace=acme", "")), []string{"a1", "a2"})
+	assert.DeepEquals(t, changeIDs(t, rt.SendAdminRequest("POST", "/db/_changes", `{"namespace":"globex"}`)), []string{"g1"})
+	assert.DeepEquals(t, changeIDs(t, rt.SendRequestWithHeaders("GET", "/db/_changes?namespace=globex", "", basicAuthHeader("alice", "letmein"))), []string{})
+	assertStatus(t, rt.SendAdminRequest("GET", "/db/_changes?namespace=initech", ""), 400)
+
+	// The namespace's sync function sees the user's channels in the namespace, unqualified:
+	aliceHeaders := basicAuthHeader("alice", "letmein")
+	assertStatus(t, rt.SendRequestWithHeaders("PUT", "/db/a3", `{"tenant":"acme", "needs":"orders", "channels":["orders"]}`, aliceHeaders), 201)
+	assertStatus(t, rt.SendRequestWithHeaders("PUT", "/db/a4", `{"tenant":"acme", "needs":"other", "channels":["other"]}`, aliceHeaders), 403)
+
+	// Roles granted by the namespace's sync function are qualified too:
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/a5", `{"tenant":"acme", "staff":"alice"}`), 201)
+	response = rt.SendAdminRequest("GET", "/db/_user/alice", "")
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.DeepEquals(t, body["roles"], []interface{}{"acme@staff"})
+
+	// A doc outside any namespace can't use a namespace's channels or roles:
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/x2", `{"channels":["acme/orders"]}`), 403)
+
+	// A user that belongs to a namespace only gets that namespace's changes:
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_user/carol", `{"password":"letmein", "namespace":"globex", "admin_channels":["*"]}`), 201)
+	carolHeaders := basicAuthHeader("carol", "letmein")
+	assert.DeepEquals(t, changeIDs(t, rt.SendRequestWithHeaders("GET", "/db/_changes", "", carolHeaders)), []string{"g1"})
+	assert.DeepEquals(t, changeIDs(t, rt.SendRequestWithHeaders("GET", "/db/_changes?namespace=globex", "", carolHeaders)), []string{"g1"})
+	assertStatus(t, rt.SendRequestWithHeaders("GET", "/db/_changes?namespace=acme", "", carolHeaders), 403)
+
+	// ...and can only write docs in that namespace:
+	assertStatus(t, rt.SendRequestWithHeaders("PUT", "/db/g2", `{"tenant":"globex", "owner":"carol"}`, carolHeaders), 201)
+	assertStatus(t, rt.SendRequestWithHeaders("PUT", "/db/a6", `{"tenant":"acme", "channels":["orders"]}`, carolHeaders), 403)
+	assertStatus(t, rt.SendRequestWithHeaders("PUT", "/db/x3", `{"channels":["public"]}`, carolHeaders), 403)
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_user/dave", `{"password":"letmein", "namespace":"initech"}`), 400)
+
+	// Tombstones inherit the namespace of the doc:
+	assertStatus(t, rt.SendAdminRequest("DELETE", "/db/a1?rev="+a1Rev, ""), 200)
+}
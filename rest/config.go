@@ -14,6 +14,7 @@ import (
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -62,6 +63,7 @@ type ServerConfig struct {
 	ServerWriteTimeout             *int                     `json:",omitempty"`            // maximum duration.Second before timing out write of the HTTP(S) response
 	AdminInterface                 *string                  `json:",omitempty"`            // Interface to bind admin API to, default ":4985"
 	AdminUI                        *string                  `json:",omitempty"`            // Path to Admin HTML page, if omitted uses bundled HTML
+	AdminAuth                      *AdminAuthConfig         `json:"admin_auth,omitempty"`  // Authentication of admin API users; if omitted the admin API is open
 	ProfileInterface               *string                  `json:",omitempty"`            // Interface to bind Go profile API to (no default)
 	ConfigServer                   *string                  `json:",omitempty"`            // URL of config server (for dynamic db discovery)
 	Facebook                       *FacebookConfig          `json:",omitempty"`            // Configuration for Facebook validation
@@ -70,6 +72,7 @@ type ServerConfig struct {
 	DeprecatedLog                  []string                 `json:"log,omitempty"`         // Log keywords to enable
 	DeprecatedLogFilePath          *string                  `json:"logFilePath,omitempty"` // Path to log file, if missing write to stderr
 	Logging                        *base.LoggingConfigMap   `json:",omitempty"`            // Configuration for logging with optional log file rotation
+	AuditLog                       *base.AuditLogConfig     `json:"audit_log,omitempty"`   // Configuration for the audit log of security-relevant events
 	Pretty                         bool                     `json:",omitempty"`            // Pretty-print JSON responses?
 	DeploymentID                   *string                  `json:",omitempty"`            // Optional customer/deployment ID for stats reporting
 	StatsReportInterval            *float64                 `json:",omitempty"`            // Optional stats report interval (0 to disable)
@@ -85,6 +88,7 @@ type ServerConfig struct {
 	MaxHeartbeat                   uint64                   `json:",omitempty"`                        // Max heartbeat value for _changes request (seconds)
 	ClusterConfig                  *ClusterConfig           `json:"cluster_config,omitempty"`          // Bucket and other config related to CBGT
 	SkipRunmodeValidation          bool                     `json:"skip_runmode_validation,omitempty"` // If this is true, skips any config validation regarding accel vs normal mode
+	TrustedProxies                 []string                 `json:"trusted_proxies,omitempty"`         // IPs or CIDR ranges of reverse proxies whose X-Forwarded-For header is honored
 	Unsupported                    *UnsupportedServerConfig `json:"unsupported,omitempty"`             // Config for unsupported features
 	RunMode                        SyncGatewayRunMode       `json:"runmode,omitempty"`                 // Whether this is an SG reader or an SG Accelerator
 }
@@ -133,6 +137,54 @@ type DbConfig struct {
 	ViewQueryTimeoutSecs *uint32                        `json:"view_query_timeout_secs,omitempty"`     // The view query timeout in seconds
 	LocalDocExpirySecs   *uint32                        `json:"local_doc_expiry_secs,omitempty"`       // The _local doc expiry time in seconds
 	EnableXattrs         *bool                          `json:"enable_shared_bucket_access,omitempty"` // Whether to use extended attributes to store _sync metadata
+	ConflictResolver     *db.ConflictResolverConfig     `json:"conflict_resolver,omitempty"`           // Policy for resolving revision conflicts
+	DeltaSync            *DeltaSyncConfig               `json:"delta_sync,omitempty"`                  // Config for sending revisions as deltas
+	AttachmentStore      *db.AttachmentStoreConfig      `json:"attachment_store,omitempty"`            // Where attachment bodies are stored; defaults to the bucket
+	ChangesFilters       map[string]string              `json:"changes_filters,omitempty"`             // Named filter functions for _changes and subChanges
+	Namespaces           *NamespacesConfig              `json:"namespaces,omitempty"`                  // Partitions the database into tenant namespaces
+	Schemas              *SchemasConfig                 `json:"schemas,omitempty"`                     // JSON Schemas that document writes are validated against
+	Maintenance          map[string]*MaintenanceConfig  `json:"maintenance,omitempty"`                 // Schedules of background maintenance jobs, by job type
+	ExpiryTombstones     bool                           `json:"expiry_tombstones,omitempty"`           // Delete expired docs with a tombstone revision, instead of letting the bucket remove them
+	PasswordPolicy       *auth.PasswordPolicy           `json:"password_policy,omitempty"`             // Password strength rules, hash cost and lockout after failed logins
+	RateLimits           *db.RateLimitOptions           `json:"rate_limits,omitempty"`                 // Per-user and per-IP rate limits on the public API
+	GrantProvenance      bool                           `json:"grant_provenance,omitempty"`            // Record on users and roles which docs granted their channels and roles
+}
+
+type DeltaSyncConfig struct {
+	Enabled *bool `json:"enabled,omitempty"` // Whether clients may be sent deltas instead of full revisions; defaults to false
+}
+
+// Partitions a database into namespaces, identified by either a document property or a doc ID prefix.
+type NamespacesConfig struct {
+	Property    string                      `json:"property,omitempty"`     // Document property naming the doc's namespace
+	IDSeparator string                      `json:"id_separator,omitempty"` // Separator after the namespace name at the start of doc IDs
+	Namespaces  map[string]*NamespaceConfig `json:"namespaces"`             // The namespaces, by name
+}
+
+type NamespaceConfig struct {
+	Sync         *string `json:"sync,omitempty"`          // Sync function; defaults to assigning the "channels" property
+	ImportFilter *string `json:"import_filter,omitempty"` // Import filter; defaults to the database's
+}
+
+// JSON Schemas that documents are validated against when they're saved.
+type SchemasConfig struct {
+	TypeProperty string          `json:"type_property,omitempty"` // Document property matched against a schema's "type"; defaults to "type"
+	Schemas      []*SchemaConfig `json:"schemas"`                 // The schemas; the first one that applies to a document is used
+}
+
+type SchemaConfig struct {
+	Name         string      `json:"name"`                     // Name of the schema, used in error messages
+	Type         string      `json:"type,omitempty"`           // Applies to documents whose type property has this value
+	DocIDPattern string      `json:"doc_id_pattern,omitempty"` // Applies to documents whose IDs match this regular expression
+	Schema       interface{} `json:"schema"`                   // The JSON Schema itself
+}
+
+// Schedule and options of a background maintenance job, like "tombstone_purge".
+type MaintenanceConfig struct {
+	Schedule     string `json:"schedule"`                 // Cron-style schedule, e.g. "30 2 * * *" for 2:30am daily
+	DryRun       bool   `json:"dry_run,omitempty"`        // Only count the items that would be purged
+	BatchSize    int    `json:"batch_size,omitempty"`     // Items processed between pauses; defaults to 500
+	BatchDelayMs int    `json:"batch_delay_ms,omitempty"` // Pause between batches, in milliseconds
 }
 
 type DbConfigMap map[string]*DbConfig
@@ -162,17 +214,37 @@ type ShadowConfig struct {
 }
 
 type EventHandlerConfig struct {
-	MaxEventProc    uint           `json:"max_processes,omitempty"`    // Max concurrent event handling goroutines
-	WaitForProcess  string         `json:"wait_for_process,omitempty"` // Max wait time when event queue is full (ms)
-	DocumentChanged []*EventConfig `json:"document_changed,omitempty"` // Document Commit
-	DBStateChanged  []*EventConfig `json:"db_state_changed,omitempty"` // DB state change
-}
-
-type EventConfig struct {
-	HandlerType string  `json:"handler"`           // Handler type
-	Url         string  `json:"url,omitempty"`     // Url (webhook)
-	Filter      string  `json:"filter,omitempty"`  // Filter function (webhook)
-	Timeout     *uint64 `json:"timeout,omitempty"` // Timeout (webhook)
+	MaxEventProc     uint              `json:"max_processes,omitempty"`     // Max concurrent event handling goroutines
+	WaitForProcess   string            `json:"wait_for_process,omitempty"`  // Max wait time when event queue is full (ms)
+	DocumentChanged  []*db.EventConfig `json:"document_changed,omitempty"`  // Document Commit
+	DBStateChanged   []*db.EventConfig `json:"db_state_changed,omitempty"`  // DB state change
+	PrincipalChanged []*db.EventConfig `json:"principal_changed,omitempty"` // User or role created, updated or deleted
+	AccessChanged    []*db.EventConfig `json:"access_changed,omitempty"`    // Channel or role access granted or revoked
+	SessionCreated   []*db.EventConfig `json:"session_created,omitempty"`   // Login session created
+	AuthFailed       []*db.EventConfig `json:"auth_failed,omitempty"`       // Authentication failed
+	DocumentPurged   []*db.EventConfig `json:"document_purged,omitempty"`   // Document purged
+	DocumentExpired  []*db.EventConfig `json:"document_expired,omitempty"`  // Expired document tombstoned
+	Durable          bool              `json:"durable,omitempty"`           // Deliver document changes from the feed, with checkpoints
+	AuthFailedLimit  *db.RateLimit     `json:"auth_failed_limit,omitempty"` // Max rate of auth_failed events; the rest are dropped
+}
+
+// The valid properties of "event_handlers" in a database config.
+var kEventHandlerConfigKeys = base.SetOf("max_processes", "wait_for_process", "durable", "document_changed",
+	"db_state_changed", "principal_changed", "access_changed", "session_created", "auth_failed",
+	"auth_failed_limit", "document_purged", "document_expired")
+
+// The handler configs of each event type.
+func (config *EventHandlerConfig) handlersByType() map[db.EventType][]*db.EventConfig {
+	return map[db.EventType][]*db.EventConfig{
+		db.DocumentChange:  config.DocumentChanged,
+		db.DBStateChange:   config.DBStateChanged,
+		db.PrincipalChange: config.PrincipalChanged,
+		db.AccessChange:    config.AccessChanged,
+		db.SessionCreate:   config.SessionCreated,
+		db.AuthFailure:     config.AuthFailed,
+		db.DocumentPurge:   config.DocumentPurged,
+		db.DocumentExpiry:  config.DocumentExpired,
+	}
 }
 
 type CacheConfig struct {
@@ -293,10 +365,57 @@ func (dbConfig DbConfig) validate() error {
 		}
 	}
 
+	if dbConfig.Namespaces != nil {
+		if err := dbConfig.Namespaces.validate(); err != nil {
+			return err
+		}
+	}
+
+	if dbConfig.Schemas != nil {
+		for _, schema := range dbConfig.Schemas.Schemas {
+			if schema == nil || schema.Name == "" {
+				return fmt.Errorf("Every schema must have a 'name'")
+			} else if schema.Type == "" && schema.DocIDPattern == "" {
+				return fmt.Errorf("Schema %q must have a 'type' or 'doc_id_pattern'", schema.Name)
+			}
+		}
+	}
+
+	for jobType, maintenance := range dbConfig.Maintenance {
+		if !db.IsValidMaintenanceJobType(jobType) {
+			return fmt.Errorf("Unknown maintenance job %q", jobType)
+		} else if maintenance == nil {
+			return fmt.Errorf("Maintenance job %q must have a 'schedule'", jobType)
+		} else if _, err := base.ParseCronSchedule(maintenance.Schedule); err != nil {
+			return err
+		}
+	}
+
+	for name := range dbConfig.ChangesFilters {
+		if !db.IsValidChangesFilterName(name) {
+			return fmt.Errorf("Invalid changes filter name %q; names can't start with '_' or be %q", name, db.ChangesFilterByChannel)
+		}
+	}
+
 	return nil
 
 }
 
+func (config *NamespacesConfig) validate() error {
+	if (config.Property == "") == (config.IDSeparator == "") {
+		return fmt.Errorf("Namespaces config must have exactly one of 'property' or 'id_separator'")
+	}
+	if len(config.Namespaces) == 0 {
+		return fmt.Errorf("Namespaces config has no namespaces")
+	}
+	for name := range config.Namespaces {
+		if !db.IsValidNamespaceName(name) || (config.IDSeparator != "" && strings.Contains(name, config.IDSeparator)) {
+			return fmt.Errorf("Invalid namespace name %q", name)
+		}
+	}
+	return nil
+}
+
 func (dbConfig *DbConfig) validateSgDbConfig() error {
 
 	if err := dbConfig.validate(); err != nil {
@@ -408,6 +527,12 @@ func ReadServerConfigFromData(runMode SyncGatewayRunMode, data []byte) (*ServerC
 	if err := config.setupAndValidateDatabases(); err != nil {
 		return nil, err
 	}
+	if err := config.AdminAuth.validate(); err != nil {
+		return nil, err
+	}
+	if _, err := parseTrustedProxies(config.TrustedProxies); err != nil {
+		return nil, err
+	}
 
 	return config, nil
 }
@@ -461,11 +586,42 @@ func ReadServerConfigFromFile(runMode SyncGatewayRunMode, path string) (*ServerC
 	if err := config.setupAndValidateDatabases(); err != nil {
 		return nil, err
 	}
+	if err := config.AdminAuth.validate(); err != nil {
+		return nil, err
+	}
+	if _, err := parseTrustedProxies(config.TrustedProxies); err != nil {
+		return nil, err
+	}
 
 	return config, nil
 
 }
 
+// Parses the trusted_proxies config: each entry is either a CIDR range or a single IP address.
+func parseTrustedProxies(entries []string) ([]*net.IPNet, error) {
+	proxies := make([]*net.IPNet, 0, len(entries))
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("trusted_proxies: invalid IP address %q", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("trusted_proxies: invalid CIDR range %q", entry)
+		}
+		proxies = append(proxies, ipNet)
+	}
+	return proxies, nil
+}
+
 func (config *ServerConfig) setupAndValidateDatabases() error {
 	for name, dbConfig := range config.Databases {
 		dbConfig.setup(name)
@@ -496,6 +652,12 @@ func (config *ServerConfig) setupAndValidateLogging(verbose bool) error {
 		}
 	}
 
+	if config.AuditLog != nil {
+		if err := base.EnableAuditLog(config.AuditLog); err != nil {
+			return err
+		}
+	}
+
 	base.EnableLogKey("HTTP")
 	if verbose {
 		base.EnableLogKey("HTTP+")
@@ -541,6 +703,15 @@ func (self *ServerConfig) MergeWith(other *ServerConfig) error {
 	if self.CORS == nil {
 		self.CORS = other.CORS
 	}
+	if self.AdminAuth == nil {
+		self.AdminAuth = other.AdminAuth
+	}
+	if self.AuditLog == nil {
+		self.AuditLog = other.AuditLog
+	}
+	if self.TrustedProxies == nil {
+		self.TrustedProxies = other.TrustedProxies
+	}
 	for _, flag := range other.DeprecatedLog {
 		self.DeprecatedLog = append(self.DeprecatedLog, flag)
 	}
@@ -695,6 +866,19 @@ func SetMaxFileDescriptors(maxP *uint64) {
 }
 
 func (config *ServerConfig) Serve(addr string, handler http.Handler) {
+	config.serve(addr, handler, nil)
+}
+
+// Serves the admin API. If admin auth has a client CA cert, TLS client certs are verified with it.
+func (config *ServerConfig) ServeAdmin(addr string, handler http.Handler) {
+	var clientCACert *string
+	if config.AdminAuth != nil {
+		clientCACert = config.AdminAuth.ClientCACert
+	}
+	config.serve(addr, handler, clientCACert)
+}
+
+func (config *ServerConfig) serve(addr string, handler http.Handler, clientCACert *string) {
 	maxConns := DefaultMaxIncomingConnections
 	if config.MaxIncomingConnections != nil {
 		maxConns = *config.MaxIncomingConnections
@@ -709,6 +893,7 @@ func (config *ServerConfig) Serve(addr string, handler http.Handler) {
 		maxConns,
 		config.SSLCert,
 		config.SSLKey,
+		clientCACert,
 		handler,
 		config.ServerReadTimeout,
 		config.ServerWriteTimeout,
@@ -781,7 +966,7 @@ func RunServer(config *ServerConfig) {
 	}
 
 	base.Logf("Starting admin server on %s", *config.AdminInterface)
-	go config.Serve(*config.AdminInterface, CreateAdminHandler(sc))
+	go config.ServeAdmin(*config.AdminInterface, CreateAdminHandler(sc))
 	base.Logf("Starting server on %s ...", *config.Interface)
 	config.Serve(*config.Interface, CreatePublicHandler(sc))
 }
@@ -14,6 +14,7 @@ import (
 	"fmt"
 	"github.com/couchbase/sync_gateway/base"
 	"github.com/couchbase/sync_gateway/db"
+	"io"
 	"math"
 	"mime/multipart"
 	"net/http"
@@ -153,18 +154,40 @@ func (h *handler) handleGetAttachment() error {
 		return base.HTTPErrorf(http.StatusNotFound, "missing attachment %s", attachmentName)
 	}
 	digest := meta["digest"].(string)
-	data, err := h.db.GetAttachment(db.AttachmentKey(digest))
-	if err != nil {
-		return err
+	key := db.AttachmentKey(digest)
+
+	// Get the length of the stored data from the metadata if possible, else from the store:
+	var reader io.ReadCloser
+	length, ok := base.ToInt64(meta["encoded_length"])
+	if !ok {
+		length, ok = base.ToInt64(meta["length"])
+	}
+	if !ok || (meta["encoding"] != nil && meta["encoded_length"] == nil) {
+		if reader, length, err = h.db.OpenAttachment(key, 0); err != nil {
+			return err
+		}
 	}
 
-	status, start, end := h.handleRange(uint64(len(data)))
+	// Only the requested range is read from the store:
+	status, start, end := h.handleRange(uint64(length))
 	if status > 299 {
+		if reader != nil {
+			reader.Close()
+		}
 		return base.HTTPErrorf(status, "")
-	} else if status == http.StatusPartialContent {
-		data = data[start:end]
+	} else if status != http.StatusPartialContent {
+		start, end = 0, uint64(length)
 	}
-	h.setHeader("Content-Length", strconv.FormatUint(uint64(len(data)), 10))
+	if reader == nil || start > 0 {
+		if reader != nil {
+			reader.Close()
+		}
+		if reader, _, err = h.db.OpenAttachment(key, int64(start)); err != nil {
+			return err
+		}
+	}
+	defer reader.Close()
+	h.setHeader("Content-Length", strconv.FormatUint(end-start, 10))
 
 	h.setHeader("Etag", strconv.Quote(digest))
 	if contentType, ok := meta["content_type"].(string); ok {
@@ -187,7 +210,11 @@ func (h *handler) handleGetAttachment() error {
 		h.setHeader("Content-Disposition", fmt.Sprintf("attachment; filename=%q", attachmentName))
 	}
 	h.response.WriteHeader(status)
-	h.response.Write(data)
+	if h.rq.Method != "HEAD" {
+		if _, err := io.CopyN(h.response, reader, int64(end-start)); err != nil {
+			base.Warn("Error streaming attachment %q of doc %q: %v", attachmentName, docid, err)
+		}
+	}
 	return nil
 }
 
@@ -203,7 +230,9 @@ func (h *handler) handlePutAttachment() error {
 	if revid == "" {
 		revid = h.rq.Header.Get("If-Match")
 	}
-	attachmentData, err := h.readBody()
+	// Stream the attachment into the store before updating the doc; if the update fails, it's
+	// left as an orphan for vacuum to remove.
+	attachmentData, err := h.db.StoreAttachmentStream(h.requestBody)
 	if err != nil {
 		return err
 	}
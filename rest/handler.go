@@ -21,6 +21,7 @@ import (
 	"math"
 	"mime"
 	"mime/multipart"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -63,20 +64,23 @@ func init() {
 
 // Encapsulates the state of handling an HTTP request.
 type handler struct {
-	server         *ServerContext
-	rq             *http.Request
-	response       http.ResponseWriter
-	status         int
-	statusMessage  string
-	requestBody    io.ReadCloser
-	db             *db.Database
-	user           auth.User
-	privs          handlerPrivs
-	startTime      time.Time
-	serialNumber   uint64
-	loggedDuration bool
-	runOffline     bool
-	queryValues    url.Values // Copy of results of rq.URL.Query()
+	server          *ServerContext
+	rq              *http.Request
+	response        http.ResponseWriter
+	status          int
+	statusMessage   string
+	requestBody     io.ReadCloser
+	db              *db.Database
+	user            auth.User
+	privs           handlerPrivs
+	startTime       time.Time
+	serialNumber    uint64
+	loggedDuration  bool
+	runOffline      bool
+	queryValues     url.Values       // Copy of results of rq.URL.Query()
+	adminPermission AdminPermission  // Permission needed to call this handler on the admin port
+	adminUser       string           // Name of the authenticated admin user, if admin auth is enabled
+	logCtx          *base.LogContext // Identifies the request in log messages
 }
 
 type handlerPrivs int
@@ -89,22 +93,35 @@ const (
 
 type handlerMethod func(*handler) error
 
-// Creates an http.Handler that will run a handler with the given method
+// Creates an http.Handler that will run a handler with the given method.
+// On the admin port, it requires AdminPermDocs.
 func makeHandler(server *ServerContext, privs handlerPrivs, method handlerMethod) http.Handler {
-	return http.HandlerFunc(func(r http.ResponseWriter, rq *http.Request) {
-		runOffline := false
-		h := newHandler(server, privs, r, rq, runOffline)
-		err := h.invoke(method)
-		h.writeError(err)
-		h.logDuration(true)
-	})
+	return makeHandlerWithPermission(server, privs, AdminPermDocs, false, method)
 }
 
-// Creates an http.Handler that will run a handler with the given method even if the target DB is offline
+// Creates an http.Handler that will run a handler with the given method even if the target DB is offline.
+// On the admin port, it requires AdminPermDocs.
 func makeOfflineHandler(server *ServerContext, privs handlerPrivs, method handlerMethod) http.Handler {
+	return makeHandlerWithPermission(server, privs, AdminPermDocs, true, method)
+}
+
+// Creates an http.Handler for the admin port that will run a handler with the given method, if
+// the admin user has the given permission.
+func makeAdminHandler(server *ServerContext, permission AdminPermission, method handlerMethod) http.Handler {
+	return makeHandlerWithPermission(server, adminPrivs, permission, false, method)
+}
+
+// Like makeAdminHandler, but runs the handler even if the target DB is offline.
+func makeOfflineAdminHandler(server *ServerContext, permission AdminPermission, method handlerMethod) http.Handler {
+	return makeHandlerWithPermission(server, adminPrivs, permission, true, method)
+}
+
+// Creates an http.Handler that will run a handler with the given method. If privs is adminPrivs
+// and admin authentication is enabled, the admin user must have the given permission.
+func makeHandlerWithPermission(server *ServerContext, privs handlerPrivs, permission AdminPermission, runOffline bool, method handlerMethod) http.Handler {
 	return http.HandlerFunc(func(r http.ResponseWriter, rq *http.Request) {
-		runOffline := true
 		h := newHandler(server, privs, r, rq, runOffline)
+		h.adminPermission = permission
 		err := h.invoke(method)
 		h.writeError(err)
 		h.logDuration(true)
@@ -112,7 +129,7 @@ func makeOfflineHandler(server *ServerContext, privs handlerPrivs, method handle
 }
 
 func newHandler(server *ServerContext, privs handlerPrivs, r http.ResponseWriter, rq *http.Request, runOffline bool) *handler {
-	return &handler{
+	h := &handler{
 		server:       server,
 		privs:        privs,
 		rq:           rq,
@@ -122,6 +139,29 @@ func newHandler(server *ServerContext, privs handlerPrivs, r http.ResponseWriter
 		startTime:    time.Now(),
 		runOffline:   runOffline,
 	}
+	h.logCtx = &base.LogContext{
+		SerialNumber: h.serialNumber,
+		RequestID:    sanitizeRequestID(rq.Header.Get("X-Request-ID")),
+	}
+	return h
+}
+
+// Maximum length of an X-Request-ID header that will be logged
+const kMaxRequestIDLength = 128
+
+// Returns a request ID from a client's X-Request-ID header that's safe to log: it's truncated,
+// and any characters other than letters, digits and "-_.:/+=" are removed.
+func sanitizeRequestID(id string) string {
+	id = strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || strings.ContainsRune("-_.:/+=", r) {
+			return r
+		}
+		return -1
+	}, id)
+	if len(id) > kMaxRequestIDLength {
+		id = id[:kMaxRequestIDLength]
+	}
+	return id
 }
 
 // Top-level handler call. It's passed a pointer to the specific method to run.
@@ -151,6 +191,9 @@ func (h *handler) invoke(method handlerMethod) error {
 	}
 
 	h.setHeader("Server", base.VersionString)
+	if h.logCtx.RequestID != "" {
+		h.setHeader("X-Request-ID", h.logCtx.RequestID)
+	}
 
 	// If there is a "db" path variable, look up the database context:
 	var dbContext *db.DatabaseContext
@@ -159,6 +202,7 @@ func (h *handler) invoke(method handlerMethod) error {
 			h.logRequestLine()
 			return err
 		}
+		h.logCtx.Database = dbContext.Name
 	}
 
 	// If this call is in the context of a DB make sure the DB is in a valid state
@@ -186,12 +230,31 @@ func (h *handler) invoke(method handlerMethod) error {
 		}
 	}
 
-	// Authenticate, if not on admin port:
+	// Rate-limit public requests by client IP before authenticating, since that's expensive:
+	if dbContext != nil && h.privs != adminPrivs {
+		if err = dbContext.CheckIPRateLimit(db.RateLimitRequests, h.clientIP()); err != nil {
+			h.logRequestLine()
+			return err
+		}
+	}
+
+	// Authenticate; on the admin port only the admin user (if any) is authenticated:
 	if h.privs != adminPrivs {
 		if err = h.checkAuth(dbContext); err != nil {
 			h.logRequestLine()
 			return err
 		}
+	} else if err = h.checkAdminAuth(); err != nil {
+		h.logRequestLine()
+		return err
+	}
+	h.logCtx.Username = h.requestUsername()
+
+	if dbContext != nil && h.privs != adminPrivs && h.user != nil {
+		if err = dbContext.CheckUserRateLimit(db.RateLimitRequests, h.user.Name()); err != nil {
+			h.logRequestLine()
+			return err
+		}
 	}
 
 	h.logRequestLine()
@@ -206,6 +269,7 @@ func (h *handler) invoke(method handlerMethod) error {
 		if err != nil {
 			return err
 		}
+		h.db.LogCtx = h.logCtx
 	}
 
 	if base.EnableLogHTTPBodies {
@@ -227,7 +291,9 @@ func (h *handler) logRequestLine() {
 		return
 	}
 	as := ""
-	if h.privs == adminPrivs {
+	if h.privs == adminPrivs && h.adminUser != "" {
+		as = fmt.Sprintf("  (ADMIN %s)", h.adminUser)
+	} else if h.privs == adminPrivs {
 		as = "  (ADMIN)"
 	} else if h.user != nil && h.user.Name() != "" {
 		as = fmt.Sprintf("  (as %s)", h.user.Name())
@@ -237,7 +303,7 @@ func (h *handler) logRequestLine() {
 		proto = " HTTP/2"
 	}
 
-	base.LogTo("HTTP", " #%03d: %s %s%s%s", h.serialNumber, h.rq.Method, base.SanitizeRequestURL(h.rq.URL), proto, as)
+	base.LogToCtx(h.logCtx, "HTTP", "%s %s%s%s", h.rq.Method, base.SanitizeRequestURL(h.rq.URL), proto, as)
 }
 
 func (h *handler) logRequestBody() {
@@ -271,13 +337,18 @@ func (h *handler) logDuration(realTime bool) {
 		bin := int(duration/(100*time.Millisecond)) * 100
 		restExpvars.Add(fmt.Sprintf("requests_%04dms", bin), 1)
 	}
+	dbName := ""
+	if h.db != nil {
+		dbName = h.db.Name
+	}
+	restRequestMetrics.record(dbName, h.status, duration)
 
 	logKey := "HTTP+"
 	if h.status >= 300 {
 		logKey = "HTTP"
 	}
-	base.LogTo(logKey, "#%03d:     --> %d %s  (%.1f ms)",
-		h.serialNumber, h.status, h.statusMessage,
+	base.LogToCtx(h.logCtx, logKey, "    --> %d %s  (%.1f ms)",
+		h.status, h.statusMessage,
 		float64(duration)/float64(time.Millisecond))
 }
 
@@ -301,8 +372,12 @@ func (h *handler) checkAuth(context *db.DatabaseContext) error {
 		if token := h.getBearerToken(); token != "" {
 			h.user, _, err = context.Authenticator().AuthenticateUntrustedJWT(token, context.OIDCProviders, h.getOIDCCallbackURL)
 			if h.user == nil || err != nil {
+				h.user = nil
+				h.audit(base.AuditAuthFailure, "", map[string]interface{}{"method": "oidc"})
+				context.EventMgr.RaiseAuthFailureEvent("", "oidc", h.clientIP())
 				return base.HTTPErrorf(http.StatusUnauthorized, "Invalid login")
 			}
+			h.audit(base.AuditAuthSuccess, h.user.Name(), map[string]interface{}{"method": "oidc"})
 			return nil
 		}
 
@@ -326,12 +401,18 @@ func (h *handler) checkAuth(context *db.DatabaseContext) error {
 
 	// Check basic auth first
 	if userName, password := h.getBasicAuth(); userName != "" {
-		h.user = context.Authenticator().AuthenticateUser(userName, password)
+		h.user, err = context.Authenticator().AuthenticateUserPassword(userName, password)
 		if h.user == nil {
 			base.Logf("HTTP auth failed for username=%q", userName)
+			h.audit(base.AuditAuthFailure, userName, map[string]interface{}{"method": "basic"})
+			context.EventMgr.RaiseAuthFailureEvent(userName, "basic", h.clientIP())
 			h.response.Header().Set("WWW-Authenticate", `Basic realm="Couchbase Sync Gateway"`)
+			if err == auth.ErrLockedOut {
+				return err
+			}
 			return base.HTTPErrorf(http.StatusUnauthorized, "Invalid login")
 		}
+		h.audit(base.AuditAuthSuccess, userName, map[string]interface{}{"method": "basic"})
 		return nil
 	}
 
@@ -340,6 +421,7 @@ func (h *handler) checkAuth(context *db.DatabaseContext) error {
 	if err != nil {
 		return err
 	} else if h.user != nil {
+		h.audit(base.AuditAuthSuccess, h.user.Name(), map[string]interface{}{"method": "cookie"})
 		return nil
 	}
 
@@ -355,6 +437,51 @@ func (h *handler) checkAuth(context *db.DatabaseContext) error {
 	return nil
 }
 
+// Returns the IP address of the client, without the port. If the request comes from a trusted
+// proxy, the X-Forwarded-For header is walked from the right (the hop closest to us), skipping
+// trusted proxies, and the first untrusted address is the client. Hops left of that one could be
+// forged by the client, so they're never used.
+func (h *handler) clientIP() string {
+	host, _, err := net.SplitHostPort(h.rq.RemoteAddr)
+	if err != nil {
+		host = h.rq.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || h.server == nil || !h.server.isTrustedProxy(ip) {
+		return host
+	}
+	hops := strings.Split(strings.Join(h.rq.Header["X-Forwarded-For"], ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		hopIP := net.ParseIP(hop)
+		if hopIP == nil {
+			break // Malformed; don't trust anything beyond it
+		}
+		host = hop
+		if !h.server.isTrustedProxy(hopIP) {
+			break
+		}
+	}
+	return host
+}
+
+// Counts the opening of a changes feed against the rate limits of the user and client IP.
+// Requests on the admin port aren't limited.
+func (h *handler) checkChangesRateLimit() error {
+	if h.privs == adminPrivs {
+		return nil
+	}
+	if err := h.db.CheckIPRateLimit(db.RateLimitChanges, h.clientIP()); err != nil {
+		return err
+	} else if h.user != nil {
+		return h.db.CheckUserRateLimit(db.RateLimitChanges, h.user.Name())
+	}
+	return nil
+}
+
 func (h *handler) assertAdminOnly() {
 	if h.privs != adminPrivs {
 		panic("Admin-only handler called without admin privileges, on " + h.rq.RequestURI)
@@ -472,11 +599,15 @@ func (h *handler) readDocument() (db.Body, error) {
 			body, err := db.ReadMultipartDocument(reader)
 			if err != nil {
 				ioutil.WriteFile("GatewayPUT.mime", raw, 0600)
-				base.Warn("Error reading MIME data: copied to file GatewayPUT.mime")
+				base.WarnCtx(h.logCtx, "Error reading MIME data: copied to file GatewayPUT.mime")
 			}
 			return body, err
 		} else {
 			reader := multipart.NewReader(h.requestBody, attrs["boundary"])
+			if h.db != nil {
+				// Stream attachments straight into the attachment store:
+				return h.db.StreamMultipartDocument(reader)
+			}
 			return db.ReadMultipartDocument(reader)
 		}
 	default:
@@ -512,6 +643,25 @@ func (h *handler) getBearerToken() string {
 	return ""
 }
 
+// The name of the user who made the request: the admin user on the admin port ("ADMIN" if admin
+// auth is disabled), else the authenticated user. Empty if the request hasn't authenticated.
+func (h *handler) requestUsername() string {
+	if h.privs == adminPrivs {
+		if h.adminUser != "" {
+			return h.adminUser
+		} else if h.server.adminAuth == nil {
+			return "ADMIN"
+		}
+		return ""
+	} else if h.user != nil {
+		if h.user.Name() == "" {
+			return base.GuestUsername
+		}
+		return h.user.Name()
+	}
+	return ""
+}
+
 func (h *handler) currentEffectiveUserName() string {
 	var effectiveName string
 
@@ -550,14 +700,14 @@ func (h *handler) disableResponseCompression() {
 // If status is nonzero, the header will be written with that status.
 func (h *handler) writeJSONStatus(status int, value interface{}) {
 	if !h.requestAccepts("application/json") {
-		base.Warn("Client won't accept JSON, only %s", h.rq.Header.Get("Accept"))
+		base.WarnCtx(h.logCtx, "Client won't accept JSON, only %s", h.rq.Header.Get("Accept"))
 		h.writeStatus(http.StatusNotAcceptable, "only application/json available")
 		return
 	}
 
 	jsonOut, err := json.Marshal(value)
 	if err != nil {
-		base.Warn("Couldn't serialize JSON for %v : %s", value, err)
+		base.WarnCtx(h.logCtx, "Couldn't serialize JSON for %v : %s", value, err)
 		h.writeStatus(http.StatusInternalServerError, "JSON serialization failed")
 		return
 	}
@@ -593,7 +743,7 @@ func (h *handler) writeText(value []byte) {
 
 func (h *handler) writeTextStatus(status int, value []byte) {
 	if !h.requestAccepts("text/plain") {
-		base.Warn("Client won't accept text/plain, only %s", h.rq.Header.Get("Accept"))
+		base.WarnCtx(h.logCtx, "Client won't accept text/plain, only %s", h.rq.Header.Get("Accept"))
 		h.writeStatus(http.StatusNotAcceptable, "only text/plain available")
 		return
 	}
@@ -612,7 +762,7 @@ func (h *handler) addJSON(value interface{}) {
 	encoder := json.NewEncoder(h.response)
 	err := encoder.Encode(value)
 	if err != nil {
-		base.Warn("Couldn't serialize JSON for %v : %s", value, err)
+		base.WarnCtx(h.logCtx, "Couldn't serialize JSON for %v : %s", value, err)
 		panic("JSON serialization failed")
 	}
 }
@@ -658,13 +808,21 @@ func (h *handler) flush() {
 func (h *handler) writeError(err error) {
 	if err != nil {
 		err = auth.OIDCToHTTPError(err) // Map OIDC/OAuth2 errors to HTTP form
+		if rateLimitErr, ok := err.(*base.RateLimitError); ok {
+			h.setHeader("Retry-After", strconv.Itoa(rateLimitErr.RetryAfterSeconds()))
+		}
 		status, message := base.ErrorAsHTTPStatus(err)
-		h.writeStatus(status, message)
+		h.writeStatusWithDetails(status, message, base.ErrorDetails(err))
 	}
 }
 
 // Writes the response status code, and if it's an error writes a JSON description to the body.
 func (h *handler) writeStatus(status int, message string) {
+	h.writeStatusWithDetails(status, message, nil)
+}
+
+// Like writeStatus, but adds the details (if any) to the JSON description of an error.
+func (h *handler) writeStatusWithDetails(status int, message string, details map[string]interface{}) {
 	if status < 300 {
 		h.response.WriteHeader(status)
 		h.setStatus(status, message)
@@ -688,7 +846,11 @@ func (h *handler) writeStatus(status int, message string) {
 	h.setHeader("Content-Type", "application/json")
 	h.response.WriteHeader(status)
 	h.setStatus(status, message)
-	jsonOut, _ := json.Marshal(db.Body{"error": errorStr, "reason": message})
+	errorBody := db.Body{"error": errorStr, "reason": message}
+	for key, value := range details {
+		errorBody[key] = value
+	}
+	jsonOut, _ := json.Marshal(errorBody)
 	h.response.Write(jsonOut)
 }
 
@@ -198,3 +198,36 @@ func TestSanitizeURL(t *testing.T) {
 	sanitizedURL = base.SanitizeRequestURL(url)
 	assert.Equals(t, sanitizedURL, "http://localhost:4985/default/doctoken=code=")
 }
+
+func TestClientIP(t *testing.T) {
+	proxies, err := parseTrustedProxies([]string{"10.0.0.1", "192.168.0.0/16"})
+	assert.Equals(t, err, nil)
+	sc := &ServerContext{trustedProxies: proxies}
+
+	clientIP := func(remoteAddr string, forwardedFor ...string) string {
+		rq, _ := http.NewRequest("GET", "/db/", nil)
+		rq.RemoteAddr = remoteAddr
+		for _, value := range forwardedFor {
+			rq.Header.Add("X-Forwarded-For", value)
+		}
+		return (&handler{server: sc, rq: rq}).clientIP()
+	}
+
+	// X-Forwarded-For is ignored unless the request comes from a trusted proxy:
+	assert.Equals(t, clientIP("203.0.113.5:1234"), "203.0.113.5")
+	assert.Equals(t, clientIP("203.0.113.5:1234", "198.51.100.7"), "203.0.113.5")
+
+	// From a trusted proxy, the rightmost untrusted hop is the client:
+	assert.Equals(t, clientIP("10.0.0.1:1234", "198.51.100.7"), "198.51.100.7")
+	assert.Equals(t, clientIP("10.0.0.1:1234", "1.2.3.4, 198.51.100.7, 192.168.1.1"), "198.51.100.7")
+	assert.Equals(t, clientIP("192.168.3.3:1234", "1.2.3.4", "198.51.100.7"), "198.51.100.7")
+
+	// A proxy that doesn't add the header, or a malformed hop, leaves the last trusted address:
+	assert.Equals(t, clientIP("10.0.0.1:1234"), "10.0.0.1")
+	assert.Equals(t, clientIP("10.0.0.1:1234", "198.51.100.7, bogus"), "10.0.0.1")
+
+	_, err = parseTrustedProxies([]string{"10.0.0.300"})
+	assert.True(t, err != nil)
+	_, err = parseTrustedProxies([]string{"10.0.0.0/99"})
+	assert.True(t, err != nil)
+}
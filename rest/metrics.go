@@ -0,0 +1,138 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"bytes"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/db"
+)
+
+const kMetricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Request counts and latencies, broken down by database. Requests that aren't to a database are
+// recorded under the database name "".
+type requestMetrics struct {
+	counts    map[requestMetricsKey]uint64
+	latencies map[string]*base.LatencyHistogram
+	lock      sync.Mutex
+}
+
+type requestMetricsKey struct {
+	database string
+	status   int
+}
+
+var restRequestMetrics = &requestMetrics{
+	counts:    map[requestMetricsKey]uint64{},
+	latencies: map[string]*base.LatencyHistogram{},
+}
+
+// Records a completed request. A zero duration means the request's duration isn't meaningful
+// (as for a continuous _changes feed) and only its count is recorded.
+func (m *requestMetrics) record(database string, status int, duration time.Duration) {
+	m.lock.Lock()
+	m.counts[requestMetricsKey{database, status}]++
+	histogram := m.latencies[database]
+	if histogram == nil && duration > 0 {
+		histogram = base.NewLatencyHistogram(nil)
+		m.latencies[database] = histogram
+	}
+	m.lock.Unlock()
+	if duration > 0 {
+		histogram.Observe(duration)
+	}
+}
+
+func (m *requestMetrics) writeMetrics(pw *base.PrometheusWriter) {
+	m.lock.Lock()
+	keys := make([]requestMetricsKey, 0, len(m.counts))
+	for key := range m.counts {
+		keys = append(keys, key)
+	}
+	counts := make(map[requestMetricsKey]uint64, len(m.counts))
+	for key, count := range m.counts {
+		counts[key] = count
+	}
+	databases := make([]string, 0, len(m.latencies))
+	for database := range m.latencies {
+		databases = append(databases, database)
+	}
+	latencies := make(map[string]*base.LatencyHistogram, len(m.latencies))
+	for database, histogram := range m.latencies {
+		latencies[database] = histogram
+	}
+	m.lock.Unlock()
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].database != keys[j].database {
+			return keys[i].database < keys[j].database
+		}
+		return keys[i].status < keys[j].status
+	})
+	for _, key := range keys {
+		pw.Write(base.PrometheusMetricPrefix+"http_requests_total", base.PrometheusCounter,
+			"Number of HTTP requests handled, by database and status",
+			float64(counts[key]), "database", key.database, "status", strconv.Itoa(key.status))
+	}
+
+	sort.Strings(databases)
+	for _, database := range databases {
+		latencies[database].WriteMetric(pw, base.PrometheusMetricPrefix+"http_request_duration_seconds",
+			"Latency of HTTP requests, by database", "database", database)
+	}
+}
+
+// Writes gauges describing the current state of each database.
+func writeDatabaseMetrics(pw *base.PrometheusWriter, databases map[string]*db.DatabaseContext) {
+	names := make([]string, 0, len(databases))
+	for name := range databases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		pw.Write(base.PrometheusMetricPrefix+"database_changes_feeds_active", base.PrometheusGauge,
+			"Number of active _changes feeds", float64(databases[name].ChangesClientStats.CurrentCount()),
+			"database", name)
+	}
+	for _, name := range names {
+		if eventMgr := databases[name].EventMgr; eventMgr != nil {
+			pw.Write(base.PrometheusMetricPrefix+"database_event_queue_length", base.PrometheusGauge,
+				"Number of events waiting to be sent to event handlers", float64(eventMgr.QueueLength()),
+				"database", name)
+		}
+	}
+	for _, name := range names {
+		if lastSeq, err := databases[name].LastSequence(); err == nil {
+			pw.Write(base.PrometheusMetricPrefix+"database_sequence_number", base.PrometheusGauge,
+				"Latest sequence number allocated", float64(lastSeq), "database", name)
+		}
+	}
+}
+
+// HTTP handler for GET /_metrics. Exports all expvars, plus per-database request and state
+// metrics, in the Prometheus text exposition format.
+func (h *handler) handleMetrics() error {
+	var output bytes.Buffer
+	pw := base.NewPrometheusWriter(&output)
+	base.WriteExpvarMetrics(pw)
+	restRequestMetrics.writeMetrics(pw)
+	writeDatabaseMetrics(pw, h.server.AllDatabases())
+
+	h.setHeader("Content-Type", kMetricsContentType)
+	h.response.Write(output.Bytes())
+	return nil
+}
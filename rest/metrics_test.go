@@ -0,0 +1,27 @@
+package rest
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestMetricsEndpoint(t *testing.T) {
+	var rt RestTester
+	defer rt.Close()
+
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/doc1", `{"value":1}`), 201)
+	assertStatus(t, rt.SendAdminRequest("GET", "/db/doc1", ""), 200)
+
+	response := rt.SendAdminRequest("GET", "/_metrics", "")
+	assertStatus(t, response, 200)
+	assert.Equals(t, response.Header().Get("Content-Type"), kMetricsContentType)
+
+	metrics := response.Body.String()
+	assert.True(t, strings.Contains(metrics, "# TYPE sgw_http_request_duration_seconds histogram\n"))
+	assert.True(t, strings.Contains(metrics, `sgw_http_requests_total{database="db",status="201"}`))
+	assert.True(t, strings.Contains(metrics, `sgw_http_request_duration_seconds_bucket{database="db",le="+Inf"}`))
+	assert.True(t, strings.Contains(metrics, `sgw_database_changes_feeds_active{database="db"} 0`))
+	assert.True(t, strings.Contains(metrics, "\nsgw_stats_requests_total "))
+}
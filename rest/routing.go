@@ -15,7 +15,6 @@ import (
 	"strconv"
 	"strings"
 
-	"github.com/couchbaselabs/sync_gateway_admin_ui"
 	"github.com/gorilla/mux"
 )
 
@@ -36,15 +35,16 @@ func init() {
 
 // Creates a GorillaMux router containing the basic HTTP handlers for a server.
 // This is the common functionality of the public and admin ports.
-// The 'privs' parameter specifies the authentication the handler will use.
+// The 'privs' parameter specifies the authentication the handler will use. On the admin port,
+// these routes require AdminPermDocs, except for the server and database info.
 func createHandler(sc *ServerContext, privs handlerPrivs) (*mux.Router, *mux.Router) {
 	r := mux.NewRouter()
 	r.StrictSlash(true)
 	// Global operations:
-	r.Handle("/", makeHandler(sc, privs, (*handler).handleRoot)).Methods("GET", "HEAD")
+	r.Handle("/", makeHandlerWithPermission(sc, privs, AdminPermStats, false, (*handler).handleRoot)).Methods("GET", "HEAD")
 
 	// Operations on databases:
-	r.Handle("/{db:"+dbRegex+"}/", makeOfflineHandler(sc, privs, (*handler).handleGetDB)).Methods("GET", "HEAD")
+	r.Handle("/{db:"+dbRegex+"}/", makeHandlerWithPermission(sc, privs, AdminPermStats, true, (*handler).handleGetDB)).Methods("GET", "HEAD")
 	r.Handle("/{db:"+dbRegex+"}/", makeHandler(sc, privs, (*handler).handlePostDoc)).Methods("POST")
 
 	// Special database URLs:
@@ -145,138 +145,180 @@ func CreateAdminHandlerForRouter(sc *ServerContext, r *mux.Router) http.Handler
 func CreateAdminRouter(sc *ServerContext) *mux.Router {
 	r, dbr := createHandler(sc, adminPrivs)
 
-	r.PathPrefix("/_admin/").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if sc.config.AdminUI != nil {
-			http.ServeFile(w, r, *sc.config.AdminUI)
-		} else {
-			w.Write(sync_gateway_admin_ui.Admin_bundle_html())
-		}
-	})
+	r.PathPrefix("/_admin/").Handler(makeAdminHandler(sc, AdminPermStats, (*handler).handleAdminUI))
 
 	dbr.Handle("/_session",
-		makeHandler(sc, adminPrivs, (*handler).createUserSession)).Methods("POST")
+		makeAdminHandler(sc, AdminPermUsers, (*handler).createUserSession)).Methods("POST")
 
 	dbr.Handle("/_session/{sessionid}",
-		makeHandler(sc, adminPrivs, (*handler).getUserSession)).Methods("GET")
+		makeAdminHandler(sc, AdminPermUsers, (*handler).getUserSession)).Methods("GET")
 
 	dbr.Handle("/_session/{sessionid}",
-		makeHandler(sc, adminPrivs, (*handler).deleteUserSession)).Methods("DELETE")
+		makeAdminHandler(sc, AdminPermUsers, (*handler).deleteUserSession)).Methods("DELETE")
 
 	dbr.Handle("/_raw/{docid:"+docRegex+"}",
-		makeHandler(sc, adminPrivs, (*handler).handleGetRawDoc)).Methods("GET", "HEAD")
+		makeAdminHandler(sc, AdminPermDocs, (*handler).handleGetRawDoc)).Methods("GET", "HEAD")
 
 	dbr.Handle("/_revtree/{docid:"+docRegex+"}",
-		makeHandler(sc, adminPrivs, (*handler).handleGetRevTree)).Methods("GET")
+		makeAdminHandler(sc, AdminPermDocs, (*handler).handleGetRevTree)).Methods("GET")
+
+	dbr.Handle("/_expiry/{docid:"+docRegex+"}",
+		makeAdminHandler(sc, AdminPermDocs, (*handler).handleGetDocExpiry)).Methods("GET")
+	dbr.Handle("/_expiry/{docid:"+docRegex+"}",
+		makeAdminHandler(sc, AdminPermDocs, (*handler).handlePutDocExpiry)).Methods("PUT")
+	dbr.Handle("/_expiry/{docid:"+docRegex+"}",
+		makeAdminHandler(sc, AdminPermDocs, (*handler).handleDeleteDocExpiry)).Methods("DELETE")
+	dbr.Handle("/_expiring",
+		makeAdminHandler(sc, AdminPermDocs, (*handler).handleGetExpiringDocs)).Methods("GET")
+
+	dbr.Handle("/_dead_letters",
+		makeAdminHandler(sc, AdminPermConfig, (*handler).handleGetDeadLetters)).Methods("GET")
+	dbr.Handle("/_dead_letters/_replay",
+		makeAdminHandler(sc, AdminPermConfig, (*handler).handleReplayDeadLetters)).Methods("POST")
+	dbr.Handle("/_dead_letters/{id}",
+		makeAdminHandler(sc, AdminPermConfig, (*handler).handleGetDeadLetter)).Methods("GET")
+	dbr.Handle("/_dead_letters/{id}",
+		makeAdminHandler(sc, AdminPermConfig, (*handler).handleDeleteDeadLetter)).Methods("DELETE")
+	dbr.Handle("/_dead_letters/{id}/_replay",
+		makeAdminHandler(sc, AdminPermConfig, (*handler).handleReplayDeadLetter)).Methods("POST")
 
 	dbr.Handle("/_user/",
-		makeHandler(sc, adminPrivs, (*handler).getUsers)).Methods("GET", "HEAD")
+		makeAdminHandler(sc, AdminPermUsers, (*handler).getUsers)).Methods("GET", "HEAD")
 	dbr.Handle("/_user/",
-		makeHandler(sc, adminPrivs, (*handler).putUser)).Methods("POST")
+		makeAdminHandler(sc, AdminPermUsers, (*handler).putUser)).Methods("POST")
 	dbr.Handle("/_user/{name}",
-		makeHandler(sc, adminPrivs, (*handler).getUserInfo)).Methods("GET", "HEAD")
+		makeAdminHandler(sc, AdminPermUsers, (*handler).getUserInfo)).Methods("GET", "HEAD")
 	dbr.Handle("/_user/{name}",
-		makeHandler(sc, adminPrivs, (*handler).putUser)).Methods("PUT")
+		makeAdminHandler(sc, AdminPermUsers, (*handler).putUser)).Methods("PUT")
 	dbr.Handle("/_user/{name}",
-		makeHandler(sc, adminPrivs, (*handler).deleteUser)).Methods("DELETE")
+		makeAdminHandler(sc, AdminPermUsers, (*handler).deleteUser)).Methods("DELETE")
 
 	dbr.Handle("/_user/{name}/_session",
-		makeHandler(sc, adminPrivs, (*handler).deleteUserSessions)).Methods("DELETE")
+		makeAdminHandler(sc, AdminPermUsers, (*handler).deleteUserSessions)).Methods("DELETE")
 	dbr.Handle("/_user/{name}/_session/{sessionid}",
-		makeHandler(sc, adminPrivs, (*handler).deleteUserSession)).Methods("DELETE")
+		makeAdminHandler(sc, AdminPermUsers, (*handler).deleteUserSession)).Methods("DELETE")
+
+	dbr.Handle("/_access_explain",
+		makeAdminHandler(sc, AdminPermUsers, (*handler).handleAccessExplain)).Methods("GET")
+
+	dbr.Handle("/_principals/_export",
+		makeAdminHandler(sc, AdminPermUsers, (*handler).handleExportPrincipals)).Methods("GET")
+	dbr.Handle("/_principals/_import",
+		makeAdminHandler(sc, AdminPermUsers, (*handler).handleImportPrincipals)).Methods("POST")
 
 	dbr.Handle("/_role/",
-		makeHandler(sc, adminPrivs, (*handler).getRoles)).Methods("GET", "HEAD")
+		makeAdminHandler(sc, AdminPermUsers, (*handler).getRoles)).Methods("GET", "HEAD")
 	dbr.Handle("/_role/",
-		makeHandler(sc, adminPrivs, (*handler).putRole)).Methods("POST")
+		makeAdminHandler(sc, AdminPermUsers, (*handler).putRole)).Methods("POST")
 	dbr.Handle("/_role/{name}",
-		makeHandler(sc, adminPrivs, (*handler).getRoleInfo)).Methods("GET", "HEAD")
+		makeAdminHandler(sc, AdminPermUsers, (*handler).getRoleInfo)).Methods("GET", "HEAD")
 	dbr.Handle("/_role/{name}",
-		makeHandler(sc, adminPrivs, (*handler).putRole)).Methods("PUT")
+		makeAdminHandler(sc, AdminPermUsers, (*handler).putRole)).Methods("PUT")
 	dbr.Handle("/_role/{name}",
-		makeHandler(sc, adminPrivs, (*handler).deleteRole)).Methods("DELETE")
+		makeAdminHandler(sc, AdminPermUsers, (*handler).deleteRole)).Methods("DELETE")
 
 	r.Handle("/_logging",
-		makeHandler(sc, adminPrivs, (*handler).handleGetLogging)).Methods("GET")
+		makeAdminHandler(sc, AdminPermStats, (*handler).handleGetLogging)).Methods("GET")
 	r.Handle("/_logging",
-		makeHandler(sc, adminPrivs, (*handler).handleSetLogging)).Methods("PUT", "POST")
+		makeAdminHandler(sc, AdminPermConfig, (*handler).handleSetLogging)).Methods("PUT", "POST")
 	r.Handle("/_profile/{name}",
-		makeHandler(sc, adminPrivs, (*handler).handleProfiling)).Methods("POST")
+		makeAdminHandler(sc, AdminPermDebug, (*handler).handleProfiling)).Methods("POST")
 	r.Handle("/_profile",
-		makeHandler(sc, adminPrivs, (*handler).handleProfiling)).Methods("POST")
+		makeAdminHandler(sc, AdminPermDebug, (*handler).handleProfiling)).Methods("POST")
 	r.Handle("/_heap",
-		makeHandler(sc, adminPrivs, (*handler).handleHeapProfiling)).Methods("POST")
+		makeAdminHandler(sc, AdminPermDebug, (*handler).handleHeapProfiling)).Methods("POST")
 	r.Handle("/_stats",
-		makeHandler(sc, adminPrivs, (*handler).handleStats)).Methods("GET")
+		makeAdminHandler(sc, AdminPermStats, (*handler).handleStats)).Methods("GET")
 	r.Handle(kDebugURLPathPrefix,
-		makeHandler(sc, adminPrivs, (*handler).handleExpvar)).Methods("GET")
+		makeAdminHandler(sc, AdminPermStats, (*handler).handleExpvar)).Methods("GET")
+	r.Handle("/_metrics",
+		makeAdminHandler(sc, AdminPermStats, (*handler).handleMetrics)).Methods("GET")
 	r.Handle("/_config",
-		makeHandler(sc, adminPrivs, (*handler).handleGetConfig)).Methods("GET")
+		makeAdminHandler(sc, AdminPermConfig, (*handler).handleGetConfig)).Methods("GET")
 	r.Handle("/_replicate",
-		makeOfflineHandler(sc, adminPrivs, (*handler).handleReplicate)).Methods("POST")
+		makeOfflineAdminHandler(sc, AdminPermConfig, (*handler).handleReplicate)).Methods("POST")
 	r.Handle("/_active_tasks",
-		makeOfflineHandler(sc, adminPrivs, (*handler).handleActiveTasks)).Methods("GET")
+		makeOfflineAdminHandler(sc, AdminPermStats, (*handler).handleActiveTasks)).Methods("GET")
 
 	// Debugging handlers
 	r.Handle("/_debug/pprof/goroutine",
-		makeHandler(sc, adminPrivs, (*handler).handlePprofGoroutine)).Methods("GET", "POST")
+		makeAdminHandler(sc, AdminPermDebug, (*handler).handlePprofGoroutine)).Methods("GET", "POST")
 	r.Handle("/_debug/pprof/cmdline",
-		makeHandler(sc, adminPrivs, (*handler).handlePprofCmdline)).Methods("GET", "POST")
+		makeAdminHandler(sc, AdminPermDebug, (*handler).handlePprofCmdline)).Methods("GET", "POST")
 	r.Handle("/_debug/pprof/symbol",
-		makeHandler(sc, adminPrivs, (*handler).handlePprofSymbol)).Methods("GET", "POST")
+		makeAdminHandler(sc, AdminPermDebug, (*handler).handlePprofSymbol)).Methods("GET", "POST")
 	r.Handle("/_debug/pprof/heap",
-		makeHandler(sc, adminPrivs, (*handler).handlePprofHeap)).Methods("GET", "POST")
+		makeAdminHandler(sc, AdminPermDebug, (*handler).handlePprofHeap)).Methods("GET", "POST")
 	r.Handle("/_debug/pprof/profile",
-		makeHandler(sc, adminPrivs, (*handler).handlePprofProfile)).Methods("GET", "POST")
+		makeAdminHandler(sc, AdminPermDebug, (*handler).handlePprofProfile)).Methods("GET", "POST")
 	r.Handle("/_debug/pprof/block",
-		makeHandler(sc, adminPrivs, (*handler).handlePprofBlock)).Methods("GET", "POST")
+		makeAdminHandler(sc, AdminPermDebug, (*handler).handlePprofBlock)).Methods("GET", "POST")
 	r.Handle("/_debug/pprof/threadcreate",
-		makeHandler(sc, adminPrivs, (*handler).handlePprofThreadcreate)).Methods("GET", "POST")
+		makeAdminHandler(sc, AdminPermDebug, (*handler).handlePprofThreadcreate)).Methods("GET", "POST")
 	r.Handle("/_debug/pprof/trace",
-		makeHandler(sc, adminPrivs, (*handler).handlePprofTrace)).Methods("GET", "POST")
+		makeAdminHandler(sc, AdminPermDebug, (*handler).handlePprofTrace)).Methods("GET", "POST")
 
 	// Database-relative handlers:
 	dbr.Handle("/_config",
-		makeHandler(sc, adminPrivs, (*handler).handleGetDbConfig)).Methods("GET")
+		makeAdminHandler(sc, AdminPermConfig, (*handler).handleGetDbConfig)).Methods("GET")
 	dbr.Handle("/_config",
-		makeOfflineHandler(sc, adminPrivs, (*handler).handlePutDbConfig)).Methods("PUT")
+		makeOfflineAdminHandler(sc, AdminPermConfig, (*handler).handlePutDbConfig)).Methods("PUT")
+	dbr.Handle("/_resync",
+		makeOfflineAdminHandler(sc, AdminPermConfig, (*handler).handleResync)).Methods("POST")
 	dbr.Handle("/_resync",
-		makeOfflineHandler(sc, adminPrivs, (*handler).handleResync)).Methods("POST")
+		makeOfflineAdminHandler(sc, AdminPermStats, (*handler).handleGetResync)).Methods("GET")
+	dbr.Handle("/_resync/_cancel",
+		makeOfflineAdminHandler(sc, AdminPermConfig, (*handler).handleCancelResync)).Methods("POST")
+	dbr.Handle("/_sync_test",
+		makeOfflineAdminHandler(sc, AdminPermConfig, (*handler).handleSyncFnTest)).Methods("POST")
 	dbr.Handle("/_vacuum",
-		makeHandler(sc, adminPrivs, (*handler).handleVacuum)).Methods("POST")
+		makeAdminHandler(sc, AdminPermConfig, (*handler).handleVacuum)).Methods("POST")
+	dbr.Handle("/_maintenance",
+		makeAdminHandler(sc, AdminPermStats, (*handler).handleGetMaintenance)).Methods("GET")
+	dbr.Handle("/_maintenance/{job}",
+		makeAdminHandler(sc, AdminPermStats, (*handler).handleGetMaintenanceJob)).Methods("GET")
+	dbr.Handle("/_maintenance/{job}",
+		makeAdminHandler(sc, AdminPermConfig, (*handler).handleStartMaintenanceJob)).Methods("POST")
+	dbr.Handle("/_maintenance/{job}/_pause",
+		makeAdminHandler(sc, AdminPermConfig, (*handler).handlePauseMaintenanceJob)).Methods("POST")
+	dbr.Handle("/_maintenance/{job}/_resume",
+		makeAdminHandler(sc, AdminPermConfig, (*handler).handleResumeMaintenanceJob)).Methods("POST")
+	dbr.Handle("/_maintenance/{job}/_cancel",
+		makeAdminHandler(sc, AdminPermConfig, (*handler).handleCancelMaintenanceJob)).Methods("POST")
 	dbr.Handle("/_purge",
-		makeHandler(sc, adminPrivs, (*handler).handlePurge)).Methods("POST")
+		makeAdminHandler(sc, AdminPermDocs, (*handler).handlePurge)).Methods("POST")
 	dbr.Handle("/_flush",
-		makeHandler(sc, adminPrivs, (*handler).handleFlush)).Methods("POST")
+		makeAdminHandler(sc, AdminPermConfig, (*handler).handleFlush)).Methods("POST")
 	dbr.Handle("/_online",
-		makeOfflineHandler(sc, adminPrivs, (*handler).handleDbOnline)).Methods("POST")
+		makeOfflineAdminHandler(sc, AdminPermConfig, (*handler).handleDbOnline)).Methods("POST")
 	dbr.Handle("/_offline",
-		makeOfflineHandler(sc, adminPrivs, (*handler).handleDbOffline)).Methods("POST")
+		makeOfflineAdminHandler(sc, AdminPermConfig, (*handler).handleDbOffline)).Methods("POST")
 	dbr.Handle("/_dump/{view}",
-		makeHandler(sc, adminPrivs, (*handler).handleDump)).Methods("GET")
+		makeAdminHandler(sc, AdminPermDocs, (*handler).handleDump)).Methods("GET")
 	dbr.Handle("/_view/{view}", // redundant; just for backward compatibility with 1.0
-		makeHandler(sc, adminPrivs, (*handler).handleView)).Methods("GET")
+		makeAdminHandler(sc, AdminPermDocs, (*handler).handleView)).Methods("GET")
 	dbr.Handle("/_dumpchannel/{channel}",
-		makeHandler(sc, adminPrivs, (*handler).handleDumpChannel)).Methods("GET")
+		makeAdminHandler(sc, AdminPermDocs, (*handler).handleDumpChannel)).Methods("GET")
 	dbr.Handle("/_index",
-		makeHandler(sc, adminPrivs, (*handler).handleIndex)).Methods("GET")
+		makeAdminHandler(sc, AdminPermDocs, (*handler).handleIndex)).Methods("GET")
 	dbr.Handle("/_index/channel/{channel}",
-		makeHandler(sc, adminPrivs, (*handler).handleIndexChannel)).Methods("GET")
+		makeAdminHandler(sc, AdminPermDocs, (*handler).handleIndexChannel)).Methods("GET")
 	dbr.Handle("/_index/channels",
-		makeHandler(sc, adminPrivs, (*handler).handleIndexAllChannels)).Methods("GET")
+		makeAdminHandler(sc, AdminPermDocs, (*handler).handleIndexAllChannels)).Methods("GET")
 	dbr.Handle("/_repair",
-		makeHandler(sc, adminPrivs, (*handler).handleRepair)).Methods("POST")
+		makeAdminHandler(sc, AdminPermConfig, (*handler).handleRepair)).Methods("POST")
 
 	// The routes below are part of the CouchDB REST API but should only be available to admins,
 	// so the handlers are moved to the admin port.
 	r.Handle("/{newdb:"+dbRegex+"}/",
-		makeHandler(sc, adminPrivs, (*handler).handleCreateDB)).Methods("PUT")
+		makeAdminHandler(sc, AdminPermConfig, (*handler).handleCreateDB)).Methods("PUT")
 	r.Handle("/{db:"+dbRegex+"}/",
-		makeOfflineHandler(sc, adminPrivs, (*handler).handleDeleteDB)).Methods("DELETE")
+		makeOfflineAdminHandler(sc, AdminPermConfig, (*handler).handleDeleteDB)).Methods("DELETE")
 
 	r.Handle("/_all_dbs",
-		makeHandler(sc, adminPrivs, (*handler).handleAllDbs)).Methods("GET", "HEAD")
+		makeAdminHandler(sc, AdminPermStats, (*handler).handleAllDbs)).Methods("GET", "HEAD")
 	dbr.Handle("/_compact",
-		makeHandler(sc, adminPrivs, (*handler).handleCompact)).Methods("POST")
+		makeAdminHandler(sc, AdminPermConfig, (*handler).handleCompact)).Methods("POST")
 
 	return r
 }
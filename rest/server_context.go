@@ -15,6 +15,7 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"regexp"
@@ -26,6 +27,7 @@ import (
 
 	"github.com/couchbase/go-couchbase"
 	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
 	"github.com/couchbase/sync_gateway/db"
 	"github.com/couchbaselabs/sg-replicate"
 	pkgerrors "github.com/pkg/errors"
@@ -43,12 +45,15 @@ const KDefaultNumShards = 16
 // This struct is accessed from HTTP handlers running on multiple goroutines, so it needs to
 // be thread-safe.
 type ServerContext struct {
-	config      *ServerConfig
-	databases_  map[string]*db.DatabaseContext
-	lock        sync.RWMutex
-	statsTicker *time.Ticker
-	HTTPClient  *http.Client
-	replicator  *base.Replicator
+	config         *ServerConfig
+	databases_     map[string]*db.DatabaseContext
+	lock           sync.RWMutex
+	statsTicker    *time.Ticker
+	HTTPClient     *http.Client
+	replicator     *base.Replicator
+	blipReplicator *blipReplicator
+	adminAuth      *adminAuthenticator // Authenticates admin API requests; nil if admin auth is disabled
+	trustedProxies []*net.IPNet        // Proxies whose X-Forwarded-For header is honored
 }
 
 func NewServerContext(config *ServerConfig) *ServerContext {
@@ -57,6 +62,13 @@ func NewServerContext(config *ServerConfig) *ServerContext {
 		databases_: map[string]*db.DatabaseContext{},
 		HTTPClient: http.DefaultClient,
 		replicator: base.NewReplicator(),
+		adminAuth:  newAdminAuthenticator(config.AdminAuth),
+	}
+	sc.blipReplicator = newBlipReplicator(sc)
+	if proxies, err := parseTrustedProxies(config.TrustedProxies); err != nil {
+		base.Warn("Ignoring trusted_proxies config: %v", err)
+	} else {
+		sc.trustedProxies = proxies
 	}
 	if config.Databases == nil {
 		config.Databases = DbConfigMap{}
@@ -90,6 +102,11 @@ func NewServerContext(config *ServerConfig) *ServerContext {
 
 		for _, replicationConfig := range config.Replications {
 
+			if replicationConfig.Protocol == kBlipReplicationProtocol {
+				sc.startBlipReplicationFromConfig(*replicationConfig)
+				continue
+			}
+
 			params, _, localdb, err := validateReplicationParameters(*replicationConfig, true, *config.AdminInterface)
 
 			if err != nil {
@@ -118,6 +135,28 @@ func NewServerContext(config *ServerConfig) *ServerContext {
 	return sc
 }
 
+// Starts a BLIP replication listed in the server config. Since these always involve a local
+// database, the start is delayed to allow the databases and REST APIs to come up.
+func (sc *ServerContext) startBlipReplicationFromConfig(replicationConfig ReplicationConfig) {
+	params, _, err := validateBlipReplicationParameters(replicationConfig, true)
+	if err != nil {
+		base.LogError(err)
+		return
+	}
+
+	//Force one-shot replications to run Async
+	//to avoid blocking server startup
+	params.Async = true
+
+	go func() {
+		base.Warn("Delaying start of BLIP replication of local database %v with %v for %v seconds", params.LocalDb, params.remoteForLog(), kOneShotLocalDbReplicateWait)
+		time.Sleep(kOneShotLocalDbReplicateWait)
+		if _, err := sc.blipReplicator.Replicate(params, false); err != nil {
+			base.Warn("Error starting BLIP replication of local database %v with %v: %v", params.LocalDb, params.remoteForLog(), err)
+		}
+	}()
+}
+
 func (sc *ServerContext) FindDbByBucketName(bucketName string) string {
 
 	// Loop through all known database contexts and return the first one
@@ -138,6 +177,7 @@ func (sc *ServerContext) Close() {
 	if err := sc.replicator.StopReplications(); err != nil {
 		base.Warn("Error stopping replications: %+v.  This could cause a resource leak.  Please restart Sync Gateway to cleanup leaked resources.", err)
 	}
+	sc.blipReplicator.StopReplications()
 
 	sc.stopStatsReporter()
 	for _, ctx := range sc.databases_ {
@@ -336,6 +376,100 @@ func (sc *ServerContext) _getOrAddDatabaseFromConfig(config *DbConfig, useExisti
 		importOptions.ImportFilter = db.NewImportFilterFunction(*config.ImportFilter)
 	}
 
+	var changesFilters map[string]*db.JSChangesFilterFunction
+	if len(config.ChangesFilters) > 0 {
+		changesFilters = make(map[string]*db.JSChangesFilterFunction, len(config.ChangesFilters))
+		for name, fnSource := range config.ChangesFilters {
+			changesFilters[name] = db.NewJSChangesFilterFunction(fnSource)
+		}
+	}
+
+	var namespaces *db.NamespaceOptions
+	if config.Namespaces != nil {
+		namespaces = &db.NamespaceOptions{
+			Property:    config.Namespaces.Property,
+			IDSeparator: config.Namespaces.IDSeparator,
+			Namespaces:  make(map[string]*db.Namespace, len(config.Namespaces.Namespaces)),
+		}
+		for name, nsConfig := range config.Namespaces.Namespaces {
+			ns := &db.Namespace{}
+			if nsConfig != nil && nsConfig.Sync != nil {
+				ns.ChannelMapper = channels.NewChannelMapper(*nsConfig.Sync)
+			}
+			if nsConfig != nil && nsConfig.ImportFilter != nil {
+				ns.ImportFilter = db.NewImportFilterFunction(*nsConfig.ImportFilter)
+			}
+			namespaces.Namespaces[name] = ns
+		}
+	}
+
+	var schemaOptions *db.SchemaOptions
+	if config.Schemas != nil {
+		schemaOptions = &db.SchemaOptions{TypeProperty: config.Schemas.TypeProperty}
+		for _, schemaConfig := range config.Schemas.Schemas {
+			schema, err := db.NewDocumentSchema(schemaConfig.Name, schemaConfig.Type, schemaConfig.DocIDPattern, schemaConfig.Schema)
+			if err != nil {
+				return nil, err
+			}
+			schemaOptions.Schemas = append(schemaOptions.Schemas, schema)
+		}
+	}
+
+	var maintenanceOptions *db.MaintenanceOptions
+	if len(config.Maintenance) > 0 || config.ExpiryTombstones {
+		maintenanceOptions = &db.MaintenanceOptions{Schedules: map[db.MaintenanceJobType]*db.MaintenanceSchedule{}}
+		for jobType, maintenanceConfig := range config.Maintenance {
+			schedule, err := base.ParseCronSchedule(maintenanceConfig.Schedule)
+			if err != nil {
+				return nil, err
+			}
+			maintenanceOptions.Schedules[db.MaintenanceJobType(jobType)] = &db.MaintenanceSchedule{
+				Schedule: schedule,
+				Options: db.MaintenanceJobOptions{
+					DryRun:     maintenanceConfig.DryRun,
+					BatchSize:  maintenanceConfig.BatchSize,
+					BatchDelay: time.Duration(maintenanceConfig.BatchDelayMs) * time.Millisecond,
+				},
+			}
+		}
+		if _, found := maintenanceOptions.Schedules[db.MaintenanceExpiryTombstones]; config.ExpiryTombstones && !found {
+			schedule, _ := base.ParseCronSchedule(db.DefaultExpiryTombstonesSchedule)
+			maintenanceOptions.Schedules[db.MaintenanceExpiryTombstones] = &db.MaintenanceSchedule{Schedule: schedule}
+		}
+	}
+
+	if config.PasswordPolicy != nil {
+		if err := config.PasswordPolicy.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	if config.RateLimits != nil {
+		if err := config.RateLimits.Validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	var conflictResolver db.ConflictResolverFunc
+	if config.ConflictResolver != nil {
+		var err error
+		if conflictResolver, err = db.NewConflictResolverFunc(*config.ConflictResolver); err != nil {
+			return nil, err
+		}
+	}
+
+	var attachmentStore db.AttachmentStore
+	if config.AttachmentStore != nil {
+		var err error
+		if attachmentStore, err = db.NewAttachmentStore(*config.AttachmentStore); err != nil {
+			return nil, err
+		}
+	}
+
+	deltaSyncOptions := db.DeltaSyncOptions{}
+	if config.DeltaSync != nil && config.DeltaSync.Enabled != nil {
+		deltaSyncOptions.Enabled = *config.DeltaSync.Enabled
+	}
+
 	feedType := strings.ToLower(config.FeedType)
 
 	couchbaseDriver := base.ChooseCouchbaseDriver(base.DataBucket)
@@ -519,6 +653,11 @@ func (sc *ServerContext) _getOrAddDatabaseFromConfig(config *DbConfig, useExisti
 		sc.TakeDbOnline(dbContext)
 	}
 
+	// And one that updates the database's config when an online resync switches its sync function
+	syncFunctionCallback := func(dbContext *db.DatabaseContext, syncFn string) {
+		sc.updateDatabaseSyncFunction(dbContext.Name, syncFn)
+	}
+
 	contextOptions := db.DatabaseContextOptions{
 		CacheOptions:          &cacheOptions,
 		IndexOptions:          channelIndexOptions,
@@ -531,8 +670,20 @@ func (sc *ServerContext) _getOrAddDatabaseFromConfig(config *DbConfig, useExisti
 		TrackDocs:             trackDocs,
 		OIDCOptions:           config.OIDCConfig,
 		DBOnlineCallback:      dbOnlineCallback,
+		SyncFunctionCallback:  syncFunctionCallback,
 		ImportOptions:         importOptions,
 		EnableXattr:           config.UseXattrs(),
+		ConflictResolver:      conflictResolver,
+		DeltaSyncOptions:      deltaSyncOptions,
+		AttachmentStore:       attachmentStore,
+		ChangesFilters:        changesFilters,
+		Namespaces:            namespaces,
+		SchemaOptions:         schemaOptions,
+		MaintenanceOptions:    maintenanceOptions,
+		ExpiryTombstones:      config.ExpiryTombstones,
+		PasswordPolicy:        config.PasswordPolicy,
+		RateLimits:            config.RateLimits,
+		GrantProvenance:       config.GrantProvenance,
 	}
 
 	// Create the DB Context
@@ -546,6 +697,11 @@ func (sc *ServerContext) _getOrAddDatabaseFromConfig(config *DbConfig, useExisti
 	if config.Sync != nil {
 		syncFn = *config.Sync
 	}
+	if resyncedFn := dbcontext.ResyncedSyncFunction(syncFn); resyncedFn != syncFn {
+		base.Logf("Using the sync function %q switched to by an online resync, instead of the one in its config; update the config to match", dbName)
+		syncFn = resyncedFn
+		config.Sync = &resyncedFn
+	}
 	if err := sc.applySyncFunction(dbcontext, syncFn); err != nil {
 		return nil, err
 	}
@@ -577,7 +733,7 @@ func (sc *ServerContext) _getOrAddDatabaseFromConfig(config *DbConfig, useExisti
 
 	dbcontext.AllowEmptyPassword = config.AllowEmptyPassword
 
-	if dbcontext.ChannelMapper == nil {
+	if dbcontext.GetChannelMapper() == nil {
 		base.Logf("Using default sync function 'channel(doc.channels)' for database %q", dbName)
 	}
 
@@ -671,7 +827,7 @@ func (sc *ServerContext) initEventHandlers(dbcontext *db.DatabaseContext, config
 
 		// validate event-related keys
 		for k := range eventHandlersMap {
-			if k != "max_processes" && k != "wait_for_process" && k != "document_changed" && k != "db_state_changed" {
+			if !kEventHandlerConfigKeys.Contains(k) {
 				return errors.New(fmt.Sprintf("Unsupported event property '%s' defined for db %s", k, dbcontext.Name))
 			}
 		}
@@ -684,15 +840,13 @@ func (sc *ServerContext) initEventHandlers(dbcontext *db.DatabaseContext, config
 			return pkgerrors.Wrapf(err, "Error calling json.Unmarshal() in initEventHandlers")
 		}
 
-		// Process document commit event handlers
-		if err = sc.processEventHandlersForEvent(eventHandlers.DocumentChanged, db.DocumentChange, dbcontext); err != nil {
-			return err
+		// Process the event handlers of each event type
+		for eventType, handlers := range eventHandlers.handlersByType() {
+			if err = sc.processEventHandlersForEvent(handlers, eventType, dbcontext); err != nil {
+				return err
+			}
 		}
 
-		// Process db state change event handlers
-		if err = sc.processEventHandlersForEvent(eventHandlers.DBStateChanged, db.DBStateChange, dbcontext); err != nil {
-			return err
-		}
 		// WaitForProcess uses string, to support both omitempty and zero values
 		customWaitTime := int64(-1)
 		if eventHandlers.WaitForProcess != "" {
@@ -702,7 +856,16 @@ func (sc *ServerContext) initEventHandlers(dbcontext *db.DatabaseContext, config
 				base.Warn("Error parsing wait_for_process from config, using default %s", err)
 			}
 		}
+		if limit := eventHandlers.AuthFailedLimit; limit != nil {
+			if limit.Rate <= 0 || limit.Burst < 0 {
+				return fmt.Errorf("event_handlers.auth_failed_limit of db %s must have a rate > 0 and a burst >= 0", dbcontext.Name)
+			}
+			dbcontext.EventMgr.SetAuthFailureRateLimit(limit.Rate, limit.Burst)
+		}
 		dbcontext.EventMgr.Start(eventHandlers.MaxEventProc, int(customWaitTime))
+		if eventHandlers.Durable {
+			dbcontext.StartDurableEvents()
+		}
 
 	}
 	return nil
@@ -714,25 +877,31 @@ func (sc *ServerContext) AddDatabaseFromConfig(config *DbConfig) (*db.DatabaseCo
 	return sc.getOrAddDatabaseFromConfig(config, false)
 }
 
-func (sc *ServerContext) processEventHandlersForEvent(events []*EventConfig, eventType db.EventType, dbcontext *db.DatabaseContext) error {
+func (sc *ServerContext) processEventHandlersForEvent(events []*db.EventConfig, eventType db.EventType, dbcontext *db.DatabaseContext) error {
 
 	for _, event := range events {
-		switch event.HandlerType {
-		case "webhook":
-			wh, err := db.NewWebhook(event.Url, event.Filter, event.Timeout)
-			if err != nil {
-				base.Warn("Error creating webhook %v", err)
-				return err
-			}
-			dbcontext.EventMgr.RegisterEventHandler(wh, eventType)
-		default:
-			return errors.New(fmt.Sprintf("Unknown event handler type %s", event.HandlerType))
+		handler, err := db.NewEventHandler(dbcontext, event)
+		if err != nil {
+			base.Warn("Error creating %s event handler: %v", event.HandlerType, err)
+			return err
 		}
-
+		dbcontext.EventMgr.RegisterEventHandler(handler, eventType)
 	}
 	return nil
 }
 
+// Records a database's new sync function in its config, replacing the config rather than
+// modifying it, since it may be being read.
+func (sc *ServerContext) updateDatabaseSyncFunction(dbName string, syncFn string) {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	if config := sc.config.Databases[dbName]; config != nil {
+		newConfig := *config
+		newConfig.Sync = &syncFn
+		sc.config.Databases[dbName] = &newConfig
+	}
+}
+
 func (sc *ServerContext) applySyncFunction(dbcontext *db.DatabaseContext, syncFn string) error {
 	changed, err := dbcontext.UpdateSyncFun(syncFn)
 	if err != nil || !changed {
@@ -1018,3 +1187,13 @@ func collectAccessRelatedWarnings(config *DbConfig, context *db.DatabaseContext)
 	return []string{}
 
 }
+
+// Returns true if the IP address is one of the configured trusted proxies.
+func (sc *ServerContext) isTrustedProxy(ip net.IP) bool {
+	for _, proxy := range sc.trustedProxies {
+		if proxy.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
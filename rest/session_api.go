@@ -50,6 +50,9 @@ func (h *handler) handleSessionPOST() error {
 	}
 
 	user, err := h.getUserFromSessionRequestBody()
+	if err == auth.ErrLockedOut {
+		return err // As in checkAuth, a locked-out user is told so, not that the login is invalid
+	}
 
 	// If we fail to get a user from the body and we've got a non-GUEST authenticated user, create the session based on that user
 	if user == nil && h.user != nil && h.user.Name() != "" {
@@ -75,13 +78,18 @@ func (h *handler) getUserFromSessionRequestBody() (auth.User, error) {
 	}
 
 	var user auth.User
-	user, err = h.db.Authenticator().GetUser(params.Name)
-	if err != nil {
+	user, err = h.db.Authenticator().AuthenticateUserPassword(params.Name, params.Password)
+	if err != nil && err != auth.ErrLockedOut {
 		return nil, err
 	}
 
-	if user != nil && !user.Authenticate(params.Password) {
-		user = nil
+	if params.Name != "" {
+		if user != nil {
+			h.audit(base.AuditAuthSuccess, params.Name, map[string]interface{}{"method": "session"})
+		} else {
+			h.audit(base.AuditAuthFailure, params.Name, map[string]interface{}{"method": "session"})
+			h.db.EventMgr.RaiseAuthFailureEvent(params.Name, "session", h.clientIP())
+		}
 	}
 	return user, err
 }
@@ -104,6 +112,7 @@ func (h *handler) handleSessionDELETE() error {
 	if cookie == nil {
 		return base.HTTPErrorf(http.StatusNotFound, "no session")
 	}
+	h.audit(base.AuditSessionDelete, h.requestUsername(), nil)
 	http.SetCookie(h.response, cookie)
 	return nil
 }
@@ -128,6 +137,8 @@ func (h *handler) makeSessionWithTTL(user auth.User, expiry time.Duration) (sess
 	if err != nil {
 		return "", err
 	}
+	h.audit(base.AuditSessionCreate, user.Name(), map[string]interface{}{"ttl": int(expiry / time.Second)})
+	h.db.EventMgr.RaiseSessionCreateEvent(user.Name(), expiry)
 	cookie := auth.MakeSessionCookie(session)
 	base.AddDbPathToCookie(h.rq, cookie)
 	http.SetCookie(h.response, cookie)
@@ -237,6 +248,8 @@ func (h *handler) createUserSession() error {
 	if err != nil {
 		return err
 	}
+	h.audit(base.AuditSessionCreate, params.Name, map[string]interface{}{"ttl": params.TTL})
+	h.db.EventMgr.RaiseSessionCreateEvent(params.Name, ttl)
 	var response struct {
 		SessionID  string    `json:"session_id"`
 		Expires    time.Time `json:"expires"`
@@ -269,11 +282,16 @@ func (h *handler) getUserSession() error {
 func (h *handler) deleteUserSession() error {
 	h.assertAdminOnly()
 	userName := h.PathVar("name")
+	var err error
 	if userName != "" {
-		return h.deleteUserSessionWithValidation(h.PathVar("sessionid"), userName)
+		err = h.deleteUserSessionWithValidation(h.PathVar("sessionid"), userName)
 	} else {
-		return h.db.Authenticator().DeleteSession(h.PathVar("sessionid"))
+		err = h.db.Authenticator().DeleteSession(h.PathVar("sessionid"))
 	}
+	if err == nil {
+		h.audit(base.AuditSessionDelete, userName, nil)
+	}
+	return err
 }
 
 // ADMIN API: Deletes all sessions for a user
@@ -281,7 +299,11 @@ func (h *handler) deleteUserSessions() error {
 	h.assertAdminOnly()
 
 	userName := h.PathVar("name")
-	return h.db.DeleteUserSessions(userName)
+	if err := h.db.DeleteUserSessions(userName); err != nil {
+		return err
+	}
+	h.audit(base.AuditSessionDelete, userName, map[string]interface{}{"all": true})
+	return nil
 }
 
 // Delete a session if associated with the user provided
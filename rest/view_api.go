@@ -21,9 +21,9 @@ func (h *handler) handleGetDesignDoc() error {
 		// we serve this content here so that CouchDB 1.2 has something to
 		// hash into the replication-id, to correspond to our filter.
 		filter := "ok"
-		if h.db.DatabaseContext.ChannelMapper != nil {
+		if mapper := h.db.GetChannelMapper(); mapper != nil {
 			hash := sha1.New()
-			io.WriteString(hash, h.db.DatabaseContext.ChannelMapper.Function())
+			io.WriteString(hash, mapper.Function())
 			filter = fmt.Sprint(hash.Sum(nil))
 		}
 		result = db.Body{"filters": db.Body{"bychannel": filter}}